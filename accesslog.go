@@ -0,0 +1,121 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// accessLogEntry is written as one JSON line per request.
+type accessLogEntry struct {
+	Time       string  `json:"time"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	Bytes      int     `json:"bytes"`
+	Duration   float64 `json:"duration_seconds"`
+	RemoteAddr string  `json:"remote_addr"`
+	UserAgent  string  `json:"user_agent,omitempty"`
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Flush keeps streaming handlers working behind the access log.
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+var accessLogLock sync.Mutex
+
+// withAccessLog logs every request handled by next to stdout.
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		line, err := json.Marshal(accessLogEntry{
+			Time:       start.UTC().Format(time.RFC3339Nano),
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Status:     recorder.status,
+			Bytes:      recorder.bytes,
+			Duration:   time.Since(start).Seconds(),
+			RemoteAddr: r.RemoteAddr,
+			UserAgent:  r.UserAgent(),
+		})
+		if err != nil {
+			fmt.Println("Unable to encode access log entry: ", err)
+			return
+		}
+		accessLogLock.Lock()
+		defer accessLogLock.Unlock()
+		os.Stdout.Write(append(line, '\n'))
+	})
+}
+
+// listenAndServe serves the handlers registered on the default mux, with
+// access logs if enabled.
+func listenAndServe(address string) error {
+	var handler http.Handler = http.DefaultServeMux
+	if *accessLog {
+		handler = withAccessLog(handler)
+	}
+	server := &http.Server{
+		Addr:           address,
+		Handler:        handler,
+		ReadTimeout:    *httpReadTimeout,
+		WriteTimeout:   *httpWriteTimeout,
+		IdleTimeout:    *httpIdleTimeout,
+		MaxHeaderBytes: *httpMaxHeaderBytes,
+	}
+	return server.ListenAndServe()
+}
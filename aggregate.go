@@ -0,0 +1,131 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// aggregateRealm is the realm label value of aggregated series.
+const aggregateRealm = "_all"
+
+// realmAggregator sums the series of the selected metric families across
+// realms at scrape time, so that deployments with many realms only store one
+// series per remaining label set. Quantiles of summaries cannot be summed and
+// are dropped.
+type realmAggregator struct {
+	gatherer prometheus.Gatherer
+	// families to aggregate, nil means all
+	families map[string]bool
+}
+
+func newRealmAggregator(gatherer prometheus.Gatherer, families []string) *realmAggregator {
+	a := &realmAggregator{gatherer: gatherer}
+	if len(families) == 1 && families[0] == "all" {
+		return a
+	}
+	a.families = make(map[string]bool)
+	for _, family := range families {
+		a.families[family] = true
+	}
+	return a
+}
+
+func (a *realmAggregator) Gather() ([]*dto.MetricFamily, error) {
+	families, err := a.gatherer.Gather()
+	for _, family := range families {
+		if a.families == nil || a.families[family.GetName()] {
+			aggregateFamily(family)
+		}
+	}
+	return families, err
+}
+
+func aggregateFamily(family *dto.MetricFamily) {
+	var keys []string
+	merged := make(map[string]*dto.Metric)
+	for _, m := range family.GetMetric() {
+		hasRealm := false
+		for _, label := range m.GetLabel() {
+			if label.GetName() == "realm" {
+				label.Value = proto.String(aggregateRealm)
+				hasRealm = true
+			}
+		}
+		if !hasRealm {
+			return
+		}
+
+		key := labelsKey(m.GetLabel())
+		if existing, ok := merged[key]; ok {
+			mergeMetric(existing, m)
+			continue
+		}
+		if m.Summary != nil {
+			m.Summary.Quantile = nil
+		}
+		merged[key] = m
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	family.Metric = family.Metric[:0]
+	for _, key := range keys {
+		family.Metric = append(family.Metric, merged[key])
+	}
+}
+
+func labelsKey(labels []*dto.LabelPair) string {
+	parts := make([]string, len(labels))
+	for i, label := range labels {
+		parts[i] = label.GetName() + "=" + label.GetValue()
+	}
+	return strings.Join(parts, "\xff")
+}
+
+func mergeMetric(into *dto.Metric, m *dto.Metric) {
+	switch {
+	case into.Counter != nil:
+		into.Counter.Value = proto.Float64(into.Counter.GetValue() + m.GetCounter().GetValue())
+	case into.Gauge != nil:
+		into.Gauge.Value = proto.Float64(into.Gauge.GetValue() + m.GetGauge().GetValue())
+	case into.Untyped != nil:
+		into.Untyped.Value = proto.Float64(into.Untyped.GetValue() + m.GetUntyped().GetValue())
+	case into.Summary != nil:
+		into.Summary.SampleCount = proto.Uint64(into.Summary.GetSampleCount() + m.GetSummary().GetSampleCount())
+		into.Summary.SampleSum = proto.Float64(into.Summary.GetSampleSum() + m.GetSummary().GetSampleSum())
+	case into.Histogram != nil:
+		h := m.GetHistogram()
+		into.Histogram.SampleCount = proto.Uint64(into.Histogram.GetSampleCount() + h.GetSampleCount())
+		into.Histogram.SampleSum = proto.Float64(into.Histogram.GetSampleSum() + h.GetSampleSum())
+		// the series of a family share their buckets
+		for i, bucket := range into.Histogram.GetBucket() {
+			if i < len(h.GetBucket()) {
+				bucket.CumulativeCount = proto.Uint64(bucket.GetCumulativeCount() + h.GetBucket()[i].GetCumulativeCount())
+			}
+		}
+	}
+}
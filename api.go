@@ -0,0 +1,126 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/iknow/coturn_exporter/billing"
+	"github.com/iknow/coturn_exporter/collector"
+	"github.com/iknow/coturn_exporter/parser"
+)
+
+// apiAllocation is an allocation as listed by /api/v1/allocations.
+type apiAllocation struct {
+	Name       string                `json:"name"`
+	Realm      string                `json:"realm"`
+	User       string                `json:"user,omitempty"`
+	Status     string                `json:"status"`
+	AgeSeconds float64               `json:"age_seconds"`
+	Rates      *parser.TrafficMetric `json:"rates,omitempty"`
+	// RatesAgeSeconds is how long ago the rates were reported.
+	RatesAgeSeconds float64 `json:"rates_age_seconds,omitempty"`
+}
+
+func registerAPIHandlers(coll *collector.Collector, token string) {
+	http.Handle("/api/v1/allocations", requireToken(token, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(listAllocations(coll, r.URL.Query().Get("realm"), time.Now()))
+	})))
+}
+
+// listAllocations returns the tracked allocations of realm, or of all realms
+// when realm is empty, sorted by name.
+func listAllocations(coll *collector.Collector, realm string, now time.Time) []apiAllocation {
+	result := []apiAllocation{}
+	for name, info := range coll.Allocations() {
+		if realm != "" && info.Realm != realm {
+			continue
+		}
+		allocation := apiAllocation{
+			Name:       name,
+			Realm:      info.Realm,
+			User:       info.User,
+			Status:     info.Status,
+			AgeSeconds: now.Sub(info.Created).Seconds(),
+		}
+		if info.PreviousRates != nil {
+			allocation.Rates = info.PreviousRates
+			allocation.RatesAgeSeconds = now.Sub(info.LastMetricTimestamp).Seconds()
+		}
+		result = append(result, allocation)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func registerBillingHandler(ledger *billing.Ledger, token string) {
+	http.Handle("/api/v1/billing", requireToken(token, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		month := r.URL.Query().Get("month")
+		if month == "" {
+			month = ledger.Month(time.Now())
+		} else if _, err := time.Parse(billing.MonthFormat, month); err != nil {
+			http.Error(w, "month must be YYYY-MM", http.StatusBadRequest)
+			return
+		}
+		entries, err := ledger.Read(month)
+		if err != nil {
+			fmt.Println("Unable to read billing totals: ", err)
+			http.Error(w, "unable to read billing totals", http.StatusBadGateway)
+			return
+		}
+
+		switch r.URL.Query().Get("format") {
+		case "", "json":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(entries)
+		case "csv":
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"billing-%s.csv\"", month))
+			out := csv.NewWriter(w)
+			out.Write([]string{"month", "realm", "user", "received_bytes", "sent_bytes"})
+			for _, e := range entries {
+				out.Write([]string{
+					month, e.Realm, e.User,
+					strconv.FormatInt(e.ReceivedBytes, 10),
+					strconv.FormatInt(e.SentBytes, 10),
+				})
+			}
+			out.Flush()
+		default:
+			http.Error(w, "format must be json or csv", http.StatusBadRequest)
+		}
+	})))
+}
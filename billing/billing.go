@@ -0,0 +1,369 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package billing accumulates the monthly traffic per realm, and optionally
+// per user, in redis hashes for invoicing.
+//
+// The totals of a month are kept in the hash <key>:<month> with the fields
+// <realm>/received_bytes and <realm>/sent_bytes, and the per user totals in
+// <key>:<month>:users:<realm> with the fields <user>/received_bytes and
+// <user>/sent_bytes. The ledger only adds to them, so the exporters of
+// several coturn servers can share the same hashes.
+package billing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iknow/coturn_exporter/source"
+
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	receivedField = "received_bytes"
+	sentField     = "sent_bytes"
+	// MonthFormat is the format of the months the totals are kept by.
+	MonthFormat = "2006-01"
+)
+
+type Config struct {
+	Client *redis.Client
+	// Key is the prefix of the redis hashes.
+	Key string
+	// PerUser also keeps the totals per user.
+	PerUser bool
+	// Location is the time zone the months start in, UTC if nil.
+	Location *time.Location
+}
+
+// Entry is the traffic of a realm, or of a user of it, in a month.
+type Entry struct {
+	Realm         string `json:"realm"`
+	User          string `json:"user,omitempty"`
+	ReceivedBytes int64  `json:"received_bytes"`
+	SentBytes     int64  `json:"sent_bytes"`
+}
+
+type entryKey struct {
+	month string
+	realm string
+	user  string
+}
+
+type usage struct {
+	received int64
+	sent     int64
+}
+
+// Ledger is a source.Handler counting the client traffic, which is written
+// to redis by Flush.
+type Ledger struct {
+	config Config
+
+	lock sync.Mutex
+	// traffic not flushed yet
+	pending map[entryKey]*usage
+	// failed is the batch of a failed flush, which may still have been
+	// applied if only the reply was lost
+	failed *flushBatch
+	// flushLock keeps the flushes of Run and of the shutdown apart
+	flushLock sync.Mutex
+
+	flushes *prometheus.CounterVec
+}
+
+func New(config Config) *Ledger {
+	if config.Location == nil {
+		config.Location = time.UTC
+	}
+	return &Ledger{
+		config:  config,
+		pending: make(map[entryKey]*usage),
+		flushes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "coturn_exporter_billing_flushes_total",
+			Help: "Number of times the billing totals were written to redis by result",
+		}, []string{"result"}),
+	}
+}
+
+// Month returns the month t is billed in.
+func (l *Ledger) Month(t time.Time) string {
+	return t.In(l.config.Location).Format(MonthFormat)
+}
+
+// HandleAllocation implements source.Handler.
+func (l *Ledger) HandleAllocation(e source.AllocationEvent) {}
+
+// HandleTraffic implements source.Handler. Only the periodic client
+// reports are counted, the lifetime totals of deleted allocations would
+// count the same traffic twice.
+func (l *Ledger) HandleTraffic(e source.TrafficEvent) {
+	if e.Kind != source.TrafficClient || e.Traffic.Rcvb < 0 || e.Traffic.Sentb < 0 {
+		return
+	}
+	received, sent := int64(e.Traffic.Rcvb), int64(e.Traffic.Sentb)
+	// events without a receive time would be billed to year one
+	at := e.Time
+	if at.IsZero() {
+		at = time.Now()
+	}
+	month := l.Month(at)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.add(entryKey{month, e.Metadata.Realm, ""}, received, sent)
+	if l.config.PerUser {
+		l.add(entryKey{month, e.Metadata.Realm, e.Metadata.User}, received, sent)
+	}
+}
+
+func (l *Ledger) add(key entryKey, received int64, sent int64) {
+	u := l.pending[key]
+	if u == nil {
+		u = &usage{}
+		l.pending[key] = u
+	}
+	u.received += received
+	u.sent += sent
+}
+
+func (l *Ledger) monthKey(month string) string {
+	return l.config.Key + ":" + month
+}
+
+func (l *Ledger) usersKey(month string, realm string) string {
+	return l.config.Key + ":" + month + ":users:" + realm
+}
+
+// flushGuardTTL is how long a flush is remembered as applied, far longer
+// than it is retried for.
+const flushGuardTTL = 7 * 24 * time.Hour
+
+// flushScript applies the increments of a flush unless a flush with the
+// same ID was applied before, so that a retry after the reply was lost does
+// not count the traffic twice. KEYS[1] is the guard of the flush ID followed
+// by a hash per increment, ARGV[1] the seconds the guard is kept followed by
+// the field and increment of every hash.
+var flushScript = redis.NewScript(`
+if not redis.call('SET', KEYS[1], '1', 'NX', 'EX', ARGV[1]) then
+	return 0
+end
+for i = 2, #KEYS do
+	redis.call('HINCRBY', KEYS[i], ARGV[2 * i - 2], ARGV[2 * i - 1])
+end
+return 1
+`)
+
+// flushBatch is the traffic written by one flush, retried with the same ID
+// until it succeeds.
+type flushBatch struct {
+	id      string
+	pending map[entryKey]*usage
+}
+
+// Flush adds the traffic counted since the last flush to the redis hashes.
+// If that fails the traffic is retried with the same flush ID by the next
+// flush, before the traffic counted in the meantime.
+func (l *Ledger) Flush() error {
+	l.flushLock.Lock()
+	defer l.flushLock.Unlock()
+
+	for {
+		l.lock.Lock()
+		batch, retry := l.failed, l.failed != nil
+		if !retry && len(l.pending) > 0 {
+			batch = &flushBatch{id: newFlushID(), pending: l.pending}
+			l.pending = make(map[entryKey]*usage)
+		}
+		l.lock.Unlock()
+		if batch == nil {
+			return nil
+		}
+
+		err := l.write(batch)
+		l.lock.Lock()
+		if err != nil {
+			l.failed = batch
+		} else {
+			l.failed = nil
+		}
+		l.lock.Unlock()
+		if err != nil {
+			l.flushes.WithLabelValues("failed").Inc()
+			return err
+		}
+		l.flushes.WithLabelValues("ok").Inc()
+		if !retry {
+			return nil
+		}
+	}
+}
+
+// write applies a batch through flushScript.
+func (l *Ledger) write(batch *flushBatch) error {
+	keys := []string{l.config.Key + ":flush:" + batch.id}
+	args := []interface{}{int(flushGuardTTL / time.Second)}
+	for key, u := range batch.pending {
+		hash, name := l.monthKey(key.month), key.realm
+		if key.user != "" {
+			hash, name = l.usersKey(key.month, key.realm), key.user
+		}
+		keys = append(keys, hash, hash)
+		args = append(args, name+"/"+receivedField, u.received, name+"/"+sentField, u.sent)
+	}
+	return flushScript.Run(l.config.Client, keys, args...).Err()
+}
+
+// newFlushID returns an ID that is unique across the exporters sharing the
+// hashes.
+func newFlushID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Run flushes every interval. It never returns.
+func (l *Ledger) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := l.Flush(); err != nil {
+			fmt.Println("Unable to write billing totals: ", err)
+		}
+	}
+}
+
+// Read returns the totals of month from redis including the traffic of this
+// exporter that is not flushed yet, sorted by realm with the realm totals
+// before its users.
+func (l *Ledger) Read(month string) ([]Entry, error) {
+	entries := make(map[entryKey]*Entry)
+	get := func(key entryKey) *Entry {
+		e := entries[key]
+		if e == nil {
+			e = &Entry{Realm: key.realm, User: key.user}
+			entries[key] = e
+		}
+		return e
+	}
+
+	realms, err := l.config.Client.HGetAll(l.monthKey(month)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if err := readFields(realms, func(realm string, received int64, sent int64) {
+		e := get(entryKey{month, realm, ""})
+		e.ReceivedBytes += received
+		e.SentBytes += sent
+	}); err != nil {
+		return nil, err
+	}
+
+	if l.config.PerUser {
+		names := make([]string, 0, len(entries))
+		for key := range entries {
+			names = append(names, key.realm)
+		}
+		for _, realm := range names {
+			users, err := l.config.Client.HGetAll(l.usersKey(month, realm)).Result()
+			if err != nil {
+				return nil, err
+			}
+			realm := realm
+			if err := readFields(users, func(user string, received int64, sent int64) {
+				e := get(entryKey{month, realm, user})
+				e.ReceivedBytes += received
+				e.SentBytes += sent
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	l.lock.Lock()
+	unflushed := []map[entryKey]*usage{l.pending}
+	if l.failed != nil {
+		// counted twice if the failed flush was applied after all
+		unflushed = append(unflushed, l.failed.pending)
+	}
+	for _, pending := range unflushed {
+		for key, u := range pending {
+			if key.month != month {
+				continue
+			}
+			e := get(key)
+			e.ReceivedBytes += u.received
+			e.SentBytes += u.sent
+		}
+	}
+	l.lock.Unlock()
+
+	result := make([]Entry, 0, len(entries))
+	for _, e := range entries {
+		result = append(result, *e)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Realm != result[j].Realm {
+			return result[i].Realm < result[j].Realm
+		}
+		return result[i].User < result[j].User
+	})
+	return result, nil
+}
+
+// readFields calls f with the totals of every name in the fields of a
+// hash. Names may contain slashes, the field type is after the last one.
+func readFields(fields map[string]string, f func(name string, received int64, sent int64)) error {
+	for field, value := range fields {
+		i := strings.LastIndex(field, "/")
+		if i < 0 {
+			continue
+		}
+		var n int64
+		if _, err := fmt.Sscan(value, &n); err != nil {
+			return fmt.Errorf("invalid billing total %q in field %q", value, field)
+		}
+		switch field[i+1:] {
+		case receivedField:
+			f(field[:i], n, 0)
+		case sentField:
+			f(field[:i], 0, n)
+		}
+	}
+	return nil
+}
+
+// Describe implements prometheus.Collector.
+func (l *Ledger) Describe(ch chan<- *prometheus.Desc) {
+	l.flushes.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (l *Ledger) Collect(ch chan<- prometheus.Metric) {
+	l.flushes.Collect(ch)
+}
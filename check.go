@@ -0,0 +1,66 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/iknow/coturn_exporter/parser"
+
+	"github.com/go-redis/redis"
+)
+
+// checkConfig validates the configuration without starting the HTTP server.
+// It returns the process exit code.
+func checkConfig(client *redis.Client, opt *redis.Options) int {
+	fmt.Println("listen address:", *listenAddress)
+	fmt.Println("redis address: ", opt.Addr)
+	fmt.Println("redis db:      ", opt.DB)
+
+	if err := client.Ping().Err(); err != nil {
+		fmt.Println("FAIL: cannot connect to redis:", err)
+		return 1
+	}
+	fmt.Println("OK: connected to redis")
+
+	var matched, unexpected int
+	iter := client.Scan(0, parser.StatusPattern(), 1000).Iterator()
+	for iter.Next() {
+		if _, err := parser.ParseKeyName(iter.Val()); err != nil {
+			unexpected++
+			continue
+		}
+		matched++
+	}
+	if err := iter.Err(); err != nil {
+		fmt.Println("FAIL: cannot scan keys:", err)
+		return 1
+	}
+	if unexpected > 0 {
+		fmt.Printf("WARN: %d keys matching %s could not be parsed\n", unexpected, parser.StatusPattern())
+	}
+	if matched == 0 {
+		fmt.Println("FAIL: no keys match", parser.StatusPattern())
+		return 1
+	}
+	fmt.Printf("OK: %d allocations found\n", matched)
+	return 0
+}
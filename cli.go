@@ -0,0 +1,161 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/iknow/coturn_exporter/collector"
+	"github.com/iknow/coturn_exporter/exporter"
+
+	"github.com/go-redis/redis"
+)
+
+// Set at build time with -ldflags "-X main.version=... -X main.revision=...".
+var (
+	version  = "dev"
+	revision = "unknown"
+)
+
+// The flags every command talking to the statsdb takes.
+var (
+	redisFlags = []string{"redis-url", "redis-dial-timeout", "redis-read-timeout", "redis-write-timeout", "redis-pool-size", "redis-min-idle-conns"}
+	keyFlags   = []string{"key-pattern", "key-prefix", "key-regexp"}
+)
+
+var commands = []struct {
+	name        string
+	description string
+	// flags are the names of the serve flags the command takes, nil for all
+	// of them
+	flags []string
+}{
+	{"serve", "Export metrics (the default when no command is given)", nil},
+	{"check", "Validate the configuration and redis connectivity, same as -check-config", nil},
+	{"doctor", "Diagnose why no allocations show up and print a pass/fail report, same as -doctor",
+		flagNames(redisFlags, keyFlags, []string{"doctor-timeout", "doctor-samples"})},
+	{"simulate", "Publish synthetic coturn traffic into redis, same as -simulate",
+		flagNames(redisFlags, keyFlags, []string{"simulate-allocations", "simulate-realms", "simulate-rate"})},
+	{"suggest-buckets", "Observe live rates and print suggested histogram buckets, same as -suggest-buckets",
+		flagNames(redisFlags, keyFlags, []string{"realm-config", "report-interval", "max-packet-rate", "max-byte-rate", "clamp-suspect-samples", "payload-mode",
+			"rate-window", "rate-window-reports", "suggest-duration", "suggest-bucket-count"})},
+	{"version", "Print the version and exit", []string{}},
+}
+
+func flagNames(groups ...[]string) []string {
+	var names []string
+	for _, group := range groups {
+		names = append(names, group...)
+	}
+	return names
+}
+
+// parseCommand splits the command off the arguments and returns it with the
+// flag set to parse the rest with. Without a command the arguments are flags
+// for serve, so that invocations from before the commands existed keep
+// working.
+func parseCommand(args []string) (string, *flag.FlagSet, []string) {
+	flag.Usage = usage
+
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return "serve", flag.CommandLine, args
+	}
+	for _, command := range commands {
+		if args[0] != command.name {
+			continue
+		}
+		if command.flags == nil {
+			return command.name, flag.CommandLine, args[1:]
+		}
+		return command.name, newCommandFlagSet(command.name, command.description, command.flags), args[1:]
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+	usage()
+	os.Exit(2)
+	return "", nil, nil
+}
+
+// newCommandFlagSet returns a flag set with only the named serve flags. They
+// share their values with the serve flags, so serve() picks them up.
+func newCommandFlagSet(name string, description string, names []string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	for _, n := range names {
+		f := flag.Lookup(n)
+		flags.Var(f.Value, f.Name, f.Usage)
+	}
+	flags.Usage = func() {
+		out := flags.Output()
+		fmt.Fprintf(out, "Usage: %s %s", os.Args[0], name)
+		if len(names) > 0 {
+			fmt.Fprintf(out, " [flags]")
+		}
+		fmt.Fprintf(out, "\n\n%s\n", description)
+		if len(names) > 0 {
+			fmt.Fprintf(out, "\nFlags:\n")
+			flags.PrintDefaults()
+		}
+	}
+	return flags
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+	for _, command := range commands {
+		fmt.Fprintf(out, "  %-16s %s\n", command.name, command.description)
+	}
+	fmt.Fprintf(out, "\nFlags of serve and check, see %s <command> -h for the others:\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+// runOneShotCommand runs check, doctor, simulate or suggest-buckets and
+// exits, ahead of and regardless of -replay and -multi-target. It returns if
+// serve was selected.
+func runOneShotCommand(opts collector.Options) {
+	if !*checkOnly && !*doctorMode && !*simulateMode && !*suggestMode {
+		return
+	}
+	opt, err := parseRedisURL(*redisUrl)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client := redis.NewClient(opt)
+
+	switch {
+	case *checkOnly:
+		os.Exit(checkConfig(client, opt))
+	case *doctorMode:
+		os.Exit(doctor(client, opt, *doctorTimeout, *doctorSamples))
+	case *simulateMode:
+		fmt.Printf("Simulating %d allocations at %g messages/s\n", *simulateAllocations, *simulateRate)
+		log.Fatal(simulate(client, *simulateAllocations, *simulateRealms, *simulateRate))
+	case *suggestMode:
+		coll := exporter.NewCollector(exporter.Config{Options: opts})
+		if err := suggestBuckets(client, coll, *suggestDuration, *suggestBucketCount); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+}
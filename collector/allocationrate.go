@@ -0,0 +1,69 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var allocationRateLabels = []string{"realm", "allocation"}
+
+var (
+	allocationReceivedBytesDesc = prometheus.NewDesc(
+		"coturn_allocation_received_bytes_per_second",
+		"Current received byte rate of the allocation",
+		allocationRateLabels, nil,
+	)
+	allocationSentBytesDesc = prometheus.NewDesc(
+		"coturn_allocation_sent_bytes_per_second",
+		"Current sent byte rate of the allocation",
+		allocationRateLabels, nil,
+	)
+	allocationReceivedPacketsDesc = prometheus.NewDesc(
+		"coturn_allocation_received_packets_per_second",
+		"Current received packet rate of the allocation",
+		allocationRateLabels, nil,
+	)
+	allocationSentPacketsDesc = prometheus.NewDesc(
+		"coturn_allocation_sent_packets_per_second",
+		"Current sent packet rate of the allocation",
+		allocationRateLabels, nil,
+	)
+)
+
+// collectAllocationRates exposes the last rates of every allocation that
+// reported traffic. Since the series come and go with the allocations they
+// are only built at scrape time, leaving nothing behind to delete.
+func (c *Collector) collectAllocationRates(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, allocation := range c.allocations {
+		r := allocation.previousRates
+		if r == nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(allocationReceivedBytesDesc, prometheus.GaugeValue, r.Rcvb, allocation.realm, allocation.id)
+		ch <- prometheus.MustNewConstMetric(allocationSentBytesDesc, prometheus.GaugeValue, r.Sentb, allocation.realm, allocation.id)
+		ch <- prometheus.MustNewConstMetric(allocationReceivedPacketsDesc, prometheus.GaugeValue, r.Rcvp, allocation.realm, allocation.id)
+		ch <- prometheus.MustNewConstMetric(allocationSentPacketsDesc, prometheus.GaugeValue, r.Sentp, allocation.realm, allocation.id)
+	}
+}
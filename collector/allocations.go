@@ -0,0 +1,47 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var allocationsDesc = prometheus.NewDesc(
+	"coturn_allocations",
+	"Number of allocations",
+	metricLabels, nil,
+)
+
+// collectAllocations counts the tracked allocations of every realm at scrape
+// time, so that the count cannot drift from the allocations actually
+// tracked.
+func (c *Collector) collectAllocations(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	counts := make(map[string]int, len(c.allocationRealms))
+	for _, allocation := range c.allocations {
+		counts[allocation.realm]++
+	}
+	for realm := range c.allocationRealms {
+		ch <- prometheus.MustNewConstMetric(allocationsDesc, prometheus.GaugeValue, float64(counts[realm]), realm)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"fmt"
+
+	"github.com/iknow/coturn_exporter/histogauge"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RateUnit selects the unit of the byte rate distributions.
+type RateUnit string
+
+const (
+	// RateUnitBytes exposes the historical coturn_*_byte_rate_bps_bucket
+	// families, which count bytes per second despite their name.
+	RateUnitBytes RateUnit = "bytes"
+	// RateUnitBits exposes coturn_*_bit_rate_bits_per_second_bucket
+	// instead.
+	RateUnitBits RateUnit = "bits"
+	// RateUnitBoth exposes both.
+	RateUnitBoth RateUnit = "both"
+)
+
+func ParseRateUnit(unit string) (RateUnit, error) {
+	switch u := RateUnit(unit); u {
+	case RateUnitBytes, RateUnitBits, RateUnitBoth:
+		return u, nil
+	}
+	return "", fmt.Errorf("invalid rate unit %q, expected bytes, bits or both", unit)
+}
+
+// byteRateHistogauges passes byte rates to the histogauges of every
+// configured unit.
+type byteRateHistogauges []histogauge.Histogauge
+
+func newByteRateHistogauges(unit RateUnit, preset BucketPreset, direction string) byteRateHistogauges {
+	buckets := preset.buckets()
+	var h byteRateHistogauges
+	if unit != RateUnitBits {
+		h = append(h, histogauge.NewHistogauge(prometheus.GaugeOpts{
+			Name: "coturn_" + direction + "_byte_rate_bps_bucket",
+			Help: fmt.Sprintf("%s byte rate distribution", directionHelp[direction]),
+		}, metricLabels, buckets.byteRate))
+	}
+	if unit == RateUnitBits || unit == RateUnitBoth {
+		h = append(h, histogauge.NewScaledHistogauge(prometheus.GaugeOpts{
+			Name: "coturn_" + direction + "_bit_rate_bits_per_second_bucket",
+			Help: fmt.Sprintf("%s bit rate distribution", directionHelp[direction]),
+		}, metricLabels, buckets.bitRate, 8))
+	}
+	return h
+}
+
+var directionHelp = map[string]string{"received": "Received", "sent": "Sent"}
+
+func (h byteRateHistogauges) Add(labels prometheus.Labels, v float64) {
+	for _, g := range h {
+		g.Add(labels, v)
+	}
+}
+
+func (h byteRateHistogauges) Remove(labels prometheus.Labels, v float64) {
+	for _, g := range h {
+		g.Remove(labels, v)
+	}
+}
+
+func (h byteRateHistogauges) Replace(labels prometheus.Labels, v float64, o float64) {
+	for _, g := range h {
+		g.Replace(labels, v, o)
+	}
+}
+
+func (h byteRateHistogauges) Delete(labels prometheus.Labels) {
+	for _, g := range h {
+		g.Delete(labels)
+	}
+}
+
+func (h byteRateHistogauges) reset() {
+	for _, g := range h {
+		g.Reset()
+	}
+}
+
+func (h byteRateHistogauges) collectors() []prometheus.Collector {
+	var collectors []prometheus.Collector
+	for _, g := range h {
+		collectors = append(collectors, g.GaugeVec())
+	}
+	return collectors
+}
@@ -0,0 +1,164 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// BucketPreset names a set of rate histogauge buckets suited to a kind of
+// traffic.
+type BucketPreset string
+
+const (
+	// BucketPresetDefault are the historical buckets.
+	BucketPresetDefault BucketPreset = "default"
+	// BucketPresetVoice resolves audio only calls, around 50 packets and a
+	// few KB per second.
+	BucketPresetVoice BucketPreset = "voice"
+	// BucketPresetVideo resolves video calls from thumbnails to HD.
+	BucketPresetVideo BucketPreset = "video"
+	// BucketPresetBulk resolves file transfers and other data channel
+	// traffic up to several hundred Mbit/s.
+	BucketPresetBulk BucketPreset = "bulk"
+	// BucketPresetHighRes covers all of the above with 30 buckets, two per
+	// doubling.
+	BucketPresetHighRes BucketPreset = "high-res"
+)
+
+type presetBuckets struct {
+	packetRate []float64
+	byteRate   []float64
+	bitRate    []float64
+}
+
+var bucketPresets = map[BucketPreset]presetBuckets{
+	BucketPresetDefault: {
+		// 50, 100, 150, 200, 250, 300, 350, 400
+		packetRate: prometheus.LinearBuckets(50, 50, 8),
+		// 16K, 32K, 64K, 128K, 256K, 512K, 1M, 2M
+		byteRate: prometheus.ExponentialBuckets(16384, 2, 8),
+		// 125K, 250K, 500K, 1M, 2M, 4M, 8M, 16M
+		bitRate: prometheus.ExponentialBuckets(125000, 2, 8),
+	},
+	BucketPresetVoice: {
+		packetRate: []float64{10, 20, 30, 40, 50, 60, 80, 100, 150},
+		byteRate:   []float64{1000, 2000, 3000, 4000, 6000, 8000, 12000, 16000, 24000},
+		bitRate:    []float64{8000, 16000, 24000, 32000, 48000, 64000, 96000, 128000, 192000},
+	},
+	BucketPresetVideo: {
+		packetRate: []float64{50, 100, 200, 300, 400, 600, 800, 1000, 1500},
+		// 16K to 4M
+		byteRate: prometheus.ExponentialBuckets(16384, 2, 9),
+		// 125K to 32M
+		bitRate: prometheus.ExponentialBuckets(125000, 2, 9),
+	},
+	BucketPresetBulk: {
+		packetRate: []float64{100, 250, 500, 1000, 2500, 5000, 10000, 25000, 50000},
+		// 64K to 64M
+		byteRate: prometheus.ExponentialBuckets(65536, 2, 11),
+		// 500K to 500M
+		bitRate: prometheus.ExponentialBuckets(500000, 2, 11),
+	},
+	BucketPresetHighRes: {
+		// 2 to 48K
+		packetRate: halfOctaveBuckets(2, 30),
+		// 1K to 24M
+		byteRate: halfOctaveBuckets(1024, 30),
+		// 8K to 192M
+		bitRate: halfOctaveBuckets(8192, 30),
+	},
+}
+
+// halfOctaveBuckets returns count buckets alternately multiplied by 1.5 and
+// by 4/3, so that every second bucket doubles and all stay integers for even
+// starts.
+func halfOctaveBuckets(start float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		if i%2 == 0 {
+			buckets[i] = start
+		} else {
+			buckets[i] = start * 1.5
+			start *= 2
+		}
+	}
+	return buckets
+}
+
+// ParseBucketPreset accepts the name of a preset or a comma separated list
+// of ascending bucket boundaries. A list given for the byte rates is
+// multiplied by 8 for the bit rates.
+func ParseBucketPreset(name string) (BucketPreset, error) {
+	if _, ok := bucketPresets[BucketPreset(name)]; ok {
+		return BucketPreset(name), nil
+	}
+	if strings.ContainsAny(name, "0123456789") {
+		if _, err := parseBucketList(name); err != nil {
+			return "", err
+		}
+		return BucketPreset(name), nil
+	}
+	var names []string
+	for preset := range bucketPresets {
+		names = append(names, string(preset))
+	}
+	sort.Strings(names)
+	return "", fmt.Errorf("invalid bucket preset %q, expected one of %s or a list of buckets", name, strings.Join(names, ", "))
+}
+
+func parseBucketList(list string) ([]float64, error) {
+	var buckets []float64
+	for _, field := range strings.Split(list, ",") {
+		bucket, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket %q", field)
+		}
+		if len(buckets) > 0 && bucket <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("buckets %q are not in ascending order", list)
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, nil
+}
+
+// buckets returns the buckets of the preset, the default ones if it is
+// empty.
+func (p BucketPreset) buckets() presetBuckets {
+	if p == "" {
+		p = BucketPresetDefault
+	}
+	if preset, ok := bucketPresets[p]; ok {
+		return preset
+	}
+	// validated by ParseBucketPreset
+	list, _ := parseBucketList(string(p))
+	bitRate := make([]float64, len(list))
+	for i, bucket := range list {
+		bitRate[i] = bucket * 8
+	}
+	return presetBuckets{packetRate: list, byteRate: list, bitRate: bitRate}
+}
@@ -0,0 +1,182 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"net"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CountryLookup returns the ISO country code of an address, or an empty
+// string if it is not known.
+type CountryLookup interface {
+	Country(ip net.IP) string
+}
+
+// ASNLookup returns the autonomous system number of an address, or an empty
+// string if it is not known.
+type ASNLookup interface {
+	ASN(ip net.IP) string
+}
+
+// countedGauge counts allocations by realm and one more label and deletes the
+// series that drop to zero, so that the number of series stays bounded by
+// the active label values.
+type countedGauge struct {
+	vec   *prometheus.GaugeVec
+	label string
+	// maxValues limits the number of distinct label values, further ones
+	// are counted as "other"
+	maxValues int
+	// maxPerRealm limits the number of label values within a realm
+	maxPerRealm int
+	counts      map[realmKey]int
+	// number of realms with a series per label value
+	values map[string]int
+	// number of label values per realm
+	realmValues map[string]int
+	// counts the allocations that were counted as "other"
+	overflows *prometheus.CounterVec
+}
+
+func newCountedGauge(opts prometheus.GaugeOpts, label string, maxValues int, maxPerRealm int, overflows *prometheus.CounterVec) *countedGauge {
+	return &countedGauge{
+		vec:         prometheus.NewGaugeVec(opts, []string{"realm", label}),
+		label:       label,
+		maxValues:   maxValues,
+		maxPerRealm: maxPerRealm,
+		counts:      make(map[realmKey]int),
+		values:      make(map[string]int),
+		realmValues: make(map[string]int),
+		overflows:   overflows,
+	}
+}
+
+// add counts an allocation and returns the label value it was counted as,
+// which has to be passed to remove.
+func (g *countedGauge) add(realm string, value string) string {
+	key := realmKey{realm, value}
+	if g.counts[key] == 0 {
+		if (g.maxValues > 0 && g.values[value] == 0 && len(g.values) >= g.maxValues) ||
+			(g.maxPerRealm > 0 && g.realmValues[realm] >= g.maxPerRealm) {
+			g.overflows.With(prometheus.Labels{"realm": realm, "label": g.label}).Inc()
+			value = "other"
+			key = realmKey{realm, value}
+		}
+	}
+	if g.counts[key] == 0 {
+		g.values[value]++
+		g.realmValues[realm]++
+	}
+	g.counts[key]++
+	g.vec.With(prometheus.Labels{"realm": realm, g.label: value}).Inc()
+	return value
+}
+
+func (g *countedGauge) remove(realm string, value string) {
+	key := realmKey{realm, value}
+	labels := prometheus.Labels{"realm": realm, g.label: value}
+	g.counts[key]--
+	if g.counts[key] > 0 {
+		g.vec.With(labels).Dec()
+		return
+	}
+	delete(g.counts, key)
+	g.vec.Delete(labels)
+	g.values[value]--
+	if g.values[value] <= 0 {
+		delete(g.values, value)
+	}
+	g.realmValues[realm]--
+	if g.realmValues[realm] <= 0 {
+		delete(g.realmValues, realm)
+	}
+}
+
+func (g *countedGauge) reset() {
+	g.counts = make(map[realmKey]int)
+	g.values = make(map[string]int)
+	g.realmValues = make(map[string]int)
+	g.vec.Reset()
+}
+
+// setClientAddress assigns an allocation to the subnet, country and
+// autonomous system of its client address. Allocations keep the first
+// address they were assigned.
+func (c *Collector) setClientAddress(allocation *trackedAllocation, address string) {
+	if address == "" || allocation.hasClient {
+		return
+	}
+	ip := parseClientIP(address)
+	if ip == nil {
+		return
+	}
+	allocation.hasClient = true
+
+	if c.opts.ClientSubnets {
+		allocation.subnet = c.subnetAllocations.add(allocation.realm, c.subnetOf(ip))
+	}
+	if c.opts.GeoCountries != nil {
+		allocation.country = c.countryAllocations.add(allocation.realm, orUnknown(c.opts.GeoCountries.Country(ip)))
+	}
+	if c.opts.GeoASNs != nil {
+		allocation.asn = c.asnAllocations.add(allocation.realm, orUnknown(c.opts.GeoASNs.ASN(ip)))
+	}
+}
+
+func (c *Collector) removeClient(allocation *trackedAllocation) {
+	if c.opts.ClientSubnets {
+		c.subnetAllocations.remove(allocation.realm, allocation.subnet)
+	}
+	if c.opts.GeoCountries != nil {
+		c.countryAllocations.remove(allocation.realm, allocation.country)
+	}
+	if c.opts.GeoASNs != nil {
+		c.asnAllocations.remove(allocation.realm, allocation.asn)
+	}
+}
+
+// parseClientIP parses an ip or ip:port address.
+func parseClientIP(address string) net.IP {
+	host := address
+	if h, _, err := net.SplitHostPort(address); err == nil {
+		host = h
+	}
+	return net.ParseIP(host)
+}
+
+// subnetOf returns the subnet of ip in CIDR notation.
+func (c *Collector) subnetOf(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		mask := net.CIDRMask(c.opts.ClientSubnetIPv4Prefix, 32)
+		return (&net.IPNet{IP: ip4.Mask(mask), Mask: mask}).String()
+	}
+	mask := net.CIDRMask(c.opts.ClientSubnetIPv6Prefix, 128)
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+func orUnknown(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	return value
+}
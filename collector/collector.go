@@ -0,0 +1,1111 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package collector maintains coturn metrics from source events. A Collector
+// can be registered with any prometheus registry.
+package collector
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/iknow/coturn_exporter/histogauge"
+	"github.com/iknow/coturn_exporter/logging"
+	"github.com/iknow/coturn_exporter/parser"
+	"github.com/iknow/coturn_exporter/source"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	metricLabels = []string{"realm"}
+	userLabels   = []string{"realm", "user"}
+)
+
+// Options configures a Collector. The zero value disables every optional
+// behaviour.
+type Options struct {
+	// MaxPacketRate and MaxByteRate are the highest plausible per-allocation
+	// rates in packets/s and bytes/s. Traffic reports implying higher rates,
+	// as well as negative reports, are counted as suspect. Zero disables the
+	// rate check.
+	MaxPacketRate float64
+	MaxByteRate   float64
+	// ClampSuspectSamples clamps suspect reports to the plausible range
+	// instead of dropping them.
+	ClampSuspectSamples bool
+	// ReportInterval is coturn's stats report interval. If set, rates are
+	// computed by dividing the reported deltas by it instead of by the gap
+	// between message arrivals, which jitters with pubsub latency.
+	ReportInterval time.Duration
+	// InferReportInterval uses the median of the observed gaps between
+	// reports as the report interval. It is ignored if ReportInterval is
+	// set.
+	InferReportInterval bool
+	// Reconcile makes the collector remember recent deletions, which
+	// Reconcile needs to tell lost creations from allocations deleted while
+	// the scan was running. It must be set if Reconcile is called.
+	Reconcile bool
+	// DropOrphans drops tracked allocations that Reconcile does not find in
+	// the source instead of only reporting them.
+	DropOrphans bool
+	// StaleTimeout is how long an allocation may go without any status or
+	// traffic message before ExpireStale drops it. Zero disables expiry.
+	StaleTimeout time.Duration
+	// RateIdleTimeout is how long an allocation may go without a traffic
+	// report before ExpireIdleRates takes its last rates out of the rate
+	// histogauges. Zero disables it.
+	RateIdleTimeout time.Duration
+	// RemoveIdleRates removes the rates of idle allocations from the
+	// histogauges instead of counting them as zero.
+	RemoveIdleRates bool
+	// EmptyRealmGracePeriod is how long a realm may go without allocations
+	// before DeleteEmptyRealms deletes its gauge series. Zero keeps them.
+	EmptyRealmGracePeriod time.Duration
+	// UserLabelMode enables the per user metrics and sets how user names
+	// are turned into label values. Empty disables the per user metrics.
+	UserLabelMode UserLabelMode
+	// UserLabelSalt is prepended to the user name before hashing in the
+	// sha256 mode, so that hashes of known user names cannot be looked up.
+	UserLabelSalt string
+	// UserLabelLength is the number of characters kept in the truncated
+	// mode.
+	UserLabelLength int
+	// ClientSubnets enables counting allocations by the subnet of their
+	// client address, for sources that report it.
+	ClientSubnets bool
+	// ClientSubnetIPv4Prefix and ClientSubnetIPv6Prefix are the prefix
+	// lengths client addresses are aggregated to.
+	ClientSubnetIPv4Prefix int
+	ClientSubnetIPv6Prefix int
+	// GeoCountries and GeoASNs enable counting allocations by the country
+	// and autonomous system of their client address.
+	GeoCountries CountryLookup
+	GeoASNs      ASNLookup
+	// GeoMaxLabelValues limits the number of distinct countries and
+	// autonomous systems with their own series. Further ones are counted
+	// as "other". Zero means no limit.
+	GeoMaxLabelValues int
+	// MaxSeriesPerRealm limits the number of users, subnets, countries,
+	// autonomous systems and origins with their own series within a realm, so that a
+	// single realm cannot blow up the number of series. Further ones are
+	// counted as "other". Zero means no limit.
+	MaxSeriesPerRealm int
+	// OriginLabel counts allocations and bytes by the origin of
+	// multi-tenant deployments, from the origin group of the key schema or
+	// the origin status field. It is limited by MaxSeriesPerRealm.
+	OriginLabel bool
+	// DailyPeaks exposes the peak allocation count of each realm over the
+	// last 24 hours in addition to the peak since the start.
+	DailyPeaks bool
+	// RateUnit selects whether the byte rate distributions are exposed in
+	// bytes, bits or both. Empty means bytes.
+	RateUnit RateUnit
+	// PacketRateBuckets and ByteRateBuckets select the buckets of the packet
+	// and of the byte and bit rate histogauges. Empty means the default
+	// preset.
+	PacketRateBuckets BucketPreset
+	ByteRateBuckets   BucketPreset
+	// RateQuantiles are the quantiles of the byte rates computed at scrape
+	// time. None are exposed if empty.
+	RateQuantiles []float64
+	// RateWindowReports and RateWindow average the rates of an allocation
+	// over up to its last RateWindowReports reports and over the reports
+	// of the last RateWindow, instead of only the last report. Zero means
+	// no limit, both zero the last report only.
+	RateWindowReports int
+	RateWindow        time.Duration
+	// PeakRateWindow exposes the highest byte rates of a single allocation
+	// of each realm over this window, at a sixtieth of it granularity. Zero
+	// disables it.
+	PeakRateWindow time.Duration
+	// DailyUsageLocation enables the received and sent bytes counters that
+	// start over every day at DailyUsageOffset after midnight in this
+	// location.
+	DailyUsageLocation *time.Location
+	DailyUsageOffset   time.Duration
+	// AllocationRates exposes the current rates of every allocation with
+	// an allocation label. Only suitable for small deployments, since it
+	// adds four series per allocation.
+	AllocationRates bool
+	// LifetimeExpiry makes ExpireStale also drop allocations whose granted
+	// lifetime ran out LifetimeGrace ago without a refresh.
+	LifetimeExpiry bool
+	LifetimeGrace  time.Duration
+	// TopTalkers exposes the estimated traffic of the TopTalkers users with
+	// the most traffic, decayed with a half-life of TopTalkersHalfLife, in
+	// place of per user series for everyone. Zero disables it, the half-life
+	// defaults to five minutes.
+	TopTalkers         int
+	TopTalkersHalfLife time.Duration
+	// TopTalkersLabelMode sets how the user names of the top talkers are
+	// turned into label values, independent of UserLabelMode.
+	TopTalkersLabelMode UserLabelMode
+	// RestartDeletionRatio is the share of the tracked allocations that
+	// has to be deleted within RestartWindow, or be missing from a
+	// Reconcile scan, for a coturn restart to be suspected. The restart is
+	// detected when an allocation is created within RestartWindow after.
+	// Zero disables the detection.
+	RestartDeletionRatio float64
+	RestartWindow        time.Duration
+	// OnRestart is called in its own goroutine when a restart is detected,
+	// e.g. to reconcile the tracked allocations.
+	OnRestart func()
+	// Clock is the time source of the collector, the system clock when nil.
+	// A replay can pass the recorded times to compute the historical rates.
+	Clock Clock
+}
+
+type trackedAllocation struct {
+	realm               string
+	id                  string
+	created             time.Time
+	previousRates       *parser.TrafficMetric
+	lastMetricTimestamp time.Time
+	// lastSeen is the last time any message was received for the allocation
+	lastSeen time.Time
+	// lastEvent is when the source received the last message, before it
+	// possibly waited in a buffer
+	lastEvent time.Time
+	// expires is when the granted lifetime runs out, zero if unknown
+	expires time.Time
+	// status is the last status reported by coturn
+	status string
+	// user is the user label value, only set if the user label is enabled
+	user string
+	// userName is the user name as reported by coturn
+	userName string
+	// idle is set once ExpireIdleRates took the rates out of the
+	// histogauges, until traffic resumes
+	idle bool
+	// window holds the recent reports if rates are averaged over more than
+	// the last one
+	window *rateWindow
+	// hasClient is set once the client address is known, the client
+	// labels below are only set if their metric is enabled
+	hasClient bool
+	subnet    string
+	country   string
+	asn       string
+	// origin is the origin label value, only set with OriginLabel
+	origin string
+}
+
+// realmKey identifies a series with a label besides the realm.
+type realmKey struct {
+	realm string
+	name  string
+}
+
+func newTrackedAllocation(realm string, now time.Time) *trackedAllocation {
+	return &trackedAllocation{realm: realm, created: now, lastMetricTimestamp: now, lastSeen: now, lastEvent: now}
+}
+
+// received returns when the source received an event at t, now if it did
+// not say.
+func received(t, now time.Time) time.Time {
+	if t.IsZero() {
+		return now
+	}
+	return t
+}
+
+// Collector tracks allocations and their traffic rates.
+type Collector struct {
+	opts Options
+
+	// lock guards allocations and the metrics derived from them
+	lock        sync.Mutex
+	allocations map[string]*trackedAllocation
+	intervals   intervalEstimator
+	// allocation name -> deletion time, only kept for Reconcile
+	deletions map[string]time.Time
+	// number of tracked allocations per user, only kept with a user label
+	userAllocations map[realmKey]int
+	// number of users with allocations per realm
+	realmUsers map[string]int
+	// number of tracked allocations per user name, regardless of the user
+	// label
+	userNameAllocations map[realmKey]int
+	// number of tracked allocations per realm
+	realmAllocations map[string]int
+	// limits per realm, only set with SetQuotas
+	quotas        map[string]Quota
+	fallbackQuota Quota
+	hasQuotas     bool
+	// highest allocation count per realm since the start
+	realmPeaks map[string]float64
+	// allocation counts of the last 24 hours per realm, only kept with
+	// DailyPeaks
+	dailyPeaks map[string]*hourlyPeaks
+	// rolling maxima of the allocation rates per realm, only kept with a
+	// PeakRateWindow
+	ratePeaks map[string]*ratePeaks
+	// traffic per realm of the current day, only kept with a
+	// DailyUsageLocation
+	dayUsage map[string]*dayUsage
+	// realm -> time it lost its last allocation, only kept with a grace
+	// period for empty realms
+	emptyRealms map[string]time.Time
+	// realm -> time its first allocation was seen, carried over restarts
+	// in the snapshots
+	seenRealms map[string]time.Time
+	// realms exported by coturn_allocations, including those at zero
+	// until DeleteEmptyRealms
+	allocationRealms map[string]struct{}
+	// realm -> labels and series resolved once for the hot path
+	realmSeries map[string]*realmSeries
+	restart     restartDetector
+	// nil unless TopTalkers is set
+	topTalkers *topTalkers
+
+	allocationPeak               *prometheus.GaugeVec
+	receivedPackets              *prometheus.CounterVec
+	receivedBytes                *prometheus.CounterVec
+	sentPackets                  *prometheus.CounterVec
+	sentBytes                    *prometheus.CounterVec
+	receivedPacketRateHistogauge histogauge.Histogauge
+	receivedByteRateHistogauge   byteRateHistogauges
+	sentPacketRateHistogauge     histogauge.Histogauge
+	sentByteRateHistogauge       byteRateHistogauges
+	suspectSamples               *prometheus.CounterVec
+	allocationRefreshes          *prometheus.CounterVec
+	staleAllocations             *prometheus.CounterVec
+	expiredAllocations           *prometheus.CounterVec
+	allocationLifetime           *prometheus.HistogramVec
+	deletedAllocations           *prometheus.CounterVec
+	reportInterval               prometheus.Gauge
+	reportGaps                   *prometheus.HistogramVec
+	ignoredEvents                *prometheus.CounterVec
+	missedAllocations            *prometheus.CounterVec
+	orphanedAllocations          *prometheus.GaugeVec
+	droppedOrphans               *prometheus.CounterVec
+	processingLatency            *prometheus.HistogramVec
+	trafficLatency               prometheus.Observer
+	allocationLatency            prometheus.Observer
+	peerReceivedPackets          *prometheus.CounterVec
+	peerReceivedBytes            *prometheus.CounterVec
+	peerSentPackets              *prometheus.CounterVec
+	peerSentBytes                *prometheus.CounterVec
+	allocationTotalBytes         *prometheus.HistogramVec
+	userAllocationGauge          *prometheus.GaugeVec
+	allocationsPerUser           histogauge.Histogauge
+	userReceivedBytes            *prometheus.CounterVec
+	userSentBytes                *prometheus.CounterVec
+	subnetAllocations            *countedGauge
+	countryAllocations           *countedGauge
+	asnAllocations               *countedGauge
+	originAllocations            *countedGauge
+	originReceivedBytes          *prometheus.CounterVec
+	originSentBytes              *prometheus.CounterVec
+	labelOverflows               *prometheus.CounterVec
+
+	exemplarLock sync.Mutex
+	// metric name -> realm -> latest exemplar
+	exemplars map[string]map[string]Exemplar
+}
+
+func New(opts Options) *Collector {
+	if opts.Clock == nil {
+		opts.Clock = systemClock{}
+	}
+	if opts.TopTalkersHalfLife <= 0 {
+		opts.TopTalkersHalfLife = 5 * time.Minute
+	}
+	labelOverflows := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "coturn_exporter_label_overflows_total",
+		Help: "Number of allocations counted as other because of a label value limit",
+	}, []string{"realm", "label"})
+
+	c := &Collector{
+		opts:                opts,
+		allocations:         make(map[string]*trackedAllocation),
+		deletions:           make(map[string]time.Time),
+		userAllocations:     make(map[realmKey]int),
+		userNameAllocations: make(map[realmKey]int),
+		realmUsers:          make(map[string]int),
+		realmAllocations:    make(map[string]int),
+		realmPeaks:          make(map[string]float64),
+		dailyPeaks:          make(map[string]*hourlyPeaks),
+		ratePeaks:           make(map[string]*ratePeaks),
+		dayUsage:            make(map[string]*dayUsage),
+		emptyRealms:         make(map[string]time.Time),
+		allocationRealms:    make(map[string]struct{}),
+		seenRealms:          make(map[string]time.Time),
+		realmSeries:         make(map[string]*realmSeries),
+		exemplars:           make(map[string]map[string]Exemplar),
+
+		allocationPeak: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "coturn_allocations_peak",
+			Help: "Highest number of concurrent allocations since the exporter started",
+		}, metricLabels),
+		receivedPackets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "coturn_received_packets_total",
+			Help: "Number of packets received",
+		}, metricLabels),
+		receivedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "coturn_received_bytes_total",
+			Help: "Number of bytes received",
+		}, metricLabels),
+		sentPackets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "coturn_sent_packets_total",
+			Help: "Number of packets sent",
+		}, metricLabels),
+		sentBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "coturn_sent_bytes_total",
+			Help: "Number of bytes sent",
+		}, metricLabels),
+		receivedPacketRateHistogauge: histogauge.NewHistogauge(prometheus.GaugeOpts{
+			Name: "coturn_received_packet_rate_pps_bucket",
+			Help: "Received packet rate distribution",
+		}, metricLabels, opts.PacketRateBuckets.buckets().packetRate),
+		receivedByteRateHistogauge: newByteRateHistogauges(opts.RateUnit, opts.ByteRateBuckets, "received"),
+		sentPacketRateHistogauge: histogauge.NewHistogauge(prometheus.GaugeOpts{
+			Name: "coturn_sent_packet_rate_pps_bucket",
+			Help: "Sent packet rate distribution",
+		}, metricLabels, opts.PacketRateBuckets.buckets().packetRate),
+		sentByteRateHistogauge: newByteRateHistogauges(opts.RateUnit, opts.ByteRateBuckets, "sent"),
+		suspectSamples: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "coturn_exporter_suspect_samples_total",
+			Help: "Number of traffic reports with negative or implausibly large values",
+		}, []string{"realm", "reason"}),
+		allocationRefreshes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "coturn_allocation_refreshes_total",
+			Help: "Number of allocation refreshes",
+		}, metricLabels),
+		staleAllocations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "coturn_exporter_stale_allocations_total",
+			Help: "Number of allocations dropped after not being seen for the stale timeout",
+		}, metricLabels),
+		expiredAllocations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "coturn_exporter_lifetime_expired_allocations_total",
+			Help: "Number of allocations dropped after their granted lifetime ran out without a refresh",
+		}, metricLabels),
+		deletedAllocations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "coturn_allocations_deleted_total",
+			Help: "Number of allocations deleted by coturn by the reason of the deleted status: expired, deallocated, error, other or unknown",
+		}, []string{"realm", "reason"}),
+		allocationLifetime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "coturn_allocation_lifetime_seconds",
+			Help: "Lifetimes granted to new and refreshed allocations",
+			// coturn grants 600s by default and at most 3600s
+			Buckets: []float64{30, 60, 120, 300, 600, 900, 1200, 1800, 3600, 7200},
+		}, metricLabels),
+		reportInterval: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "coturn_exporter_report_interval_seconds",
+			Help: "Interval the traffic reports are assumed to cover when computing rates, 0 if the arrival gaps are used",
+		}),
+		reportGaps: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "coturn_traffic_report_gap_seconds",
+			Help: "Time between consecutive traffic reports of the same allocation",
+			// fine around the usual stats intervals, coarse for the delays
+			// and stalls of the pubsub delivery
+			Buckets: []float64{1, 2.5, 5, 7.5, 10, 12.5, 15, 20, 30, 60, 120, 300},
+		}, metricLabels),
+		ignoredEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "coturn_exporter_ignored_allocation_events_total",
+			Help: "Number of allocation events ignored because they did not match the tracked state",
+		}, []string{"realm", "reason"}),
+		missedAllocations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "coturn_exporter_missed_allocations_total",
+			Help: "Number of allocations found by a key scan without having been announced on pubsub",
+		}, metricLabels),
+		orphanedAllocations: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "coturn_exporter_orphaned_allocations",
+			Help: "Number of tracked allocations not found by the last key scan",
+		}, metricLabels),
+		droppedOrphans: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "coturn_exporter_dropped_orphaned_allocations_total",
+			Help: "Number of tracked allocations dropped because a key scan did not find them",
+		}, metricLabels),
+		processingLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "coturn_exporter_event_processing_seconds",
+			Help: "Time from receiving an event to having updated the metrics, including the wait in the subscription buffer",
+			// 1us to 16s, a backed up buffer takes seconds
+			Buckets: prometheus.ExponentialBuckets(1e-6, 4, 13),
+		}, []string{"type"}),
+		peerReceivedPackets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "coturn_peer_received_packets_total",
+			Help: "Number of packets received from peers",
+		}, metricLabels),
+		peerReceivedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "coturn_peer_received_bytes_total",
+			Help: "Number of bytes received from peers",
+		}, metricLabels),
+		peerSentPackets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "coturn_peer_sent_packets_total",
+			Help: "Number of packets sent to peers",
+		}, metricLabels),
+		peerSentBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "coturn_peer_sent_bytes_total",
+			Help: "Number of bytes sent to peers",
+		}, metricLabels),
+		allocationTotalBytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "coturn_allocation_total_bytes",
+			Help: "Bytes transferred over the lifetime of deleted allocations",
+			// 1KiB to 128GiB
+			Buckets: prometheus.ExponentialBuckets(1024, 8, 10),
+		}, []string{"realm", "leg", "direction"}),
+		userAllocationGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "coturn_user_allocations",
+			Help: "Number of allocations per user",
+		}, userLabels),
+		allocationsPerUser: histogauge.NewHistogauge(prometheus.GaugeOpts{
+			Name: "coturn_allocations_per_user_bucket",
+			Help: "Distribution of the number of concurrent allocations of the users with allocations",
+		}, metricLabels, allocationsPerUserBuckets),
+		userReceivedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "coturn_user_received_bytes_total",
+			Help: "Number of bytes received per user with allocations",
+		}, userLabels),
+		userSentBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "coturn_user_sent_bytes_total",
+			Help: "Number of bytes sent per user with allocations",
+		}, userLabels),
+		subnetAllocations: newCountedGauge(prometheus.GaugeOpts{
+			Name: "coturn_allocations_by_client_subnet",
+			Help: "Number of allocations by the subnet of the client address",
+		}, "subnet", 0, opts.MaxSeriesPerRealm, labelOverflows),
+		countryAllocations: newCountedGauge(prometheus.GaugeOpts{
+			Name: "coturn_allocations_by_country",
+			Help: "Number of allocations by the country of the client address",
+		}, "country", opts.GeoMaxLabelValues, opts.MaxSeriesPerRealm, labelOverflows),
+		asnAllocations: newCountedGauge(prometheus.GaugeOpts{
+			Name: "coturn_allocations_by_asn",
+			Help: "Number of allocations by the autonomous system of the client address",
+		}, "asn", opts.GeoMaxLabelValues, opts.MaxSeriesPerRealm, labelOverflows),
+		originAllocations: newCountedGauge(prometheus.GaugeOpts{
+			Name: "coturn_allocations_by_origin",
+			Help: "Number of allocations by origin",
+		}, "origin", 0, opts.MaxSeriesPerRealm, labelOverflows),
+		originReceivedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "coturn_origin_received_bytes_total",
+			Help: "Number of bytes received by origin",
+		}, []string{"realm", "origin"}),
+		originSentBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "coturn_origin_sent_bytes_total",
+			Help: "Number of bytes sent by origin",
+		}, []string{"realm", "origin"}),
+		labelOverflows: labelOverflows,
+	}
+	if opts.TopTalkers > 0 {
+		c.topTalkers = newTopTalkers(opts.TopTalkers, opts.TopTalkersHalfLife, c.now())
+	}
+	c.trafficLatency = c.processingLatency.WithLabelValues("traffic")
+	c.allocationLatency = c.processingLatency.WithLabelValues("allocation")
+	return c
+}
+
+func (c *Collector) collectors() []prometheus.Collector {
+	collectors := []prometheus.Collector{
+		c.allocationPeak,
+		c.receivedPackets,
+		c.receivedBytes,
+		c.sentPackets,
+		c.sentBytes,
+		c.receivedPacketRateHistogauge.GaugeVec(),
+		c.sentPacketRateHistogauge.GaugeVec(),
+		c.suspectSamples,
+		c.allocationRefreshes,
+		c.staleAllocations,
+		c.expiredAllocations,
+		c.allocationLifetime,
+		c.deletedAllocations,
+		c.reportInterval,
+		c.reportGaps,
+		c.ignoredEvents,
+		c.missedAllocations,
+		c.orphanedAllocations,
+		c.droppedOrphans,
+		c.processingLatency,
+		c.peerReceivedPackets,
+		c.peerReceivedBytes,
+		c.peerSentPackets,
+		c.peerSentBytes,
+		c.allocationTotalBytes,
+		c.userAllocationGauge,
+		c.allocationsPerUser.GaugeVec(),
+		c.userReceivedBytes,
+		c.userSentBytes,
+		c.subnetAllocations.vec,
+		c.countryAllocations.vec,
+		c.asnAllocations.vec,
+		c.originAllocations.vec,
+		c.originReceivedBytes,
+		c.originSentBytes,
+		c.labelOverflows,
+	}
+	collectors = append(collectors, c.receivedByteRateHistogauge.collectors()...)
+	return append(collectors, c.sentByteRateHistogauge.collectors()...)
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range c.collectors() {
+		collector.Describe(ch)
+	}
+	ch <- allocationsDesc
+	ch <- realmsDesc
+	ch <- realmsSeenDesc
+	ch <- realmFirstSeenDesc
+	ch <- realmReceivedRateDesc
+	ch <- realmSentRateDesc
+	ch <- meanReceivedRateDesc
+	ch <- meanSentRateDesc
+	if len(c.opts.RateQuantiles) > 0 {
+		ch <- receivedRateQuantileDesc
+		ch <- sentRateQuantileDesc
+	}
+	if c.opts.DailyPeaks {
+		ch <- dailyPeakDesc
+	}
+	if c.opts.DailyUsageLocation != nil {
+		ch <- dayReceivedBytesDesc
+		ch <- daySentBytesDesc
+	}
+	if c.opts.PeakRateWindow > 0 {
+		ch <- peakReceivedRateDesc
+		ch <- peakSentRateDesc
+	}
+	if c.opts.AllocationRates {
+		ch <- allocationReceivedBytesDesc
+		ch <- allocationSentBytesDesc
+		ch <- allocationReceivedPacketsDesc
+		ch <- allocationSentPacketsDesc
+	}
+	if c.opts.UserLabelMode != "" {
+		ch <- userQuotaUtilizationDesc
+	}
+	if c.topTalkers != nil {
+		ch <- topTalkerDesc
+	}
+	if c.opts.RestartDeletionRatio > 0 {
+		ch <- restartsDetectedDesc
+		ch <- lastRestartDesc
+	}
+	ch <- maxBPSDesc
+	ch <- totalQuotaDesc
+	ch <- userQuotaDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, collector := range c.collectors() {
+		collector.Collect(ch)
+	}
+	c.collectAllocations(ch)
+	c.collectRealms(ch)
+	c.collectRealmRates(ch)
+	if len(c.opts.RateQuantiles) > 0 {
+		c.collectRateQuantiles(ch)
+	}
+	if c.opts.DailyPeaks {
+		c.collectDailyPeaks(ch)
+	}
+	if c.opts.DailyUsageLocation != nil {
+		c.collectDayUsage(ch)
+	}
+	if c.opts.PeakRateWindow > 0 {
+		c.collectRatePeaks(ch)
+	}
+	if c.opts.AllocationRates {
+		c.collectAllocationRates(ch)
+	}
+	if c.opts.UserLabelMode != "" {
+		c.collectQuotaUtilization(ch)
+	}
+	if c.topTalkers != nil {
+		c.collectTopTalkers(ch)
+	}
+	if c.opts.RestartDeletionRatio > 0 {
+		c.collectRestarts(ch)
+	}
+	c.collectLimits(ch)
+}
+
+// HandleTraffic implements source.Handler.
+func (c *Collector) HandleTraffic(e source.TrafficEvent) {
+	// registered first so that it runs after the unlock below
+	defer c.observeLatency(c.trafficLatency, e.Time)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	metadata := e.Metadata
+	allocation := c.allocations[metadata.AllocationName]
+	now := c.now()
+
+	switch e.Kind {
+	case source.TrafficPeer:
+		c.handlePeerTraffic(e, allocation, now)
+		return
+	case source.TrafficTotal, source.TrafficPeerTotal:
+		c.handleTotalTraffic(e)
+		return
+	}
+
+	trafficMetric, ok := c.checkSample(metadata, e.Traffic, allocation, now)
+	if !ok {
+		return
+	}
+
+	c.addTraffic(metadata.Realm, trafficMetric)
+	if c.topTalkers != nil {
+		c.topTalkers.add(metadata.Realm, metadata.User, trafficMetric.Rcvb+trafficMetric.Sentb, now)
+	}
+	c.recordExemplar("coturn_received_packets_total", metadata, trafficMetric.Rcvp)
+	c.recordExemplar("coturn_received_bytes_total", metadata, trafficMetric.Rcvb)
+	c.recordExemplar("coturn_sent_packets_total", metadata, trafficMetric.Sentp)
+	c.recordExemplar("coturn_sent_bytes_total", metadata, trafficMetric.Sentb)
+	if c.opts.DailyUsageLocation != nil {
+		c.addDayUsage(metadata.Realm, trafficMetric, now)
+	}
+	c.addOriginTraffic(allocation, trafficMetric)
+	if allocation != nil && c.opts.UserLabelMode != "" {
+		c.userReceivedBytes.WithLabelValues(allocation.realm, allocation.user).Add(trafficMetric.Rcvb)
+		c.userSentBytes.WithLabelValues(allocation.realm, allocation.user).Add(trafficMetric.Sentb)
+	}
+
+	if allocation != nil {
+		gap := now.Sub(allocation.lastMetricTimestamp)
+		// the gap before the first report is measured from the creation
+		// of the allocation and says nothing about the report interval
+		if allocation.previousRates != nil {
+			c.intervals.Observe(gap)
+			c.observeReportGap(allocation.realm, gap)
+		}
+		interval := c.rateInterval(gap)
+		if interval != gap {
+			c.reportInterval.Set(interval.Seconds())
+		}
+
+		elapsed := interval.Seconds()
+		rcvp_rate := trafficMetric.Rcvp / elapsed
+		rcvb_rate := trafficMetric.Rcvb / elapsed
+		sentp_rate := trafficMetric.Sentp / elapsed
+		sentb_rate := trafficMetric.Sentb / elapsed
+		rates := parser.TrafficMetric{Rcvp: rcvp_rate, Rcvb: rcvb_rate, Sentp: sentp_rate, Sentb: sentb_rate}
+		if c.opts.RateWindowReports > 1 || c.opts.RateWindow > 0 {
+			if allocation.window == nil {
+				allocation.window = &rateWindow{}
+			}
+			rates = allocation.window.add(rateSample{trafficMetric, elapsed, now}, c.opts.RateWindowReports, c.opts.RateWindow)
+		}
+
+		labels := c.realm(allocation.realm).labels
+		if allocation.previousRates != nil {
+			c.receivedPacketRateHistogauge.Replace(labels, rates.Rcvp, allocation.previousRates.Rcvp)
+			c.receivedByteRateHistogauge.Replace(labels, rates.Rcvb, allocation.previousRates.Rcvb)
+			c.sentPacketRateHistogauge.Replace(labels, rates.Sentp, allocation.previousRates.Sentp)
+			c.sentByteRateHistogauge.Replace(labels, rates.Sentb, allocation.previousRates.Sentb)
+		} else {
+			c.addRates(labels, &rates)
+		}
+
+		if c.opts.PeakRateWindow > 0 {
+			c.updateRatePeaks(metadata.Realm, rates.Rcvb, rates.Sentb, now)
+		}
+
+		// updated in place, readers outside the lock get copies
+		if allocation.previousRates == nil {
+			allocation.previousRates = new(parser.TrafficMetric)
+		}
+		*allocation.previousRates = rates
+		allocation.idle = false
+		allocation.lastMetricTimestamp = now
+		allocation.lastSeen = now
+		allocation.lastEvent = received(e.Time, now)
+	}
+}
+
+// handlePeerTraffic counts the traffic relayed to and from the peers. Peer
+// reports arrive together with the client reports, so they are only checked
+// for negative values and do not affect the rates.
+func (c *Collector) handlePeerTraffic(e source.TrafficEvent, allocation *trackedAllocation, now time.Time) {
+	trafficMetric, ok := c.checkSample(e.Metadata, e.Traffic, nil, now)
+	if !ok {
+		return
+	}
+
+	realm := e.Metadata.Realm
+	c.peerReceivedPackets.WithLabelValues(realm).Add(trafficMetric.Rcvp)
+	c.peerReceivedBytes.WithLabelValues(realm).Add(trafficMetric.Rcvb)
+	c.peerSentPackets.WithLabelValues(realm).Add(trafficMetric.Sentp)
+	c.peerSentBytes.WithLabelValues(realm).Add(trafficMetric.Sentb)
+
+	if allocation != nil {
+		allocation.lastSeen = now
+		allocation.lastEvent = received(e.Time, now)
+	}
+}
+
+// handleTotalTraffic records the lifetime traffic of a deleted allocation.
+// The traffic itself was already counted from the periodic reports.
+func (c *Collector) handleTotalTraffic(e source.TrafficEvent) {
+	leg := "client"
+	if e.Kind == source.TrafficPeerTotal {
+		leg = "peer"
+	}
+	if e.Traffic.Rcvb >= 0 {
+		c.allocationTotalBytes.With(prometheus.Labels{"realm": e.Metadata.Realm, "leg": leg, "direction": "received"}).Observe(e.Traffic.Rcvb)
+	}
+	if e.Traffic.Sentb >= 0 {
+		c.allocationTotalBytes.With(prometheus.Labels{"realm": e.Metadata.Realm, "leg": leg, "direction": "sent"}).Observe(e.Traffic.Sentb)
+	}
+}
+
+// HandleAllocation implements source.Handler.
+func (c *Collector) HandleAllocation(e source.AllocationEvent) {
+	defer c.observeLatency(c.allocationLatency, e.Time)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	metadata := e.Metadata
+	labels := c.realm(metadata.Realm).labels
+
+	allocation := c.allocations[metadata.AllocationName]
+
+	switch e.Type {
+	case source.AllocationNew:
+		if allocation != nil {
+			c.ignoredEvents.With(prometheus.Labels{"realm": metadata.Realm, "reason": "duplicate_new"}).Inc()
+			logging.Debugf("ignored new status of tracked allocation %s", metadata.AllocationName)
+			allocation.lastSeen = c.now()
+			allocation.lastEvent = received(e.Time, allocation.lastSeen)
+			return
+		}
+		allocation = c.addAllocation(metadata, c.now())
+		allocation.status = e.Status
+		c.setClientAddress(allocation, e.ClientAddress)
+		c.setOrigin(allocation, metadata, e.Status)
+		c.grantLifetime(allocation, e.Lifetime, e.Time, labels)
+		c.observeRestartCreation(c.now())
+	case source.AllocationRefreshed:
+		c.allocationRefreshes.With(labels).Inc()
+		if allocation == nil {
+			// a refresh proves the allocation exists even if we missed its
+			// creation
+			allocation = c.addAllocation(metadata, c.now())
+		}
+		allocation.lastSeen = c.now()
+		allocation.lastEvent = received(e.Time, allocation.lastSeen)
+		allocation.status = e.Status
+		c.setClientAddress(allocation, e.ClientAddress)
+		c.setOrigin(allocation, metadata, e.Status)
+		c.grantLifetime(allocation, e.Lifetime, e.Time, labels)
+	case source.AllocationDeleted:
+		if c.opts.Reconcile {
+			c.deletions[metadata.AllocationName] = received(e.Time, c.now())
+		}
+		// only allocations we track were counted, so anything else must not
+		// be subtracted or the gauge drifts below the real count
+		if allocation == nil {
+			c.ignoredEvents.With(prometheus.Labels{"realm": metadata.Realm, "reason": "unknown_deleted"}).Inc()
+			logging.Debugf("ignored deletion of untracked allocation %s", metadata.AllocationName)
+			return
+		}
+		reason := e.DeletionReason
+		if reason == "" {
+			reason = parser.DeletionUnknown
+		}
+		c.deletedAllocations.With(prometheus.Labels{"realm": metadata.Realm, "reason": reason}).Inc()
+		c.observeRestartDeletion(c.now())
+		c.removeAllocation(metadata.AllocationName, allocation)
+	}
+}
+
+// grantLifetime records the lifetime granted by a status received at
+// received.
+func (c *Collector) grantLifetime(allocation *trackedAllocation, lifetime time.Duration, received time.Time, labels prometheus.Labels) {
+	if lifetime <= 0 {
+		return
+	}
+	if received.IsZero() {
+		received = c.now()
+	}
+	allocation.expires = received.Add(lifetime)
+	c.allocationLifetime.With(labels).Observe(lifetime.Seconds())
+}
+
+// addAllocation starts tracking an allocation the caller knows is not
+// tracked yet.
+func (c *Collector) addAllocation(metadata parser.MessageMetadata, now time.Time) *trackedAllocation {
+	allocation := newTrackedAllocation(metadata.Realm, now)
+	c.allocationRealms[metadata.Realm] = struct{}{}
+	c.addRealmAllocation(metadata.Realm, now)
+	allocation.id = metadata.AllocationID
+	allocation.userName = metadata.User
+	c.addUserNameAllocation(allocation.realm, allocation.userName)
+	if c.opts.UserLabelMode != "" {
+		allocation.user = c.userLabel(metadata.User)
+		allocation.user = c.addUserAllocation(allocation.realm, allocation.user)
+	}
+	c.allocations[metadata.AllocationName] = allocation
+	return allocation
+}
+
+// removeAllocation stops tracking an allocation and removes it from the
+// metrics derived from the tracked allocations.
+func (c *Collector) removeAllocation(name string, allocation *trackedAllocation) {
+	if allocation.previousRates != nil {
+		c.removeRates(c.realm(allocation.realm).labels, allocation.previousRates)
+	}
+	c.removeRealmAllocation(allocation.realm, c.now())
+	c.removeUserNameAllocation(allocation.realm, allocation.userName)
+	if c.opts.UserLabelMode != "" {
+		c.removeUserAllocation(allocation.realm, allocation.user)
+	}
+	if allocation.hasClient {
+		c.removeClient(allocation)
+	}
+	c.removeOrigin(allocation)
+	delete(c.allocations, name)
+}
+
+func (c *Collector) observeLatency(latency prometheus.Observer, received time.Time) {
+	if received.IsZero() {
+		return
+	}
+	latency.Observe(c.now().Sub(received).Seconds())
+}
+
+// checkSample validates a traffic report. Negative counts can only come from
+// a broken or restarted coturn, and a report implying a rate above the
+// configured maximum is usually a duplicate or reordered message arriving
+// right after the previous one. Suspect reports are dropped, or clamped if
+// configured.
+func (c *Collector) checkSample(metadata parser.MessageMetadata, t parser.TrafficMetric, allocation *trackedAllocation, now time.Time) (parser.TrafficMetric, bool) {
+	reason := ""
+	if t.Rcvp < 0 || t.Rcvb < 0 || t.Sentp < 0 || t.Sentb < 0 {
+		reason = "negative"
+		t.Rcvp = math.Max(t.Rcvp, 0)
+		t.Rcvb = math.Max(t.Rcvb, 0)
+		t.Sentp = math.Max(t.Sentp, 0)
+		t.Sentb = math.Max(t.Sentb, 0)
+	}
+
+	if allocation != nil {
+		elapsed := now.Sub(allocation.lastMetricTimestamp).Seconds()
+		if c.opts.MaxPacketRate > 0 {
+			max := c.opts.MaxPacketRate * elapsed
+			if t.Rcvp > max || t.Sentp > max {
+				reason = "burst"
+				t.Rcvp = math.Min(t.Rcvp, max)
+				t.Sentp = math.Min(t.Sentp, max)
+			}
+		}
+		if c.opts.MaxByteRate > 0 {
+			max := c.opts.MaxByteRate * elapsed
+			if t.Rcvb > max || t.Sentb > max {
+				reason = "burst"
+				t.Rcvb = math.Min(t.Rcvb, max)
+				t.Sentb = math.Min(t.Sentb, max)
+			}
+		}
+	}
+
+	if reason == "" {
+		return t, true
+	}
+	c.suspectSamples.With(prometheus.Labels{"realm": metadata.Realm, "reason": reason}).Inc()
+	logging.Debugf("suspect traffic report of %s (%s): %+v", metadata.AllocationName, reason, t)
+	return t, c.opts.ClampSuspectSamples
+}
+
+func (c *Collector) addRates(labels prometheus.Labels, rates *parser.TrafficMetric) {
+	c.receivedPacketRateHistogauge.Add(labels, rates.Rcvp)
+	c.receivedByteRateHistogauge.Add(labels, rates.Rcvb)
+	c.sentPacketRateHistogauge.Add(labels, rates.Sentp)
+	c.sentByteRateHistogauge.Add(labels, rates.Sentb)
+}
+
+func (c *Collector) removeRates(labels prometheus.Labels, rates *parser.TrafficMetric) {
+	c.receivedPacketRateHistogauge.Remove(labels, rates.Rcvp)
+	c.receivedByteRateHistogauge.Remove(labels, rates.Rcvb)
+	c.sentPacketRateHistogauge.Remove(labels, rates.Sentp)
+	c.sentByteRateHistogauge.Remove(labels, rates.Sentb)
+}
+
+// ExpireStale drops allocations that have not been seen for the stale
+// timeout, or with LifetimeExpiry whose lifetime ran out, which happens when
+// their deletion message was lost. It returns the number of allocations
+// dropped.
+func (c *Collector) ExpireStale() int {
+	if c.opts.StaleTimeout <= 0 && !c.opts.LifetimeExpiry {
+		return 0
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	expired := 0
+	now := c.now()
+	for name, allocation := range c.allocations {
+		labels := c.realm(allocation.realm).labels
+		if c.opts.LifetimeExpiry && !allocation.expires.IsZero() && now.Sub(allocation.expires) >= c.opts.LifetimeGrace {
+			c.expiredAllocations.With(labels).Inc()
+			logging.Debugf("expired allocation %s, its lifetime ended at %v", name, allocation.expires)
+		} else if c.opts.StaleTimeout > 0 && now.Sub(allocation.lastSeen) >= c.opts.StaleTimeout {
+			c.staleAllocations.With(labels).Inc()
+			logging.Debugf("expired allocation %s, last seen at %v", name, allocation.lastSeen)
+		} else {
+			continue
+		}
+		c.removeAllocation(name, allocation)
+		expired++
+	}
+	return expired
+}
+
+// TrackAllocation starts tracking an allocation found outside of pubsub, such
+// as during the initial key scan. Allocations already tracked are ignored.
+func (c *Collector) TrackAllocation(a source.Allocation) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	metadata := a.Metadata
+	// the allocation may have been announced on pubsub in the meantime
+	if c.allocations[metadata.AllocationName] != nil {
+		return
+	}
+	c.trackFound(a, c.now())
+}
+
+// trackFound starts tracking an allocation found outside of pubsub the
+// caller knows is not tracked yet.
+func (c *Collector) trackFound(a source.Allocation, now time.Time) *trackedAllocation {
+	metadata := a.Metadata
+	allocation := c.addAllocation(metadata, now)
+	allocation.status = a.Status
+	c.setClientAddress(allocation, a.ClientAddress)
+	c.setOrigin(allocation, metadata, a.Status)
+	// the status may be older, so this is the latest the lifetime can end
+	if lifetime := parser.ParseStatus(a.Status).Lifetime; lifetime > 0 {
+		allocation.expires = now.Add(lifetime)
+	}
+	if a.Traffic != nil {
+		c.seedRates(allocation, *a.Traffic)
+	}
+	return allocation
+}
+
+// seedRates takes the rates of an allocation found outside of pubsub from
+// its last traffic report, so that the rate distributions are complete
+// before it reports again. This needs a configured ReportInterval, since
+// the report covers an unknown time otherwise.
+func (c *Collector) seedRates(allocation *trackedAllocation, t parser.TrafficMetric) {
+	if c.opts.ReportInterval <= 0 || t.Rcvp < 0 || t.Rcvb < 0 || t.Sentp < 0 || t.Sentb < 0 {
+		return
+	}
+	elapsed := c.opts.ReportInterval.Seconds()
+	rates := parser.TrafficMetric{Rcvp: t.Rcvp / elapsed, Rcvb: t.Rcvb / elapsed, Sentp: t.Sentp / elapsed, Sentb: t.Sentb / elapsed}
+	if (c.opts.MaxPacketRate > 0 && math.Max(rates.Rcvp, rates.Sentp) > c.opts.MaxPacketRate) ||
+		(c.opts.MaxByteRate > 0 && math.Max(rates.Rcvb, rates.Sentb) > c.opts.MaxByteRate) {
+		return
+	}
+	c.addRates(c.realm(allocation.realm).labels, &rates)
+	allocation.previousRates = &rates
+}
+
+// Reset drops all tracked allocations along with the metrics derived from
+// them. Traffic counters are kept.
+func (c *Collector) Reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.allocations = make(map[string]*trackedAllocation)
+	c.allocationRealms = make(map[string]struct{})
+	c.receivedPacketRateHistogauge.Reset()
+	c.receivedByteRateHistogauge.reset()
+	c.sentPacketRateHistogauge.Reset()
+	c.sentByteRateHistogauge.reset()
+	c.realmAllocations = make(map[string]int)
+	c.emptyRealms = make(map[string]time.Time)
+	c.userAllocations = make(map[realmKey]int)
+	c.realmUsers = make(map[string]int)
+	c.userAllocationGauge.Reset()
+	c.userNameAllocations = make(map[realmKey]int)
+	c.allocationsPerUser.Reset()
+	c.userReceivedBytes.Reset()
+	c.userSentBytes.Reset()
+	c.subnetAllocations.reset()
+	c.countryAllocations.reset()
+	c.asnAllocations.reset()
+	c.originAllocations.reset()
+}
+
+// AllocationInfo describes a tracked allocation.
+type AllocationInfo struct {
+	Realm string `json:"realm"`
+	// User is the user label value, only set if the user label is enabled.
+	User   string `json:"user,omitempty"`
+	Status string `json:"status"`
+	// Created is when the exporter started tracking the allocation.
+	Created             time.Time             `json:"created"`
+	PreviousRates       *parser.TrafficMetric `json:"previous_rates,omitempty"`
+	LastMetricTimestamp time.Time             `json:"last_metric_timestamp"`
+}
+
+// Allocations returns the tracked allocations keyed by allocation name.
+func (c *Collector) Allocations() map[string]AllocationInfo {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	result := make(map[string]AllocationInfo, len(c.allocations))
+	for name, allocation := range c.allocations {
+		info := AllocationInfo{
+			Realm:               allocation.realm,
+			User:                allocation.user,
+			Status:              allocation.status,
+			Created:             allocation.created,
+			LastMetricTimestamp: allocation.lastMetricTimestamp,
+		}
+		if r := allocation.previousRates; r != nil {
+			rates := *r
+			info.PreviousRates = &rates
+		}
+		result[name] = info
+	}
+	return result
+}
+
+// AllocationCount returns the number of tracked allocations.
+func (c *Collector) AllocationCount() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.allocations)
+}
+
+// RealmTotals returns the number of tracked allocations and the sum of their
+// last known received and sent byte rates per realm.
+func (c *Collector) RealmTotals() (map[string]float64, map[string]float64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	counts := make(map[string]float64)
+	byteRates := make(map[string]float64)
+	for _, allocation := range c.allocations {
+		counts[allocation.realm]++
+		if r := allocation.previousRates; r != nil {
+			byteRates[allocation.realm] += r.Rcvb + r.Sentb
+		}
+	}
+	return counts, byteRates
+}
@@ -0,0 +1,206 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/iknow/coturn_exporter/collector"
+	"github.com/iknow/coturn_exporter/parser"
+	"github.com/iknow/coturn_exporter/source"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// metricValue returns the value of the gauge, counter or untyped series of
+// family name with the given labels, or -1 if c does not expose it.
+func metricValue(t *testing.T, c prometheus.Collector, name string, labels map[string]string) float64 {
+	t.Helper()
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(c)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if !hasLabels(metric, labels) {
+				continue
+			}
+			switch {
+			case metric.Gauge != nil:
+				return metric.Gauge.GetValue()
+			case metric.Counter != nil:
+				return metric.Counter.GetValue()
+			case metric.Untyped != nil:
+				return metric.Untyped.GetValue()
+			}
+		}
+	}
+	return -1
+}
+
+func hasLabels(metric *dto.Metric, labels map[string]string) bool {
+	matched := 0
+	for _, pair := range metric.GetLabel() {
+		value, ok := labels[pair.GetName()]
+		if !ok {
+			continue
+		}
+		if value != pair.GetValue() {
+			return false
+		}
+		matched++
+	}
+	return matched == len(labels)
+}
+
+func parseKey(t testing.TB, key string) parser.MessageMetadata {
+	t.Helper()
+	metadata, err := parser.ParseKeyName(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metadata
+}
+
+// trackedTraffic returns a collector tracking n allocations spread over four
+// realms, and a traffic report for each of them.
+func trackedTraffic(n int) (*collector.Collector, []source.TrafficEvent) {
+	c := collector.New(collector.Options{ReportInterval: 10 * time.Second})
+	events := make([]source.TrafficEvent, n)
+	for i := range events {
+		name := fmt.Sprintf("turn/realm/r%d/user/u%d/allocation/%d", i%4, i, i)
+		metadata, err := parser.ParseKeyName(name + "/status")
+		if err != nil {
+			panic(err)
+		}
+		c.HandleAllocation(source.AllocationEvent{Type: source.AllocationNew, Metadata: metadata, Status: "new lifetime=600"})
+		metadata.MessageType = parser.MessageTraffic
+		events[i] = source.TrafficEvent{
+			Metadata: metadata,
+			Traffic:  parser.TrafficMetric{Rcvp: 100, Rcvb: float64(1000 * (i%50 + 1)), Sentp: 100, Sentb: 5000},
+			Kind:     source.TrafficClient,
+		}
+	}
+	return c, events
+}
+
+// BenchmarkHandleTraffic measures the hot path of busy clusters, which send
+// 10k and more traffic reports per second. It should not allocate.
+func BenchmarkHandleTraffic(b *testing.B) {
+	c, events := trackedTraffic(10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e := events[i%len(events)]
+		// vary the rates so that the histogauges move between buckets
+		e.Traffic.Rcvb *= float64(i%3 + 1)
+		c.HandleTraffic(e)
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+}
+
+func TestRestoreRatesReplacesSeededRates(t *testing.T) {
+	c := collector.New(collector.Options{ReportInterval: 10 * time.Second})
+	metadata := parseKey(t, "turn/realm/r/user/u/allocation/1/status")
+	c.TrackAllocation(source.Allocation{
+		Metadata: metadata,
+		Status:   "new lifetime=600",
+		Traffic:  &parser.TrafficMetric{Rcvp: 10, Rcvb: 10000, Sentp: 10, Sentb: 10000},
+	})
+	c.RestoreRates(&collector.Snapshot{Allocations: map[string]collector.SnapshotAllocation{
+		metadata.AllocationName: {PreviousRates: &parser.TrafficMetric{Rcvp: 2, Rcvb: 500, Sentp: 2, Sentb: 500}},
+	}})
+
+	inf := map[string]string{"realm": "r", "le": "+Inf"}
+	if got := metricValue(t, c, "coturn_received_byte_rate_bps_bucket", inf); got != 1 {
+		t.Fatalf("+Inf bucket after restoring = %v, want 1", got)
+	}
+
+	c.HandleAllocation(source.AllocationEvent{Type: source.AllocationDeleted, Metadata: metadata, Status: "deleted"})
+	if got := metricValue(t, c, "coturn_received_byte_rate_bps_bucket", inf); got != 0 {
+		t.Fatalf("+Inf bucket after deletion = %v, want 0", got)
+	}
+}
+
+func TestDeletionsOfUntrackedAllocationsAreNotCounted(t *testing.T) {
+	c := collector.New(collector.Options{ReportInterval: 10 * time.Second})
+	metadata := parseKey(t, "turn/realm/r/user/u/allocation/1/status")
+	deleted := source.AllocationEvent{Type: source.AllocationDeleted, Metadata: metadata, Status: "deleted reason=timeout", DeletionReason: parser.DeletionExpired}
+
+	c.HandleAllocation(source.AllocationEvent{Type: source.AllocationNew, Metadata: metadata, Status: "new lifetime=600"})
+	c.HandleAllocation(deleted)
+	c.HandleAllocation(deleted)
+
+	labels := map[string]string{"realm": "r", "reason": parser.DeletionExpired}
+	if got := metricValue(t, c, "coturn_allocations_deleted_total", labels); got != 1 {
+		t.Fatalf("deleted allocations = %v, want 1", got)
+	}
+	labels["reason"] = "unknown_deleted"
+	if got := metricValue(t, c, "coturn_exporter_ignored_allocation_events_total", labels); got != 1 {
+		t.Fatalf("ignored deletions = %v, want 1", got)
+	}
+}
+
+// testClock is a collector clock that only moves when told to.
+type testClock struct{ now time.Time }
+
+func (c *testClock) Now() time.Time { return c.now }
+
+func TestReconcileTracksMissedAllocationsLikeLoaded(t *testing.T) {
+	clock := &testClock{time.Unix(1000, 0)}
+	c := collector.New(collector.Options{Reconcile: true, LifetimeExpiry: true, Clock: clock})
+	metadata := parseKey(t, "turn/realm/r/user/u/allocation/1/status")
+
+	c.Reconcile([]source.Allocation{{Metadata: metadata, Status: "new lifetime=60"}}, clock.now)
+	if got := metricValue(t, c, "coturn_exporter_missed_allocations_total", map[string]string{"realm": "r"}); got != 1 {
+		t.Fatalf("missed allocations = %v, want 1", got)
+	}
+
+	clock.now = clock.now.Add(61 * time.Second)
+	if expired := c.ExpireStale(); expired != 1 {
+		t.Fatalf("expired %d allocations after the lifetime, want 1", expired)
+	}
+}
+
+func TestReconcileComparesReceiveTimes(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := &testClock{start}
+	c := collector.New(collector.Options{Reconcile: true, DropOrphans: true, Clock: clock})
+	metadata := parseKey(t, "turn/realm/r/user/u/allocation/1/status")
+
+	c.HandleAllocation(source.AllocationEvent{Type: source.AllocationNew, Metadata: metadata, Status: "new lifetime=600", Time: start})
+	// received before the scan started, but only handled after it
+	clock.now = start.Add(10 * time.Second)
+	c.HandleAllocation(source.AllocationEvent{Type: source.AllocationRefreshed, Metadata: metadata, Status: "refreshed lifetime=600", Time: start.Add(5 * time.Second)})
+
+	c.Reconcile(nil, start.Add(8*time.Second))
+	if got := metricValue(t, c, "coturn_exporter_dropped_orphaned_allocations_total", map[string]string{"realm": "r"}); got != 1 {
+		t.Fatalf("dropped orphans = %v, want 1", got)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"time"
+
+	"github.com/iknow/coturn_exporter/parser"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	dayReceivedBytesDesc = prometheus.NewDesc(
+		"coturn_received_bytes_day_total",
+		"Number of bytes received from clients since the start of the current day",
+		metricLabels, nil,
+	)
+	daySentBytesDesc = prometheus.NewDesc(
+		"coturn_sent_bytes_day_total",
+		"Number of bytes sent to clients since the start of the current day",
+		metricLabels, nil,
+	)
+)
+
+// dayUsage is the traffic of a realm during day.
+type dayUsage struct {
+	day      string
+	received float64
+	sent     float64
+}
+
+// usageDay returns the day t belongs to, as YYYY-MM-DD of the day it
+// started on.
+func (c *Collector) usageDay(t time.Time) string {
+	return t.In(c.opts.DailyUsageLocation).Add(-c.opts.DailyUsageOffset).Format("2006-01-02")
+}
+
+// realmDayUsage returns the usage of realm during day, starting over if the
+// usage recorded so far is of an earlier day.
+func (c *Collector) realmDayUsage(realm string, day string) *dayUsage {
+	usage := c.dayUsage[realm]
+	if usage == nil {
+		usage = &dayUsage{}
+		c.dayUsage[realm] = usage
+	}
+	if usage.day != day {
+		*usage = dayUsage{day: day}
+	}
+	return usage
+}
+
+func (c *Collector) addDayUsage(realm string, t parser.TrafficMetric, now time.Time) {
+	usage := c.realmDayUsage(realm, c.usageDay(now))
+	usage.received += t.Rcvb
+	usage.sent += t.Sentb
+}
+
+// collectDayUsage also starts the realms without traffic since the day
+// boundary over, so they drop to zero at the boundary as well.
+func (c *Collector) collectDayUsage(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	day := c.usageDay(c.now())
+	for realm := range c.dayUsage {
+		usage := c.realmDayUsage(realm, day)
+		ch <- prometheus.MustNewConstMetric(dayReceivedBytesDesc, prometheus.CounterValue, usage.received, realm)
+		ch <- prometheus.MustNewConstMetric(daySentBytesDesc, prometheus.CounterValue, usage.sent, realm)
+	}
+}
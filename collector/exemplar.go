@@ -0,0 +1,74 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/iknow/coturn_exporter/parser"
+)
+
+// Exemplar identifies the allocation behind the latest increment of a
+// traffic counter.
+type Exemplar struct {
+	Allocation string
+	UserHash   string
+	Value      float64
+	Timestamp  time.Time
+	// user is hashed into UserHash when the exemplar is read, which is
+	// rare compared to the updates
+	user string
+}
+
+func (c *Collector) recordExemplar(metricName string, metadata parser.MessageMetadata, value float64) {
+	if value == 0 {
+		return
+	}
+
+	c.exemplarLock.Lock()
+	defer c.exemplarLock.Unlock()
+
+	byRealm := c.exemplars[metricName]
+	if byRealm == nil {
+		byRealm = make(map[string]Exemplar)
+		c.exemplars[metricName] = byRealm
+	}
+	byRealm[metadata.Realm] = Exemplar{Allocation: metadata.AllocationID, Value: value, Timestamp: c.now(), user: metadata.User}
+}
+
+func hashUser(user string) string {
+	sum := sha256.Sum256([]byte(user))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Exemplar returns the latest exemplar of a traffic counter in a realm.
+func (c *Collector) Exemplar(metricName string, realm string) (Exemplar, bool) {
+	c.exemplarLock.Lock()
+	defer c.exemplarLock.Unlock()
+
+	e, ok := c.exemplars[metricName][realm]
+	if ok {
+		e.UserHash = hashUser(e.user)
+	}
+	return e, ok
+}
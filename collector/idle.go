@@ -0,0 +1,64 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"github.com/iknow/coturn_exporter/parser"
+)
+
+// ExpireIdleRates stops counting the last rates of allocations that have not
+// reported traffic for the idle timeout, which would otherwise stay in the
+// rate distribution forever. Their rates are counted as zero, or removed
+// with RemoveIdleRates, until traffic resumes. It returns the number of
+// allocations that became idle.
+func (c *Collector) ExpireIdleRates() int {
+	if c.opts.RateIdleTimeout <= 0 {
+		return 0
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	idle := 0
+	now := c.now()
+	for _, allocation := range c.allocations {
+		if allocation.previousRates == nil || allocation.idle || now.Sub(allocation.lastMetricTimestamp) < c.opts.RateIdleTimeout {
+			continue
+		}
+		labels := c.realm(allocation.realm).labels
+		if c.opts.RemoveIdleRates {
+			c.removeRates(labels, allocation.previousRates)
+			allocation.previousRates = nil
+		} else {
+			previous := allocation.previousRates
+			c.receivedPacketRateHistogauge.Replace(labels, 0, previous.Rcvp)
+			c.receivedByteRateHistogauge.Replace(labels, 0, previous.Rcvb)
+			c.sentPacketRateHistogauge.Replace(labels, 0, previous.Sentp)
+			c.sentByteRateHistogauge.Replace(labels, 0, previous.Sentb)
+			allocation.previousRates = &parser.TrafficMetric{}
+			allocation.idle = true
+		}
+		// the rates start over when traffic resumes
+		allocation.window = nil
+		idle++
+	}
+	return idle
+}
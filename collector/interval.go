@@ -0,0 +1,80 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// number of recent report gaps the interval is inferred from
+	intervalSamples = 256
+	// number of gaps required before the inferred interval is used
+	minIntervalSamples = 16
+)
+
+// intervalEstimator infers coturn's stats report interval as the median of
+// the most recently observed gaps between traffic reports of the same
+// allocation. The median ignores the occasional delayed or bunched message
+// that makes the individual gaps jitter.
+type intervalEstimator struct {
+	gaps   []time.Duration
+	next   int
+	median time.Duration
+}
+
+func (e *intervalEstimator) Observe(gap time.Duration) {
+	if len(e.gaps) < intervalSamples {
+		e.gaps = append(e.gaps, gap)
+	} else {
+		e.gaps[e.next] = gap
+		e.next = (e.next + 1) % intervalSamples
+	}
+
+	// sorting on every report would be wasteful, the interval hardly changes
+	if len(e.gaps) >= minIntervalSamples && (len(e.gaps) < intervalSamples || e.next%16 == 0) {
+		sorted := make([]time.Duration, len(e.gaps))
+		copy(sorted, e.gaps)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		e.median = sorted[len(sorted)/2]
+	}
+}
+
+// Interval returns the inferred interval, or zero if not enough gaps have
+// been observed yet.
+func (e *intervalEstimator) Interval() time.Duration {
+	return e.median
+}
+
+// rateInterval returns the duration a traffic report covers, given the gap
+// since the previous report of the same allocation.
+func (c *Collector) rateInterval(gap time.Duration) time.Duration {
+	if c.opts.ReportInterval > 0 {
+		return c.opts.ReportInterval
+	}
+	if c.opts.InferReportInterval {
+		if interval := c.intervals.Interval(); interval > 0 {
+			return interval
+		}
+	}
+	return gap
+}
@@ -0,0 +1,56 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"github.com/iknow/coturn_exporter/parser"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// setOrigin assigns an allocation to its origin, taken from the key or the
+// status. Allocations keep the first origin they were assigned, those
+// without one count as "unknown".
+func (c *Collector) setOrigin(allocation *trackedAllocation, metadata parser.MessageMetadata, status string) {
+	if !c.opts.OriginLabel || allocation.origin != "" {
+		return
+	}
+	origin := metadata.Origin
+	if origin == "" {
+		origin = parser.ParseStatusFields(status)[parser.StatusFieldOrigin]
+	}
+	allocation.origin = c.originAllocations.add(allocation.realm, orUnknown(origin))
+}
+
+func (c *Collector) removeOrigin(allocation *trackedAllocation) {
+	if allocation.origin != "" {
+		c.originAllocations.remove(allocation.realm, allocation.origin)
+	}
+}
+
+func (c *Collector) addOriginTraffic(allocation *trackedAllocation, t parser.TrafficMetric) {
+	if allocation == nil || allocation.origin == "" {
+		return
+	}
+	labels := prometheus.Labels{"realm": allocation.realm, "origin": allocation.origin}
+	c.originReceivedBytes.With(labels).Add(t.Rcvb)
+	c.originSentBytes.With(labels).Add(t.Sentb)
+}
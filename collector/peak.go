@@ -0,0 +1,106 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var dailyPeakDesc = prometheus.NewDesc(
+	"coturn_allocations_daily_peak",
+	"Highest number of concurrent allocations over the last 24 hours, at hour granularity",
+	metricLabels, nil,
+)
+
+// hourlyPeaks keeps the highest allocation count of each of the last 24
+// hours of a realm.
+type hourlyPeaks struct {
+	// hour since the epoch each slot belongs to
+	hours  [24]int64
+	values [24]float64
+}
+
+// observe records a change of the allocation count from before to after.
+// The first change of an hour seeds its slot with the count the hour started
+// with.
+func (p *hourlyPeaks) observe(hour int64, before float64, after float64) {
+	i := hour % 24
+	if p.hours[i] != hour {
+		p.hours[i] = hour
+		p.values[i] = before
+	}
+	if after > p.values[i] {
+		p.values[i] = after
+	}
+}
+
+// max returns the peak over the last 24 hours. Hours without changes kept
+// the count of the last change, which is either in an observed slot or still
+// the current count.
+func (p *hourlyPeaks) max(hour int64, current float64) float64 {
+	peak := current
+	for i, h := range p.hours {
+		if h > hour-24 && p.values[i] > peak {
+			peak = p.values[i]
+		}
+	}
+	return peak
+}
+
+func hourOf(t time.Time) int64 {
+	return t.Unix() / 3600
+}
+
+// updatePeaks records a change of the allocation count of a realm.
+func (c *Collector) updatePeaks(realm string, before float64, after float64, now time.Time) {
+	if after > c.realmPeaks[realm] {
+		c.realmPeaks[realm] = after
+		c.allocationPeak.WithLabelValues(realm).Set(after)
+	}
+	if c.opts.DailyPeaks {
+		peaks := c.dailyPeaks[realm]
+		if peaks == nil {
+			peaks = &hourlyPeaks{}
+			c.dailyPeaks[realm] = peaks
+		}
+		peaks.observe(hourOf(now), before, after)
+	}
+}
+
+func (c *Collector) deletePeaks(realm string) {
+	c.allocationPeak.DeleteLabelValues(realm)
+	delete(c.realmPeaks, realm)
+	delete(c.dailyPeaks, realm)
+	delete(c.ratePeaks, realm)
+}
+
+func (c *Collector) collectDailyPeaks(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	hour := hourOf(c.now())
+	for realm, peaks := range c.dailyPeaks {
+		peak := peaks.max(hour, float64(c.realmAllocations[realm]))
+		ch <- prometheus.MustNewConstMetric(dailyPeakDesc, prometheus.GaugeValue, peak, realm)
+	}
+}
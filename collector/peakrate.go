@@ -0,0 +1,109 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// peakSlots is the number of slots a peak rate window is divided into,
+// which is the granularity at which old peaks leave the window.
+const peakSlots = 60
+
+var (
+	peakReceivedRateDesc = prometheus.NewDesc(
+		"coturn_allocation_peak_received_bytes_per_second",
+		"Highest received byte rate of a single allocation over the peak rate window",
+		metricLabels, nil,
+	)
+	peakSentRateDesc = prometheus.NewDesc(
+		"coturn_allocation_peak_sent_bytes_per_second",
+		"Highest sent byte rate of a single allocation over the peak rate window",
+		metricLabels, nil,
+	)
+)
+
+// rollingMax keeps the maximum of each slot of a window, so that the
+// maximum over the window can be computed without keeping every value.
+type rollingMax struct {
+	// slot since the epoch each entry belongs to
+	slots  [peakSlots]int64
+	values [peakSlots]float64
+}
+
+func (m *rollingMax) observe(slot int64, value float64) {
+	i := slot % peakSlots
+	if m.slots[i] != slot {
+		m.slots[i] = slot
+		m.values[i] = value
+	} else if value > m.values[i] {
+		m.values[i] = value
+	}
+}
+
+func (m *rollingMax) max(slot int64) float64 {
+	var peak float64
+	for i, s := range m.slots {
+		if s > slot-peakSlots && m.values[i] > peak {
+			peak = m.values[i]
+		}
+	}
+	return peak
+}
+
+// ratePeaks are the rolling maxima of the allocation rates of a realm.
+type ratePeaks struct {
+	received rollingMax
+	sent     rollingMax
+}
+
+func (c *Collector) peakSlot(now time.Time) int64 {
+	length := int64(c.opts.PeakRateWindow / peakSlots)
+	if length < 1 {
+		length = 1
+	}
+	return now.UnixNano() / length
+}
+
+// updateRatePeaks records the new rates of an allocation of realm.
+func (c *Collector) updateRatePeaks(realm string, receivedBytes float64, sentBytes float64, now time.Time) {
+	peaks := c.ratePeaks[realm]
+	if peaks == nil {
+		peaks = &ratePeaks{}
+		c.ratePeaks[realm] = peaks
+	}
+	slot := c.peakSlot(now)
+	peaks.received.observe(slot, receivedBytes)
+	peaks.sent.observe(slot, sentBytes)
+}
+
+func (c *Collector) collectRatePeaks(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	slot := c.peakSlot(c.now())
+	for realm, peaks := range c.ratePeaks {
+		ch <- prometheus.MustNewConstMetric(peakReceivedRateDesc, prometheus.GaugeValue, peaks.received.max(slot), realm)
+		ch <- prometheus.MustNewConstMetric(peakSentRateDesc, prometheus.GaugeValue, peaks.sent.max(slot), realm)
+	}
+}
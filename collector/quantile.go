@@ -0,0 +1,96 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	receivedRateQuantileDesc = prometheus.NewDesc(
+		"coturn_received_byte_rate_quantile",
+		"Quantiles of the current received byte rates of the allocations that reported traffic",
+		[]string{"realm", "quantile"}, nil,
+	)
+	sentRateQuantileDesc = prometheus.NewDesc(
+		"coturn_sent_byte_rate_quantile",
+		"Quantiles of the current sent byte rates of the allocations that reported traffic",
+		[]string{"realm", "quantile"}, nil,
+	)
+)
+
+// ParseQuantiles parses a comma separated list of quantiles between 0 and 1.
+func ParseQuantiles(list string) ([]float64, error) {
+	var quantiles []float64
+	for _, field := range strings.Split(list, ",") {
+		q, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || q < 0 || q > 1 {
+			return nil, fmt.Errorf("invalid quantile %q, expected a number between 0 and 1", field)
+		}
+		quantiles = append(quantiles, q)
+	}
+	return quantiles, nil
+}
+
+// collectRateQuantiles computes the quantiles exactly from the tracked
+// rates at scrape time, instead of estimating them from the histogauge
+// buckets.
+func (c *Collector) collectRateQuantiles(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	received := make(map[string][]float64)
+	sent := make(map[string][]float64)
+	for _, allocation := range c.allocations {
+		if r := allocation.previousRates; r != nil {
+			received[allocation.realm] = append(received[allocation.realm], r.Rcvb)
+			sent[allocation.realm] = append(sent[allocation.realm], r.Sentb)
+		}
+	}
+	c.lock.Unlock()
+
+	for realm, rates := range received {
+		c.collectQuantiles(ch, receivedRateQuantileDesc, realm, rates)
+		c.collectQuantiles(ch, sentRateQuantileDesc, realm, sent[realm])
+	}
+}
+
+func (c *Collector) collectQuantiles(ch chan<- prometheus.Metric, desc *prometheus.Desc, realm string, rates []float64) {
+	sort.Float64s(rates)
+	for _, q := range c.opts.RateQuantiles {
+		label := strconv.FormatFloat(q, 'f', -1, 64)
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, quantile(rates, q), realm, label)
+	}
+}
+
+// quantile interpolates linearly between the closest ranks of sorted.
+func quantile(sorted []float64, q float64) float64 {
+	rank := q * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	if lower+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[lower] + (rank-float64(lower))*(sorted[lower+1]-sorted[lower])
+}
@@ -0,0 +1,142 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	userQuotaUtilizationDesc = prometheus.NewDesc(
+		"coturn_user_quota_utilization_ratio",
+		"Utilization of the coturn limits per user: the highest byte rate of an allocation relative to max-bps, or the number of allocations relative to user-quota",
+		[]string{"realm", "user", "quota"}, nil,
+	)
+	maxBPSDesc = prometheus.NewDesc(
+		"coturn_config_max_bps",
+		"Configured max-bps of the realm, the highest byte rate of an allocation in each direction",
+		[]string{"realm"}, nil,
+	)
+	totalQuotaDesc = prometheus.NewDesc(
+		"coturn_config_total_quota",
+		"Configured total-quota of the realm, the highest number of concurrent allocations",
+		[]string{"realm"}, nil,
+	)
+	userQuotaDesc = prometheus.NewDesc(
+		"coturn_config_user_quota",
+		"Configured user-quota of the realm, the highest number of concurrent allocations of a user",
+		[]string{"realm"}, nil,
+	)
+)
+
+// Quota holds the limits coturn enforces in a realm. Zero means unlimited.
+type Quota struct {
+	// MaxBPS is the highest byte rate of a single allocation, applied to
+	// each direction separately.
+	MaxBPS float64
+	// UserQuota is the highest number of concurrent allocations of a user.
+	UserQuota float64
+	// TotalQuota is the highest number of concurrent allocations.
+	TotalQuota float64
+}
+
+// SetQuotas sets the limits per realm, which are exported and which the
+// user utilization is computed against. Realms not in quotas use fallback.
+func (c *Collector) SetQuotas(quotas map[string]Quota, fallback Quota) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.quotas = quotas
+	c.fallbackQuota = fallback
+	c.hasQuotas = true
+}
+
+func (c *Collector) quota(realm string) Quota {
+	if q, ok := c.quotas[realm]; ok {
+		return q
+	}
+	return c.fallbackQuota
+}
+
+// collectQuotaUtilization computes the utilization of every user with
+// allocations at scrape time, since it depends on rates of several
+// allocations.
+func (c *Collector) collectQuotaUtilization(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.hasQuotas {
+		return
+	}
+
+	maxRates := make(map[realmKey]float64)
+	for _, allocation := range c.allocations {
+		key := realmKey{allocation.realm, allocation.user}
+		rate := maxRates[key]
+		if r := allocation.previousRates; r != nil {
+			rate = math.Max(rate, math.Max(r.Rcvb, r.Sentb))
+		}
+		maxRates[key] = rate
+	}
+
+	for key, rate := range maxRates {
+		quota := c.quota(key.realm)
+		if quota.MaxBPS > 0 {
+			ch <- prometheus.MustNewConstMetric(userQuotaUtilizationDesc, prometheus.GaugeValue, rate/quota.MaxBPS, key.realm, key.name, "bandwidth")
+		}
+		if quota.UserQuota > 0 {
+			allocations := float64(c.userAllocations[key])
+			ch <- prometheus.MustNewConstMetric(userQuotaUtilizationDesc, prometheus.GaugeValue, allocations/quota.UserQuota, key.realm, key.name, "allocations")
+		}
+	}
+}
+
+// collectLimits exports the limits of the realms with limits or
+// allocations. Unlimited ones are left out.
+func (c *Collector) collectLimits(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.hasQuotas {
+		return
+	}
+
+	realms := make(map[string]bool)
+	for realm := range c.quotas {
+		realms[realm] = true
+	}
+	for realm := range c.realmAllocations {
+		realms[realm] = true
+	}
+	for realm := range realms {
+		quota := c.quota(realm)
+		if quota.MaxBPS > 0 {
+			ch <- prometheus.MustNewConstMetric(maxBPSDesc, prometheus.GaugeValue, quota.MaxBPS, realm)
+		}
+		if quota.TotalQuota > 0 {
+			ch <- prometheus.MustNewConstMetric(totalQuotaDesc, prometheus.GaugeValue, quota.TotalQuota, realm)
+		}
+		if quota.UserQuota > 0 {
+			ch <- prometheus.MustNewConstMetric(userQuotaDesc, prometheus.GaugeValue, quota.UserQuota, realm)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	realmsDesc = prometheus.NewDesc(
+		"coturn_realms",
+		"Number of realms with allocations",
+		nil, nil,
+	)
+	realmsSeenDesc = prometheus.NewDesc(
+		"coturn_realms_seen_total",
+		"Number of distinct realms that had an allocation",
+		nil, nil,
+	)
+	realmFirstSeenDesc = prometheus.NewDesc(
+		"coturn_realm_first_seen_timestamp_seconds",
+		"Time the first allocation of the realm was seen",
+		metricLabels, nil,
+	)
+)
+
+func (c *Collector) addRealmAllocation(realm string, now time.Time) {
+	if _, ok := c.seenRealms[realm]; !ok {
+		c.seenRealms[realm] = now
+	}
+	c.realmAllocations[realm]++
+	count := float64(c.realmAllocations[realm])
+	c.updatePeaks(realm, count-1, count, now)
+	delete(c.emptyRealms, realm)
+}
+
+// removeRealmAllocation remembers when a realm lost its last allocation so
+// that DeleteEmptyRealms can drop its series after the grace period.
+func (c *Collector) removeRealmAllocation(realm string, now time.Time) {
+	c.realmAllocations[realm]--
+	count := float64(c.realmAllocations[realm])
+	c.updatePeaks(realm, count+1, count, now)
+	if c.realmAllocations[realm] > 0 {
+		return
+	}
+	delete(c.realmAllocations, realm)
+	if c.opts.EmptyRealmGracePeriod > 0 {
+		c.emptyRealms[realm] = now
+	}
+}
+
+// DeleteEmptyRealms deletes the allocation gauge, peak and rate histogauge
+// series of realms that have had no allocations for the grace period, which would
+// otherwise linger at zero forever. Counters are kept. It returns the number
+// of realms deleted.
+func (c *Collector) DeleteEmptyRealms() int {
+	if c.opts.EmptyRealmGracePeriod <= 0 {
+		return 0
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	deleted := 0
+	now := c.now()
+	for realm, since := range c.emptyRealms {
+		if now.Sub(since) < c.opts.EmptyRealmGracePeriod {
+			continue
+		}
+		labels := prometheus.Labels{"realm": realm}
+		delete(c.allocationRealms, realm)
+		c.receivedPacketRateHistogauge.Delete(labels)
+		c.receivedByteRateHistogauge.Delete(labels)
+		c.sentPacketRateHistogauge.Delete(labels)
+		c.sentByteRateHistogauge.Delete(labels)
+		c.allocationsPerUser.Delete(labels)
+		c.deletePeaks(realm)
+		delete(c.emptyRealms, realm)
+		deleted++
+	}
+	return deleted
+}
+
+// collectRealms exposes which realms are in use and since when.
+func (c *Collector) collectRealms(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(realmsDesc, prometheus.GaugeValue, float64(len(c.realmAllocations)))
+	ch <- prometheus.MustNewConstMetric(realmsSeenDesc, prometheus.CounterValue, float64(len(c.seenRealms)))
+	for realm, seen := range c.seenRealms {
+		ch <- prometheus.MustNewConstMetric(realmFirstSeenDesc, prometheus.GaugeValue, float64(seen.UnixNano())/1e9, realm)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"github.com/iknow/coturn_exporter/parser"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	realmReceivedRateDesc = prometheus.NewDesc(
+		"coturn_realm_received_bytes_per_second",
+		"Sum of the current received byte rates of the allocations",
+		metricLabels, nil,
+	)
+	realmSentRateDesc = prometheus.NewDesc(
+		"coturn_realm_sent_bytes_per_second",
+		"Sum of the current sent byte rates of the allocations",
+		metricLabels, nil,
+	)
+	meanReceivedRateDesc = prometheus.NewDesc(
+		"coturn_allocation_mean_received_bytes_per_second",
+		"Mean current received byte rate of the allocations that reported traffic",
+		metricLabels, nil,
+	)
+	meanSentRateDesc = prometheus.NewDesc(
+		"coturn_allocation_mean_sent_bytes_per_second",
+		"Mean current sent byte rate of the allocations that reported traffic",
+		metricLabels, nil,
+	)
+)
+
+type realmRate struct {
+	sum parser.TrafficMetric
+	// reporting is the number of allocations that reported traffic, idle
+	// ones included
+	reporting int
+}
+
+// realmRates sums the current rates of the allocations of every realm.
+// Realms whose allocations have not reported traffic yet have zero rates.
+func (c *Collector) realmRates() map[string]*realmRate {
+	rates := make(map[string]*realmRate)
+	for _, allocation := range c.allocations {
+		rate := rates[allocation.realm]
+		if rate == nil {
+			rate = &realmRate{}
+			rates[allocation.realm] = rate
+		}
+		if r := allocation.previousRates; r != nil {
+			rate.sum.Rcvp += r.Rcvp
+			rate.sum.Rcvb += r.Rcvb
+			rate.sum.Sentp += r.Sentp
+			rate.sum.Sentb += r.Sentb
+			rate.reporting++
+		}
+	}
+	return rates
+}
+
+// collectRealmRates sums the rates at scrape time rather than keeping
+// running sums, which would drift with floating point errors as rates are
+// added and removed.
+func (c *Collector) collectRealmRates(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for realm, rate := range c.realmRates() {
+		ch <- prometheus.MustNewConstMetric(realmReceivedRateDesc, prometheus.GaugeValue, rate.sum.Rcvb, realm)
+		ch <- prometheus.MustNewConstMetric(realmSentRateDesc, prometheus.GaugeValue, rate.sum.Sentb, realm)
+		// allocations that have not reported yet would pull the mean down
+		if rate.reporting > 0 {
+			n := float64(rate.reporting)
+			ch <- prometheus.MustNewConstMetric(meanReceivedRateDesc, prometheus.GaugeValue, rate.sum.Rcvb/n, realm)
+			ch <- prometheus.MustNewConstMetric(meanSentRateDesc, prometheus.GaugeValue, rate.sum.Sentb/n, realm)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"time"
+
+	"github.com/iknow/coturn_exporter/parser"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// realmSeries holds what every message of a realm needs, so that handling a
+// message neither builds label maps nor looks up series by label values.
+// Entries are never dropped, like the traffic counters they refer to.
+type realmSeries struct {
+	// labels is shared and must not be modified.
+	labels prometheus.Labels
+	// the traffic counters, nil until the first traffic report so that
+	// their series are not created at zero by status messages
+	receivedPackets prometheus.Counter
+	receivedBytes   prometheus.Counter
+	sentPackets     prometheus.Counter
+	sentBytes       prometheus.Counter
+	// reportGap is nil until the second traffic report of an allocation
+	reportGap prometheus.Observer
+}
+
+// realm returns the cached series of realm. The caller must hold the lock.
+func (c *Collector) realm(realm string) *realmSeries {
+	series, ok := c.realmSeries[realm]
+	if !ok {
+		series = &realmSeries{labels: prometheus.Labels{"realm": realm}}
+		c.realmSeries[realm] = series
+	}
+	return series
+}
+
+// addTraffic adds a traffic report to the traffic counters of realm.
+func (c *Collector) addTraffic(realm string, t parser.TrafficMetric) {
+	series := c.realm(realm)
+	if series.receivedPackets == nil {
+		series.receivedPackets = c.receivedPackets.WithLabelValues(realm)
+		series.receivedBytes = c.receivedBytes.WithLabelValues(realm)
+		series.sentPackets = c.sentPackets.WithLabelValues(realm)
+		series.sentBytes = c.sentBytes.WithLabelValues(realm)
+	}
+	series.receivedPackets.Add(t.Rcvp)
+	series.receivedBytes.Add(t.Rcvb)
+	series.sentPackets.Add(t.Sentp)
+	series.sentBytes.Add(t.Sentb)
+}
+
+// observeReportGap records the time between two traffic reports of an
+// allocation of realm.
+func (c *Collector) observeReportGap(realm string, gap time.Duration) {
+	series := c.realm(realm)
+	if series.reportGap == nil {
+		series.reportGap = c.reportGaps.WithLabelValues(realm)
+	}
+	series.reportGap.Observe(gap.Seconds())
+}
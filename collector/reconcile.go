@@ -0,0 +1,88 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"time"
+
+	"github.com/iknow/coturn_exporter/source"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reconcile compares the tracked allocations with the allocations found by
+// a scan of the source that started at scanStart, as told by Now.
+//
+// Allocations found but not tracked were announced while we were not
+// listening or their message was lost. They are counted as missed and
+// tracked from now on. Tracked allocations that were not found lost their
+// deletion message and are reported as orphaned, and dropped if the
+// collector is configured to. Allocations with any message received after
+// the scan started are left alone since the scan may not reflect it, even
+// if the message was only handled after a wait in the subscription buffer.
+func (c *Collector) Reconcile(found []source.Allocation, scanStart time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.now()
+	tracked := len(c.allocations)
+	present := make(map[string]bool, len(found))
+	for _, a := range found {
+		metadata := a.Metadata
+		present[metadata.AllocationName] = true
+		if c.allocations[metadata.AllocationName] != nil {
+			continue
+		}
+		if deleted, ok := c.deletions[metadata.AllocationName]; ok && deleted.After(scanStart) {
+			continue
+		}
+		c.missedAllocations.With(prometheus.Labels{"realm": metadata.Realm}).Inc()
+		c.trackFound(a, now)
+	}
+
+	orphaned := make(map[string]float64)
+	missing := 0
+	for name, allocation := range c.allocations {
+		if present[name] || allocation.lastEvent.After(scanStart) {
+			continue
+		}
+		missing++
+		if !c.opts.DropOrphans {
+			orphaned[allocation.realm]++
+			continue
+		}
+		c.droppedOrphans.With(prometheus.Labels{"realm": allocation.realm}).Inc()
+		c.removeAllocation(name, allocation)
+	}
+
+	c.checkRestartLoss(tracked, missing, now)
+
+	c.orphanedAllocations.Reset()
+	for realm, count := range orphaned {
+		c.orphanedAllocations.With(prometheus.Labels{"realm": realm}).Set(count)
+	}
+
+	for name, deleted := range c.deletions {
+		if !deleted.After(scanStart) {
+			delete(c.deletions, name)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/iknow/coturn_exporter/logging"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// minRestartAllocations is the number of tracked allocations below which
+// losing most of them is not taken as a sign of a restart, since a handful
+// of users leaving at once is common.
+const minRestartAllocations = 10
+
+var (
+	restartsDetectedDesc = prometheus.NewDesc(
+		"coturn_restarts_detected_total",
+		"Number of coturn restarts inferred from the loss and re-creation of most allocations",
+		nil, nil,
+	)
+	lastRestartDesc = prometheus.NewDesc(
+		"coturn_last_restart_detected_timestamp_seconds",
+		"Time the last coturn restart was detected, 0 if none was",
+		nil, nil,
+	)
+)
+
+// restartDetector infers coturn restarts, which show as most allocations
+// being deleted at once or vanishing from the statsdb, followed by clients
+// creating new allocations.
+type restartDetector struct {
+	// windowStart starts the window deletions are counted in, tracked is
+	// the number of allocations tracked when it started
+	windowStart time.Time
+	tracked     int
+	deleted     int
+	// suspected is when the loss of allocations was noticed, zero if no
+	// restart is suspected
+	suspected time.Time
+	detected  int
+	last      time.Time
+}
+
+// observeRestartDeletion counts the deletion of a tracked allocation, which
+// must still be tracked.
+func (c *Collector) observeRestartDeletion(now time.Time) {
+	if c.opts.RestartDeletionRatio <= 0 {
+		return
+	}
+	r := &c.restart
+	if now.Sub(r.windowStart) >= c.opts.RestartWindow {
+		r.windowStart = now
+		r.tracked = len(c.allocations)
+		r.deleted = 0
+	}
+	r.deleted++
+	c.checkRestartLoss(r.tracked, r.deleted, now)
+}
+
+// checkRestartLoss suspects a restart if lost is a large enough share of
+// tracked allocations.
+func (c *Collector) checkRestartLoss(tracked int, lost int, now time.Time) {
+	if c.opts.RestartDeletionRatio <= 0 || tracked < minRestartAllocations {
+		return
+	}
+	if float64(lost) < c.opts.RestartDeletionRatio*float64(tracked) {
+		return
+	}
+	if c.restart.suspected.IsZero() {
+		logging.Debugf("suspecting a coturn restart, %d of %d allocations lost", lost, tracked)
+	}
+	c.restart.suspected = now
+}
+
+// observeRestartCreation detects a restart if an allocation is created
+// within the restart window after a restart was suspected.
+func (c *Collector) observeRestartCreation(now time.Time) {
+	r := &c.restart
+	if r.suspected.IsZero() {
+		return
+	}
+	if now.Sub(r.suspected) > c.opts.RestartWindow {
+		// the allocations went away for good, e.g. coturn was stopped
+		r.suspected = time.Time{}
+		return
+	}
+	r.suspected = time.Time{}
+	r.detected++
+	r.last = now
+	fmt.Println("Detected a coturn restart")
+	if c.opts.OnRestart != nil {
+		go c.opts.OnRestart()
+	}
+}
+
+// collectRestarts exposes the detected restarts.
+func (c *Collector) collectRestarts(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	last := 0.0
+	if !c.restart.last.IsZero() {
+		last = float64(c.restart.last.UnixNano()) / 1e9
+	}
+	ch <- prometheus.MustNewConstMetric(restartsDetectedDesc, prometheus.CounterValue, float64(c.restart.detected))
+	ch <- prometheus.MustNewConstMetric(lastRestartDesc, prometheus.GaugeValue, last)
+}
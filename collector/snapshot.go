@@ -0,0 +1,177 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"time"
+
+	"github.com/iknow/coturn_exporter/parser"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Snapshot is the state carried over an exporter restart.
+type Snapshot struct {
+	Time time.Time `json:"time"`
+	// counter name -> realm -> value
+	Counters    map[string]map[string]float64 `json:"counters"`
+	Allocations map[string]SnapshotAllocation `json:"allocations"`
+	// realm -> traffic of the current day, with daily usage enabled
+	DayUsage map[string]SnapshotDayUsage `json:"day_usage,omitempty"`
+	// realm -> time its first allocation was seen
+	SeenRealms map[string]time.Time `json:"seen_realms,omitempty"`
+}
+
+type SnapshotDayUsage struct {
+	Day      string  `json:"day"`
+	Received float64 `json:"received"`
+	Sent     float64 `json:"sent"`
+}
+
+type SnapshotAllocation struct {
+	Realm         string                `json:"realm"`
+	PreviousRates *parser.TrafficMetric `json:"previous_rates,omitempty"`
+}
+
+// counterVecs are the counters that are carried over a restart, keyed by
+// the name they are stored under in the snapshot.
+func (c *Collector) counterVecs() map[string]*prometheus.CounterVec {
+	return map[string]*prometheus.CounterVec{
+		"received_packets": c.receivedPackets,
+		"received_bytes":   c.receivedBytes,
+		"sent_packets":     c.sentPackets,
+		"sent_bytes":       c.sentBytes,
+	}
+}
+
+func (c *Collector) Snapshot() *Snapshot {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	s := &Snapshot{
+		Time:        c.now(),
+		Counters:    make(map[string]map[string]float64),
+		Allocations: make(map[string]SnapshotAllocation),
+	}
+
+	for name, vec := range c.counterVecs() {
+		values := make(map[string]float64)
+		ch := make(chan prometheus.Metric)
+		go func() {
+			vec.Collect(ch)
+			close(ch)
+		}()
+		for metric := range ch {
+			var m dto.Metric
+			if err := metric.Write(&m); err != nil {
+				continue
+			}
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "realm" {
+					values[label.GetValue()] = m.GetCounter().GetValue()
+				}
+			}
+		}
+		s.Counters[name] = values
+	}
+
+	s.SeenRealms = make(map[string]time.Time, len(c.seenRealms))
+	for realm, seen := range c.seenRealms {
+		s.SeenRealms[realm] = seen
+	}
+
+	for name, allocation := range c.allocations {
+		a := SnapshotAllocation{Realm: allocation.realm}
+		if r := allocation.previousRates; r != nil {
+			rates := *r
+			a.PreviousRates = &rates
+		}
+		s.Allocations[name] = a
+	}
+
+	if len(c.dayUsage) > 0 {
+		s.DayUsage = make(map[string]SnapshotDayUsage, len(c.dayUsage))
+		for realm, usage := range c.dayUsage {
+			s.DayUsage[realm] = SnapshotDayUsage{usage.day, usage.received, usage.sent}
+		}
+	}
+	return s
+}
+
+func (c *Collector) RestoreCounters(s *Snapshot) {
+	vecs := c.counterVecs()
+	for name, values := range s.Counters {
+		vec := vecs[name]
+		if vec == nil {
+			continue
+		}
+		for realm, value := range values {
+			vec.With(prometheus.Labels{"realm": realm}).Add(value)
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for realm, seen := range s.SeenRealms {
+		if current, ok := c.seenRealms[realm]; !ok || seen.Before(current) {
+			c.seenRealms[realm] = seen
+		}
+	}
+
+	if c.opts.DailyUsageLocation == nil {
+		return
+	}
+	// the usage of an earlier day is zero by now
+	day := c.usageDay(c.now())
+	for realm, saved := range s.DayUsage {
+		if saved.Day != day {
+			continue
+		}
+		usage := c.realmDayUsage(realm, day)
+		usage.received += saved.Received
+		usage.sent += saved.Sent
+	}
+}
+
+// RestoreRates seeds the rate histogauges with the last known rates of
+// allocations that are still tracked. It must run after the initial key scan
+// so that allocations which ended while the exporter was down are skipped.
+func (c *Collector) RestoreRates(s *Snapshot) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for name, saved := range s.Allocations {
+		allocation := c.allocations[name]
+		if allocation == nil || saved.PreviousRates == nil {
+			continue
+		}
+		labels := c.realm(allocation.realm).labels
+		// the rates seeded from the statsdb are replaced by the saved ones
+		if allocation.previousRates != nil {
+			c.removeRates(labels, allocation.previousRates)
+		}
+		rates := *saved.PreviousRates
+		allocation.previousRates = &rates
+		allocation.idle = false
+		c.addRates(labels, &rates)
+	}
+}
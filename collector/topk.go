@@ -0,0 +1,178 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// the count-min sketch has topTalkersDepth rows of topTalkersWidth
+	// counters, overestimating a user's traffic by at most e/width of the
+	// total traffic with a probability of 1-e^-depth
+	topTalkersDepth = 4
+	topTalkersWidth = 4096
+	// the decayed counts are scaled up by the time since the landmark
+	// instead of decaying every counter, and rescaled once the factor
+	// grows this large
+	maxTopTalkerScale = 1e100
+	// users whose decayed rate fell below this are no longer exposed
+	minTopTalkerRate = 1
+)
+
+var topTalkerDesc = prometheus.NewDesc(
+	"coturn_top_talker_bytes_per_second",
+	"Estimated exponentially decayed average traffic, received and sent, of the users with the most traffic",
+	[]string{"realm", "user"}, nil,
+)
+
+// topTalkers estimates which users have the most traffic with exponential
+// decay, keeping only a fixed size sketch and the k heaviest users instead
+// of counters for every user.
+type topTalkers struct {
+	k int
+	// decay rate per second
+	lambda   float64
+	landmark time.Time
+	sketch   [topTalkersDepth][topTalkersWidth]float64
+	// user -> estimated count scaled to the landmark
+	top    map[realmKey]float64
+	minKey realmKey
+}
+
+func newTopTalkers(k int, halfLife time.Duration, now time.Time) *topTalkers {
+	return &topTalkers{
+		k:        k,
+		lambda:   math.Ln2 / halfLife.Seconds(),
+		landmark: now,
+		top:      make(map[realmKey]float64, k+1),
+	}
+}
+
+// scale returns the factor counts added at now are scaled by.
+func (t *topTalkers) scale(now time.Time) float64 {
+	return math.Exp(t.lambda * now.Sub(t.landmark).Seconds())
+}
+
+// add counts bytes of traffic of user in realm.
+func (t *topTalkers) add(realm string, user string, bytes float64, now time.Time) {
+	if bytes <= 0 {
+		return
+	}
+	scale := t.scale(now)
+	if scale > maxTopTalkerScale {
+		t.rescale(scale, now)
+		scale = 1
+	}
+
+	h1, h2 := hashRealmUser(realm, user)
+	estimate := math.Inf(1)
+	for i := range t.sketch {
+		counter := &t.sketch[i][(h1+uint64(i)*h2)%topTalkersWidth]
+		*counter += bytes * scale
+		estimate = math.Min(estimate, *counter)
+	}
+
+	key := realmKey{realm, user}
+	if _, ok := t.top[key]; !ok && len(t.top) >= t.k {
+		if estimate <= t.top[t.minKey] {
+			return
+		}
+		delete(t.top, t.minKey)
+	} else if ok && key != t.minKey {
+		// only the minimum can change which user is the lightest
+		t.top[key] = estimate
+		return
+	}
+	t.top[key] = estimate
+	t.updateMin()
+}
+
+func (t *topTalkers) updateMin() {
+	first := true
+	for key, count := range t.top {
+		if first || count < t.top[t.minKey] {
+			t.minKey = key
+			first = false
+		}
+	}
+}
+
+// rescale moves the landmark to now, dividing every count by scale.
+func (t *topTalkers) rescale(scale float64, now time.Time) {
+	for i := range t.sketch {
+		for j := range t.sketch[i] {
+			t.sketch[i][j] /= scale
+		}
+	}
+	for key := range t.top {
+		t.top[key] /= scale
+	}
+	t.landmark = now
+}
+
+// rates returns the decayed average rates of the top users in bytes/s.
+// With a constant rate r, the decayed count converges to r/lambda.
+func (t *topTalkers) rates(now time.Time) map[realmKey]float64 {
+	scale := t.scale(now)
+	rates := make(map[realmKey]float64, len(t.top))
+	for key, count := range t.top {
+		if rate := count / scale * t.lambda; rate >= minTopTalkerRate {
+			rates[key] = rate
+		}
+	}
+	return rates
+}
+
+// hashRealmUser returns two FNV-1a hashes of realm and user for the double
+// hashing of the sketch rows, without allocating.
+func hashRealmUser(realm string, user string) (uint64, uint64) {
+	const prime = 1099511628211
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(realm); i++ {
+		h = (h ^ uint64(realm[i])) * prime
+	}
+	// separates "ab"+"c" from "a"+"bc"
+	h = (h ^ 0xff) * prime
+	for i := 0; i < len(user); i++ {
+		h = (h ^ uint64(user[i])) * prime
+	}
+	// the second hash only needs to be odd and differ from the first
+	return h, (h>>32 | h<<32) | 1
+}
+
+// collectTopTalkers exposes the users with the most traffic.
+func (c *Collector) collectTopTalkers(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// truncated user names may collide
+	labelled := make(map[realmKey]float64)
+	for key, rate := range c.topTalkers.rates(c.now()) {
+		labelled[realmKey{key.realm, c.labelUser(c.opts.TopTalkersLabelMode, key.name)}] += rate
+	}
+	for key, rate := range labelled {
+		ch <- prometheus.MustNewConstMetric(topTalkerDesc, prometheus.GaugeValue, rate, key.realm, key.name)
+	}
+}
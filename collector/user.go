@@ -0,0 +1,139 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// UserLabelMode sets how user names are turned into user label values.
+type UserLabelMode string
+
+const (
+	// UserLabelPlain uses the user name as is.
+	UserLabelPlain UserLabelMode = "plain"
+	// UserLabelSHA256 uses a salted hash of the user name.
+	UserLabelSHA256 UserLabelMode = "sha256"
+	// UserLabelTruncated keeps only the start of the user name.
+	UserLabelTruncated UserLabelMode = "truncated"
+)
+
+func ParseUserLabelMode(mode string) (UserLabelMode, error) {
+	switch m := UserLabelMode(mode); m {
+	case UserLabelPlain, UserLabelSHA256, UserLabelTruncated:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid user label mode %q, expected plain, sha256 or truncated", mode)
+}
+
+func (c *Collector) userLabel(user string) string {
+	return c.labelUser(c.opts.UserLabelMode, user)
+}
+
+// labelUser turns a user name into a label value in mode, as is if mode is
+// empty.
+func (c *Collector) labelUser(mode UserLabelMode, user string) string {
+	switch mode {
+	case UserLabelSHA256:
+		sum := sha256.Sum256([]byte(c.opts.UserLabelSalt + user))
+		return hex.EncodeToString(sum[:8])
+	case UserLabelTruncated:
+		runes := []rune(user)
+		if c.opts.UserLabelLength > 0 && len(runes) > c.opts.UserLabelLength {
+			return string(runes[:c.opts.UserLabelLength])
+		}
+	}
+	return user
+}
+
+// addUserAllocation counts an allocation for a user and returns the user
+// label it was counted as, which is "other" once the realm has reached
+// MaxSeriesPerRealm users.
+func (c *Collector) addUserAllocation(realm string, user string) string {
+	key := realmKey{realm, user}
+	if c.userAllocations[key] == 0 {
+		if c.opts.MaxSeriesPerRealm > 0 && c.realmUsers[realm] >= c.opts.MaxSeriesPerRealm {
+			c.labelOverflows.With(prometheus.Labels{"realm": realm, "label": "user"}).Inc()
+			user = "other"
+			key = realmKey{realm, user}
+		}
+	}
+	if c.userAllocations[key] == 0 {
+		c.realmUsers[realm]++
+	}
+	c.userAllocations[key]++
+	c.userAllocationGauge.With(prometheus.Labels{"realm": realm, "user": user}).Inc()
+	return user
+}
+
+// removeUserAllocation drops all series of a user once their last allocation
+// is gone, so that the number of series follows the active users.
+func (c *Collector) removeUserAllocation(realm string, user string) {
+	key := realmKey{realm, user}
+	c.userAllocations[key]--
+	labels := prometheus.Labels{"realm": realm, "user": user}
+	if c.userAllocations[key] > 0 {
+		c.userAllocationGauge.With(labels).Dec()
+		return
+	}
+	delete(c.userAllocations, key)
+	c.realmUsers[realm]--
+	if c.realmUsers[realm] <= 0 {
+		delete(c.realmUsers, realm)
+	}
+	c.userAllocationGauge.Delete(labels)
+	c.userReceivedBytes.Delete(labels)
+	c.userSentBytes.Delete(labels)
+}
+
+var allocationsPerUserBuckets = []float64{1, 2, 3, 4, 5, 10, 20, 50, 100}
+
+// addUserNameAllocation moves the user up in the allocations per user
+// distribution. It is kept by user name rather than label so that it does
+// not depend on the user label.
+func (c *Collector) addUserNameAllocation(realm string, user string) {
+	key := realmKey{realm, user}
+	labels := prometheus.Labels{"realm": realm}
+	count := c.userNameAllocations[key]
+	if count == 0 {
+		c.allocationsPerUser.Add(labels, 1)
+	} else {
+		c.allocationsPerUser.Replace(labels, float64(count+1), float64(count))
+	}
+	c.userNameAllocations[key] = count + 1
+}
+
+func (c *Collector) removeUserNameAllocation(realm string, user string) {
+	key := realmKey{realm, user}
+	labels := prometheus.Labels{"realm": realm}
+	count := c.userNameAllocations[key]
+	if count <= 1 {
+		c.allocationsPerUser.Remove(labels, 1)
+		delete(c.userNameAllocations, key)
+		return
+	}
+	c.allocationsPerUser.Replace(labels, float64(count-1), float64(count))
+	c.userNameAllocations[key] = count - 1
+}
@@ -0,0 +1,78 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collector
+
+import (
+	"time"
+
+	"github.com/iknow/coturn_exporter/parser"
+)
+
+// rateSample is one traffic report and the number of seconds it covers.
+type rateSample struct {
+	traffic parser.TrafficMetric
+	elapsed float64
+	at      time.Time
+}
+
+// rateWindow keeps the recent reports of an allocation, so that its rate
+// is the traffic of the whole window divided by the time the window covers
+// instead of the last report only. This smooths bursty traffic like screen
+// sharing, which otherwise jumps between buckets with every report.
+type rateWindow struct {
+	samples []rateSample
+}
+
+// add appends a sample, drops the ones beyond maxReports or older than
+// maxAge, zero meaning no limit, and returns the rates over the remaining
+// ones. The newest sample is always kept.
+func (w *rateWindow) add(sample rateSample, maxReports int, maxAge time.Duration) parser.TrafficMetric {
+	w.samples = append(w.samples, sample)
+
+	drop := 0
+	if maxReports > 0 && len(w.samples) > maxReports {
+		drop = len(w.samples) - maxReports
+	}
+	if maxAge > 0 {
+		for drop < len(w.samples)-1 && sample.at.Sub(w.samples[drop].at) >= maxAge {
+			drop++
+		}
+	}
+	if drop > 0 {
+		w.samples = append(w.samples[:0], w.samples[drop:]...)
+	}
+
+	var sum parser.TrafficMetric
+	var elapsed float64
+	for _, s := range w.samples {
+		sum.Rcvp += s.traffic.Rcvp
+		sum.Rcvb += s.traffic.Rcvb
+		sum.Sentp += s.traffic.Sentp
+		sum.Sentb += s.traffic.Sentb
+		elapsed += s.elapsed
+	}
+	return parser.TrafficMetric{
+		Rcvp:  sum.Rcvp / elapsed,
+		Rcvb:  sum.Rcvb / elapsed,
+		Sentp: sum.Sentp / elapsed,
+		Sentb: sum.Sentb / elapsed,
+	}
+}
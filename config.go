@@ -0,0 +1,145 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// envFlags are the flags falling back to an environment variable through
+// stringOrEnv.
+var envFlags = map[string]string{
+	"user-label-salt":       "USER_LABEL_SALT",
+	"telnet-password":       "TELNET_PASSWORD",
+	"kafka-sasl-password":   "KAFKA_SASL_PASSWORD",
+	"nats-url":              "NATS_URL",
+	"vm-password":           "VM_PASSWORD",
+	"vm-bearer-token":       "VM_BEARER_TOKEN",
+	"grafana-cloud-api-key": "GRAFANA_CLOUD_API_KEY",
+}
+
+// secretFlags are redacted entirely. Webhook URLs usually carry their
+// credentials in the path.
+var secretFlags = map[string]bool{
+	"webhook-url":    true,
+	"snmp-community": true,
+}
+
+// configValue is a flag as the running instance uses it.
+type configValue struct {
+	Value string `json:"value"`
+	// Source is where the value comes from: default, flag or env.
+	Source string `json:"source"`
+}
+
+type effectiveConfig struct {
+	Version  string                 `json:"version"`
+	Revision string                 `json:"revision"`
+	Flags    map[string]configValue `json:"flags"`
+}
+
+// currentConfig returns the effective configuration with secrets redacted.
+func currentConfig() effectiveConfig {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	config := effectiveConfig{
+		Version:  version,
+		Revision: revision,
+		Flags:    make(map[string]configValue),
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		value := configValue{Value: f.Value.String(), Source: "default"}
+		if set[f.Name] {
+			value.Source = "flag"
+		}
+		if env, ok := envFlags[f.Name]; ok && value.Value == "" {
+			if v := os.Getenv(env); v != "" {
+				value = configValue{Value: v, Source: "env"}
+			}
+		}
+		value.Value = redactFlag(f.Name, value.Value)
+		config.Flags[f.Name] = value
+	})
+	return config
+}
+
+// redactFlag hides the value of secret flags and the passwords in URLs.
+func redactFlag(name string, value string) string {
+	if value == "" {
+		return value
+	}
+	if secretFlags[name] {
+		return "REDACTED"
+	}
+	for _, suffix := range []string{"password", "token", "secret", "salt", "api-key"} {
+		if strings.HasSuffix(name, suffix) {
+			return "REDACTED"
+		}
+	}
+	if !strings.Contains(value, "://") {
+		return value
+	}
+	// also covers comma separated lists of URLs
+	urls := strings.Split(value, ",")
+	for i, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil {
+			// where the password is in a malformed URL is anyone's guess
+			urls[i] = "REDACTED"
+			continue
+		}
+		if u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), "REDACTED")
+			} else {
+				// redis URLs may pass the password as the user name
+				u.User = url.User("REDACTED")
+			}
+		}
+		if query := u.Query(); query.Get("password") != "" {
+			query.Set("password", "REDACTED")
+			u.RawQuery = query.Encode()
+		}
+		urls[i] = u.String()
+	}
+	return strings.Join(urls, ",")
+}
+
+func registerConfigHandler(token string) {
+	http.Handle("/-/config", requireToken(token, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(currentConfig())
+	})))
+}
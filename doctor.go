@@ -0,0 +1,254 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/iknow/coturn_exporter/parser"
+
+	"github.com/go-redis/redis"
+)
+
+// doctorScanLimit bounds the number of keys doctor looks at, so that it
+// stays quick on a busy statsdb.
+const doctorScanLimit = 10000
+
+// doctorReport counts the failures and warnings of a doctor run.
+type doctorReport struct {
+	failures int
+	warnings int
+}
+
+func (r *doctorReport) ok(format string, args ...interface{}) {
+	fmt.Printf("OK:   "+format+"\n", args...)
+}
+
+func (r *doctorReport) warn(format string, args ...interface{}) {
+	r.warnings++
+	fmt.Printf("WARN: "+format+"\n", args...)
+}
+
+func (r *doctorReport) fail(format string, args ...interface{}) {
+	r.failures++
+	fmt.Printf("FAIL: "+format+"\n", args...)
+}
+
+func (r *doctorReport) hint(format string, args ...interface{}) {
+	fmt.Printf("      "+format+"\n", args...)
+}
+
+// summary prints the result line and returns the exit code.
+func (r *doctorReport) summary() int {
+	fmt.Println()
+	if r.failures > 0 {
+		fmt.Printf("%d failures, %d warnings\n", r.failures, r.warnings)
+		return 1
+	}
+	fmt.Printf("No failures, %d warnings\n", r.warnings)
+	return 0
+}
+
+// doctor diagnoses why the exporter might not see anything: it checks the
+// connection, whether the keyspace looks like coturn's statsdb, samples a
+// few allocations and waits up to timeout for pubsub messages. It prints a
+// report and returns the process exit code.
+func doctor(client *redis.Client, opt *redis.Options, timeout time.Duration, samples int) int {
+	fmt.Println("redis address:", opt.Addr)
+	fmt.Println("redis db:     ", opt.DB)
+	fmt.Println("key pattern:  ", parser.ChannelPattern())
+	fmt.Println()
+
+	report := &doctorReport{}
+	if err := client.Ping().Err(); err != nil {
+		report.fail("cannot connect to redis: %v", err)
+		report.hint("check -redis-url and the -redis-*-timeout flags")
+		return report.summary()
+	}
+	report.ok("connected to redis")
+
+	statusKeys := doctorKeyspace(client, opt, report)
+	doctorStatuses(client, statusKeys, samples, report)
+	doctorPubsub(client, timeout, len(statusKeys) > 0, report)
+	return report.summary()
+}
+
+// doctorKeyspace checks that the keys of the database follow the key
+// schema and returns the status keys found.
+func doctorKeyspace(client *redis.Client, opt *redis.Options, report *doctorReport) []string {
+	var statusKeys, unparsed []string
+	matched := 0
+	iter := client.Scan(0, parser.ChannelPattern(), 1000).Iterator()
+	for matched < doctorScanLimit && iter.Next() {
+		matched++
+		metadata, err := parser.ParseKeyName(iter.Val())
+		if err != nil {
+			unparsed = append(unparsed, iter.Val())
+			continue
+		}
+		if metadata.MessageType == parser.MessageStatus {
+			statusKeys = append(statusKeys, iter.Val())
+		}
+	}
+	if err := iter.Err(); err != nil {
+		report.fail("cannot scan keys: %v", err)
+		return nil
+	}
+
+	if matched == 0 {
+		report.fail("no keys match %s", parser.ChannelPattern())
+		doctorOtherKeys(client, opt, report)
+		return nil
+	}
+	if len(unparsed) > 0 {
+		report.warn("%d of %d keys matching the pattern cannot be parsed, e.g. %s", len(unparsed), matched, unparsed[0])
+		report.hint("check -key-regexp")
+	}
+	if len(statusKeys) == 0 {
+		report.warn("%d statsdb keys but no allocation status keys", matched)
+	} else {
+		report.ok("%d statsdb keys, %d allocations", matched, len(statusKeys))
+	}
+	return statusKeys
+}
+
+// doctorOtherKeys explains an empty result: either the database has no keys
+// at all or they follow another layout.
+func doctorOtherKeys(client *redis.Client, opt *redis.Options, report *doctorReport) {
+	keys, _, err := client.Scan(0, "*", 100).Result()
+	if err != nil {
+		return
+	}
+	if len(keys) > 0 {
+		report.hint("the database holds other keys, e.g. %s", keys[0])
+		report.hint("check -key-prefix, -key-pattern and -key-regexp")
+		return
+	}
+	report.hint("database %d is empty", opt.DB)
+	if other := otherDatabases(client, opt.DB); len(other) > 0 {
+		report.hint("keys exist in %s, check the database in -redis-url", strings.Join(other, ", "))
+	}
+	report.hint("check that coturn is started with redis-statsdb pointing at this server")
+}
+
+// otherDatabases returns the databases besides db that hold keys according
+// to INFO keyspace.
+func otherDatabases(client *redis.Client, db int) []string {
+	info, err := client.Info("keyspace").Result()
+	if err != nil {
+		return nil
+	}
+	var other []string
+	for _, line := range strings.Split(info, "\n") {
+		name := strings.SplitN(strings.TrimSpace(line), ":", 2)[0]
+		if strings.HasPrefix(name, "db") && name != fmt.Sprintf("db%d", db) {
+			other = append(other, name)
+		}
+	}
+	return other
+}
+
+// doctorStatuses reads and parses the status of a few allocations.
+func doctorStatuses(client *redis.Client, statusKeys []string, samples int, report *doctorReport) {
+	if samples > len(statusKeys) {
+		samples = len(statusKeys)
+	}
+	for _, key := range statusKeys[:samples] {
+		payload, err := client.Get(key).Result()
+		if err != nil {
+			report.warn("cannot read %s: %v", key, err)
+			continue
+		}
+		if parser.ParseStatus(payload).State == "" {
+			report.warn("%s = %q has no state", key, payload)
+			continue
+		}
+		report.ok("%s = %q", key, payload)
+	}
+}
+
+// doctorPubsub waits up to timeout for the first messages on the statsdb
+// channels. Without allocations an idle server publishes nothing, so a
+// timeout is only a failure when allocations were found.
+func doctorPubsub(client *redis.Client, timeout time.Duration, expectMessages bool, report *doctorReport) {
+	pubsub := client.PSubscribe(parser.ChannelPattern())
+	defer pubsub.Close()
+	if _, err := pubsub.ReceiveTimeout(timeout); err != nil {
+		report.fail("cannot subscribe to %s: %v", parser.ChannelPattern(), err)
+		return
+	}
+
+	fmt.Printf("      waiting up to %v for pubsub messages\n", timeout)
+	received, unparsed := 0, 0
+	deadline := time.Now().Add(timeout)
+	for received < 10 {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			break
+		}
+		msg, err := pubsub.ReceiveTimeout(remaining)
+		if err != nil {
+			// a timeout, or a broken connection reported below
+			break
+		}
+		m, ok := msg.(*redis.Message)
+		if !ok {
+			continue
+		}
+		received++
+		if err := doctorParseMessage(m); err != nil {
+			unparsed++
+			report.warn("cannot parse message on %s: %v", m.Channel, err)
+		}
+	}
+
+	switch {
+	case received == 0 && expectMessages:
+		report.fail("no pubsub messages within %v although allocations exist", timeout)
+		report.hint("coturn publishes the traffic reports, check that it uses this server as redis-statsdb")
+		report.hint("and that no proxy in between drops pubsub")
+	case received == 0:
+		report.warn("no pubsub messages within %v, the server may be idle", timeout)
+	case unparsed < received:
+		report.ok("received %d pubsub messages, %d parsed", received, received-unparsed)
+	}
+}
+
+// doctorParseMessage parses a pubsub message like the exporter would.
+func doctorParseMessage(m *redis.Message) error {
+	metadata, err := parser.ParseKeyName(m.Channel)
+	if err != nil {
+		return err
+	}
+	switch metadata.MessageType {
+	case parser.MessageStatus:
+		if parser.ParseStatus(m.Payload).State == "" {
+			return fmt.Errorf("status %q has no state", m.Payload)
+		}
+	default:
+		if _, err := parser.ParseTrafficMetric(m.Payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package eventstream fans source events out to live subscribers.
+package eventstream
+
+import (
+	"sync"
+
+	"github.com/iknow/coturn_exporter/source"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// subscriptionBuffer is the number of events a subscriber may fall behind
+// before events are dropped for it.
+const subscriptionBuffer = 1024
+
+type EventType int32
+
+const (
+	EventAllocationNew       EventType = 0
+	EventAllocationRefreshed EventType = 1
+	EventAllocationDeleted   EventType = 2
+	EventTraffic             EventType = 3
+	EventPeerTraffic         EventType = 4
+	EventTotalTraffic        EventType = 5
+	EventTotalPeerTraffic    EventType = 6
+)
+
+var trafficEventTypes = map[source.TrafficKind]EventType{
+	source.TrafficClient:    EventTraffic,
+	source.TrafficPeer:      EventPeerTraffic,
+	source.TrafficTotal:     EventTotalTraffic,
+	source.TrafficPeerTotal: EventTotalPeerTraffic,
+}
+
+// Event is the message sent to subscribers. The protobuf tags match
+// events.proto.
+type Event struct {
+	Type            EventType `protobuf:"varint,1,opt,name=type,proto3,enum=coturn.exporter.v1.EventType" json:"type"`
+	Realm           string    `protobuf:"bytes,2,opt,name=realm,proto3" json:"realm"`
+	User            string    `protobuf:"bytes,3,opt,name=user,proto3" json:"user"`
+	AllocationId    string    `protobuf:"bytes,4,opt,name=allocation_id,json=allocationId,proto3" json:"allocation_id"`
+	TimestampMs     int64     `protobuf:"varint,5,opt,name=timestamp_ms,json=timestampMs,proto3" json:"timestamp_ms"`
+	Status          string    `protobuf:"bytes,6,opt,name=status,proto3" json:"status,omitempty"`
+	ReceivedPackets float64   `protobuf:"fixed64,7,opt,name=received_packets,json=receivedPackets,proto3" json:"received_packets,omitempty"`
+	ReceivedBytes   float64   `protobuf:"fixed64,8,opt,name=received_bytes,json=receivedBytes,proto3" json:"received_bytes,omitempty"`
+	SentPackets     float64   `protobuf:"fixed64,9,opt,name=sent_packets,json=sentPackets,proto3" json:"sent_packets,omitempty"`
+	SentBytes       float64   `protobuf:"fixed64,10,opt,name=sent_bytes,json=sentBytes,proto3" json:"sent_bytes,omitempty"`
+}
+
+func (m *Event) Reset()         { *m = Event{} }
+func (m *Event) String() string { return proto.CompactTextString(m) }
+func (*Event) ProtoMessage()    {}
+
+// Subscription receives the events of one subscriber.
+type Subscription struct {
+	// C delivers the events. It is never closed.
+	C     <-chan *Event
+	c     chan *Event
+	realm string
+}
+
+// Broadcaster is a source.Handler passing every event on to its
+// subscribers. A subscriber that does not keep up loses events rather than
+// slowing down the event processing.
+type Broadcaster struct {
+	lock        sync.Mutex
+	subscribers map[*Subscription]bool
+
+	subscriberGauge prometheus.Gauge
+	dropped         prometheus.Counter
+}
+
+func NewBroadcaster() *Broadcaster {
+	return &Broadcaster{
+		subscribers: make(map[*Subscription]bool),
+		subscriberGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "coturn_exporter_event_subscribers",
+			Help: "Number of connected event stream subscribers",
+		}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "coturn_exporter_event_subscriber_dropped_events_total",
+			Help: "Number of events dropped because a subscriber did not keep up",
+		}),
+	}
+}
+
+// Subscribe registers a subscriber for the events of realm, or of all realms
+// if realm is empty.
+func (b *Broadcaster) Subscribe(realm string) *Subscription {
+	c := make(chan *Event, subscriptionBuffer)
+	s := &Subscription{C: c, c: c, realm: realm}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.subscribers[s] = true
+	b.subscriberGauge.Set(float64(len(b.subscribers)))
+	return s
+}
+
+func (b *Broadcaster) Unsubscribe(s *Subscription) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.subscribers, s)
+	b.subscriberGauge.Set(float64(len(b.subscribers)))
+}
+
+func (b *Broadcaster) publish(e *Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for s := range b.subscribers {
+		if s.realm != "" && s.realm != e.Realm {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+			b.dropped.Inc()
+		}
+	}
+}
+
+// NewAllocationEvent converts an allocation event of a source.
+func NewAllocationEvent(e source.AllocationEvent) *Event {
+	eventType := EventAllocationNew
+	switch e.Type {
+	case source.AllocationRefreshed:
+		eventType = EventAllocationRefreshed
+	case source.AllocationDeleted:
+		eventType = EventAllocationDeleted
+	}
+	return &Event{
+		Type:         eventType,
+		Realm:        e.Metadata.Realm,
+		User:         e.Metadata.User,
+		AllocationId: e.Metadata.AllocationID,
+		TimestampMs:  e.Time.UnixNano() / 1e6,
+		Status:       e.Status,
+	}
+}
+
+// NewTrafficEvent converts a traffic event of a source.
+func NewTrafficEvent(e source.TrafficEvent) *Event {
+	return &Event{
+		Type:            trafficEventTypes[e.Kind],
+		Realm:           e.Metadata.Realm,
+		User:            e.Metadata.User,
+		AllocationId:    e.Metadata.AllocationID,
+		TimestampMs:     e.Time.UnixNano() / 1e6,
+		ReceivedPackets: e.Traffic.Rcvp,
+		ReceivedBytes:   e.Traffic.Rcvb,
+		SentPackets:     e.Traffic.Sentp,
+		SentBytes:       e.Traffic.Sentb,
+	}
+}
+
+// HandleAllocation implements source.Handler.
+func (b *Broadcaster) HandleAllocation(e source.AllocationEvent) {
+	b.publish(NewAllocationEvent(e))
+}
+
+// HandleTraffic implements source.Handler.
+func (b *Broadcaster) HandleTraffic(e source.TrafficEvent) {
+	b.publish(NewTrafficEvent(e))
+}
+
+// Describe implements prometheus.Collector.
+func (b *Broadcaster) Describe(ch chan<- *prometheus.Desc) {
+	b.subscriberGauge.Describe(ch)
+	b.dropped.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (b *Broadcaster) Collect(ch chan<- prometheus.Metric) {
+	b.subscriberGauge.Collect(ch)
+	b.dropped.Collect(ch)
+}
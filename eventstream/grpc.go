@@ -0,0 +1,146 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package eventstream
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// The vendored dependencies do not include grpc-go, so the single
+// server-streaming method of events.proto is served directly over HTTP/2
+// following the gRPC wire protocol. Any gRPC client can consume it.
+
+const subscribeMethod = "/coturn.exporter.v1.Events/Subscribe"
+
+// gRPC status codes
+const (
+	grpcOK              = 0
+	grpcInvalidArgument = 3
+	grpcUnimplemented   = 12
+	grpcInternal        = 13
+)
+
+// SubscribeRequest selects the events to stream. The protobuf tags match
+// events.proto.
+type SubscribeRequest struct {
+	// Realm limits the stream to one realm if set.
+	Realm string `protobuf:"bytes,1,opt,name=realm,proto3" json:"realm,omitempty"`
+}
+
+func (m *SubscribeRequest) Reset()         { *m = SubscribeRequest{} }
+func (m *SubscribeRequest) String() string { return proto.CompactTextString(m) }
+func (*SubscribeRequest) ProtoMessage()    {}
+
+// GRPCHandler serves the Events gRPC service. It must be served over
+// HTTP/2, either with TLS or with unencrypted HTTP/2 enabled.
+func GRPCHandler(b *Broadcaster) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Content-Type") != "application/grpc" && r.Header.Get("Content-Type") != "application/grpc+proto" {
+			http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+
+		if r.URL.Path != subscribeMethod {
+			writeStatus(w, grpcUnimplemented, "unknown method "+r.URL.Path)
+			return
+		}
+
+		var request SubscribeRequest
+		if err := readMessage(r.Body, &request); err != nil {
+			writeStatus(w, grpcInvalidArgument, err.Error())
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeStatus(w, grpcInternal, "streaming unsupported")
+			return
+		}
+
+		subscription := b.Subscribe(request.Realm)
+		defer b.Unsubscribe(subscription)
+
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event := <-subscription.C:
+				if err := writeMessage(w, event); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	})
+}
+
+// writeStatus ends the call with a status. If nothing was written yet this
+// is a trailers-only response.
+func writeStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set("Grpc-Message", message)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// readMessage reads one length-prefixed message from a gRPC request body.
+func readMessage(body io.Reader, message proto.Message) error {
+	data, err := ioutil.ReadAll(io.LimitReader(body, 64*1024))
+	if err != nil {
+		return err
+	}
+	// an empty body is an empty message
+	if len(data) == 0 {
+		return nil
+	}
+	if len(data) < 5 || data[0] != 0 {
+		return io.ErrUnexpectedEOF
+	}
+	length := binary.BigEndian.Uint32(data[1:5])
+	if uint32(len(data)-5) < length {
+		return io.ErrUnexpectedEOF
+	}
+	return proto.Unmarshal(data[5:5+length], message)
+}
+
+func writeMessage(w io.Writer, message proto.Message) error {
+	data, err := proto.Marshal(message)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(data)))
+	copy(frame[5:], data)
+	_, err = w.Write(frame)
+	return err
+}
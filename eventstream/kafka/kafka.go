@@ -0,0 +1,308 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package kafka publishes the allocation and traffic events to a Kafka topic
+// for analytics beyond the retention of Prometheus.
+package kafka
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"time"
+
+	"github.com/iknow/coturn_exporter/eventstream"
+	"github.com/iknow/coturn_exporter/source"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type Config struct {
+	// Brokers are the host:port of the bootstrap brokers.
+	Brokers []string
+	Topic   string
+	// TLS enables TLS if not nil.
+	TLS *tls.Config
+	// SASLUser enables SASL/PLAIN authentication if not empty.
+	SASLUser     string
+	SASLPassword string
+	// BatchSize is the maximum number of events sent in one request.
+	BatchSize int
+	// FlushInterval is the longest an event waits for a batch to fill up.
+	FlushInterval time.Duration
+	// QueueSize is the number of events queued before further ones are
+	// dropped.
+	QueueSize int
+}
+
+// Producer is a source.Handler publishing every event as JSON, keyed by
+// realm and allocation so that the events of an allocation stay in order.
+// Events are queued and sent in batches by Run.
+type Producer struct {
+	config Config
+	queue  chan *eventstream.Event
+	// closing passes Close's channel to Run
+	closing chan chan struct{}
+
+	conns    map[int32]*conn
+	metadata *metadata
+
+	events *prometheus.CounterVec
+}
+
+func New(config Config) *Producer {
+	if config.BatchSize < 1 {
+		config.BatchSize = 1
+	}
+	return &Producer{
+		config:  config,
+		queue:   make(chan *eventstream.Event, config.QueueSize),
+		closing: make(chan chan struct{}),
+		conns:   make(map[int32]*conn),
+		events: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "coturn_exporter_kafka_events_total",
+			Help: "Number of events handed to Kafka by result",
+		}, []string{"result"}),
+	}
+}
+
+// HandleAllocation implements source.Handler.
+func (p *Producer) HandleAllocation(e source.AllocationEvent) {
+	p.enqueue(eventstream.NewAllocationEvent(e))
+}
+
+// HandleTraffic implements source.Handler.
+func (p *Producer) HandleTraffic(e source.TrafficEvent) {
+	p.enqueue(eventstream.NewTrafficEvent(e))
+}
+
+func (p *Producer) enqueue(e *eventstream.Event) {
+	select {
+	case p.queue <- e:
+	default:
+		p.events.WithLabelValues("dropped").Inc()
+	}
+}
+
+// Run sends the queued events until Close is called.
+func (p *Producer) Run() {
+	ticker := time.NewTicker(p.config.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*eventstream.Event, 0, p.config.BatchSize)
+	for {
+		select {
+		case e := <-p.queue:
+			batch = append(batch, e)
+			if len(batch) < p.config.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case done := <-p.closing:
+			p.drain(batch)
+			close(done)
+			return
+		}
+		p.send(batch)
+		batch = batch[:0]
+	}
+}
+
+// Close sends the events queued so far and stops Run, which has to be
+// running. Events handled afterwards are dropped.
+func (p *Producer) Close() {
+	done := make(chan struct{})
+	p.closing <- done
+	<-done
+}
+
+// drain sends batch and the queued events.
+func (p *Producer) drain(batch []*eventstream.Event) {
+	for {
+		select {
+		case e := <-p.queue:
+			batch = append(batch, e)
+			if len(batch) < p.config.BatchSize {
+				continue
+			}
+		default:
+			if len(batch) > 0 {
+				p.send(batch)
+			}
+			return
+		}
+		p.send(batch)
+		batch = batch[:0]
+	}
+}
+
+// send publishes a batch, retrying once with fresh metadata since failures
+// are usually caused by a leader change.
+func (p *Producer) send(events []*eventstream.Event) {
+	encoded := make([]record, 0, len(events))
+	for _, e := range events {
+		r, err := newRecord(e)
+		if err != nil {
+			fmt.Println("Unable to encode Kafka event: ", err)
+			p.events.WithLabelValues("failed").Inc()
+			continue
+		}
+		encoded = append(encoded, r)
+	}
+	if len(encoded) == 0 {
+		return
+	}
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if err = p.refreshMetadata(attempt > 0); err != nil {
+			continue
+		}
+		partitions := p.partitions()
+		records := make(map[int32][]record)
+		for _, r := range encoded {
+			partition := partitions[partitionIndex(r.key, len(partitions))]
+			records[partition] = append(records[partition], r)
+		}
+		if err = p.produce(records); err == nil {
+			p.events.WithLabelValues("sent").Add(float64(len(encoded)))
+			return
+		}
+	}
+	fmt.Println("Unable to send events to Kafka: ", err)
+	p.events.WithLabelValues("failed").Add(float64(len(encoded)))
+}
+
+func newRecord(e *eventstream.Event) (record, error) {
+	value, err := json.Marshal(e)
+	if err != nil {
+		return record{}, err
+	}
+	return record{
+		key:       []byte(e.Realm + "/" + e.AllocationId),
+		value:     value,
+		timestamp: e.TimestampMs,
+	}, nil
+}
+
+func partitionIndex(key []byte, partitions int) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(partitions))
+}
+
+func (p *Producer) partitions() []int32 {
+	partitions := make([]int32, 0, len(p.metadata.leaders))
+	for partition := range p.metadata.leaders {
+		partitions = append(partitions, partition)
+	}
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+	return partitions
+}
+
+// produce sends the records of every partition to its leader.
+func (p *Producer) produce(records map[int32][]record) error {
+	byLeader := make(map[int32]map[int32][]record)
+	for partition, r := range records {
+		leader := p.metadata.leaders[partition]
+		if byLeader[leader] == nil {
+			byLeader[leader] = make(map[int32][]record)
+		}
+		byLeader[leader][partition] = r
+	}
+
+	for leader, batches := range byLeader {
+		c, err := p.brokerConn(leader)
+		if err == nil {
+			err = c.produce(p.config.Topic, batches)
+		}
+		if err != nil {
+			p.closeConn(leader)
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshMetadata fetches the partition leaders from the first reachable
+// broker if they are not known yet or force is set.
+func (p *Producer) refreshMetadata(force bool) error {
+	if p.metadata != nil && !force {
+		return nil
+	}
+	p.metadata = nil
+	for id := range p.conns {
+		p.closeConn(id)
+	}
+
+	var lastErr error
+	for _, address := range p.config.Brokers {
+		c, err := dial(address, p.config.TLS, p.config.SASLUser, p.config.SASLPassword)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		p.metadata, err = c.metadata(p.config.Topic)
+		c.Close()
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+	}
+	return lastErr
+}
+
+func (p *Producer) brokerConn(id int32) (*conn, error) {
+	if c := p.conns[id]; c != nil {
+		return c, nil
+	}
+	address, ok := p.metadata.brokers[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown broker %d", id)
+	}
+	c, err := dial(address, p.config.TLS, p.config.SASLUser, p.config.SASLPassword)
+	if err != nil {
+		return nil, err
+	}
+	p.conns[id] = c
+	return c, nil
+}
+
+func (p *Producer) closeConn(id int32) {
+	if c := p.conns[id]; c != nil {
+		c.Close()
+		delete(p.conns, id)
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (p *Producer) Describe(ch chan<- *prometheus.Desc) {
+	p.events.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (p *Producer) Collect(ch chan<- prometheus.Metric) {
+	p.events.Collect(ch)
+}
@@ -0,0 +1,425 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package kafka
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"time"
+)
+
+// The vendored dependencies do not include a Kafka client, so the few
+// requests a producer needs are implemented here following
+// https://kafka.apache.org/protocol. Produce v3 with record batches is
+// understood by every broker since 0.11.
+
+const (
+	apiProduce          = 0
+	apiMetadata         = 3
+	apiSaslHandshake    = 17
+	apiSaslAuthenticate = 36
+)
+
+const clientID = "coturn_exporter"
+
+const ioTimeout = 30 * time.Second
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaError is an error code returned by the broker.
+type kafkaError int16
+
+func (e kafkaError) Error() string {
+	return fmt.Sprintf("kafka error code %d", int16(e))
+}
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) int8(v int8) {
+	e.buf = append(e.buf, byte(v))
+}
+
+func (e *encoder) int16(v int16) {
+	e.buf = append(e.buf, byte(v>>8), byte(v))
+}
+
+func (e *encoder) int32(v int32) {
+	e.buf = append(e.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (e *encoder) int64(v int64) {
+	e.int32(int32(v >> 32))
+	e.int32(int32(v))
+}
+
+// varint writes a zigzag encoded variable length integer as used in records.
+func (e *encoder) varint(v int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], v)
+	e.buf = append(e.buf, tmp[:n]...)
+}
+
+func (e *encoder) string(v string) {
+	e.int16(int16(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *encoder) nullString() {
+	e.int16(-1)
+}
+
+func (e *encoder) bytes(v []byte) {
+	e.int32(int32(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+// decoder reads a response. The first read past the end sets err and every
+// later read returns zero values.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.data) < n {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	v := d.data[:n]
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) int8() int8 {
+	if v := d.take(1); v != nil {
+		return int8(v[0])
+	}
+	return 0
+}
+
+func (d *decoder) int16() int16 {
+	if v := d.take(2); v != nil {
+		return int16(binary.BigEndian.Uint16(v))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if v := d.take(4); v != nil {
+		return int32(binary.BigEndian.Uint32(v))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if v := d.take(8); v != nil {
+		return int64(binary.BigEndian.Uint64(v))
+	}
+	return 0
+}
+
+func (d *decoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return d.take(int(n))
+}
+
+// arrayLength reads an array length, treating null arrays as empty.
+func (d *decoder) arrayLength() int {
+	n := d.int32()
+	if n < 0 || d.err != nil {
+		return 0
+	}
+	// every element takes at least a byte, anything longer is corrupt
+	if int(n) > len(d.data) {
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	return int(n)
+}
+
+// conn is a connection to a single broker.
+type conn struct {
+	conn          net.Conn
+	reader        *bufio.Reader
+	correlationID int32
+}
+
+func dial(address string, tlsConfig *tls.Config, saslUser, saslPassword string) (*conn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var c net.Conn
+	var err error
+	if tlsConfig != nil {
+		c, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	} else {
+		c, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	result := &conn{conn: c, reader: bufio.NewReader(c)}
+	if saslUser != "" {
+		if err := result.authenticate(saslUser, saslPassword); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("SASL authentication with %s failed: %v", address, err)
+		}
+	}
+	return result, nil
+}
+
+func (c *conn) Close() error {
+	return c.conn.Close()
+}
+
+// roundTrip sends a request and returns the response body following the
+// response header.
+func (c *conn) roundTrip(apiKey, apiVersion int16, body []byte) (*decoder, error) {
+	c.correlationID++
+
+	var request encoder
+	request.int32(0) // size, filled in below
+	request.int16(apiKey)
+	request.int16(apiVersion)
+	request.int32(c.correlationID)
+	request.string(clientID)
+	request.buf = append(request.buf, body...)
+	binary.BigEndian.PutUint32(request.buf, uint32(len(request.buf)-4))
+
+	c.conn.SetDeadline(time.Now().Add(ioTimeout))
+	if _, err := c.conn.Write(request.buf); err != nil {
+		return nil, err
+	}
+
+	var size [4]byte
+	if _, err := io.ReadFull(c.reader, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > 64*1024*1024 {
+		return nil, fmt.Errorf("invalid response size %d", n)
+	}
+	response := make([]byte, n)
+	if _, err := io.ReadFull(c.reader, response); err != nil {
+		return nil, err
+	}
+
+	d := &decoder{data: response}
+	if id := d.int32(); id != c.correlationID {
+		return nil, fmt.Errorf("unexpected correlation id %d, expected %d", id, c.correlationID)
+	}
+	return d, nil
+}
+
+// authenticate performs a SASL/PLAIN exchange.
+func (c *conn) authenticate(user, password string) error {
+	var handshake encoder
+	handshake.string("PLAIN")
+	d, err := c.roundTrip(apiSaslHandshake, 1, handshake.buf)
+	if err != nil {
+		return err
+	}
+	if code := d.int16(); code != 0 {
+		return kafkaError(code)
+	}
+
+	var authenticate encoder
+	authenticate.bytes([]byte("\x00" + user + "\x00" + password))
+	d, err = c.roundTrip(apiSaslAuthenticate, 0, authenticate.buf)
+	if err != nil {
+		return err
+	}
+	if code := d.int16(); code != 0 {
+		if message := d.string(); message != "" {
+			return errors.New(message)
+		}
+		return kafkaError(code)
+	}
+	return d.err
+}
+
+// metadata is the part of a metadata response the producer needs.
+type metadata struct {
+	brokers map[int32]string
+	// leaders holds the leader broker of every partition of the topic
+	leaders map[int32]int32
+}
+
+func (c *conn) metadata(topic string) (*metadata, error) {
+	var request encoder
+	request.int32(1)
+	request.string(topic)
+	d, err := c.roundTrip(apiMetadata, 1, request.buf)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &metadata{brokers: make(map[int32]string), leaders: make(map[int32]int32)}
+	for i, n := 0, d.arrayLength(); i < n; i++ {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.string() // rack
+		result.brokers[id] = net.JoinHostPort(host, fmt.Sprint(port))
+	}
+	d.int32() // controller id
+	for i, n := 0, d.arrayLength(); i < n; i++ {
+		code := d.int16()
+		name := d.string()
+		d.int8() // is internal
+		partitions := d.arrayLength()
+		if d.err == nil && name == topic && code != 0 {
+			return nil, fmt.Errorf("topic %s: %v", topic, kafkaError(code))
+		}
+		for j := 0; j < partitions; j++ {
+			d.int16() // partition error code
+			partition := d.int32()
+			leader := d.int32()
+			for k, replicas := 0, d.arrayLength(); k < replicas; k++ {
+				d.int32()
+			}
+			for k, isr := 0, d.arrayLength(); k < isr; k++ {
+				d.int32()
+			}
+			if name == topic && leader >= 0 {
+				result.leaders[partition] = leader
+			}
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if len(result.leaders) == 0 {
+		return nil, fmt.Errorf("topic %s has no available partitions", topic)
+	}
+	return result, nil
+}
+
+// record is a message to produce.
+type record struct {
+	key       []byte
+	value     []byte
+	timestamp int64
+}
+
+// encodeRecordBatch encodes records as an uncompressed v2 record batch.
+func encodeRecordBatch(records []record) []byte {
+	first, last := records[0].timestamp, records[0].timestamp
+	for _, r := range records {
+		if r.timestamp < first {
+			first = r.timestamp
+		}
+		if r.timestamp > last {
+			last = r.timestamp
+		}
+	}
+
+	// the part covered by the CRC
+	var body encoder
+	body.int16(0) // attributes: no compression, create time
+	body.int32(int32(len(records) - 1))
+	body.int64(first)
+	body.int64(last)
+	body.int64(-1) // producer id
+	body.int16(-1) // producer epoch
+	body.int32(-1) // base sequence
+	body.int32(int32(len(records)))
+	for i, r := range records {
+		var rec encoder
+		rec.int8(0) // attributes
+		rec.varint(r.timestamp - first)
+		rec.varint(int64(i))
+		rec.varint(int64(len(r.key)))
+		rec.buf = append(rec.buf, r.key...)
+		rec.varint(int64(len(r.value)))
+		rec.buf = append(rec.buf, r.value...)
+		rec.varint(0) // headers
+		body.varint(int64(len(rec.buf)))
+		body.buf = append(body.buf, rec.buf...)
+	}
+
+	var batch encoder
+	batch.int64(0) // base offset
+	batch.int32(int32(4 + 1 + 4 + len(body.buf)))
+	batch.int32(-1) // partition leader epoch
+	batch.int8(2)   // magic
+	batch.int32(int32(crc32.Checksum(body.buf, castagnoli)))
+	batch.buf = append(batch.buf, body.buf...)
+	return batch.buf
+}
+
+// produce writes a record batch to every given partition, waiting for all
+// in-sync replicas to acknowledge it.
+func (c *conn) produce(topic string, batches map[int32][]record) error {
+	var request encoder
+	request.nullString() // transactional id
+	request.int16(-1)    // acks
+	request.int32(int32(ioTimeout / time.Millisecond))
+	request.int32(1)
+	request.string(topic)
+	request.int32(int32(len(batches)))
+	for partition, records := range batches {
+		request.int32(partition)
+		request.bytes(encodeRecordBatch(records))
+	}
+
+	d, err := c.roundTrip(apiProduce, 3, request.buf)
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	for i, n := 0, d.arrayLength(); i < n; i++ {
+		d.string() // topic
+		for j, partitions := 0, d.arrayLength(); j < partitions; j++ {
+			partition := d.int32()
+			code := d.int16()
+			d.int64() // base offset
+			d.int64() // log append time
+			if code != 0 && d.err == nil && firstErr == nil {
+				firstErr = fmt.Errorf("partition %d: %v", partition, kafkaError(code))
+			}
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	return firstErr
+}
@@ -0,0 +1,350 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package nats publishes the allocation and traffic events to NATS, and
+// optionally persists them in a JetStream stream.
+package nats
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/iknow/coturn_exporter/eventstream"
+	"github.com/iknow/coturn_exporter/source"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// streamNameInUse is the JetStream error code of a stream that already
+// exists with a different configuration.
+const streamNameInUse = 10058
+
+var subjectTokens = map[eventstream.EventType]string{
+	eventstream.EventAllocationNew:       "allocation_new",
+	eventstream.EventAllocationRefreshed: "allocation_refreshed",
+	eventstream.EventAllocationDeleted:   "allocation_deleted",
+	eventstream.EventTraffic:             "traffic",
+	eventstream.EventPeerTraffic:         "peer_traffic",
+	eventstream.EventTotalTraffic:        "total_traffic",
+	eventstream.EventTotalPeerTraffic:    "total_peer_traffic",
+}
+
+type Config struct {
+	// URL is a nats:// or tls:// server URL, optionally with user:password
+	// or a token as user info.
+	URL string
+	// Subject is the prefix of the subjects, the event type is appended,
+	// e.g. coturn.events.allocation_new.
+	Subject string
+	// TLS configures TLS if the URL scheme is tls or the server requires it.
+	TLS *tls.Config
+	// Stream enables JetStream if not empty. The stream is created for the
+	// subjects if it does not exist, and every event has to be acknowledged.
+	Stream string
+	// BatchSize is the maximum number of events sent before waiting for the
+	// server.
+	BatchSize int
+	// FlushInterval is the longest an event waits for a batch to fill up.
+	FlushInterval time.Duration
+	// QueueSize is the number of events queued before further ones are
+	// dropped.
+	QueueSize int
+}
+
+// jsError is the error of a JetStream API response.
+type jsError struct {
+	Code        int    `json:"code"`
+	ErrCode     int    `json:"err_code"`
+	Description string `json:"description"`
+}
+
+func (e *jsError) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Description, e.ErrCode)
+}
+
+type jsResponse struct {
+	Error *jsError `json:"error"`
+}
+
+// Publisher is a source.Handler publishing every event as JSON. Events are
+// queued and sent in batches by Run.
+type Publisher struct {
+	config Config
+	queue  chan *eventstream.Event
+	conn   *conn
+	// lastFlush is when the server last answered, the connection is pinged
+	// when idle so that the server does not drop it
+	lastFlush time.Time
+	// closing passes Close's channel to Run
+	closing chan chan struct{}
+
+	events *prometheus.CounterVec
+}
+
+func New(config Config) *Publisher {
+	if config.BatchSize < 1 {
+		config.BatchSize = 1
+	}
+	return &Publisher{
+		config:  config,
+		queue:   make(chan *eventstream.Event, config.QueueSize),
+		closing: make(chan chan struct{}),
+		events: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "coturn_exporter_nats_events_total",
+			Help: "Number of events handed to NATS by result",
+		}, []string{"result"}),
+	}
+}
+
+// HandleAllocation implements source.Handler.
+func (p *Publisher) HandleAllocation(e source.AllocationEvent) {
+	p.enqueue(eventstream.NewAllocationEvent(e))
+}
+
+// HandleTraffic implements source.Handler.
+func (p *Publisher) HandleTraffic(e source.TrafficEvent) {
+	p.enqueue(eventstream.NewTrafficEvent(e))
+}
+
+func (p *Publisher) enqueue(e *eventstream.Event) {
+	select {
+	case p.queue <- e:
+	default:
+		p.events.WithLabelValues("dropped").Inc()
+	}
+}
+
+// Run sends the queued events until Close is called.
+func (p *Publisher) Run() {
+	ticker := time.NewTicker(p.config.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*eventstream.Event, 0, p.config.BatchSize)
+	for {
+		select {
+		case e := <-p.queue:
+			batch = append(batch, e)
+			if len(batch) < p.config.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				p.keepalive()
+				continue
+			}
+		case done := <-p.closing:
+			p.drain(batch)
+			close(done)
+			return
+		}
+		p.send(batch)
+		batch = batch[:0]
+	}
+}
+
+// Close sends the events queued so far and stops Run, which has to be
+// running. Events handled afterwards are dropped.
+func (p *Publisher) Close() {
+	done := make(chan struct{})
+	p.closing <- done
+	<-done
+}
+
+// drain sends batch and the queued events.
+func (p *Publisher) drain(batch []*eventstream.Event) {
+	for {
+		select {
+		case e := <-p.queue:
+			batch = append(batch, e)
+			if len(batch) < p.config.BatchSize {
+				continue
+			}
+		default:
+			if len(batch) > 0 {
+				p.send(batch)
+			}
+			return
+		}
+		p.send(batch)
+		batch = batch[:0]
+	}
+}
+
+// send publishes a batch, retrying once on a new connection.
+func (p *Publisher) send(events []*eventstream.Event) {
+	payloads := make([][]byte, 0, len(events))
+	subjects := make([]string, 0, len(events))
+	for _, e := range events {
+		payload, err := json.Marshal(e)
+		if err != nil {
+			fmt.Println("Unable to encode NATS event: ", err)
+			p.events.WithLabelValues("failed").Inc()
+			continue
+		}
+		payloads = append(payloads, payload)
+		subjects = append(subjects, p.config.Subject+"."+subjectTokens[e.Type])
+	}
+	if len(payloads) == 0 {
+		return
+	}
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var rejected int
+		if rejected, err = p.publish(subjects, payloads); err == nil {
+			p.events.WithLabelValues("sent").Add(float64(len(payloads) - rejected))
+			p.events.WithLabelValues("failed").Add(float64(rejected))
+			return
+		}
+		p.disconnect()
+	}
+	fmt.Println("Unable to send events to NATS: ", err)
+	p.events.WithLabelValues("failed").Add(float64(len(payloads)))
+}
+
+// publish sends the messages and returns the number rejected by JetStream.
+func (p *Publisher) publish(subjects []string, payloads [][]byte) (int, error) {
+	if err := p.connect(); err != nil {
+		return 0, err
+	}
+
+	jetStream := p.config.Stream != ""
+	for i, payload := range payloads {
+		reply := ""
+		if jetStream {
+			reply = strconv.Itoa(i)
+		}
+		p.conn.publish(subjects[i], reply, payload)
+	}
+	if !jetStream {
+		return 0, p.flush(0, nil)
+	}
+
+	rejected := 0
+	var lastErr error
+	err := p.flush(len(payloads), func(m message) {
+		if err := ackError(m); err != nil {
+			rejected++
+			lastErr = err
+		}
+	})
+	if lastErr != nil {
+		fmt.Printf("JetStream rejected %d events: %v\n", rejected, lastErr)
+	}
+	return rejected, err
+}
+
+func ackError(m message) error {
+	if m.status >= 400 {
+		return fmt.Errorf("status %d", m.status)
+	}
+	var response jsResponse
+	if err := json.Unmarshal(m.payload, &response); err != nil {
+		return err
+	}
+	if response.Error != nil {
+		return response.Error
+	}
+	return nil
+}
+
+func (p *Publisher) flush(expectedReplies int, handleReply func(message)) error {
+	err := p.conn.flush(expectedReplies, handleReply)
+	if err == nil {
+		p.lastFlush = time.Now()
+	}
+	return err
+}
+
+func (p *Publisher) keepalive() {
+	if p.conn == nil || time.Since(p.lastFlush) < time.Minute {
+		return
+	}
+	if err := p.flush(0, nil); err != nil {
+		p.disconnect()
+	}
+}
+
+// connect connects if not connected yet, creating the stream if JetStream
+// is enabled.
+func (p *Publisher) connect() error {
+	if p.conn != nil {
+		return nil
+	}
+	c, err := dial(p.config.URL, p.config.TLS)
+	if err != nil {
+		return err
+	}
+	p.conn = c
+	if p.config.Stream != "" {
+		if err := p.createStream(); err != nil {
+			p.disconnect()
+			return fmt.Errorf("unable to create stream %s: %v", p.config.Stream, err)
+		}
+	}
+	p.lastFlush = time.Now()
+	return nil
+}
+
+// createStream creates the stream if it does not exist. An existing stream
+// is left as it is.
+func (p *Publisher) createStream() error {
+	request, err := json.Marshal(map[string]interface{}{
+		"name":     p.config.Stream,
+		"subjects": []string{p.config.Subject + ".>"},
+		"storage":  "file",
+	})
+	if err != nil {
+		return err
+	}
+	p.conn.publish("$JS.API.STREAM.CREATE."+p.config.Stream, "stream", request)
+
+	var createErr error
+	err = p.conn.flush(1, func(m message) {
+		createErr = ackError(m)
+	})
+	if err != nil {
+		return err
+	}
+	if e, ok := createErr.(*jsError); ok && e.ErrCode == streamNameInUse {
+		return nil
+	}
+	return createErr
+}
+
+func (p *Publisher) disconnect() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (p *Publisher) Describe(ch chan<- *prometheus.Desc) {
+	p.events.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (p *Publisher) Collect(ch chan<- prometheus.Metric) {
+	p.events.Collect(ch)
+}
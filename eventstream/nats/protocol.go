@@ -0,0 +1,262 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package nats
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The vendored dependencies do not include a NATS client. The client
+// protocol is line based, see https://docs.nats.io/reference/reference-protocols/nats-protocol,
+// and a publisher only needs a handful of its messages.
+
+const ioTimeout = 30 * time.Second
+
+// serverInfo is the part of the INFO message the publisher needs.
+type serverInfo struct {
+	TLSRequired bool `json:"tls_required"`
+	Headers     bool `json:"headers"`
+}
+
+type connectOptions struct {
+	Verbose      bool   `json:"verbose"`
+	Pedantic     bool   `json:"pedantic"`
+	TLSRequired  bool   `json:"tls_required"`
+	Name         string `json:"name"`
+	Lang         string `json:"lang"`
+	Version      string `json:"version"`
+	Protocol     int    `json:"protocol"`
+	Headers      bool   `json:"headers"`
+	NoResponders bool   `json:"no_responders"`
+	User         string `json:"user,omitempty"`
+	Pass         string `json:"pass,omitempty"`
+	AuthToken    string `json:"auth_token,omitempty"`
+}
+
+// message is a message delivered to the inbox subscription. status is the
+// status code of a header-only message, such as 503 for no responders.
+type message struct {
+	status  int
+	payload []byte
+}
+
+type conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	// inbox is the prefix of the reply subjects, subscribed to with sid 1
+	inbox string
+}
+
+// dial connects to the server at rawURL. Credentials are taken from the URL,
+// either as user:password or as a token in place of the user.
+func dial(rawURL string, tlsConfig *tls.Config) (*conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "nats" && u.Scheme != "tls" {
+		return nil, fmt.Errorf("unsupported NATS URL %q", rawURL)
+	}
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), "4222")
+	}
+
+	c, err := net.DialTimeout("tcp", address, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	result := &conn{conn: c, reader: bufio.NewReader(c), inbox: "_INBOX." + randomToken()}
+	if err := result.handshake(u, tlsConfig); err != nil {
+		result.Close()
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *conn) handshake(u *url.URL, tlsConfig *tls.Config) error {
+	c.conn.SetDeadline(time.Now().Add(ioTimeout))
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("unexpected greeting %q", line)
+	}
+	var info serverInfo
+	if err := json.Unmarshal([]byte(line[len("INFO "):]), &info); err != nil {
+		return err
+	}
+
+	useTLS := u.Scheme == "tls" || info.TLSRequired
+	if useTLS {
+		config := &tls.Config{}
+		if tlsConfig != nil {
+			config = tlsConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(c.conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		c.conn = tlsConn
+		c.reader = bufio.NewReader(tlsConn)
+	}
+	c.writer = bufio.NewWriter(c.conn)
+
+	options := connectOptions{
+		TLSRequired:  useTLS,
+		Name:         "coturn_exporter",
+		Lang:         "go",
+		Protocol:     1,
+		Headers:      info.Headers,
+		NoResponders: info.Headers,
+	}
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			options.User = u.User.Username()
+			options.Pass = password
+		} else {
+			options.AuthToken = u.User.Username()
+		}
+	}
+	encoded, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.writer, "CONNECT %s\r\nSUB %s.* 1\r\n", encoded, c.inbox)
+	return c.flush(0, nil)
+}
+
+func (c *conn) Close() error {
+	return c.conn.Close()
+}
+
+// publish queues a message, with a reply subject in the inbox if reply is
+// not empty.
+func (c *conn) publish(subject, reply string, payload []byte) {
+	if reply != "" {
+		fmt.Fprintf(c.writer, "PUB %s %s.%s %d\r\n", subject, c.inbox, reply, len(payload))
+	} else {
+		fmt.Fprintf(c.writer, "PUB %s %d\r\n", subject, len(payload))
+	}
+	c.writer.Write(payload)
+	c.writer.WriteString("\r\n")
+}
+
+// flush sends the queued messages followed by a PING and waits until the
+// server processed them and replies arrived for expectedReplies messages,
+// which are passed to handleReply.
+func (c *conn) flush(expectedReplies int, handleReply func(message)) error {
+	c.writer.WriteString("PING\r\n")
+	c.conn.SetDeadline(time.Now().Add(ioTimeout))
+	if err := c.writer.Flush(); err != nil {
+		return err
+	}
+
+	pong := false
+	for !pong || expectedReplies > 0 {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		switch {
+		case line == "PING":
+			c.writer.WriteString("PONG\r\n")
+			if err := c.writer.Flush(); err != nil {
+				return err
+			}
+		case line == "PONG":
+			pong = true
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New(strings.Trim(strings.TrimSpace(line[len("-ERR"):]), "'"))
+		case strings.HasPrefix(line, "MSG ") || strings.HasPrefix(line, "HMSG "):
+			m, err := c.readMessage(line)
+			if err != nil {
+				return err
+			}
+			if handleReply != nil {
+				handleReply(m)
+			}
+			expectedReplies--
+		}
+	}
+	return nil
+}
+
+// readMessage reads the payload of a MSG or HMSG whose first line was read.
+func (c *conn) readMessage(line string) (message, error) {
+	fields := strings.Fields(line)
+	headers := fields[0] == "HMSG"
+	var m message
+	size, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil {
+		return m, fmt.Errorf("invalid message %q", line)
+	}
+	headerSize := 0
+	if headers {
+		if headerSize, err = strconv.Atoi(fields[len(fields)-2]); err != nil || headerSize > size {
+			return m, fmt.Errorf("invalid message %q", line)
+		}
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(c.reader, data); err != nil {
+		return m, err
+	}
+	if headers {
+		// NATS/1.0 503 followed by optional headers
+		status := strings.Fields(strings.SplitN(string(data[:headerSize]), "\r\n", 2)[0])
+		if len(status) > 1 {
+			m.status, _ = strconv.Atoi(status[1])
+		}
+	}
+	m.payload = data[headerSize:size]
+	return m, nil
+}
+
+func (c *conn) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func randomToken() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,118 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package eventstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// RealmTotals returns the number of allocations and the sum of their byte
+// rates per realm.
+type RealmTotals func() (allocations map[string]float64, byteRates map[string]float64)
+
+// RealmRates is the data of the periodic rates event.
+type RealmRates struct {
+	Allocations float64 `json:"allocations"`
+	ByteRate    float64 `json:"byte_rate"`
+}
+
+type ratesEvent struct {
+	TimestampMs int64                 `json:"timestamp_ms"`
+	Realms      map[string]RealmRates `json:"realms"`
+}
+
+var sseEventNames = map[EventType]string{
+	EventAllocationNew:     "allocation_created",
+	EventAllocationDeleted: "allocation_deleted",
+}
+
+// SSEHandler streams allocation_created and allocation_deleted events as
+// server-sent events, along with a rates event holding the allocations and
+// byte rates per realm every interval. The realm query parameter limits the
+// stream to one realm.
+func SSEHandler(b *Broadcaster, totals RealmTotals, interval time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		realm := r.URL.Query().Get("realm")
+
+		subscription := b.Subscribe(realm)
+		defer b.Unsubscribe(subscription)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			var err error
+			select {
+			case <-r.Context().Done():
+				return
+			case event := <-subscription.C:
+				name, ok := sseEventNames[event.Type]
+				if !ok {
+					continue
+				}
+				err = writeSSE(w, name, event)
+			case now := <-ticker.C:
+				err = writeSSE(w, "rates", realmRates(totals, realm, now))
+			}
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	})
+}
+
+func realmRates(totals RealmTotals, realm string, now time.Time) ratesEvent {
+	allocations, byteRates := totals()
+	event := ratesEvent{
+		TimestampMs: now.UnixNano() / 1e6,
+		Realms:      make(map[string]RealmRates, len(allocations)),
+	}
+	for name, count := range allocations {
+		if realm != "" && name != realm {
+			continue
+		}
+		event.Realms[name] = RealmRates{Allocations: count, ByteRate: byteRates[name]}
+	}
+	return event
+}
+
+func writeSSE(w http.ResponseWriter, name string, data interface{}) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, encoded)
+	return err
+}
@@ -0,0 +1,284 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package exporter runs the exporter inside another program.
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/iknow/coturn_exporter/collector"
+	"github.com/iknow/coturn_exporter/source"
+	redissource "github.com/iknow/coturn_exporter/source/redis"
+
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Config configures Run. The key schema, prefix and realm mapping are
+// still set on the parser package.
+type Config struct {
+	// RedisURL is the statsdb to subscribe to.
+	RedisURL string
+	// Options configures the collector created by NewCollector.
+	Options collector.Options
+	// Collector is used instead of creating one if set.
+	Collector *collector.Collector
+	// Registerer is where the metrics are registered, the default
+	// registerer if nil.
+	Registerer prometheus.Registerer
+	// ReconcileInterval is how often the tracked allocations are compared
+	// with the statsdb. Zero disables it, otherwise Options.Reconcile must
+	// be set.
+	ReconcileInterval time.Duration
+	// ChannelSize and HealthCheckInterval configure the subscription, see
+	// the redis source. The source defaults are used if zero.
+	ChannelSize         int
+	HealthCheckInterval time.Duration
+	// TuneRedis, if set, adjusts the options parsed from RedisURL, e.g. the
+	// timeouts.
+	TuneRedis func(*redis.Options)
+	// UserFilter, if set, leaves out the allocations of excluded users. It
+	// is not registered by Run.
+	UserFilter *source.UserFilter
+	// Restarts, if set, reconciles the tracked allocations for every coturn
+	// restart it signals, see NotifyRestarts.
+	Restarts <-chan struct{}
+}
+
+// NewCollector returns a collector for the config that still has to be
+// registered and fed.
+func NewCollector(config Config) *collector.Collector {
+	return collector.New(config.Options)
+}
+
+// Run tracks the allocations on the statsdb until ctx is done. The
+// metrics are unregistered again before it returns.
+func Run(ctx context.Context, config Config) error {
+	opt, err := ParseRedisURL(config.RedisURL)
+	if err != nil {
+		return err
+	}
+	if config.TuneRedis != nil {
+		config.TuneRedis(opt)
+	}
+	client := redis.NewClient(opt)
+	defer client.Close()
+
+	coll := config.Collector
+	if coll == nil {
+		coll = NewCollector(config)
+	}
+
+	src := redissource.New(client)
+	if config.ChannelSize > 0 {
+		src.ChannelSize = config.ChannelSize
+	}
+	if config.HealthCheckInterval > 0 {
+		src.HealthCheckInterval = config.HealthCheckInterval
+	}
+	var handler source.Handler = coll
+	var loader source.Loader = src
+	if config.UserFilter != nil {
+		handler = config.UserFilter.Handler(handler)
+		loader = config.UserFilter.Loader(loader)
+	}
+	if config.ReconcileInterval > 0 {
+		src.OnResubscribe = ReconcileOnResubscribe(loader, coll)
+	}
+
+	registerer := config.Registerer
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+	// the package level metrics are shared by all runs, so they go to the
+	// default registerer, where the program or an earlier Run may already
+	// have registered them
+	for _, c := range []prometheus.Collector{source.ParseDuration, source.UnknownFields, source.ParseFailures, redissource.Errors} {
+		if err := prometheus.DefaultRegisterer.Register(c); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				return err
+			}
+		}
+	}
+	if err := registerer.Register(coll); err != nil {
+		return err
+	}
+	defer registerer.Unregister(coll)
+	if err := registerer.Register(src); err != nil {
+		return err
+	}
+	defer registerer.Unregister(src)
+
+	if err := LoadAllocations(loader, coll); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- src.Run(handler)
+	}()
+
+	maintainCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	go Maintain(maintainCtx, loader, coll, config.Options, config.ReconcileInterval)
+	if config.Restarts != nil {
+		go ReconcileOnRestart(maintainCtx, config.Restarts, loader, coll)
+	}
+
+	select {
+	case <-ctx.Done():
+		src.Close()
+		return <-done
+	case err := <-done:
+		return err
+	}
+}
+
+// LoadAllocations tracks every allocation that already exists.
+func LoadAllocations(loader source.Loader, coll *collector.Collector) error {
+	found, err := loader.LoadAllocations()
+	if err != nil {
+		return err
+	}
+	for _, allocation := range found {
+		coll.TrackAllocation(allocation)
+	}
+	return nil
+}
+
+// lifetimeCheckInterval is the longest interval between checks for
+// allocations whose lifetime ran out.
+const lifetimeCheckInterval = 15 * time.Second
+
+// Maintain runs the periodic expiry and reconciliation enabled in opts
+// until ctx is done.
+func Maintain(ctx context.Context, loader source.Loader, coll *collector.Collector, opts collector.Options, reconcileInterval time.Duration) {
+	expireInterval := opts.StaleTimeout / 4
+	// lifetimes are only minutes, so they are checked more often than a
+	// long stale timeout
+	if opts.LifetimeExpiry && (expireInterval <= 0 || expireInterval > lifetimeCheckInterval) {
+		expireInterval = lifetimeCheckInterval
+	}
+	if expireInterval > 0 {
+		go every(ctx, expireInterval, func() {
+			if expired := coll.ExpireStale(); expired > 0 {
+				fmt.Println("Expired stale allocations: ", expired)
+			}
+		})
+	}
+
+	if opts.RateIdleTimeout > 0 {
+		go every(ctx, opts.RateIdleTimeout/4, func() { coll.ExpireIdleRates() })
+	}
+
+	if opts.EmptyRealmGracePeriod > 0 {
+		go every(ctx, opts.EmptyRealmGracePeriod/4, func() { coll.DeleteEmptyRealms() })
+	}
+
+	if reconcileInterval > 0 {
+		go every(ctx, reconcileInterval, func() {
+			if err := Reconcile(loader, coll); err != nil {
+				fmt.Println("Unable to reconcile allocations: ", err)
+			}
+		})
+	}
+}
+
+// Reconcile compares the tracked allocations with a scan of loader. The
+// collector must have been created with Options.Reconcile.
+func Reconcile(loader source.Loader, coll *collector.Collector) error {
+	// in the collector's time, which the event times are compared with
+	start := coll.Now()
+	found, err := loader.LoadAllocations()
+	if err != nil {
+		return err
+	}
+	coll.Reconcile(found, start)
+	return nil
+}
+
+// NotifyRestarts sets opts.OnRestart to signal the returned channel, see
+// ReconcileOnRestart. Restarts detected while one is still pending are
+// dropped.
+func NotifyRestarts(opts *collector.Options) <-chan struct{} {
+	restarts := make(chan struct{}, 1)
+	opts.OnRestart = func() {
+		select {
+		case restarts <- struct{}{}:
+		default:
+		}
+	}
+	return restarts
+}
+
+// ReconcileOnRestart reconciles the tracked allocations for every restart
+// signalled on restarts until ctx is done.
+func ReconcileOnRestart(ctx context.Context, restarts <-chan struct{}, loader source.Loader, coll *collector.Collector) {
+	for {
+		select {
+		case <-restarts:
+			fmt.Println("Reconciling allocations after a coturn restart")
+			if err := Reconcile(loader, coll); err != nil {
+				fmt.Println("Unable to reconcile allocations: ", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ReconcileOnResubscribe returns an OnResubscribe hook for the redis
+// source that reconciles in the background, picking up the allocations
+// created and deleted while the subscription was down.
+func ReconcileOnResubscribe(loader source.Loader, coll *collector.Collector) func() {
+	return func() {
+		go func() {
+			fmt.Println("Reconciling allocations after resubscribing")
+			if err := Reconcile(loader, coll); err != nil {
+				fmt.Println("Unable to reconcile allocations: ", err)
+			}
+		}()
+	}
+}
+
+// minEveryInterval is the shortest interval every runs at. Intervals
+// derived from the options, e.g. RateIdleTimeout/4, can round down to zero,
+// which time.NewTicker does not take.
+const minEveryInterval = 100 * time.Millisecond
+
+func every(ctx context.Context, interval time.Duration, f func()) {
+	if interval < minEveryInterval {
+		interval = minEveryInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			f()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
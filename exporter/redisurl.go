@@ -0,0 +1,161 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package exporter
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// redisURLDurations are the duration options of a redis URL.
+var redisURLDurations = map[string]func(*redis.Options) *time.Duration{
+	"dial_timeout":         func(o *redis.Options) *time.Duration { return &o.DialTimeout },
+	"read_timeout":         func(o *redis.Options) *time.Duration { return &o.ReadTimeout },
+	"write_timeout":        func(o *redis.Options) *time.Duration { return &o.WriteTimeout },
+	"pool_timeout":         func(o *redis.Options) *time.Duration { return &o.PoolTimeout },
+	"idle_timeout":         func(o *redis.Options) *time.Duration { return &o.IdleTimeout },
+	"idle_check_frequency": func(o *redis.Options) *time.Duration { return &o.IdleCheckFrequency },
+	"max_conn_age":         func(o *redis.Options) *time.Duration { return &o.MaxConnAge },
+	"min_retry_backoff":    func(o *redis.Options) *time.Duration { return &o.MinRetryBackoff },
+	"max_retry_backoff":    func(o *redis.Options) *time.Duration { return &o.MaxRetryBackoff },
+}
+
+// redisURLInts are the integer options of a redis URL.
+var redisURLInts = map[string]func(*redis.Options) *int{
+	"db":             func(o *redis.Options) *int { return &o.DB },
+	"pool_size":      func(o *redis.Options) *int { return &o.PoolSize },
+	"min_idle_conns": func(o *redis.Options) *int { return &o.MinIdleConns },
+	"max_retries":    func(o *redis.Options) *int { return &o.MaxRetries },
+}
+
+// ParseRedisURL parses a redis:// or rediss:// URL. Unlike redis.ParseURL
+// it accepts IPv6 hosts in brackets with or without a port, e.g.
+// redis://[2001:db8::1]/2, and the connection options of newer go-redis
+// versions as query parameters, e.g. ?dial_timeout=3s&pool_size=20.
+// Durations are Go durations or whole seconds.
+func ParseRedisURL(redisURL string) (*redis.Options, error) {
+	u, err := url.Parse(redisURL)
+	if err != nil {
+		// the error of url.Parse quotes the URL, password included
+		return nil, errors.New("invalid redis URL: it is malformed, reserved characters in the password have to be percent-encoded")
+	}
+	shown := redactRedisURL(u)
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("invalid redis URL %q: scheme has to be redis or rediss", shown)
+	}
+
+	host := u.Hostname()
+	if strings.Contains(host, ":") && !strings.HasPrefix(u.Host, "[") {
+		return nil, fmt.Errorf("invalid redis URL %q: IPv6 addresses have to be in brackets, e.g. redis://[::1]:6379", shown)
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	port := u.Port()
+	if port == "" {
+		port = "6379"
+	} else if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return nil, fmt.Errorf("invalid redis URL %q: invalid port %q", shown, port)
+	}
+
+	opt := &redis.Options{Network: "tcp", Addr: net.JoinHostPort(host, port)}
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			opt.Password = password
+		}
+	}
+
+	switch path := strings.Trim(u.Path, "/"); {
+	case path == "":
+	case strings.Contains(path, "/"):
+		return nil, fmt.Errorf("invalid redis URL %q: path has to be a database number", shown)
+	default:
+		if opt.DB, err = strconv.Atoi(path); err != nil || opt.DB < 0 {
+			return nil, fmt.Errorf("invalid redis URL %q: invalid database %q", shown, path)
+		}
+	}
+
+	// in a fixed order, so that the same URL always fails on the same option
+	query := u.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := query[name]
+		value := values[len(values)-1]
+		if field, ok := redisURLDurations[name]; ok {
+			d, err := parseURLDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid redis URL %q: invalid %s %q", shown, name, value)
+			}
+			*field(opt) = d
+		} else if name == "max_retries" && value == "-1" {
+			// newer go-redis versions disable retries with -1, which is 0
+			// for this one
+			opt.MaxRetries = 0
+		} else if field, ok := redisURLInts[name]; ok {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid redis URL %q: invalid %s %q", shown, name, value)
+			}
+			*field(opt) = n
+		} else if name == "password" {
+			opt.Password = value
+		} else {
+			return nil, fmt.Errorf("invalid redis URL %q: unknown option %q", shown, name)
+		}
+	}
+
+	if u.Scheme == "rediss" {
+		opt.TLSConfig = &tls.Config{ServerName: host}
+	}
+	return opt, nil
+}
+
+// redactRedisURL returns u for error messages, without the passwords.
+func redactRedisURL(u *url.URL) string {
+	shown := *u
+	if query := shown.Query(); query.Get("password") != "" {
+		query.Set("password", "REDACTED")
+		shown.RawQuery = query.Encode()
+	}
+	return shown.Redacted()
+}
+
+// parseURLDuration parses a Go duration, or whole seconds like newer go-redis
+// versions.
+func parseURLDuration(s string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(s); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(s)
+}
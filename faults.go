@@ -0,0 +1,149 @@
+//go:build faults
+
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/iknow/coturn_exporter/source"
+
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The fault injection flags only exist in binaries built with -tags faults,
+// for exercising the reconciliation and reconnection logic in staging.
+var (
+	faultDropRatio          = flag.Float64("fault-drop-ratio", 0, "Fraction of events between 0 and 1 to drop as if the pubsub message was lost.")
+	faultDelay              = flag.Duration("fault-delay", 0, "Time to block before handling every event, backing up the subscription buffer.")
+	faultDisconnectInterval = flag.Duration("fault-disconnect-interval", 0, "Close every open redis connection at this interval, 0 disables the disconnects.")
+)
+
+var injectedFaults = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "coturn_exporter_injected_faults_total",
+	Help: "Number of faults injected by the fault injection flags",
+}, []string{"fault"})
+
+func init() {
+	prometheus.MustRegister(injectedFaults)
+}
+
+// faultInjector drops and delays the events passed to its handler.
+type faultInjector struct {
+	handler   source.Handler
+	dropRatio float64
+	delay     time.Duration
+}
+
+// injectFaults wraps handler in the faults configured by the flags.
+func injectFaults(handler source.Handler) source.Handler {
+	if *faultDropRatio <= 0 && *faultDelay <= 0 {
+		return handler
+	}
+	fmt.Printf("Injecting faults: dropping %g of the events, delaying them by %v\n", *faultDropRatio, *faultDelay)
+	return &faultInjector{handler: handler, dropRatio: *faultDropRatio, delay: *faultDelay}
+}
+
+// HandleAllocation implements source.Handler.
+func (f *faultInjector) HandleAllocation(e source.AllocationEvent) {
+	if f.pass() {
+		f.handler.HandleAllocation(e)
+	}
+}
+
+// HandleTraffic implements source.Handler.
+func (f *faultInjector) HandleTraffic(e source.TrafficEvent) {
+	if f.pass() {
+		f.handler.HandleTraffic(e)
+	}
+}
+
+// pass applies the delay and decides whether the event is dropped.
+func (f *faultInjector) pass() bool {
+	if f.delay > 0 {
+		injectedFaults.WithLabelValues("delay").Inc()
+		time.Sleep(f.delay)
+	}
+	if rand.Float64() < f.dropRatio {
+		injectedFaults.WithLabelValues("drop").Inc()
+		return false
+	}
+	return true
+}
+
+// faultConns holds the open redis connections closed by the disconnects.
+var faultConns = struct {
+	sync.Mutex
+	conns map[net.Conn]struct{}
+	once  sync.Once
+}{conns: make(map[net.Conn]struct{})}
+
+// injectRedisFaults makes the clients created from opt lose their
+// connections every -fault-disconnect-interval, as if the network or the
+// server dropped them.
+func injectRedisFaults(opt *redis.Options) {
+	if *faultDisconnectInterval <= 0 {
+		return
+	}
+	// the same dialing as the client default, which is only set up when
+	// the client is created
+	opt.Dialer = func() (net.Conn, error) {
+		dialer := &net.Dialer{Timeout: opt.DialTimeout, KeepAlive: 5 * time.Minute}
+		var conn net.Conn
+		var err error
+		if opt.TLSConfig == nil {
+			conn, err = dialer.Dial(opt.Network, opt.Addr)
+		} else {
+			conn, err = tls.DialWithDialer(dialer, opt.Network, opt.Addr, opt.TLSConfig)
+		}
+		if err != nil {
+			return nil, err
+		}
+		faultConns.Lock()
+		faultConns.conns[conn] = struct{}{}
+		faultConns.Unlock()
+		return conn, nil
+	}
+	faultConns.once.Do(func() {
+		fmt.Println("Injecting faults: closing the redis connections every", *faultDisconnectInterval)
+		go disconnectRedis(*faultDisconnectInterval)
+	})
+}
+
+func disconnectRedis(interval time.Duration) {
+	for range time.Tick(interval) {
+		faultConns.Lock()
+		for conn := range faultConns.conns {
+			conn.Close()
+			injectedFaults.WithLabelValues("disconnect").Inc()
+		}
+		faultConns.conns = make(map[net.Conn]struct{})
+		faultConns.Unlock()
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package geoip looks up the country and autonomous system of addresses in
+// MaxMind DB files such as GeoLite2-Country and GeoLite2-ASN.
+package geoip
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Database is a MaxMind DB file that is reloaded when it changes on disk.
+type Database struct {
+	path string
+
+	lock    sync.RWMutex
+	db      *mmdb
+	modTime time.Time
+	size    int64
+}
+
+// Open loads the database at path.
+func Open(path string) (*Database, error) {
+	d := &Database{path: path}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *Database) load() error {
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadFile(d.path)
+	if err != nil {
+		return err
+	}
+	db, err := parseMMDB(buf)
+	if err != nil {
+		return fmt.Errorf("%s: %v", d.path, err)
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.db = db
+	d.modTime = info.ModTime()
+	d.size = info.Size()
+	return nil
+}
+
+// Watch reloads the database whenever its modification time or size changes,
+// checking every interval. A database that fails to load is logged and the
+// previous one kept. It never returns.
+func (d *Database) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		info, err := os.Stat(d.path)
+		if err != nil {
+			fmt.Println("Unable to check GeoIP database: ", err)
+			continue
+		}
+		d.lock.RLock()
+		changed := !info.ModTime().Equal(d.modTime) || info.Size() != d.size
+		d.lock.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := d.load(); err != nil {
+			fmt.Println("Unable to reload GeoIP database: ", err)
+			continue
+		}
+		fmt.Println("Reloaded GeoIP database", d.path)
+	}
+}
+
+func (d *Database) lookup(ip net.IP) map[string]interface{} {
+	d.lock.RLock()
+	db := d.db
+	d.lock.RUnlock()
+
+	value, err := db.lookup(ip)
+	if err != nil {
+		fmt.Println("Unable to look up address in GeoIP database: ", err)
+		return nil
+	}
+	record, _ := value.(map[string]interface{})
+	return record
+}
+
+// Country returns the ISO code of the country of ip, falling back to the
+// country it is registered in, or an empty string if it is not known.
+func (d *Database) Country(ip net.IP) string {
+	record := d.lookup(ip)
+	for _, field := range []string{"country", "registered_country"} {
+		if country, ok := record[field].(map[string]interface{}); ok {
+			if code, ok := country["iso_code"].(string); ok {
+				return code
+			}
+		}
+	}
+	return ""
+}
+
+// ASN returns the autonomous system number of ip, or an empty string if it
+// is not known.
+func (d *Database) ASN(ip net.IP) string {
+	if asn, ok := d.lookup(ip)["autonomous_system_number"].(uint64); ok {
+		return strconv.FormatUint(asn, 10)
+	}
+	return ""
+}
@@ -0,0 +1,305 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+)
+
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// Data section types of the MaxMind DB format.
+const (
+	typeExtended = 0
+	typePointer  = 1
+	typeString   = 2
+	typeDouble   = 3
+	typeBytes    = 4
+	typeUint16   = 5
+	typeUint32   = 6
+	typeMap      = 7
+	typeInt32    = 8
+	typeUint64   = 9
+	typeUint128  = 10
+	typeArray    = 11
+	typeBoolean  = 14
+	typeFloat    = 15
+)
+
+var errInvalid = errors.New("invalid MaxMind DB")
+
+// mmdb is a MaxMind DB held in memory. Only what lookups need is decoded.
+type mmdb struct {
+	buf          []byte
+	nodeCount    uint64
+	recordSize   uint64
+	ipVersion    uint64
+	databaseType string
+	// data is the data section following the search tree
+	data []byte
+	// ipv4Start is the node IPv4 lookups start at in IPv6 databases
+	ipv4Start uint64
+}
+
+func parseMMDB(buf []byte) (*mmdb, error) {
+	i := bytes.LastIndex(buf, metadataMarker)
+	if i < 0 {
+		return nil, errors.New("MaxMind DB metadata not found")
+	}
+	metadataSection := buf[i+len(metadataMarker):]
+	value, _, err := (&decoder{metadataSection}).decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MaxMind DB metadata: %v", err)
+	}
+	metadata, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errInvalid
+	}
+
+	db := &mmdb{buf: buf}
+	db.nodeCount, _ = metadata["node_count"].(uint64)
+	db.recordSize, _ = metadata["record_size"].(uint64)
+	db.ipVersion, _ = metadata["ip_version"].(uint64)
+	db.databaseType, _ = metadata["database_type"].(string)
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported MaxMind DB record size %d", db.recordSize)
+	}
+
+	treeSize := db.recordSize * 2 / 8 * db.nodeCount
+	// the search tree is followed by 16 zero bytes before the data section
+	if treeSize+16 > uint64(i) {
+		return nil, errInvalid
+	}
+	db.data = buf[treeSize+16 : i]
+
+	if db.ipVersion == 6 {
+		node := uint64(0)
+		for bit := 0; bit < 96 && node < db.nodeCount; bit++ {
+			node, err = db.record(node, 0)
+			if err != nil {
+				return nil, err
+			}
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// record returns the left (0) or right (1) record of a node.
+func (db *mmdb) record(node uint64, bit uint) (uint64, error) {
+	size := db.recordSize * 2 / 8
+	offset := node * size
+	if offset+size > uint64(len(db.buf)) {
+		return 0, errInvalid
+	}
+	b := db.buf[offset : offset+size]
+
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2]), nil
+	case 28:
+		if bit == 0 {
+			return uint64(b[3]&0xf0)<<20 | uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2]), nil
+		}
+		return uint64(b[3]&0x0f)<<24 | uint64(b[4])<<16 | uint64(b[5])<<8 | uint64(b[6]), nil
+	default:
+		return uint64(binary.BigEndian.Uint32(b[bit*4:])), nil
+	}
+}
+
+// lookup returns the record of the network containing ip, or nil if there
+// is none.
+func (db *mmdb) lookup(ip net.IP) (interface{}, error) {
+	node := uint64(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else if db.ipVersion == 4 {
+		return nil, nil
+	}
+
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		var err error
+		node, err = db.record(node, bit)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if node == db.nodeCount {
+		return nil, nil
+	}
+	if node < db.nodeCount {
+		return nil, errInvalid
+	}
+	value, _, err := (&decoder{db.data}).decode(node - db.nodeCount - 16)
+	return value, err
+}
+
+type decoder struct {
+	buf []byte
+}
+
+func (d *decoder) bytes(offset uint64, n uint64) ([]byte, error) {
+	if offset+n > uint64(len(d.buf)) {
+		return nil, errInvalid
+	}
+	return d.buf[offset : offset+n], nil
+}
+
+func readUint(b []byte) uint64 {
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n
+}
+
+// decode returns the value at offset and the offset following it.
+func (d *decoder) decode(offset uint64) (interface{}, uint64, error) {
+	b, err := d.bytes(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	control := b[0]
+	offset++
+
+	kind := int(control >> 5)
+	if kind == typePointer {
+		size := uint64(control>>3) & 3
+		b, err := d.bytes(offset, size+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		var pointer uint64
+		switch size {
+		case 0:
+			pointer = uint64(control&7)<<8 | readUint(b)
+		case 1:
+			pointer = (uint64(control&7)<<16 | readUint(b)) + 2048
+		case 2:
+			pointer = (uint64(control&7)<<24 | readUint(b)) + 526336
+		default:
+			pointer = readUint(b)
+		}
+		value, _, err := d.decode(pointer)
+		return value, offset + size + 1, err
+	}
+	if kind == typeExtended {
+		b, err := d.bytes(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		kind = 7 + int(b[0])
+		offset++
+	}
+
+	size := uint64(control & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err := d.bytes(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + readUint(b)
+		case 2:
+			size = 285 + readUint(b)
+		default:
+			size = 65821 + readUint(b)
+		}
+	}
+
+	switch kind {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint64(0); i < size; i++ {
+			key, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, next, err := d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errInvalid
+			}
+			m[name] = value
+			offset = next
+		}
+		return m, offset, nil
+	case typeArray:
+		a := make([]interface{}, 0, size)
+		for i := uint64(0); i < size; i++ {
+			value, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+	case typeBoolean:
+		return size != 0, offset, nil
+	}
+
+	b, err = d.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+	switch kind {
+	case typeString:
+		return string(b), offset, nil
+	case typeBytes, typeUint128:
+		return append([]byte(nil), b...), offset, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errInvalid
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errInvalid
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case typeUint16, typeUint32, typeUint64:
+		return readUint(b), offset, nil
+	case typeInt32:
+		// sign extend values stored in fewer than 4 bytes
+		shift := 32 - 8*size
+		return int64(int32(uint32(readUint(b))<<shift) >> shift), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported MaxMind DB data type %d", kind)
+}
@@ -21,7 +21,10 @@
 package histogauge
 
 import (
-	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -33,84 +36,168 @@ type Histogauge interface {
 	Add(prometheus.Labels, float64)
 	Remove(prometheus.Labels, float64)
 	Replace(prometheus.Labels, float64, float64)
+	Delete(prometheus.Labels)
+	// Reset deletes all series. Resetting the GaugeVec directly leaves
+	// stale series in the cache.
+	Reset()
 }
 
 type histogauge struct {
-	gaugeVec *prometheus.GaugeVec
-	buckets  []float64
+	gaugeVec   *prometheus.GaugeVec
+	labelNames []string
+	buckets    []float64
+	// bucketNames are the le label values of the buckets, computed once
+	// since formatting them on every update dominated the allocations
+	bucketNames []string
+	// scale is applied to the values before they are put into buckets
+	scale float64
+
+	lock sync.Mutex
+	// label values joined by seriesSeparator -> bucket gauges, +Inf last
+	series map[string][]prometheus.Gauge
 }
 
+// seriesSeparator cannot occur in valid UTF-8 label values.
+const seriesSeparator = "\xff"
+
 func NewHistogauge(opts prometheus.GaugeOpts, labelNames []string, buckets []float64) Histogauge {
+	return NewScaledHistogauge(opts, labelNames, buckets, 1)
+}
+
+// NewScaledHistogauge returns a histogauge that multiplies the values by
+// scale, e.g. to count byte rates in bits.
+func NewScaledHistogauge(opts prometheus.GaugeOpts, labelNames []string, buckets []float64, scale float64) Histogauge {
+	bucketNames := make([]string, len(buckets))
+	for i, bucket := range buckets {
+		bucketNames[i] = bucketName(bucket)
+	}
+	names := append([]string(nil), labelNames...)
 	return &histogauge{
-		gaugeVec: prometheus.NewGaugeVec(opts, append(labelNames, "le")),
-		buckets:  buckets,
+		gaugeVec:    prometheus.NewGaugeVec(opts, append(names, "le")),
+		labelNames:  names,
+		buckets:     buckets,
+		bucketNames: bucketNames,
+		scale:       scale,
+		series:      make(map[string][]prometheus.Gauge),
 	}
 }
 
 func bucketName(v float64) string {
-	return fmt.Sprintf("%g", v)
+	return strconv.FormatFloat(v, 'g', -1, 64)
 }
 
 func (h *histogauge) GaugeVec() *prometheus.GaugeVec {
 	return h.gaugeVec
 }
 
-func (h *histogauge) Add(labels prometheus.Labels, v float64) {
-	newLabels := prometheus.Labels{}
-	for k, v := range labels {
-		newLabels[k] = v
+// seriesKey identifies the series of labels. The common case of a single
+// label needs no allocation.
+func (h *histogauge) seriesKey(labels prometheus.Labels) string {
+	if len(h.labelNames) == 1 {
+		return labels[h.labelNames[0]]
+	}
+	values := make([]string, len(h.labelNames))
+	for i, name := range h.labelNames {
+		values[i] = labels[name]
 	}
+	return strings.Join(values, seriesSeparator)
+}
+
+// gauges returns the bucket gauges of labels, creating and thereby
+// initializing them on first use.
+func (h *histogauge) gauges(labels prometheus.Labels) []prometheus.Gauge {
+	key := h.seriesKey(labels)
+	if gauges, ok := h.series[key]; ok {
+		return gauges
+	}
+	values := make([]string, len(h.labelNames)+1)
+	for i, name := range h.labelNames {
+		values[i] = labels[name]
+	}
+	gauges := make([]prometheus.Gauge, len(h.buckets)+1)
+	for i, name := range h.bucketNames {
+		values[len(values)-1] = name
+		gauges[i] = h.gaugeVec.WithLabelValues(values...)
+	}
+	values[len(values)-1] = "+Inf"
+	gauges[len(h.buckets)] = h.gaugeVec.WithLabelValues(values...)
+	h.series[key] = gauges
+	return gauges
+}
+
+func (h *histogauge) Add(labels prometheus.Labels, v float64) {
+	v *= h.scale
+	h.lock.Lock()
+	defer h.lock.Unlock()
 
-	for _, bucket := range h.buckets {
-		newLabels["le"] = bucketName(bucket)
-		// this ensures the bucket is initialized
-		gauge := h.gaugeVec.With(newLabels)
+	gauges := h.gauges(labels)
+	for i, bucket := range h.buckets {
 		if v <= bucket {
-			gauge.Inc()
+			gauges[i].Inc()
 		}
 	}
-	newLabels["le"] = "+Inf"
-	h.gaugeVec.With(newLabels).Inc()
+	gauges[len(h.buckets)].Inc()
 }
 
 func (h *histogauge) Remove(labels prometheus.Labels, v float64) {
-	newLabels := prometheus.Labels{}
-	for k, v := range labels {
-		newLabels[k] = v
-	}
+	v *= h.scale
+	h.lock.Lock()
+	defer h.lock.Unlock()
 
-	for _, bucket := range h.buckets {
-		newLabels["le"] = bucketName(bucket)
-		// this ensures the bucket is initialized
-		gauge := h.gaugeVec.With(newLabels)
+	gauges := h.gauges(labels)
+	for i, bucket := range h.buckets {
 		if v <= bucket {
-			gauge.Dec()
+			gauges[i].Dec()
 		}
 	}
-	newLabels["le"] = "+Inf"
-	h.gaugeVec.With(newLabels).Dec()
+	gauges[len(h.buckets)].Dec()
 }
 
 func (h *histogauge) Replace(labels prometheus.Labels, v float64, o float64) {
+	v *= h.scale
+	o *= h.scale
 	if v == o {
 		return
 	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
 
-	newLabels := prometheus.Labels{}
-	for k, v := range labels {
-		newLabels[k] = v
-	}
-
-	for _, bucket := range h.buckets {
-		newLabels["le"] = bucketName(bucket)
+	gauges := h.gauges(labels)
+	for i, bucket := range h.buckets {
 		if v > o {
 			if o <= bucket && bucket < v {
-				h.gaugeVec.With(newLabels).Dec()
+				gauges[i].Dec()
 			}
 		} else {
 			if v <= bucket && bucket < o {
-				h.gaugeVec.With(newLabels).Inc()
+				gauges[i].Inc()
 			}
 		}
 	}
 }
+
+// Delete removes all buckets of the given labels.
+func (h *histogauge) Delete(labels prometheus.Labels) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	delete(h.series, h.seriesKey(labels))
+	newLabels := prometheus.Labels{}
+	for k, v := range labels {
+		newLabels[k] = v
+	}
+	for _, name := range h.bucketNames {
+		newLabels["le"] = name
+		h.gaugeVec.Delete(newLabels)
+	}
+	newLabels["le"] = "+Inf"
+	h.gaugeVec.Delete(newLabels)
+}
+
+func (h *histogauge) Reset() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.series = make(map[string][]prometheus.Gauge)
+	h.gaugeVec.Reset()
+}
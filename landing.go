@@ -0,0 +1,57 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var landingPage = template.Must(template.New("landing").Parse(`<html>
+<head><title>coturn exporter</title></head>
+<body>
+<h1>coturn exporter</h1>
+<p><a href="{{.}}">Metrics</a></p>
+</body>
+</html>
+`))
+
+// handleMetrics registers handler on -metrics-path, and a landing page
+// linking to it on / unless the metrics are served there.
+func handleMetrics(handler http.Handler) {
+	if !strings.HasPrefix(*metricsPath, "/") {
+		log.Fatalf("Invalid metrics path %q, expected an absolute path", *metricsPath)
+	}
+	http.Handle(*metricsPath, handler)
+	if *metricsPath == "/" {
+		return
+	}
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		landingPage.Execute(w, *metricsPath)
+	})
+}
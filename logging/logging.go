@@ -0,0 +1,88 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package logging switches the exporter's diagnostic output on and off at
+// runtime. Everything else is always printed.
+package logging
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Level is how much the exporter logs.
+type Level int32
+
+const (
+	// Info logs errors and notable events only.
+	Info Level = iota
+	// Debug additionally logs every received message and every decision
+	// taken on it.
+	Debug
+)
+
+var level int32
+
+// ParseLevel parses "info" or "debug".
+func ParseLevel(s string) (Level, error) {
+	switch s {
+	case "info":
+		return Info, nil
+	case "debug":
+		return Debug, nil
+	}
+	return Info, fmt.Errorf("unknown log level %q, expected info or debug", s)
+}
+
+func (l Level) String() string {
+	if l == Debug {
+		return "debug"
+	}
+	return "info"
+}
+
+// SetLevel changes the level. It is safe to call while logging.
+func SetLevel(l Level) {
+	atomic.StoreInt32(&level, int32(l))
+}
+
+// CurrentLevel returns the level.
+func CurrentLevel() Level {
+	return Level(atomic.LoadInt32(&level))
+}
+
+// Toggle switches between Info and Debug and returns the new level.
+func Toggle() Level {
+	l := Debug
+	if CurrentLevel() == Debug {
+		l = Info
+	}
+	SetLevel(l)
+	return l
+}
+
+// Debugf prints a line at the Debug level. Callers with expensive arguments
+// should check CurrentLevel first.
+func Debugf(format string, args ...interface{}) {
+	if CurrentLevel() < Debug {
+		return
+	}
+	fmt.Printf("DEBUG: "+format+"\n", args...)
+}
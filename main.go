@@ -21,244 +21,1118 @@
 package main
 
 import (
-	"errors"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
-	"regexp"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/iknow/coturn_exporter/histogauge"
+	"github.com/iknow/coturn_exporter/billing"
+	"github.com/iknow/coturn_exporter/collector"
+	"github.com/iknow/coturn_exporter/eventstream"
+	"github.com/iknow/coturn_exporter/eventstream/kafka"
+	"github.com/iknow/coturn_exporter/eventstream/nats"
+	"github.com/iknow/coturn_exporter/exporter"
+	"github.com/iknow/coturn_exporter/geoip"
+	"github.com/iknow/coturn_exporter/logging"
+	"github.com/iknow/coturn_exporter/parser"
+	"github.com/iknow/coturn_exporter/probe"
+	"github.com/iknow/coturn_exporter/sink"
+	"github.com/iknow/coturn_exporter/sink/dogstatsd"
+	"github.com/iknow/coturn_exporter/sink/emf"
+	"github.com/iknow/coturn_exporter/sink/remotewrite"
+	"github.com/iknow/coturn_exporter/sink/vmimport"
+	"github.com/iknow/coturn_exporter/snmp"
+	"github.com/iknow/coturn_exporter/source"
+	redissource "github.com/iknow/coturn_exporter/source/redis"
+	"github.com/iknow/coturn_exporter/source/telnet"
+	"github.com/iknow/coturn_exporter/tracing"
 
 	"github.com/go-redis/redis"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
-	metricRegexp, _ = regexp.Compile("rcvp=([0-9]+), rcvb=([0-9]+), sentp=([0-9]+), sentb=([0-9]+)")
-	keyRegexp, _    = regexp.Compile("(turn/realm/([^/]+)/user/[^/]*/allocation/[^/]+)/(.+)")
-)
+	listenAddress   = flag.String("listen-address", ":8080", "The address to listen on for HTTP requests.")
+	metricsPath     = flag.String("metrics-path", "/metrics", "The path the metrics are served on.")
+	accessLog       = flag.Bool("access-log", false, "Log every HTTP request as a JSON line to stdout.")
+	logLevel        = flag.String("log-level", "info", "info, or debug to also log every received message and every event the collector ignores. SIGUSR2 toggles between the two.")
+	mode            = flag.String("mode", "subscribe", "How to collect metrics: subscribe to pubsub events or pull the statsdb keys at scrape time.")
+	redisUrl        = flag.String("redis-url", "redis://127.0.0.1:6379", "The redis server used as the coturn statsdb.")
+	redisReplicaUrl = flag.String("redis-replica-url", "", "A read-only replica of the statsdb used for the key scans at startup, during reconciliation and in pull mode. The primary is used when empty.")
+	redisDBs        = flag.String("redis-dbs", "", "Comma separated redis database indexes to read the statsdb keys from, with a db label on the key based metrics. Defaults to the database of -redis-url.")
+	multiTarget     = flag.Bool("multi-target", false, "Watch the statsdb passed as target query parameter on the metrics path, e.g. /metrics?target=redis:6379, instead of -redis-url.")
+	checkOnly       = flag.Bool("check-config", false, "Validate the configuration and redis connectivity, print a summary and exit.")
 
-var (
-	metricLabels = []string{"realm"}
+	redisDialTimeout  = flag.Duration("redis-dial-timeout", 0, "Timeout for connecting to redis, 0 for the client default of 5s.")
+	redisReadTimeout  = flag.Duration("redis-read-timeout", 0, "Timeout for reading redis replies, 0 for the client default of 3s, -1ns for none.")
+	redisWriteTimeout = flag.Duration("redis-write-timeout", 0, "Timeout for writing redis commands, 0 for the -redis-read-timeout.")
+	redisPoolSize     = flag.Int("redis-pool-size", 0, "Maximum number of connections per redis server, 0 for the client default of 10 per CPU.")
+	redisMinIdleConns = flag.Int("redis-min-idle-conns", 0, "Number of idle connections kept open per redis server.")
 
-	// 16K, 32K, 64K, 128K, 256K, 512K, 1M, 2M
-	byteRateBuckets = prometheus.ExponentialBuckets(16384, 2, 8)
-	// 50, 100, 150, 200, 250, 300, 350, 400
-	packetRateBuckets = prometheus.LinearBuckets(50, 50, 8)
-)
+	httpReadTimeout    = flag.Duration("http-read-timeout", 30*time.Second, "Maximum time to read an HTTP request including its body, 0 for no limit.")
+	httpWriteTimeout   = flag.Duration("http-write-timeout", 0, "Maximum time from the end of reading a request to the end of writing its response, 0 for no limit. Setting it cuts off the /events stream.")
+	httpIdleTimeout    = flag.Duration("http-idle-timeout", 2*time.Minute, "Maximum time an idle keep-alive connection is kept open.")
+	httpMaxHeaderBytes = flag.Int("http-max-header-bytes", http.DefaultMaxHeaderBytes, "Maximum size of the HTTP request headers.")
+	metricsGzipLevel   = flag.Int("metrics-gzip-level", gzip.DefaultCompression, "gzip level from 1 (fastest) to 9 (smallest) the metrics are compressed with for scrapers that accept it, -1 for the default level, 0 disables compression.")
 
-var (
-	listenAddress = flag.String("listen-address", ":8080", "The address to listen on for HTTP requests.")
-	redisUrl      = flag.String("redis-url", "redis://127.0.0.1:6379", "The redis server used as the coturn statsdb.")
-)
+	multiTargetIdleTimeout = flag.Duration("multi-target-idle-timeout", 10*time.Minute, "Stop watching a target that has not been scraped for this long.")
+	multiTargetMax         = flag.Int("multi-target-max", 100, "Maximum number of targets watched at once, 0 for no limit.")
 
-var (
-	allocationGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "coturn_allocations",
-		Help: "Number of allocations",
-	}, metricLabels)
-	receivedPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "coturn_received_packets_total",
-		Help: "Number of packets received",
-	}, metricLabels)
-	receivedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "coturn_received_bytes_total",
-		Help: "Number of bytes received",
-	}, metricLabels)
-	sentPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "coturn_sent_packets_total",
-		Help: "Number of packets sent",
-	}, metricLabels)
-	sentBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "coturn_sent_bytes_total",
-		Help: "Number of bytes sent",
-	}, metricLabels)
-	receivedPacketRateHistogauge = histogauge.NewHistogauge(prometheus.GaugeOpts{
-		Name: "coturn_received_packet_rate_pps_bucket",
-		Help: "Received packet rate distribution",
-	}, metricLabels, packetRateBuckets)
-	receivedByteRateHistogauge = histogauge.NewHistogauge(prometheus.GaugeOpts{
-		Name: "coturn_received_byte_rate_bps_bucket",
-		Help: "Received byte rate distribution",
-	}, metricLabels, byteRateBuckets)
-	sentPacketRateHistogauge = histogauge.NewHistogauge(prometheus.GaugeOpts{
-		Name: "coturn_sent_packet_rate_pps_bucket",
-		Help: "Sent packet rate distribution",
-	}, metricLabels, packetRateBuckets)
-	sentByteRateHistogauge = histogauge.NewHistogauge(prometheus.GaugeOpts{
-		Name: "coturn_sent_byte_rate_bps_bucket",
-		Help: "Sent byte rate distribution",
-	}, metricLabels, byteRateBuckets)
+	goCollector      = flag.Bool("go-collector", true, "Expose the go_* metrics of the exporter's Go runtime.")
+	processCollector = flag.Bool("process-collector", true, "Expose the process_* metrics of the exporter process.")
+	runtimeMetrics   = flag.Bool("runtime-metrics", false, "Expose histograms of the exporter's GC pauses and goroutine scheduling latencies, for debugging the exporter.")
+
+	simulateMode        = flag.Bool("simulate", false, "Publish synthetic coturn traffic into redis instead of exporting metrics.")
+	simulateAllocations = flag.Int("simulate-allocations", 100, "Number of concurrent allocations to simulate.")
+	simulateRealms      = flag.Int("simulate-realms", 1, "Number of realms to spread the simulated allocations over.")
+	simulateRate        = flag.Float64("simulate-rate", 10, "Number of simulated traffic messages to publish per second.")
+
+	doctorMode    = flag.Bool("doctor", false, "Diagnose the statsdb setup, print a pass/fail report and exit.")
+	doctorTimeout = flag.Duration("doctor-timeout", 30*time.Second, "How long -doctor waits for pubsub messages.")
+	doctorSamples = flag.Int("doctor-samples", 3, "Number of allocation status keys -doctor reads and prints.")
+
+	suggestMode        = flag.Bool("suggest-buckets", false, "Observe the live rates and print suggested buckets for -packet-rate-buckets and -byte-rate-buckets instead of exporting metrics.")
+	suggestDuration    = flag.Duration("suggest-duration", 10*time.Minute, "How long to observe the rates for -suggest-buckets.")
+	suggestBucketCount = flag.Int("suggest-bucket-count", 8, "Number of buckets suggested by -suggest-buckets.")
+
+	recordFile  = flag.String("record", "", "Append every received pubsub message with its timestamp to this file.")
+	replayFile  = flag.String("replay", "", "Replay messages from a recording instead of subscribing to redis.")
+	replaySpeed = flag.Float64("replay-speed", 1, "Replay speed multiplier, 0 replays as fast as possible.")
+
+	stateFile     = flag.String("state-file", "", "Persist counters and allocation state to this file across restarts.")
+	stateRedisKey = flag.String("state-redis-key", "", "Persist counters and allocation state to this redis key across restarts.")
+	stateInterval = flag.Duration("state-interval", time.Minute, "Interval between state checkpoints.")
+
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "Longest time the state save and the flushes of the sinks may take on SIGINT or SIGTERM before the exporter exits anyway.")
+
+	webhookURL                  = flag.String("webhook-url", "", "POST a JSON notification to this URL when a threshold is crossed.")
+	webhookAllocationsThreshold = flag.Float64("webhook-allocations-threshold", 0, "Notify when the number of allocations in a realm exceeds this value.")
+	webhookByteRateThreshold    = flag.Float64("webhook-byte-rate-threshold", 0, "Notify when the aggregate byte rate of a realm exceeds this value in bytes/s.")
+	webhookInterval             = flag.Duration("webhook-interval", 15*time.Second, "Interval between threshold evaluations.")
+	webhookDebounce             = flag.Duration("webhook-debounce", 5*time.Minute, "Minimum time between notifications for the same threshold and realm.")
+
+	maxPacketRate       = flag.Float64("max-packet-rate", 1e6, "Highest plausible packet rate of a single allocation in packets/s, 0 disables the check.")
+	maxByteRate         = flag.Float64("max-byte-rate", 1.25e9, "Highest plausible byte rate of a single allocation in bytes/s, 0 disables the check.")
+	clampSuspectSamples = flag.Bool("clamp-suspect-samples", false, "Clamp negative or implausibly large traffic reports instead of dropping them.")
+	payloadMode         = flag.String("payload-mode", "lenient", "How traffic payloads are parsed: lenient skips the fields it cannot parse, strict drops payloads with unknown, duplicate, malformed or missing fields.")
+
+	reportInterval = flag.String("report-interval", "", "coturn's stats report interval used to compute rates, \"auto\" to infer it from the observed report gaps. Rates are computed from message arrival times if empty.")
+
+	seedRates = flag.Bool("seed-rates", false, "Seed the rate distributions at startup from the traffic keys stored next to the allocation status keys. Requires a fixed -report-interval and a coturn that stores its traffic reports.")
+
+	rateWindow        = flag.Duration("rate-window", 0, "Average the rates of an allocation over its traffic reports of this long instead of only the last report, to smooth bursty traffic.")
+	rateWindowReports = flag.Int("rate-window-reports", 0, "Average the rates of an allocation over up to this many of its last traffic reports instead of only the last one. Both limits apply if -rate-window is set as well.")
+	peakRateWindow    = flag.Duration("peak-rate-window", 0, "Expose the highest byte rates of a single allocation per realm over this rolling window, e.g. 1h. Disabled when 0.")
+
+	dailyPeaks = flag.Bool("daily-peaks", false, "Expose the peak number of concurrent allocations per realm over the last 24 hours as coturn_allocations_daily_peak.")
+	rateUnit   = flag.String("rate-unit", "bytes", "Unit of the byte rate histograms: bytes for coturn_*_byte_rate_bps_bucket, bits for coturn_*_bit_rate_bits_per_second_bucket, or both.")
+
+	dailyUsage         = flag.Bool("daily-usage", false, "Expose the bytes received and sent per realm since the start of the day as coturn_*_bytes_day_total.")
+	dailyUsageTimezone = flag.String("daily-usage-timezone", "UTC", "IANA time zone, e.g. Asia/Tokyo, the days of -daily-usage start in.")
+	dailyUsageBoundary = flag.String("daily-usage-boundary", "00:00", "Time of day as HH:MM at which the -daily-usage counters start over.")
+
+	billingEnabled  = flag.Bool("billing", false, "Add up the monthly bytes received and sent per realm in redis hashes for invoicing, served by /api/v1/billing.")
+	billingPerUser  = flag.Bool("billing-per-user", false, "Also add up the -billing totals per user.")
+	billingRedisKey = flag.String("billing-redis-key", "coturn_exporter:billing", "Prefix of the redis hashes of the -billing totals, followed by :YYYY-MM.")
+	billingInterval = flag.Duration("billing-interval", time.Minute, "How often the -billing totals are written to redis.")
+	billingTimezone = flag.String("billing-timezone", "UTC", "IANA time zone the months of -billing start in.")
+
+	packetRateBuckets = flag.String("packet-rate-buckets", "default", "Bucket preset of the packet rate histograms: default, voice, video, bulk or high-res, or a comma separated list of buckets.")
+	byteRateBuckets   = flag.String("byte-rate-buckets", "default", "Bucket preset of the byte and bit rate histograms: default, voice, video, bulk or high-res, or a comma separated list of byte rate buckets.")
+	allocationRates   = flag.Bool("allocation-rates", false, "Expose the current rates of every allocation with an allocation label. Only suitable for small deployments.")
+	rateQuantiles     = flag.String("rate-quantiles", "", "Comma separated quantiles, e.g. 0.5,0.9,0.99, of the byte rates to expose as coturn_*_byte_rate_quantile gauges computed at scrape time. Disabled when empty.")
+
+	staleTimeout    = flag.Duration("stale-allocation-timeout", 0, "Drop allocations without any status or traffic message for this long, 0 disables expiry.")
+	rateIdleTimeout = flag.Duration("rate-idle-timeout", 0, "Count the rates of allocations without traffic reports for this long as zero, 0 disables it.")
+	removeIdleRates = flag.Bool("remove-idle-rates", false, "Remove the rates of idle allocations from the rate histograms instead of counting them as zero.")
+	emptyRealmGrace = flag.Duration("empty-realm-grace-period", 0, "Delete the allocation gauge and rate histogram series of realms without allocations for this long, 0 keeps them.")
+
+	lifetimeExpiry      = flag.Bool("lifetime-expiry", false, "Drop allocations whose lifetime granted by the last new or refreshed status ran out without a refresh.")
+	lifetimeExpiryGrace = flag.Duration("lifetime-expiry-grace", 30*time.Second, "How long after its lifetime ran out an allocation is dropped with -lifetime-expiry.")
+
+	reconcileInterval = flag.Duration("reconcile-interval", 0, "Interval between key scans detecting missed and orphaned allocations, 0 disables reconciliation.")
+	dropOrphans       = flag.Bool("drop-orphans", false, "Drop tracked allocations whose keys are gone instead of only reporting them.")
+
+	restartDeletionRatio = flag.Float64("restart-deletion-ratio", 0, "Share of the tracked allocations, e.g. 0.8, that has to be deleted within -restart-window or be missing from a key scan for a coturn restart to be suspected. A restart is detected when allocations are created again and triggers a reconciliation. 0 disables the detection.")
+	restartWindow        = flag.Duration("restart-window", time.Minute, "Window of the deletions and re-creations detecting a coturn restart.")
+
+	keyPattern = flag.String("key-pattern", parser.ChannelKeyPattern, "Redis pattern matching every channel coturn publishes to, ending in * for the message type.")
+	keyPrefix  = flag.String("key-prefix", "", "Prefix of every statsdb key, e.g. prod: when a redis proxy namespaces the keys. It is added to the key patterns and stripped before parsing.")
+	keyRegexp  = flag.String("key-regexp", parser.DefaultKeyRegexp, "Regular expression parsing keys and channels, with the named groups realm, user, allocation and type, and optionally origin. The type has to come last.")
+
+	realmConfig = flag.String("realm-config", "", "JSON file with the realm normalization: {\"lowercase\": true, \"strip_port\": true, \"aliases\": {\"old.example.com\": \"turn.example.com\"}}.")
+
+	userLabel       = flag.Bool("user-label", false, "Expose per user allocation and traffic metrics with a user label.")
+	userLabelMode   = flag.String("user-label-mode", "plain", "How user names become label values: plain, sha256 or truncated.")
+	userLabelSalt   = flag.String("user-label-salt", "", "Salt prepended to user names before hashing in the sha256 user label mode. Defaults to $USER_LABEL_SALT.")
+	userLabelLength = flag.Int("user-label-length", 8, "Number of characters kept in the truncated user label mode.")
+
+	topTalkers         = flag.Int("top-talkers", 0, "Expose the estimated traffic of this many users with the most traffic, labelled according to -user-label-mode. 0 disables it.")
+	topTalkersHalfLife = flag.Duration("top-talkers-half-life", 5*time.Minute, "Half-life of the traffic counted for -top-talkers.")
+
+	originLabel = flag.Bool("origin-label", false, "Count allocations and bytes by origin, from the origin group of -key-regexp or the origin status field of patched coturn builds.")
+
+	clientSubnets          = flag.Bool("client-subnets", false, "Count allocations by the subnet of their client address, for sources that report it.")
+	clientSubnetIPv4Prefix = flag.Int("client-subnet-ipv4-prefix", 24, "Prefix length IPv4 client addresses are aggregated to.")
+	clientSubnetIPv6Prefix = flag.Int("client-subnet-ipv6-prefix", 48, "Prefix length IPv6 client addresses are aggregated to.")
+
+	geoipCountryDB  = flag.String("geoip-country-db", "", "MaxMind DB file, e.g. GeoLite2-Country.mmdb, to count allocations by client country.")
+	geoipASNDB      = flag.String("geoip-asn-db", "", "MaxMind DB file, e.g. GeoLite2-ASN.mmdb, to count allocations by client autonomous system.")
+	geoipMaxValues  = flag.Int("geoip-max-label-values", 100, "Maximum number of distinct countries and autonomous systems with their own series, 0 for no limit.")
+	geoipReloadTime = flag.Duration("geoip-reload-interval", time.Minute, "Interval between checks whether the GeoIP databases changed on disk.")
+
+	userdbURL        = flag.String("userdb-url", "", "The redis server used as the coturn userdb, to compare the per user rates and allocations against the realm max-bps and user-quota. Requires -user-label or -rest-secrets.")
+	userdbInterval   = flag.Duration("userdb-interval", 5*time.Minute, "Interval between reloads of the userdb quotas and the limits of the admin interface.")
+	defaultMaxBPS    = flag.Float64("default-max-bps", 0, "coturn's max-bps for realms without one in the userdb, 0 for unlimited or the one of the admin interface.")
+	defaultUserQuota = flag.Float64("default-user-quota", 0, "coturn's user-quota for realms without one in the userdb, 0 for unlimited or the one of the admin interface.")
+
+	defaultTotalQuota = flag.Float64("default-total-quota", 0, "coturn's total-quota for realms without one in the userdb, 0 for unlimited or the one of the admin interface.")
+
+	restSecrets        = flag.Bool("rest-secrets", false, "Export the number and age of the TURN REST API shared secrets of every realm in the -userdb-url.")
+	restSecretFile     = flag.String("rest-secret-file", "", "coturn configuration file whose static-auth-secret number and age are exported. Disabled when empty.")
+	restSecretSeenKey  = flag.String("rest-secret-seen-key", "", "Redis hash in the -userdb-url recording when each secret was first seen, so that the ages survive restarts. Secrets are only hashed. Kept in memory when empty.")
+	restSecretInterval = flag.Duration("rest-secret-interval", time.Minute, "Interval between reloads of the TURN REST API secrets.")
+
+	excludeUsers      = flag.String("exclude-users", "", "Comma separated user names, e.g. synthetic monitoring or load test accounts, whose allocations and traffic are left out of all metrics.")
+	excludeUsersRegex = flag.String("exclude-users-regex", "", "Regular expression matching whole user names whose allocations and traffic are left out of all metrics, e.g. loadtest-.*")
+
+	maxSeriesPerRealm = flag.Int("max-series-per-realm", 0, "Maximum number of users, subnets, countries, autonomous systems and origins with their own series per realm, further ones are counted as \"other\". 0 for no limit.")
+
+	telnetAddress  = flag.String("telnet-address", "", "Address of the coturn admin interface, e.g. 127.0.0.1:5766, to export session details read with \"ps\". Disabled when empty.")
+	telnetPassword = flag.String("telnet-password", "", "Password of the coturn admin interface (cli-password). Defaults to $TELNET_PASSWORD.")
+	telnetTimeout  = flag.Duration("telnet-timeout", 10*time.Second, "Timeout for reading the session listing.")
+
+	telnetInfoCommand = flag.String("telnet-info-command", "pc", "Admin interface command printing the server configuration, read for coturn_server_info. Disabled when empty.")
+
+	tlsCertFiles      = flag.String("tls-cert-files", "", "Comma separated PEM files of the coturn certificates to expose the expiry of.")
+	tlsProbeAddresses = flag.String("tls-probe-addresses", "", "Comma separated host:port of coturn TLS listeners to read the certificate expiry from.")
+	tlsProbeTimeout   = flag.Duration("tls-probe-timeout", 5*time.Second, "Timeout for reading the certificate of a TLS listener.")
+
+	stunProbeTargets  = flag.String("stun-probe-targets", "", "Comma separated coturn listeners to send STUN binding requests to, as host:port for UDP or udp://host:port and tcp://host:port.")
+	stunProbeInterval = flag.Duration("stun-probe-interval", 15*time.Second, "Interval between STUN probes.")
+	stunProbeTimeout  = flag.Duration("stun-probe-timeout", 5*time.Second, "Timeout for a STUN binding request.")
+
+	aggregateRealms = flag.String("aggregate-realms", "", "Comma separated metric families to sum across realms into a single realm=\"_all\" series, or \"all\" for every family.")
+
+	pubsubChannelSize = flag.Int("pubsub-channel-size", 10000, "Number of received pubsub messages buffered for processing before further ones are dropped.")
+	pubsubHealthCheck = flag.Duration("pubsub-health-check-interval", 5*time.Second, "Idle time after which the subscription is pinged, and reestablished if the ping is not answered in time. 0 disables the check.")
+	pubsubLagProbe    = flag.Duration("pubsub-lag-probe-interval", 10*time.Second, "Interval between pings through the subscription measuring coturn_exporter_pubsub_lag_seconds. 0 disables the probes.")
+	pubsubRealms      = flag.Duration("pubsub-realm-discovery-interval", 0, "Subscribe to every realm separately, each with its own buffer and goroutine, discovering the realms by scanning the status keys at this interval. 0 subscribes to all realms at once.")
+	watchdogTimeout   = flag.Duration("subscription-watchdog-timeout", 2*time.Minute, "Fail the readiness check and resubscribe when nothing, not even a health check pong, was received for this long while allocations are tracked. 0 disables the watchdog.")
+
+	maxEventRate   = flag.Float64("max-event-rate", 0, "Maximum number of statsdb traffic messages processed per second, 0 for no limit. Messages arriving faster are queued, allocation messages are never limited.")
+	eventQueueSize = flag.Int("event-queue-size", 100000, "Number of traffic messages queued by -max-event-rate before further ones are dropped.")
+
+	sinkQueueSize = flag.Int("sink-queue-size", 10000, "Number of events queued for each of the event stream, Kafka and NATS sinks before further ones are dropped for that sink. 0 calls the sinks inline, holding up the subscription while they are slow.")
+
+	statsdbTotals = flag.Bool("statsdb-totals", false, "Expose the cumulative traffic stored in the statsdb at startup as coturn_statsdb_* metrics.")
+
+	grpcListenAddress = flag.String("grpc-listen-address", "", "The address to serve the gRPC event stream on (unencrypted HTTP/2). Disabled when empty.")
+	sseEvents         = flag.Bool("sse-events", false, "Stream allocation events and per realm rates as server-sent events on /events.")
+	sseRateInterval   = flag.Duration("sse-rate-interval", 5*time.Second, "Interval between the rates events on /events.")
+
+	kafkaBrokers       = flag.String("kafka-brokers", "", "Comma separated host:port of Kafka brokers to publish the allocation and traffic events to. Disabled when empty.")
+	kafkaTopic         = flag.String("kafka-topic", "coturn-events", "Kafka topic the events are published to.")
+	kafkaTLS           = flag.Bool("kafka-tls", false, "Connect to the Kafka brokers with TLS.")
+	kafkaTLSCAFile     = flag.String("kafka-tls-ca-file", "", "PEM file with the CA certificates to verify the Kafka brokers with instead of the system ones.")
+	kafkaSASLUser      = flag.String("kafka-sasl-user", "", "User to authenticate to Kafka with SASL/PLAIN. Disabled when empty.")
+	kafkaSASLPassword  = flag.String("kafka-sasl-password", "", "Password for -kafka-sasl-user. Defaults to $KAFKA_SASL_PASSWORD.")
+	kafkaBatchSize     = flag.Int("kafka-batch-size", 500, "Maximum number of events sent to Kafka in one request.")
+	kafkaFlushInterval = flag.Duration("kafka-flush-interval", time.Second, "Longest time an event waits for its Kafka batch to fill up.")
+	kafkaQueueSize     = flag.Int("kafka-queue-size", 100000, "Number of events queued for Kafka before further ones are dropped.")
+
+	natsURL           = flag.String("nats-url", "", "nats:// or tls:// URL of a NATS server to publish the allocation and traffic events to, with user:password@ or token@ for authentication. Defaults to $NATS_URL, disabled when both are empty.")
+	natsSubject       = flag.String("nats-subject", "coturn.events", "Prefix of the NATS subjects, the event type is appended.")
+	natsTLSCAFile     = flag.String("nats-tls-ca-file", "", "PEM file with the CA certificates to verify the NATS server with instead of the system ones.")
+	natsStream        = flag.String("nats-stream", "", "JetStream stream persisting the events, created if it does not exist. Events are published without persistence when empty.")
+	natsBatchSize     = flag.Int("nats-batch-size", 500, "Maximum number of events sent to NATS before waiting for the server.")
+	natsFlushInterval = flag.Duration("nats-flush-interval", time.Second, "Longest time an event waits for its NATS batch to fill up.")
+	natsQueueSize     = flag.Int("nats-queue-size", 100000, "Number of events queued for NATS before further ones are dropped.")
+
+	emfOutput    = flag.String("emf-output", "", "Write metrics in CloudWatch embedded metric format to \"stdout\" or a tcp:// or udp:// CloudWatch agent address. Disabled when empty.")
+	emfNamespace = flag.String("emf-namespace", "coturn", "CloudWatch namespace of the EMF metrics.")
+	emfInterval  = flag.Duration("emf-interval", time.Minute, "Interval between EMF flushes.")
+	emfMaxRate   = flag.Float64("emf-max-rate", 50, "Maximum number of EMF documents written per second, 0 disables the limit.")
+
+	dogstatsdAddress  = flag.String("dogstatsd-address", "", "Mirror metrics to a DogStatsD agent at udp://host:port or unix:///path. Disabled when empty.")
+	dogstatsdTags     = flag.String("dogstatsd-tags", "", "Comma separated tags added to every DogStatsD metric, e.g. env:prod,region:eu.")
+	dogstatsdInterval = flag.Duration("dogstatsd-interval", 10*time.Second, "Interval between DogStatsD flushes.")
+
+	vmURL         = flag.String("vm-url", "", "Push metrics to the VictoriaMetrics import API at this base URL. Disabled when empty.")
+	vmInterval    = flag.Duration("vm-interval", 30*time.Second, "Interval between VictoriaMetrics pushes.")
+	vmExtraLabels = flag.String("vm-extra-labels", "", "Comma separated name=value labels added to every pushed series, e.g. instance=edge1.")
+	vmUsername    = flag.String("vm-username", "", "Username for basic auth against VictoriaMetrics.")
+	vmPassword    = flag.String("vm-password", "", "Password for basic auth against VictoriaMetrics. Defaults to $VM_PASSWORD.")
+	vmBearerToken = flag.String("vm-bearer-token", "", "Bearer token for VictoriaMetrics. Defaults to $VM_BEARER_TOKEN.")
+
+	grafanaCloudURL        = flag.String("grafana-cloud-url", "", "Push metrics to this Grafana Cloud remote write URL, e.g. https://prometheus-prod-01-eu-west-0.grafana.net/api/prom/push. Disabled when empty.")
+	grafanaCloudUser       = flag.String("grafana-cloud-user", "", "Grafana Cloud Prometheus instance id used as basic auth username.")
+	grafanaCloudAPIKey     = flag.String("grafana-cloud-api-key", "", "Grafana Cloud API key. Defaults to $GRAFANA_CLOUD_API_KEY.")
+	grafanaCloudAPIKeyFile = flag.String("grafana-cloud-api-key-file", "", "File to read the Grafana Cloud API key from, instead of -grafana-cloud-api-key.")
+	grafanaCloudLabels     = flag.String("grafana-cloud-labels", "", "Comma separated name=value labels added to every pushed series, e.g. job=coturn,instance=edge1.")
+	grafanaCloudInterval   = flag.Duration("grafana-cloud-interval", 30*time.Second, "Interval between Grafana Cloud pushes.")
+	grafanaCloudBuffer     = flag.Int("grafana-cloud-buffer", 60, "Number of pushes kept while Grafana Cloud is unreachable, older ones are dropped.")
+
+	snmpListenAddress = flag.String("snmp-listen-address", "", "The UDP address to serve SNMPv2c on, e.g. :161. Disabled when empty.")
+	snmpCommunity     = flag.String("snmp-community", "public", "The SNMP community accepted by the agent.")
+	snmpBaseOID       = flag.String("snmp-base-oid", "1.3.6.1.4.1.8072.9999.1", "The OID subtree the aggregates are exposed below.")
+
+	otlpEndpoint     = flag.String("otlp-endpoint", "", "OTLP/HTTP endpoint, e.g. http://localhost:4318, to export traces of the event processing to. Disabled when empty.")
+	traceSampleRatio = flag.Float64("trace-sample-ratio", 0.01, "Ratio of processed messages that are traced.")
+
+	resourceAttributesFlag = flag.String("resource-attributes", "", "Comma separated name=value OpenTelemetry resource attributes describing the exporter in traces and remote write pushes, overriding $OTEL_RESOURCE_ATTRIBUTES and the defaults.")
+	coturnInstance         = flag.String("coturn-instance", "", "Name of the monitored coturn instance, the coturn.instance resource attribute. Defaults to the address of -redis-url.")
+
+	adminToken = flag.String("admin-token", "", "Bearer token required for the /-/ admin endpoints. The endpoints are disabled when empty.")
+	apiToken   = flag.String("api-token", "", "Bearer token required for the /api/v1/ endpoints. The endpoints are disabled when empty.")
 )
 
-func init() {
-	prometheus.MustRegister(allocationGauge)
-	prometheus.MustRegister(receivedPackets)
-	prometheus.MustRegister(receivedBytes)
-	prometheus.MustRegister(sentPackets)
-	prometheus.MustRegister(sentBytes)
-	prometheus.MustRegister(receivedPacketRateHistogauge.GaugeVec())
-	prometheus.MustRegister(receivedByteRateHistogauge.GaugeVec())
-	prometheus.MustRegister(sentPacketRateHistogauge.GaugeVec())
-	prometheus.MustRegister(sentByteRateHistogauge.GaugeVec())
+func serveGRPC(address string, broadcaster *eventstream.Broadcaster) {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	server := &http.Server{
+		Addr:      address,
+		Handler:   eventstream.GRPCHandler(broadcaster),
+		Protocols: &protocols,
+	}
+	fmt.Println("Serving gRPC event stream on", address)
+	log.Fatal(server.ListenAndServe())
 }
 
-var allocations = make(map[string]*Allocation)
+func main() {
+	command, flags, args := parseCommand(os.Args[1:])
+	flags.Parse(args)
 
-type MessageMetadata struct {
-	realm          string
-	allocationName string
-	messageType    string
+	switch command {
+	case "version":
+		fmt.Printf("coturn_exporter %s (revision %s)\n", version, revision)
+		return
+	case "check":
+		*checkOnly = true
+	case "simulate":
+		*simulateMode = true
+	case "suggest-buckets":
+		*suggestMode = true
+	case "doctor":
+		*doctorMode = true
+	}
+	serve()
 }
 
-type TrafficMetric struct {
-	rcvp  float64
-	rcvb  float64
-	sentp float64
-	sentb float64
-}
+func serve() {
+	if *metricsGzipLevel < gzip.DefaultCompression || *metricsGzipLevel > gzip.BestCompression {
+		log.Fatalf("Invalid gzip level %d, expected -1 to 9", *metricsGzipLevel)
+	}
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logging.SetLevel(level)
 
-type Allocation struct {
-	previousRates       *TrafficMetric
-	lastMetricTimestamp time.Time
-}
+	var interval time.Duration
+	if *reportInterval != "" && *reportInterval != "auto" {
+		var err error
+		interval, err = time.ParseDuration(*reportInterval)
+		if err != nil {
+			log.Fatalf("Invalid report interval %q: %v", *reportInterval, err)
+		}
+	}
+	if *seedRates && interval == 0 {
+		log.Fatal("-seed-rates requires a fixed -report-interval")
+	}
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"stale-allocation-timeout", *staleTimeout},
+		{"rate-idle-timeout", *rateIdleTimeout},
+		{"empty-realm-grace-period", *emptyRealmGrace},
+		{"reconcile-interval", *reconcileInterval},
+		{"pubsub-health-check-interval", *pubsubHealthCheck},
+		{"pubsub-lag-probe-interval", *pubsubLagProbe},
+		{"pubsub-realm-discovery-interval", *pubsubRealms},
+	} {
+		if d.value < 0 {
+			log.Fatalf("Invalid -%s %v, it cannot be negative", d.name, d.value)
+		}
+	}
+	// these drive tickers, which take neither zero nor negative intervals
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"state-interval", *stateInterval},
+		{"webhook-interval", *webhookInterval},
+		{"billing-interval", *billingInterval},
+		{"userdb-interval", *userdbInterval},
+		{"rest-secret-interval", *restSecretInterval},
+		{"stun-probe-interval", *stunProbeInterval},
+		{"sse-rate-interval", *sseRateInterval},
+		{"emf-interval", *emfInterval},
+		{"dogstatsd-interval", *dogstatsdInterval},
+		{"vm-interval", *vmInterval},
+		{"grafana-cloud-interval", *grafanaCloudInterval},
+		{"geoip-reload-interval", *geoipReloadTime},
+		{"kafka-flush-interval", *kafkaFlushInterval},
+		{"nats-flush-interval", *natsFlushInterval},
+	} {
+		if d.value <= 0 {
+			log.Fatalf("Invalid -%s %v, it has to be positive", d.name, d.value)
+		}
+	}
+	// the watchdog checks four times per timeout
+	if *watchdogTimeout != 0 && *watchdogTimeout < time.Second {
+		log.Fatalf("Invalid -subscription-watchdog-timeout %v, it has to be 0 or at least 1s", *watchdogTimeout)
+	}
+	if *multiTarget && *multiTargetIdleTimeout < time.Second {
+		log.Fatalf("Invalid -multi-target-idle-timeout %v, it has to be at least 1s", *multiTargetIdleTimeout)
+	}
+	if *restartDeletionRatio < 0 || *restartDeletionRatio > 1 {
+		log.Fatalf("Invalid restart deletion ratio %v, it has to be between 0 and 1", *restartDeletionRatio)
+	}
 
-func parseKeyName(key string) (MessageMetadata, error) {
-	var metadata MessageMetadata
+	var gatherer prometheus.Gatherer = prometheus.DefaultGatherer
+	if *aggregateRealms != "" {
+		gatherer = newRealmAggregator(gatherer, splitList(*aggregateRealms))
+	}
 
-	result := keyRegexp.FindStringSubmatch(key)
-	if result == nil {
-		return metadata, errors.New("Unexpected key name")
+	if *keyPattern != parser.ChannelKeyPattern || *keyRegexp != parser.DefaultKeyRegexp {
+		schema, err := parser.NewKeySchema(*keyPattern, *keyRegexp)
+		if err != nil {
+			log.Fatal(err)
+		}
+		parser.SetKeySchema(schema)
+	}
+	parser.SetKeyPrefix(*keyPrefix)
+	if source.PayloadMode, err = parser.ParseMode(*payloadMode); err != nil {
+		log.Fatal(err)
+	}
+	if _, ok := parser.RealmChannelPattern(""); *pubsubRealms > 0 && !ok {
+		log.Fatal("-pubsub-realm-discovery-interval requires the stock -key-pattern and -key-regexp")
 	}
 
-	metadata = MessageMetadata{
-		result[2],
-		result[1],
-		result[3],
+	if *realmConfig != "" {
+		mapping, err := loadRealmMapping(*realmConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		parser.SetRealmMapping(mapping)
 	}
-	return metadata, nil
-}
 
-func parseTrafficMetric(data string) (TrafficMetric, error) {
-	var trafficMetric TrafficMetric
-	result := metricRegexp.FindStringSubmatch(data)
-	if result == nil {
-		return trafficMetric, errors.New("Unexpected traffic metric")
+	resource, err := resourceAttributes()
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	rcvp, _ := strconv.ParseFloat(result[1], 64)
-	rcvb, _ := strconv.ParseFloat(result[2], 64)
-	sentp, _ := strconv.ParseFloat(result[3], 64)
-	sentb, _ := strconv.ParseFloat(result[4], 64)
+	if *clientSubnetIPv4Prefix < 0 || *clientSubnetIPv4Prefix > 32 || *clientSubnetIPv6Prefix < 0 || *clientSubnetIPv6Prefix > 128 {
+		log.Fatal("Invalid client subnet prefix length")
+	}
 
-	trafficMetric = TrafficMetric{rcvp, rcvb, sentp, sentb}
-	return trafficMetric, nil
-}
+	// also used by the top talkers without the per user metrics
+	userMode, err := collector.ParseUserLabelMode(*userLabelMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var labelMode collector.UserLabelMode
+	if *userLabel {
+		labelMode = userMode
+	}
 
-func watchTraffic(client *redis.Client) {
-	subscription := client.PSubscribe("turn/realm/*/user/*/allocation/*/*")
-	channel := subscription.Channel()
+	unit, err := collector.ParseRateUnit(*rateUnit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	packetRatePreset, err := collector.ParseBucketPreset(*packetRateBuckets)
+	if err != nil {
+		log.Fatal(err)
+	}
+	byteRatePreset, err := collector.ParseBucketPreset(*byteRateBuckets)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var quantiles []float64
+	if *rateQuantiles != "" {
+		if quantiles, err = collector.ParseQuantiles(*rateQuantiles); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	opts := collector.Options{
+		MaxPacketRate:          *maxPacketRate,
+		MaxByteRate:            *maxByteRate,
+		ClampSuspectSamples:    *clampSuspectSamples,
+		ReportInterval:         interval,
+		InferReportInterval:    *reportInterval == "auto",
+		Reconcile:              *reconcileInterval > 0 || *restartDeletionRatio > 0,
+		DropOrphans:            *dropOrphans,
+		StaleTimeout:           *staleTimeout,
+		LifetimeExpiry:         *lifetimeExpiry,
+		LifetimeGrace:          *lifetimeExpiryGrace,
+		RateIdleTimeout:        *rateIdleTimeout,
+		RemoveIdleRates:        *removeIdleRates,
+		EmptyRealmGracePeriod:  *emptyRealmGrace,
+		UserLabelMode:          labelMode,
+		UserLabelSalt:          stringOrEnv(*userLabelSalt, "USER_LABEL_SALT"),
+		UserLabelLength:        *userLabelLength,
+		ClientSubnets:          *clientSubnets,
+		OriginLabel:            *originLabel,
+		ClientSubnetIPv4Prefix: *clientSubnetIPv4Prefix,
+		ClientSubnetIPv6Prefix: *clientSubnetIPv6Prefix,
+		GeoMaxLabelValues:      *geoipMaxValues,
+		MaxSeriesPerRealm:      *maxSeriesPerRealm,
+		RateUnit:               unit,
+		PacketRateBuckets:      packetRatePreset,
+		ByteRateBuckets:        byteRatePreset,
+		RateQuantiles:          quantiles,
+		DailyPeaks:             *dailyPeaks,
+		RateWindowReports:      *rateWindowReports,
+		RateWindow:             *rateWindow,
+		PeakRateWindow:         *peakRateWindow,
+		AllocationRates:        *allocationRates,
+		RestartDeletionRatio:   *restartDeletionRatio,
+		TopTalkers:             *topTalkers,
+		TopTalkersHalfLife:     *topTalkersHalfLife,
+		TopTalkersLabelMode:    userMode,
+		RestartWindow:          *restartWindow,
+	}
+	// the loader to reconcile with is only set up later
+	restarts := exporter.NotifyRestarts(&opts)
+	if *dailyUsage {
+		if opts.DailyUsageLocation, err = time.LoadLocation(*dailyUsageTimezone); err != nil {
+			log.Fatal(err)
+		}
+		boundary, err := time.Parse("15:04", *dailyUsageBoundary)
+		if err != nil {
+			log.Fatalf("Invalid daily usage boundary %q, expected HH:MM", *dailyUsageBoundary)
+		}
+		opts.DailyUsageOffset = time.Duration(boundary.Hour())*time.Hour + time.Duration(boundary.Minute())*time.Minute
+	}
 
-	for {
-		msg := <-channel
+	// the commands that do not export metrics exit here, before any server,
+	// sink or background goroutine is started
+	runOneShotCommand(opts)
 
-		metadata, err := parseKeyName(msg.Channel)
+	go toggleLogLevelOnSignal()
+	go shutdownOnSignal(*shutdownTimeout)
+	registerRuntimeCollectors(*goCollector, *processCollector, *runtimeMetrics)
+
+	if *otlpEndpoint != "" {
+		tracer, err := tracing.New(*otlpEndpoint, resource, *traceSampleRatio)
 		if err != nil {
-			fmt.Println("Unexpected key name: ", msg.Channel)
-			continue
+			log.Fatal(err)
 		}
-		labels := prometheus.Labels{"realm": metadata.realm}
+		source.Tracer = tracer
+		go tracer.Run()
+		onShutdown("export spans", func() error {
+			tracer.Close()
+			return nil
+		})
+	}
 
-		if metadata.messageType == "traffic" {
-			trafficMetric, err := parseTrafficMetric(msg.Payload)
-			if err != nil {
-				fmt.Println("Unexpected traffic payload: ", msg.Payload)
-				continue
-			}
+	if *geoipCountryDB != "" {
+		db, err := geoip.Open(*geoipCountryDB)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go db.Watch(*geoipReloadTime)
+		opts.GeoCountries = db
+	}
+	if *geoipASNDB != "" {
+		db, err := geoip.Open(*geoipASNDB)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go db.Watch(*geoipReloadTime)
+		opts.GeoASNs = db
+	}
 
-			receivedPackets.With(labels).Add(trafficMetric.rcvp)
-			receivedBytes.With(labels).Add(trafficMetric.rcvb)
-			sentPackets.With(labels).Add(trafficMetric.sentp)
-			sentBytes.With(labels).Add(trafficMetric.sentb)
-
-			allocation := allocations[metadata.allocationName]
-			if allocation != nil {
-				now := time.Now()
-				elapsed := now.Sub(allocation.lastMetricTimestamp).Seconds()
-				rcvp_rate := trafficMetric.rcvp / elapsed
-				rcvb_rate := trafficMetric.rcvb / elapsed
-				sentp_rate := trafficMetric.sentp / elapsed
-				sentb_rate := trafficMetric.sentb / elapsed
-				rates := TrafficMetric{rcvp_rate, rcvb_rate, sentp_rate, sentb_rate}
-
-				if allocation.previousRates != nil {
-					receivedPacketRateHistogauge.Replace(labels, rcvp_rate, allocation.previousRates.rcvp)
-					receivedByteRateHistogauge.Replace(labels, rcvb_rate, allocation.previousRates.rcvb)
-					sentPacketRateHistogauge.Replace(labels, sentp_rate, allocation.previousRates.sentp)
-					sentByteRateHistogauge.Replace(labels, sentb_rate, allocation.previousRates.sentb)
-				} else {
-					receivedPacketRateHistogauge.Add(labels, rcvp_rate)
-					receivedByteRateHistogauge.Add(labels, rcvb_rate)
-					sentPacketRateHistogauge.Add(labels, sentp_rate)
-					sentByteRateHistogauge.Add(labels, sentb_rate)
-				}
-
-				allocations[metadata.allocationName] = &Allocation{&rates, time.Now()}
-			}
-		} else if metadata.messageType == "status" {
-			if strings.HasPrefix(msg.Payload, "new") {
-				allocationGauge.With(labels).Inc()
-				allocations[metadata.allocationName] = &Allocation{nil, time.Now()}
-			} else if msg.Payload == "deleted" {
-				allocationGauge.With(labels).Dec()
-				allocation := allocations[metadata.allocationName]
-				if allocation != nil {
-					if allocation.previousRates != nil {
-						receivedPacketRateHistogauge.Remove(labels, allocation.previousRates.rcvp)
-						receivedByteRateHistogauge.Remove(labels, allocation.previousRates.rcvb)
-						sentPacketRateHistogauge.Remove(labels, allocation.previousRates.sentp)
-						sentByteRateHistogauge.Remove(labels, allocation.previousRates.sentb)
-					}
-					delete(allocations, metadata.allocationName)
-				}
+	replayClock := &replayClock{}
+	if *replayFile != "" {
+		opts.Clock = replayClock
+	}
+	coll := exporter.NewCollector(exporter.Config{Options: opts})
+
+	// the collector is called inline so that its metrics follow the
+	// subscription, the other sinks get a queue each
+	bus := source.NewBus()
+	prometheus.MustRegister(bus)
+	bus.Subscribe("metrics", coll, 0)
+
+	if *grpcListenAddress != "" || *sseEvents {
+		broadcaster := eventstream.NewBroadcaster()
+		prometheus.MustRegister(broadcaster)
+		bus.Subscribe("eventstream", broadcaster, *sinkQueueSize)
+		if *grpcListenAddress != "" {
+			go serveGRPC(*grpcListenAddress, broadcaster)
+		}
+		if *sseEvents {
+			http.Handle("/events", eventstream.SSEHandler(broadcaster, coll.RealmTotals, *sseRateInterval))
+		}
+	}
+
+	if *kafkaBrokers != "" {
+		var tlsConfig *tls.Config
+		if *kafkaTLS {
+			var err error
+			if tlsConfig, err = loadTLSConfig(*kafkaTLSCAFile); err != nil {
+				log.Fatal(err)
 			}
 		}
+		producer := kafka.New(kafka.Config{
+			Brokers:       splitList(*kafkaBrokers),
+			Topic:         *kafkaTopic,
+			TLS:           tlsConfig,
+			SASLUser:      *kafkaSASLUser,
+			SASLPassword:  stringOrEnv(*kafkaSASLPassword, "KAFKA_SASL_PASSWORD"),
+			BatchSize:     *kafkaBatchSize,
+			FlushInterval: *kafkaFlushInterval,
+			QueueSize:     *kafkaQueueSize,
+		})
+		prometheus.MustRegister(producer)
+		bus.Subscribe("kafka", producer, *sinkQueueSize)
+		go producer.Run()
+		onShutdown("send Kafka events", func() error {
+			producer.Close()
+			return nil
+		})
 	}
-}
 
-func main() {
-	flag.Parse()
-	opt, err := redis.ParseURL(*redisUrl)
+	if url := stringOrEnv(*natsURL, "NATS_URL"); url != "" {
+		tlsConfig, err := loadTLSConfig(*natsTLSCAFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		publisher := nats.New(nats.Config{
+			URL:           url,
+			Subject:       *natsSubject,
+			TLS:           tlsConfig,
+			Stream:        *natsStream,
+			BatchSize:     *natsBatchSize,
+			FlushInterval: *natsFlushInterval,
+			QueueSize:     *natsQueueSize,
+		})
+		prometheus.MustRegister(publisher)
+		bus.Subscribe("nats", publisher, *sinkQueueSize)
+		go publisher.Run()
+		onShutdown("send NATS events", func() error {
+			publisher.Close()
+			return nil
+		})
+	}
+
+	var ledger *billing.Ledger
+	if *billingEnabled {
+		opt, err := parseRedisURL(*redisUrl)
+		if err != nil {
+			log.Fatal(err)
+		}
+		location, err := time.LoadLocation(*billingTimezone)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ledger = billing.New(billing.Config{
+			Client:   redis.NewClient(opt),
+			Key:      *billingRedisKey,
+			PerUser:  *billingPerUser,
+			Location: location,
+		})
+		prometheus.MustRegister(ledger)
+		// inline, a dropped event would be missing from the bills
+		bus.Subscribe("billing", ledger, 0)
+		go ledger.Run(*billingInterval)
+		onShutdown("write billing totals", ledger.Flush)
+	}
+
+	var eventHandler source.Handler = bus
+	if *maxEventRate > 0 {
+		limiter := source.NewRateLimiter(bus, *maxEventRate, *eventQueueSize)
+		prometheus.MustRegister(limiter)
+		limiter.Start()
+		eventHandler = limiter
+	}
+
+	var userFilter *source.UserFilter
+	if *excludeUsers != "" || *excludeUsersRegex != "" {
+		if userFilter, err = source.NewUserFilter(splitList(*excludeUsers), *excludeUsersRegex); err != nil {
+			log.Fatal(err)
+		}
+		prometheus.MustRegister(userFilter)
+		// in front of the rate limit so that excluded users do not use it up
+		eventHandler = userFilter.Handler(eventHandler)
+	}
+	eventHandler = injectFaults(eventHandler)
+
+	if *replayFile != "" {
+		prometheus.MustRegister(coll, source.ParseDuration, source.UnknownFields, source.ParseFailures)
+		fmt.Println("Replaying", *replayFile)
+		go func() {
+			if err := (&replaySource{*replayFile, *replaySpeed, replayClock}).Run(eventHandler); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println("Replay finished")
+		}()
+
+		registerHealthHandlers(nil)
+		handleMetrics(metricsHandler(gatherer, coll))
+		log.Fatal(listenAndServe(*listenAddress))
+	}
+
+	if *multiTarget {
+		targets := newTargetWatchers(exporter.Config{
+			Options:             opts,
+			ReconcileInterval:   *reconcileInterval,
+			ChannelSize:         *pubsubChannelSize,
+			HealthCheckInterval: *pubsubHealthCheck,
+			UserFilter:          userFilter,
+			TuneRedis:           tuneRedisOptions,
+		}, *multiTargetIdleTimeout, *multiTargetMax, splitList(*aggregateRealms))
+		// shared by all targets, so they are only on the default registry
+		prometheus.MustRegister(targets, source.ParseDuration, source.UnknownFields, source.ParseFailures, redissource.Errors)
+		go targets.Run()
+
+		fmt.Println("Watching the scraped targets")
+		registerHealthHandlers(nil)
+		handleMetrics(targets.Handler(metricsHandler(prometheus.DefaultGatherer, nil)))
+		log.Fatal(listenAndServe(*listenAddress))
+	}
+
+	opt, err := parseRedisURL(*redisUrl)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
 	client := redis.NewClient(opt)
 
+	// key scans go to the replica if there is one, the subscription and
+	// writes stay on the primary
+	scanOpt := opt
+	scanClient := client
+	if *redisReplicaUrl != "" {
+		scanOpt, err = parseRedisURL(*redisReplicaUrl)
+		if err != nil {
+			log.Fatal(err)
+		}
+		scanClient = redis.NewClient(scanOpt)
+	}
+
+	var dbClients []dbClient
+	if *redisDBs != "" {
+		dbClients, err = newDBClients(scanOpt, splitList(*redisDBs))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *tlsCertFiles != "" || *tlsProbeAddresses != "" {
+		prometheus.MustRegister(probe.NewCertCollector(splitList(*tlsCertFiles), splitList(*tlsProbeAddresses), *tlsProbeTimeout))
+	}
+
+	if *stunProbeTargets != "" {
+		prober := probe.NewSTUNProber(splitList(*stunProbeTargets), *stunProbeTimeout)
+		prometheus.MustRegister(prober)
+		go prober.Run(*stunProbeInterval)
+	}
+
+	var telnetClient *telnet.Client
+	if *telnetAddress != "" {
+		telnetClient = &telnet.Client{
+			Address:  *telnetAddress,
+			Password: stringOrEnv(*telnetPassword, "TELNET_PASSWORD"),
+			Timeout:  *telnetTimeout,
+		}
+		if userFilter != nil {
+			telnetClient.Exclude = userFilter.Excluded
+		}
+		prometheus.MustRegister(telnet.NewCollector(telnetClient))
+		if *telnetInfoCommand != "" {
+			prometheus.MustRegister(telnet.NewInfoCollector(telnetClient, *telnetInfoCommand))
+		}
+	}
+
+	prometheus.MustRegister(redissource.Errors)
+
+	switch *mode {
+	case "subscribe":
+		prometheus.MustRegister(coll, source.ParseDuration, source.UnknownFields, source.ParseFailures)
+	case "pull":
+		fmt.Println("Collecting allocations at scrape time")
+		if dbClients == nil {
+			prometheus.MustRegister(redissource.NewPullCollector(scanClient))
+		}
+		for _, c := range dbClients {
+			c.registerer().MustRegister(redissource.NewPullCollector(c.client))
+		}
+		registerHealthHandlers(nil)
+		handleMetrics(metricsHandler(gatherer, nil))
+		log.Fatal(listenAndServe(*listenAddress))
+	default:
+		log.Fatalf("Unknown mode %q, expected subscribe or pull", *mode)
+	}
+
+	var store stateStore
+	if *stateFile != "" {
+		store = fileStateStore(*stateFile)
+	} else if *stateRedisKey != "" {
+		store = &redisStateStore{client, *stateRedisKey}
+	}
+
+	var restored *collector.Snapshot
+	if store != nil {
+		restored, err = store.Load()
+		if err != nil {
+			fmt.Println("Unable to load state: ", err)
+		} else if restored != nil {
+			fmt.Println("Restoring state from", restored.Time)
+			coll.RestoreCounters(restored)
+		}
+	}
+
+	src := redissource.New(client)
+	src.ChannelSize = *pubsubChannelSize
+	src.HealthCheckInterval = *pubsubHealthCheck
+	src.LagProbeInterval = *pubsubLagProbe
+	src.LoadTraffic = *seedRates
+	src.RealmDiscoveryInterval = *pubsubRealms
+	prometheus.MustRegister(src)
+
+	watchdog := newSubscriptionWatchdog(src, coll, *watchdogTimeout)
+	prometheus.MustRegister(watchdog)
+	registerHealthHandlers(watchdog.Ready)
+
+	// pubsub is not scoped to a database, so a single subscription covers
+	// all of them while the keys are read from each one
+	var loader source.Loader = src
+	if scanClient != client {
+		scanSrc := redissource.New(scanClient)
+		scanSrc.LoadTraffic = *seedRates
+		loader = scanSrc
+	}
+	if dbClients != nil {
+		loaders := make(source.MultiLoader, 0, len(dbClients))
+		for _, c := range dbClients {
+			dbSrc := redissource.New(c.client)
+			dbSrc.LoadTraffic = *seedRates
+			loaders = append(loaders, dbSrc)
+		}
+		loader = loaders
+	}
+	if userFilter != nil {
+		loader = userFilter.Loader(loader)
+	}
+
+	if *statsdbTotals {
+		if dbClients == nil {
+			totals := redissource.NewTotalsCollector(scanClient)
+			if err := totals.Load(); err != nil {
+				panic(err)
+			}
+			prometheus.MustRegister(totals)
+		}
+		for _, c := range dbClients {
+			totals := redissource.NewTotalsCollector(c.client)
+			if err := totals.Load(); err != nil {
+				panic(err)
+			}
+			c.registerer().MustRegister(totals)
+		}
+	}
+
 	// initialize allocation gauge
 	fmt.Println("Initializing allocation count")
-	keys, err := client.Keys("turn/realm/*/user/*/allocation/*/status").Result()
-	if err != nil {
+	if err := exporter.LoadAllocations(loader, coll); err != nil {
 		panic(err)
 	}
-	for _, key := range keys {
-		metadata, err := parseKeyName(key)
+	if restored != nil {
+		coll.RestoreRates(restored)
+	}
+
+	var rec *recorder
+	if *recordFile != "" {
+		rec, err = newRecorder(*recordFile)
 		if err != nil {
-			fmt.Println("Unexpected key name: ", key)
-			continue
+			panic(err)
 		}
-		allocationGauge.With(prometheus.Labels{"realm": metadata.realm}).Inc()
-		allocations[metadata.allocationName] = &Allocation{nil, time.Now()}
+		fmt.Println("Recording messages to", *recordFile)
 	}
 
 	// watch for pubsub traffic events
 	fmt.Println("Watching traffic")
-	go watchTraffic(client)
+	if rec != nil {
+		src.OnMessage = func(channel string, payload string) {
+			if err := rec.Record(channel, payload); err != nil {
+				fmt.Println("Unable to record message: ", err)
+			}
+		}
+	}
+	if *reconcileInterval > 0 {
+		src.OnResubscribe = exporter.ReconcileOnResubscribe(loader, coll)
+	}
+	go exporter.ReconcileOnRestart(context.Background(), restarts, loader, coll)
+	go src.Run(eventHandler)
+	watchdog.Loaded()
+	if *watchdogTimeout > 0 {
+		go watchdog.Run()
+	}
+
+	quotas := &quotaLoader{
+		admin:        telnetClient,
+		adminCommand: *telnetInfoCommand,
+		defaults:     collector.Quota{MaxBPS: *defaultMaxBPS, UserQuota: *defaultUserQuota, TotalQuota: *defaultTotalQuota},
+	}
+	if *userdbURL != "" {
+		if !*userLabel && !*restSecrets {
+			log.Fatal("-userdb-url requires -user-label or -rest-secrets")
+		}
+		userdbOpt, err := parseRedisURL(*userdbURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		quotas.userdb = redis.NewClient(userdbOpt)
+	}
+	if *restSecrets || *restSecretFile != "" {
+		if *restSecrets && quotas.userdb == nil {
+			log.Fatal("-rest-secrets requires -userdb-url")
+		}
+		var userdb *redis.Client
+		if *restSecrets {
+			userdb = quotas.userdb
+		}
+		secrets := newRestSecretWatcher(userdb, *restSecretSeenKey, *restSecretFile)
+		prometheus.MustRegister(secrets)
+		go secrets.Run(*restSecretInterval)
+	}
+	if quotas.userdb != nil || quotas.admin != nil || quotas.defaults != (collector.Quota{}) {
+		realmQuotas, fallback, err := quotas.load()
+		if err != nil {
+			log.Fatal(err)
+		}
+		coll.SetQuotas(realmQuotas, fallback)
+		go refreshQuotas(quotas, coll, *userdbInterval)
+	}
+
+	go exporter.Maintain(context.Background(), loader, coll, opts, *reconcileInterval)
 
-	http.Handle("/metrics", promhttp.Handler())
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+	if store != nil {
+		go checkpointState(store, coll, *stateInterval)
+		onShutdown("save state", func() error {
+			fmt.Println("Saving state")
+			return store.Save(coll.Snapshot())
+		})
+	}
+
+	if *webhookURL != "" {
+		thresholds := webhookThresholds{*webhookAllocationsThreshold, *webhookByteRateThreshold}
+		go newWebhookNotifier(coll, *webhookURL, thresholds, *webhookDebounce).Run(*webhookInterval)
+	}
+
+	if *emfOutput != "" {
+		emfSink, err := emf.New(*emfNamespace, *emfOutput, *emfMaxRate)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go sink.Run("EMF", "coturn_", *emfInterval, emfSink.Push)
+	}
+
+	if *dogstatsdAddress != "" {
+		dogstatsdSink, err := dogstatsd.New(*dogstatsdAddress, splitList(*dogstatsdTags))
+		if err != nil {
+			log.Fatal(err)
+		}
+		go sink.Run("DogStatsD", "coturn_", *dogstatsdInterval, dogstatsdSink.Push)
+	}
+
+	if *vmURL != "" {
+		extraLabels, err := parseLabels(*vmExtraLabels)
+		if err != nil {
+			log.Fatal(err)
+		}
+		vmSink, err := vmimport.New(*vmURL, extraLabels, prometheus.DefaultGatherer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *vmUsername != "" {
+			vmSink.SetBasicAuth(*vmUsername, stringOrEnv(*vmPassword, "VM_PASSWORD"))
+		}
+		if token := stringOrEnv(*vmBearerToken, "VM_BEARER_TOKEN"); token != "" {
+			vmSink.SetBearerToken(token)
+		}
+		go sink.Every("VictoriaMetrics", *vmInterval, vmSink.Push)
+	}
+
+	if *grafanaCloudURL != "" {
+		labels, err := parseLabels(*grafanaCloudLabels)
+		if err != nil {
+			log.Fatal(err)
+		}
+		apiKey := stringOrEnv(*grafanaCloudAPIKey, "GRAFANA_CLOUD_API_KEY")
+		if *grafanaCloudAPIKeyFile != "" {
+			data, err := ioutil.ReadFile(*grafanaCloudAPIKeyFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			apiKey = strings.TrimSpace(string(data))
+		}
+		rwSink, err := remotewrite.New(*grafanaCloudURL, labels, prometheus.DefaultGatherer, *grafanaCloudBuffer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *grafanaCloudUser != "" {
+			rwSink.SetBasicAuth(*grafanaCloudUser, apiKey)
+		}
+		rwSink.SetResource(resource)
+		go sink.Every("Grafana Cloud", *grafanaCloudInterval, rwSink.Push)
+	}
+
+	if *snmpListenAddress != "" {
+		base, err := snmp.ParseOID(*snmpBaseOID)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Fatal(serveSNMP(*snmpListenAddress, *snmpCommunity, base, coll))
+		}()
+	}
+
+	if *adminToken != "" {
+		registerAdminHandlers(loader, coll, *adminToken)
+		registerConfigHandler(*adminToken)
+		registerLogLevelHandler(*adminToken)
+		registerParseFailureHandler(*adminToken)
+	}
+	if *apiToken != "" {
+		registerAPIHandlers(coll, *apiToken)
+		if ledger != nil {
+			registerBillingHandler(ledger, *apiToken)
+		}
+	}
+
+	handleMetrics(metricsHandler(gatherer, coll))
+	log.Fatal(listenAndServe(*listenAddress))
+}
+
+// loadTLSConfig returns a client TLS configuration trusting the
+// certificates in caFile, or the system ones if caFile is empty.
+func loadTLSConfig(caFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if caFile == "" {
+		return config, nil
+	}
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	config.RootCAs = x509.NewCertPool()
+	if !config.RootCAs.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return config, nil
+}
+
+// stringOrEnv returns value, or the environment variable name when value is
+// empty, so that secrets need not show up in the process list.
+func stringOrEnv(value string, name string) string {
+	if value != "" {
+		return value
+	}
+	return os.Getenv(name)
+}
+
+type dbClient struct {
+	db     string
+	client *redis.Client
+}
+
+// parseRedisURL parses a redis URL and applies the connection tuning flags.
+func parseRedisURL(url string) (*redis.Options, error) {
+	opt, err := exporter.ParseRedisURL(url)
+	if err != nil {
+		return nil, err
+	}
+	tuneRedisOptions(opt)
+	return opt, nil
+}
+
+// tuneRedisOptions applies the connection tuning flags to opt. Flags left
+// at zero keep the client defaults.
+func tuneRedisOptions(opt *redis.Options) {
+	if *redisDialTimeout != 0 {
+		opt.DialTimeout = *redisDialTimeout
+	}
+	if *redisReadTimeout != 0 {
+		opt.ReadTimeout = *redisReadTimeout
+	}
+	if *redisWriteTimeout != 0 {
+		opt.WriteTimeout = *redisWriteTimeout
+	}
+	if *redisPoolSize != 0 {
+		opt.PoolSize = *redisPoolSize
+	}
+	if *redisMinIdleConns != 0 {
+		opt.MinIdleConns = *redisMinIdleConns
+	}
+	injectRedisFaults(opt)
+}
+
+// newDBClients returns a client for each of the database indexes, connected
+// to the server of opt.
+func newDBClients(opt *redis.Options, dbs []string) ([]dbClient, error) {
+	clients := make([]dbClient, 0, len(dbs))
+	for _, db := range dbs {
+		index, err := strconv.Atoi(db)
+		if err != nil || index < 0 {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+		dbOpt := *opt
+		dbOpt.DB = index
+		clients = append(clients, dbClient{db, redis.NewClient(&dbOpt)})
+	}
+	return clients, nil
+}
+
+// registerer registers collectors with a db label.
+func (c dbClient) registerer() prometheus.Registerer {
+	return prometheus.WrapRegistererWith(prometheus.Labels{"db": c.db}, prometheus.DefaultRegisterer)
+}
+
+func loadRealmMapping(path string) (*parser.RealmMapping, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var mapping parser.RealmMapping
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return nil, fmt.Errorf("invalid realm config %s: %v", path, err)
+	}
+	return &mapping, nil
+}
+
+// splitList splits a comma separated flag value, returning nil for an empty
+// value.
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// parseLabels parses a comma separated list of name=value labels.
+func parseLabels(value string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, label := range splitList(value) {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid label %q, expected name=value", label)
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
 }
@@ -0,0 +1,188 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iknow/coturn_exporter/exporter"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// targetWatchers subscribes to the statsdb passed in the target query
+// parameter on the first scrape, and keeps watching it until it has not
+// been scraped for idleTimeout.
+type targetWatchers struct {
+	config      exporter.Config
+	idleTimeout time.Duration
+	maxTargets  int
+	aggregate   []string
+
+	lock     sync.Mutex
+	watchers map[string]*targetWatcher
+}
+
+type targetWatcher struct {
+	// addr is logged instead of the URL, which may contain a password
+	addr       string
+	handler    http.Handler
+	cancel     context.CancelFunc
+	lastScrape time.Time
+}
+
+func newTargetWatchers(config exporter.Config, idleTimeout time.Duration, maxTargets int, aggregate []string) *targetWatchers {
+	return &targetWatchers{
+		config:      config,
+		idleTimeout: idleTimeout,
+		maxTargets:  maxTargets,
+		aggregate:   aggregate,
+		watchers:    make(map[string]*targetWatcher),
+	}
+}
+
+// Handler serves the metrics of the target in the query, and the ones of
+// fallback if there is none.
+func (t *targetWatchers) Handler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		handler, status, err := t.get(target)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// targetURL accepts a redis URL or a bare host:port like the other
+// multi-target exporters.
+func targetURL(target string) string {
+	if strings.Contains(target, "://") {
+		return target
+	}
+	return "redis://" + target
+}
+
+func (t *targetWatchers) get(target string) (http.Handler, int, error) {
+	url := targetURL(target)
+	opt, err := exporter.ParseRedisURL(url)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if w, ok := t.watchers[url]; ok {
+		w.lastScrape = time.Now()
+		return w.handler, 0, nil
+	}
+	if t.maxTargets > 0 && len(t.watchers) >= t.maxTargets {
+		return nil, http.StatusServiceUnavailable, fmt.Errorf("already watching %d targets", len(t.watchers))
+	}
+
+	registry := prometheus.NewRegistry()
+	config := t.config
+	config.RedisURL = url
+	config.Registerer = registry
+	// the restarts of a target are reconciled by its own Run
+	config.Restarts = exporter.NotifyRestarts(&config.Options)
+	config.Collector = exporter.NewCollector(config)
+
+	var gatherer prometheus.Gatherer = registry
+	if t.aggregate != nil {
+		gatherer = newRealmAggregator(gatherer, t.aggregate)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &targetWatcher{
+		addr:       opt.Addr,
+		handler:    metricsHandler(gatherer, config.Collector),
+		cancel:     cancel,
+		lastScrape: time.Now(),
+	}
+	t.watchers[url] = w
+
+	fmt.Println("Watching target", w.addr)
+	go func() {
+		if err := exporter.Run(ctx, config); err != nil {
+			fmt.Println("Unable to watch target "+w.addr+": ", err)
+		}
+		t.remove(url, w)
+	}()
+	return w.handler, 0, nil
+}
+
+func (t *targetWatchers) remove(url string, w *targetWatcher) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.watchers[url] == w {
+		delete(t.watchers, url)
+	}
+	w.cancel()
+}
+
+// Run stops watching the targets that are no longer scraped.
+func (t *targetWatchers) Run() {
+	ticker := time.NewTicker(t.idleTimeout / 4)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		t.lock.Lock()
+		for url, w := range t.watchers {
+			if now.Sub(w.lastScrape) > t.idleTimeout {
+				fmt.Println("Target no longer scraped, unsubscribing:", w.addr)
+				delete(t.watchers, url)
+				w.cancel()
+			}
+		}
+		t.lock.Unlock()
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (t *targetWatchers) Describe(ch chan<- *prometheus.Desc) {
+	ch <- targetsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (t *targetWatchers) Collect(ch chan<- prometheus.Metric) {
+	t.lock.Lock()
+	count := len(t.watchers)
+	t.lock.Unlock()
+	ch <- prometheus.MustNewConstMetric(targetsDesc, prometheus.GaugeValue, float64(count))
+}
+
+var targetsDesc = prometheus.NewDesc(
+	"coturn_exporter_targets",
+	"Number of statsdb targets currently watched in multi-target mode",
+	nil, nil,
+)
@@ -0,0 +1,183 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+// The vendored client_golang predates exemplar support, so exemplars are
+// kept by the collector and only written by our own OpenMetrics encoder, which is used
+// when the scraper asks for application/openmetrics-text. Exemplars are only
+// valid on counters and histograms in OpenMetrics, so the histogauges, which
+// are exposed as gauges, cannot carry any.
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/iknow/coturn_exporter/collector"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const openMetricsContentType = "application/openmetrics-text; version=0.0.1; charset=utf-8"
+
+func lookupExemplar(coll *collector.Collector, metricName string, labels []*dto.LabelPair) (collector.Exemplar, bool) {
+	if coll == nil {
+		return collector.Exemplar{}, false
+	}
+	for _, label := range labels {
+		if label.GetName() == "realm" {
+			return coll.Exemplar(metricName, label.GetValue())
+		}
+	}
+	return collector.Exemplar{}, false
+}
+
+// metricsHandler serves OpenMetrics with exemplars to scrapers that accept it
+// and falls back to the regular client_golang handler otherwise, compressed
+// at -metrics-gzip-level either way.
+func metricsHandler(gatherer prometheus.Gatherer, coll *collector.Collector) http.Handler {
+	fallback := promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+		DisableCompression: true,
+	}))
+	return withGzip(*metricsGzipLevel, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text") {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+
+		families, err := gatherer.Gather()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", openMetricsContentType)
+		writeOpenMetrics(w, families, coll)
+	}))
+}
+
+func writeOpenMetrics(w http.ResponseWriter, families []*dto.MetricFamily, coll *collector.Collector) {
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	for _, family := range families {
+		name := family.GetName()
+		familyName := name
+		typ := "unknown"
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			typ = "counter"
+			familyName = strings.TrimSuffix(name, "_total")
+		case dto.MetricType_GAUGE:
+			typ = "gauge"
+		case dto.MetricType_SUMMARY:
+			typ = "summary"
+		case dto.MetricType_HISTOGRAM:
+			typ = "histogram"
+		}
+
+		fmt.Fprintf(out, "# HELP %s %s\n", familyName, escapeOpenMetrics(family.GetHelp()))
+		fmt.Fprintf(out, "# TYPE %s %s\n", familyName, typ)
+
+		for _, m := range family.GetMetric() {
+			labels := m.GetLabel()
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				writeSample(out, familyName+"_total", labels, "", "", m.GetCounter().GetValue())
+				if e, ok := lookupExemplar(coll, name, labels); ok {
+					fmt.Fprintf(out, " # {allocation=\"%s\",user_hash=\"%s\"} %s %s",
+						escapeOpenMetrics(e.Allocation), e.UserHash, formatFloat(e.Value),
+						strconv.FormatFloat(float64(e.Timestamp.UnixNano())/1e9, 'f', 3, 64))
+				}
+				out.WriteString("\n")
+			case dto.MetricType_GAUGE:
+				writeSample(out, name, labels, "", "", m.GetGauge().GetValue())
+				out.WriteString("\n")
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					writeSample(out, name, labels, "quantile", formatFloat(q.GetQuantile()), q.GetValue())
+					out.WriteString("\n")
+				}
+				writeSample(out, name+"_sum", labels, "", "", s.GetSampleSum())
+				out.WriteString("\n")
+				writeSample(out, name+"_count", labels, "", "", float64(s.GetSampleCount()))
+				out.WriteString("\n")
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					writeSample(out, name+"_bucket", labels, "le", formatFloat(b.GetUpperBound()), float64(b.GetCumulativeCount()))
+					out.WriteString("\n")
+				}
+				writeSample(out, name+"_bucket", labels, "le", "+Inf", float64(h.GetSampleCount()))
+				out.WriteString("\n")
+				writeSample(out, name+"_sum", labels, "", "", h.GetSampleSum())
+				out.WriteString("\n")
+				writeSample(out, name+"_count", labels, "", "", float64(h.GetSampleCount()))
+				out.WriteString("\n")
+			default:
+				writeSample(out, name, labels, "", "", m.GetUntyped().GetValue())
+				out.WriteString("\n")
+			}
+		}
+	}
+	out.WriteString("# EOF\n")
+}
+
+func writeSample(out *bufio.Writer, name string, labels []*dto.LabelPair, extraName string, extraValue string, value float64) {
+	pairs := make([]string, 0, len(labels)+1)
+	for _, label := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", label.GetName(), escapeOpenMetrics(label.GetValue())))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extraName, extraValue))
+	}
+	sort.Strings(pairs)
+
+	out.WriteString(name)
+	if len(pairs) > 0 {
+		out.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	out.WriteString(" " + formatFloat(value))
+}
+
+var openMetricsEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeOpenMetrics(s string) string {
+	return openMetricsEscaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
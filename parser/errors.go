@@ -0,0 +1,73 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package parser
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The reasons a key or payload is rejected, wrapped by KeyError and
+// PayloadError.
+var (
+	ErrKeyFormat      = errors.New("key does not match the key schema")
+	ErrMessageType    = errors.New("unexpected message type")
+	ErrPayloadFormat  = errors.New("unexpected traffic payload")
+	ErrMalformedField = errors.New("field is not key=value")
+	ErrInvalidValue   = errors.New("value is not an integer")
+	ErrUnknownField   = errors.New("unknown field")
+	ErrDuplicateField = errors.New("duplicate field")
+	ErrMissingField   = errors.New("missing field")
+)
+
+// KeyError is returned for keys and channels that cannot be parsed.
+type KeyError struct {
+	Key string
+	Err error
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("invalid key %q: %v", e.Key, e.Err)
+}
+
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// PayloadError is returned for traffic payloads that cannot be parsed.
+// Field is the offending field, empty if the error concerns the whole
+// payload.
+type PayloadError struct {
+	Payload string
+	Field   string
+	Err     error
+}
+
+func (e *PayloadError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("invalid traffic payload %q: %v", e.Payload, e.Err)
+	}
+	return fmt.Sprintf("invalid traffic payload %q: %v: %s", e.Payload, e.Err, e.Field)
+}
+
+func (e *PayloadError) Unwrap() error {
+	return e.Err
+}
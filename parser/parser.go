@@ -0,0 +1,98 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package parser parses the keys and payloads that coturn writes to and
+// publishes on its redis statsdb.
+package parser
+
+// The key patterns of stock coturn. Use ChannelPattern, StatusPattern and
+// TotalTrafficPattern to get the patterns of the configured KeySchema.
+const (
+	// StatusKeyPattern matches the status key of every allocation.
+	StatusKeyPattern = "turn/realm/*/user/*/allocation/*/status"
+	// TotalTrafficKeyPattern matches the keys holding the cumulative traffic
+	// of every allocation.
+	TotalTrafficKeyPattern = "turn/realm/*/user/*/allocation/*/total_traffic"
+	// ChannelKeyPattern matches every channel coturn publishes to.
+	ChannelKeyPattern = "turn/realm/*/user/*/allocation/*/*"
+)
+
+// The message types coturn writes below an allocation key.
+const (
+	// MessageStatus is the allocation status: new, refreshed or deleted.
+	MessageStatus = "status"
+	// MessageTraffic is the client traffic since the previous report.
+	MessageTraffic = "traffic"
+	// MessagePeerTraffic is the peer traffic since the previous report.
+	MessagePeerTraffic = "traffic/peer"
+	// MessageTotalTraffic is the client traffic over the whole lifetime of
+	// the allocation, published when it is deleted.
+	MessageTotalTraffic = "total_traffic"
+	// MessageTotalPeerTraffic is the peer traffic over the whole lifetime
+	// of the allocation, published when it is deleted.
+	MessageTotalPeerTraffic = "total_traffic/peer"
+)
+
+// MessageMetadata is the information encoded in a statsdb key name. The realm
+// has the realm mapping applied, AllocationName is left as is.
+type MessageMetadata struct {
+	Realm        string
+	User         string
+	AllocationID string
+	// Origin is the origin of a multi-tenant deployment if the key schema
+	// has an origin group, empty otherwise.
+	Origin string
+	// AllocationName is the key prefix shared by all keys of an allocation.
+	AllocationName string
+	MessageType    string
+}
+
+// TrafficMetric holds packet and byte counts, either as reported by coturn
+// or as rates derived from them.
+type TrafficMetric struct {
+	Rcvp  float64 `json:"rcvp"`
+	Rcvb  float64 `json:"rcvb"`
+	Sentp float64 `json:"sentp"`
+	Sentb float64 `json:"sentb"`
+}
+
+// ParseKeyName parses a statsdb key or channel name. Errors are *KeyError.
+func ParseKeyName(key string) (MessageMetadata, error) {
+	metadata, ok := parseKey(key)
+	if !ok {
+		return MessageMetadata{}, &KeyError{Key: key, Err: ErrKeyFormat}
+	}
+
+	switch metadata.MessageType {
+	case MessageStatus, MessageTraffic, MessagePeerTraffic, MessageTotalTraffic, MessageTotalPeerTraffic:
+	default:
+		return MessageMetadata{}, &KeyError{Key: key, Err: ErrMessageType}
+	}
+
+	metadata.Realm = MapRealm(metadata.Realm)
+	return metadata, nil
+}
+
+// ParseTrafficMetric parses a traffic payload in Lenient mode, ignoring
+// unknown fields. Errors are *PayloadError.
+func ParseTrafficMetric(data string) (TrafficMetric, error) {
+	trafficMetric, _, err := ParseTrafficFields(data, Lenient)
+	return trafficMetric, err
+}
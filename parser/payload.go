@@ -0,0 +1,145 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Mode selects how ParseTrafficFields treats payloads that deviate from the
+// fields of stock coturn.
+type Mode int
+
+const (
+	// Strict rejects payloads with unknown, duplicate, malformed or missing
+	// fields.
+	Strict Mode = iota
+	// Lenient extracts the traffic fields it can parse and skips the rest.
+	// Missing fields are zero, and only payloads without any traffic field
+	// are rejected.
+	Lenient
+)
+
+// ParseMode returns the Mode named strict or lenient.
+func ParseMode(name string) (Mode, error) {
+	switch name {
+	case "strict":
+		return Strict, nil
+	case "lenient":
+		return Lenient, nil
+	}
+	return Lenient, fmt.Errorf("invalid payload mode %q, expected strict or lenient", name)
+}
+
+// trafficFields are the payload field names in the order of the
+// TrafficMetric fields.
+var trafficFields = [...]string{"rcvp", "rcvb", "sentp", "sentb"}
+
+// field returns the TrafficMetric field of a payload field name and its
+// index in trafficFields, or nil and -1 for names that are not traffic
+// fields.
+func (t *TrafficMetric) field(name string) (*float64, int) {
+	switch name {
+	case "rcvp":
+		return &t.Rcvp, 0
+	case "rcvb":
+		return &t.Rcvb, 1
+	case "sentp":
+		return &t.Sentp, 2
+	case "sentb":
+		return &t.Sentb, 3
+	}
+	return nil, -1
+}
+
+// ParseTrafficFields parses a traffic payload as comma separated key=value
+// fields in any order, e.g. "rcvp=10, rcvb=1000, sentp=5, sentb=500". It
+// returns the names of the fields that are not traffic fields, which are
+// only accepted in Lenient mode. Errors are *PayloadError.
+//
+// It runs for every traffic report and does not allocate unless the payload
+// has unknown fields or is rejected.
+func ParseTrafficFields(data string, mode Mode) (TrafficMetric, []string, error) {
+	var metric TrafficMetric
+	var unknown []string
+	// bit i is set once trafficFields[i] has been parsed
+	var seen uint
+	fail := func(field string, err error) (TrafficMetric, []string, error) {
+		return TrafficMetric{}, nil, &PayloadError{Payload: data, Field: field, Err: err}
+	}
+
+	for rest, more := data, true; more; {
+		var field string
+		field, rest, more = strings.Cut(rest, ",")
+		field = strings.TrimSpace(field)
+		if field == "" && mode == Lenient {
+			continue
+		}
+		name, value, ok := strings.Cut(field, "=")
+		if !ok {
+			if mode == Strict {
+				return fail(field, ErrMalformedField)
+			}
+			continue
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+
+		target, i := metric.field(name)
+		if target == nil {
+			if mode == Strict {
+				return fail(name, ErrUnknownField)
+			}
+			unknown = append(unknown, name)
+			continue
+		}
+		if seen&(1<<i) != 0 {
+			if mode == Strict {
+				return fail(name, ErrDuplicateField)
+			}
+			continue
+		}
+		// negative values are accepted so that they can be reported as
+		// suspect samples instead of unparseable payloads
+		number, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			if mode == Strict {
+				return fail(name, ErrInvalidValue)
+			}
+			continue
+		}
+		*target = float64(number)
+		seen |= 1 << i
+	}
+
+	if seen == 0 {
+		return fail("", ErrPayloadFormat)
+	}
+	if mode == Strict {
+		for i, name := range trafficFields {
+			if seen&(1<<i) == 0 {
+				return fail(name, ErrMissingField)
+			}
+		}
+	}
+	return metric, unknown, nil
+}
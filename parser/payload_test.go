@@ -0,0 +1,127 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package parser_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/iknow/coturn_exporter/parser"
+)
+
+const stockPayload = "rcvp=10, rcvb=1000, sentp=5, sentb=500"
+
+func TestParseTrafficFields(t *testing.T) {
+	stock := parser.TrafficMetric{Rcvp: 10, Rcvb: 1000, Sentp: 5, Sentb: 500}
+	tests := []struct {
+		name    string
+		payload string
+		mode    parser.Mode
+		want    parser.TrafficMetric
+		unknown []string
+		err     error
+		field   string
+	}{
+		{name: "stock", payload: stockPayload, mode: parser.Strict, want: stock},
+		{name: "reordered", payload: "sentb=500,rcvp=10,sentp=5,rcvb=1000", mode: parser.Strict, want: stock},
+		{name: "spaces around values", payload: " rcvp = 10 ,rcvb=1000,  sentp=5 , sentb=500 ", mode: parser.Strict, want: stock},
+		{name: "negative", payload: "rcvp=-1, rcvb=0, sentp=0, sentb=0", mode: parser.Strict, want: parser.TrafficMetric{Rcvp: -1}},
+		{name: "unknown field", payload: stockPayload + ", lost=2", mode: parser.Strict, err: parser.ErrUnknownField, field: "lost"},
+		{name: "duplicate field", payload: stockPayload + ", rcvp=11", mode: parser.Strict, err: parser.ErrDuplicateField, field: "rcvp"},
+		{name: "malformed field", payload: "rcvp=10, rcvb, sentp=5, sentb=500", mode: parser.Strict, err: parser.ErrMalformedField, field: "rcvb"},
+		{name: "invalid value", payload: "rcvp=10, rcvb=1e3, sentp=5, sentb=500", mode: parser.Strict, err: parser.ErrInvalidValue, field: "rcvb"},
+		{name: "missing field", payload: "rcvp=10, rcvb=1000, sentp=5", mode: parser.Strict, err: parser.ErrMissingField, field: "sentb"},
+		{name: "trailing comma", payload: stockPayload + ",", mode: parser.Strict, err: parser.ErrMalformedField},
+		{name: "empty", payload: "", mode: parser.Strict, err: parser.ErrMalformedField},
+
+		{name: "stock", payload: stockPayload, mode: parser.Lenient, want: stock},
+		{name: "unknown fields", payload: "lost=2, " + stockPayload + ", jitter=3", mode: parser.Lenient, want: stock, unknown: []string{"lost", "jitter"}},
+		{name: "first duplicate wins", payload: stockPayload + ", rcvp=11", mode: parser.Lenient, want: stock},
+		{name: "malformed and invalid skipped", payload: "rcvp=10, rcvb, sentp=x, sentb=500", mode: parser.Lenient, want: parser.TrafficMetric{Rcvp: 10, Sentb: 500}},
+		{name: "missing fields are zero", payload: "sentb=500", mode: parser.Lenient, want: parser.TrafficMetric{Sentb: 500}},
+		{name: "empty fields", payload: ",rcvp=10,, sentb=500,", mode: parser.Lenient, want: parser.TrafficMetric{Rcvp: 10, Sentb: 500}},
+		{name: "no traffic field", payload: "lost=2", mode: parser.Lenient, err: parser.ErrPayloadFormat},
+		{name: "empty", payload: "", mode: parser.Lenient, err: parser.ErrPayloadFormat},
+	}
+	for _, tt := range tests {
+		mode := "strict"
+		if tt.mode == parser.Lenient {
+			mode = "lenient"
+		}
+		t.Run(mode+"/"+tt.name, func(t *testing.T) {
+			got, unknown, err := parser.ParseTrafficFields(tt.payload, tt.mode)
+			if tt.err != nil {
+				var payloadErr *parser.PayloadError
+				if !errors.As(err, &payloadErr) || !errors.Is(err, tt.err) {
+					t.Fatalf("error = %v, want a PayloadError wrapping %v", err, tt.err)
+				}
+				if payloadErr.Payload != tt.payload || payloadErr.Field != tt.field {
+					t.Fatalf("error payload %q field %q, want %q and %q", payloadErr.Payload, payloadErr.Field, tt.payload, tt.field)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("metric = %+v, want %+v", got, tt.want)
+			}
+			if !reflect.DeepEqual(unknown, tt.unknown) {
+				t.Errorf("unknown fields = %q, want %q", unknown, tt.unknown)
+			}
+		})
+	}
+}
+
+func TestParseTrafficFieldsDoesNotAllocate(t *testing.T) {
+	for _, mode := range []parser.Mode{parser.Strict, parser.Lenient} {
+		allocs := testing.AllocsPerRun(100, func() {
+			parser.ParseTrafficFields(stockPayload, mode)
+		})
+		if allocs != 0 {
+			t.Errorf("mode %d: %v allocations per stock payload, want 0", mode, allocs)
+		}
+	}
+}
+
+func FuzzParseTrafficFields(f *testing.F) {
+	for _, seed := range []string{stockPayload, "sentb=500,rcvp=10", "rcvp=-1, rcvb=x, lost=2,,", "=", ""} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, payload string) {
+		strict, unknown, strictErr := parser.ParseTrafficFields(payload, parser.Strict)
+		if strictErr == nil && unknown != nil {
+			t.Fatalf("strict mode accepted unknown fields %q", unknown)
+		}
+		lenient, _, lenientErr := parser.ParseTrafficFields(payload, parser.Lenient)
+		for _, err := range []error{strictErr, lenientErr} {
+			var payloadErr *parser.PayloadError
+			if err != nil && (!errors.As(err, &payloadErr) || payloadErr.Payload != payload) {
+				t.Fatalf("error %v is not a PayloadError of the payload", err)
+			}
+		}
+		// anything strict mode accepts is read the same by lenient mode
+		if strictErr == nil && (lenientErr != nil || lenient != strict) {
+			t.Fatalf("lenient mode read %+v (%v), strict mode %+v", lenient, lenientErr, strict)
+		}
+	})
+}
@@ -0,0 +1,79 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package parser
+
+import (
+	"net"
+	"strings"
+	"sync"
+)
+
+// RealmMapping normalizes realm names before they are used as labels, so that
+// differently spelled realms of the same service share their series.
+type RealmMapping struct {
+	// Lowercase lowercases realms.
+	Lowercase bool `json:"lowercase"`
+	// StripPort removes a trailing :port from realms.
+	StripPort bool `json:"strip_port"`
+	// Aliases maps realms, after the other steps, to the realm reported
+	// instead.
+	Aliases map[string]string `json:"aliases"`
+}
+
+var (
+	realmMappingLock sync.RWMutex
+	realmMapping     *RealmMapping
+)
+
+// SetRealmMapping sets the mapping ParseKeyName applies to realms. nil
+// disables it.
+func SetRealmMapping(m *RealmMapping) {
+	realmMappingLock.Lock()
+	defer realmMappingLock.Unlock()
+	realmMapping = m
+}
+
+// Apply returns the normalized realm.
+func (m *RealmMapping) Apply(realm string) string {
+	if m.StripPort {
+		if host, port, err := net.SplitHostPort(realm); err == nil && port != "" {
+			realm = host
+		}
+	}
+	if m.Lowercase {
+		realm = strings.ToLower(realm)
+	}
+	if alias, ok := m.Aliases[realm]; ok {
+		realm = alias
+	}
+	return realm
+}
+
+// MapRealm applies the realm mapping set with SetRealmMapping.
+func MapRealm(realm string) string {
+	realmMappingLock.RLock()
+	defer realmMappingLock.RUnlock()
+
+	if realmMapping == nil {
+		return realm
+	}
+	return realmMapping.Apply(realm)
+}
@@ -0,0 +1,218 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// DefaultKeyRegexp parses the keys of stock coturn.
+const DefaultKeyRegexp = "turn/realm/(?P<realm>[^/]+)/user/(?P<user>[^/]*)/allocation/(?P<allocation>[^/]+)/(?P<type>.+)"
+
+// KeySchema describes how allocation keys are laid out, for patched or older
+// coturn versions that do not use the stock layout.
+type KeySchema struct {
+	// pattern is the redis glob matching every channel, with a trailing *
+	// standing for the message type
+	pattern string
+	// re has the named groups realm, user, allocation and type, and
+	// optionally origin
+	re *regexp.Regexp
+	// group indexes in the submatches of re, origin is -1 without the group
+	realm, user, allocation, messageType, origin int
+}
+
+var keySchemaGroups = []string{"realm", "user", "allocation", "type"}
+
+// NewKeySchema returns the schema of keys matching pattern, a redis glob
+// whose last character is the * matching the message type, and parsed by
+// template, a regular expression with the named groups realm, user,
+// allocation and type, and optionally origin. The type has to come last in the key, everything
+// before it is the key prefix shared by the keys of an allocation.
+func NewKeySchema(pattern string, template string) (*KeySchema, error) {
+	if !strings.HasSuffix(pattern, "*") {
+		return nil, fmt.Errorf("key pattern %q does not end in * for the message type", pattern)
+	}
+	re, err := regexp.Compile(template)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key regexp: %v", err)
+	}
+
+	indexes := make(map[string]int)
+	for i, name := range re.SubexpNames() {
+		if name != "" {
+			indexes[name] = i
+		}
+	}
+	for _, group := range keySchemaGroups {
+		if _, ok := indexes[group]; !ok {
+			return nil, fmt.Errorf("key regexp %q has no %s group", template, group)
+		}
+	}
+
+	origin, ok := indexes["origin"]
+	if !ok {
+		origin = -1
+	}
+
+	return &KeySchema{
+		pattern:     pattern,
+		re:          re,
+		realm:       indexes["realm"],
+		user:        indexes["user"],
+		allocation:  indexes["allocation"],
+		messageType: indexes["type"],
+		origin:      origin,
+	}, nil
+}
+
+var (
+	defaultKeySchema, _ = NewKeySchema(ChannelKeyPattern, DefaultKeyRegexp)
+
+	keySchemaLock sync.RWMutex
+	keySchema     = defaultKeySchema
+	// keyPrefix namespaces every key, e.g. by a redis proxy
+	keyPrefix string
+)
+
+// SetKeyPrefix sets a prefix that is prepended to the key patterns and
+// stripped from keys before they are parsed, for deployments that namespace
+// the statsdb keys.
+func SetKeyPrefix(prefix string) {
+	keySchemaLock.Lock()
+	defer keySchemaLock.Unlock()
+	keyPrefix = prefix
+}
+
+// SetKeySchema sets the schema used by ParseKeyName and the pattern
+// functions. nil restores the stock coturn layout.
+func SetKeySchema(s *KeySchema) {
+	keySchemaLock.Lock()
+	defer keySchemaLock.Unlock()
+	if s == nil {
+		s = defaultKeySchema
+	}
+	keySchema = s
+}
+
+func currentKeySchema() (*KeySchema, string) {
+	keySchemaLock.RLock()
+	defer keySchemaLock.RUnlock()
+	return keySchema, keyPrefix
+}
+
+// ChannelPattern matches every channel coturn publishes to.
+func ChannelPattern() string {
+	schema, prefix := currentKeySchema()
+	return globEscaper.Replace(prefix) + schema.pattern
+}
+
+// RealmChannelPattern matches every channel of realm, the realm as it
+// appears in the keys before the realm mapping. It returns false unless the
+// keys have the stock layout, since the realm cannot be located in the
+// pattern of other schemas.
+func RealmChannelPattern(realm string) (string, bool) {
+	schema, prefix := currentKeySchema()
+	if schema.pattern != ChannelKeyPattern || schema.re.String() != DefaultKeyRegexp {
+		return "", false
+	}
+	// the first * of the stock pattern stands for the realm
+	pattern := strings.Replace(schema.pattern, "*", globEscaper.Replace(realm), 1)
+	return globEscaper.Replace(prefix) + pattern, true
+}
+
+// KeyRealm returns the realm of a statsdb key or channel name as it appears
+// in the key, without the realm mapping.
+func KeyRealm(key string) (string, bool) {
+	metadata, ok := parseKey(key)
+	return metadata.Realm, ok
+}
+
+// AllocationKey returns the key prefix shared by the keys of an allocation,
+// including the key prefix, for tools that write statsdb keys. The wildcards
+// of the key pattern before the message type are filled in with realm, user
+// and allocation in this order. It returns false if the key regexp does not
+// parse them back out of the result.
+func AllocationKey(realm string, user string, allocation string) (string, bool) {
+	schema, prefix := currentKeySchema()
+	key := strings.TrimSuffix(schema.pattern, "*")
+	for _, value := range []string{realm, user, allocation} {
+		key = strings.Replace(key, "*", value, 1)
+	}
+	metadata, ok := schema.parse(key + MessageStatus)
+	if !ok || metadata.Realm != realm || metadata.User != user || metadata.AllocationID != allocation {
+		return "", false
+	}
+	return prefix + key, true
+}
+
+// StatusPattern matches the status key of every allocation.
+func StatusPattern() string {
+	return patternFor(MessageStatus)
+}
+
+// TotalTrafficPattern matches the keys holding the cumulative traffic of
+// every allocation.
+func TotalTrafficPattern() string {
+	return patternFor(MessageTotalTraffic)
+}
+
+func patternFor(messageType string) string {
+	return strings.TrimSuffix(ChannelPattern(), "*") + messageType
+}
+
+// globEscaper escapes the characters that are special in redis patterns.
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// parseKey strips the key prefix and parses the rest of key with the
+// configured schema.
+func parseKey(key string) (MessageMetadata, bool) {
+	schema, prefix := currentKeySchema()
+	if !strings.HasPrefix(key, prefix) {
+		return MessageMetadata{}, false
+	}
+	return schema.parse(key[len(prefix):])
+}
+
+// parse splits key into its parts. The realm mapping is not applied.
+func (s *KeySchema) parse(key string) (MessageMetadata, bool) {
+	match := s.re.FindStringSubmatchIndex(key)
+	if match == nil || match[2*s.messageType] < 0 {
+		return MessageMetadata{}, false
+	}
+	group := func(i int) string {
+		if i < 0 || match[2*i] < 0 {
+			return ""
+		}
+		return key[match[2*i]:match[2*i+1]]
+	}
+	return MessageMetadata{
+		Realm:          group(s.realm),
+		User:           group(s.user),
+		AllocationID:   group(s.allocation),
+		AllocationName: strings.TrimRight(key[match[0]:match[2*s.messageType]], "/"),
+		MessageType:    group(s.messageType),
+		Origin:         group(s.origin),
+	}, true
+}
@@ -0,0 +1,132 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package parser
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// StatusFieldClient is the status field holding the client address as
+	// ip:port. Stock coturn does not report it, patched builds may.
+	StatusFieldClient = "client"
+	// StatusFieldLifetime is the status field holding the lifetime in
+	// seconds granted by the allocate or refresh request.
+	StatusFieldLifetime = "lifetime"
+	// StatusFieldReason is the deleted status field telling why the
+	// allocation was deleted. Stock coturn does not report it, patched
+	// builds may.
+	StatusFieldReason = "reason"
+	// StatusFieldOrigin is the status field holding the origin of a
+	// multi-tenant deployment. Stock coturn does not report it, patched
+	// builds may.
+	StatusFieldOrigin = "origin"
+)
+
+// The states of a status payload.
+const (
+	StatusNew       = "new"
+	StatusRefreshed = "refreshed"
+	StatusDeleted   = "deleted"
+)
+
+// The reasons DeletionReason maps the reason field to.
+const (
+	DeletionExpired     = "expired"
+	DeletionDeallocated = "deallocated"
+	DeletionError       = "error"
+	DeletionOther       = "other"
+	DeletionUnknown     = "unknown"
+)
+
+// deletionReasons maps the reasons builds are known to report to the
+// reasons they are counted as.
+var deletionReasons = map[string]string{
+	"expired":     DeletionExpired,
+	"expiry":      DeletionExpired,
+	"timeout":     DeletionExpired,
+	"deallocated": DeletionDeallocated,
+	"deallocate":  DeletionDeallocated,
+	"refresh":     DeletionDeallocated,
+	"client":      DeletionDeallocated,
+	"error":       DeletionError,
+	"failure":     DeletionError,
+}
+
+// DeletionReason returns why an allocation was deleted: expired,
+// deallocated by the client, error, other for reasons it does not know or
+// unknown if the status has no reason.
+func (s Status) DeletionReason() string {
+	reason, ok := s.Fields[StatusFieldReason]
+	if !ok || reason == "" {
+		return DeletionUnknown
+	}
+	if mapped, ok := deletionReasons[strings.ToLower(reason)]; ok {
+		return mapped
+	}
+	return DeletionOther
+}
+
+// Status is a parsed status payload.
+type Status struct {
+	// State is the first word of the payload, usually one of the Status
+	// constants.
+	State string
+	// Lifetime is the granted lifetime, zero if the payload has none.
+	Lifetime time.Duration
+	// Fields holds all key=value fields, see ParseStatusFields.
+	Fields map[string]string
+}
+
+// ParseStatus parses a status payload such as "new lifetime=600". A
+// lifetime that is not a number of seconds is left at zero.
+func ParseStatus(payload string) Status {
+	status := Status{Fields: ParseStatusFields(payload)}
+	state := strings.TrimSpace(payload)
+	if i := strings.IndexAny(state, " ,"); i >= 0 {
+		state = state[:i]
+	}
+	if !strings.Contains(state, "=") {
+		status.State = state
+	}
+	if seconds, err := strconv.ParseUint(status.Fields[StatusFieldLifetime], 10, 32); err == nil {
+		status.Lifetime = time.Duration(seconds) * time.Second
+	}
+	return status
+}
+
+// ParseStatusFields returns the key=value fields that follow the state in a
+// status payload such as "new lifetime=600". Fields may be separated by
+// spaces or commas.
+func ParseStatusFields(payload string) map[string]string {
+	fields := make(map[string]string)
+	for _, token := range strings.FieldsFunc(payload, func(r rune) bool {
+		return r == ' ' || r == ','
+	}) {
+		parts := strings.SplitN(token, "=", 2)
+		if len(parts) == 2 {
+			fields[parts[0]] = parts[1]
+		}
+	}
+	return fields
+}
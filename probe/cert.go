@@ -0,0 +1,132 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package probe checks the coturn listeners from the outside.
+package probe
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	certExpiryDesc = prometheus.NewDesc(
+		"coturn_tls_cert_expiry_timestamp_seconds",
+		"Time the certificate expires",
+		[]string{"source", "subject"}, nil,
+	)
+	certSuccessDesc = prometheus.NewDesc(
+		"coturn_exporter_tls_cert_success",
+		"Whether the certificate could be read",
+		[]string{"source"}, nil,
+	)
+)
+
+// certCollector reads certificates from files and TLS listeners on every
+// scrape.
+type certCollector struct {
+	files     []string
+	addresses []string
+	timeout   time.Duration
+}
+
+// NewCertCollector returns a collector exposing the expiry of the first
+// certificate in each PEM file and of the certificate presented by each TLS
+// listener.
+func NewCertCollector(files []string, addresses []string, timeout time.Duration) prometheus.Collector {
+	return &certCollector{files, addresses, timeout}
+}
+
+func (c *certCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- certExpiryDesc
+	ch <- certSuccessDesc
+}
+
+func (c *certCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, file := range c.files {
+		c.collect(ch, file, readCertFile)
+	}
+	for _, address := range c.addresses {
+		c.collect(ch, address, c.probeCert)
+	}
+}
+
+func (c *certCollector) collect(ch chan<- prometheus.Metric, source string, read func(string) (*x509.Certificate, error)) {
+	cert, err := read(source)
+	if err != nil {
+		fmt.Printf("Unable to read certificate of %s: %v\n", source, err)
+		ch <- prometheus.MustNewConstMetric(certSuccessDesc, prometheus.GaugeValue, 0, source)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(certSuccessDesc, prometheus.GaugeValue, 1, source)
+	ch <- prometheus.MustNewConstMetric(certExpiryDesc, prometheus.GaugeValue, float64(cert.NotAfter.Unix()), source, cert.Subject.CommonName)
+}
+
+func readCertFile(path string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no certificate found")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// probeCert returns the certificate a TLS listener presents. It is not
+// verified since an expired or otherwise invalid certificate is exactly what
+// should be reported.
+func (c *certCollector) probeCert(address string) (*x509.Certificate, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{InsecureSkipVerify: true}
+	if net.ParseIP(host) == nil {
+		config.ServerName = host
+	}
+
+	dialer := &net.Dialer{Timeout: c.timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, config)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate presented")
+	}
+	return certs[0], nil
+}
@@ -0,0 +1,177 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package probe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunMagicCookie     = 0x2112a442
+	stunHeaderSize      = 20
+)
+
+// STUNProber periodically sends STUN binding requests to coturn listeners.
+type STUNProber struct {
+	targets []string
+	timeout time.Duration
+
+	success *prometheus.GaugeVec
+	rtt     *prometheus.GaugeVec
+	rtts    *prometheus.HistogramVec
+}
+
+// NewSTUNProber returns a prober for the targets, given as host:port for UDP
+// or as udp://host:port or tcp://host:port.
+func NewSTUNProber(targets []string, timeout time.Duration) *STUNProber {
+	return &STUNProber{
+		targets: targets,
+		timeout: timeout,
+		success: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "coturn_stun_probe_success",
+			Help: "Whether the last STUN binding request got a response",
+		}, []string{"target"}),
+		rtt: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "coturn_stun_probe_rtt_seconds",
+			Help: "Round trip time of the last successful STUN binding request",
+		}, []string{"target"}),
+		rtts: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "coturn_stun_probe_duration_seconds",
+			Help: "Round trip times of successful STUN binding requests",
+			// 1ms to 4s
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 13),
+		}, []string{"target"}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (p *STUNProber) Describe(ch chan<- *prometheus.Desc) {
+	p.success.Describe(ch)
+	p.rtt.Describe(ch)
+	p.rtts.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (p *STUNProber) Collect(ch chan<- prometheus.Metric) {
+	p.success.Collect(ch)
+	p.rtt.Collect(ch)
+	p.rtts.Collect(ch)
+}
+
+// Run probes every target every interval. It never returns.
+func (p *STUNProber) Run(interval time.Duration) {
+	for {
+		for _, target := range p.targets {
+			go p.probe(target)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (p *STUNProber) probe(target string) {
+	rtt, err := p.bind(target)
+	if err != nil {
+		fmt.Printf("STUN probe of %s failed: %v\n", target, err)
+		p.success.WithLabelValues(target).Set(0)
+		return
+	}
+	p.success.WithLabelValues(target).Set(1)
+	p.rtt.WithLabelValues(target).Set(rtt.Seconds())
+	p.rtts.WithLabelValues(target).Observe(rtt.Seconds())
+}
+
+// bind sends a binding request and returns the time until the matching
+// response arrived.
+func (p *STUNProber) bind(target string) (time.Duration, error) {
+	network := "udp"
+	address := target
+	if i := strings.Index(target, "://"); i >= 0 {
+		network, address = target[:i], target[i+3:]
+	}
+	if network != "udp" && network != "tcp" {
+		return 0, fmt.Errorf("unsupported network %q", network)
+	}
+
+	conn, err := net.DialTimeout(network, address, p.timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(p.timeout))
+
+	request := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(request[0:], stunBindingRequest)
+	binary.BigEndian.PutUint32(request[4:], stunMagicCookie)
+	transactionID := request[8:20]
+	if _, err := rand.Read(transactionID); err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	if _, err := conn.Write(request); err != nil {
+		return 0, err
+	}
+
+	response := make([]byte, 1500)
+	for {
+		var n int
+		if network == "tcp" {
+			// TCP is a stream, so read the header and then the
+			// attributes it announces
+			if _, err := io.ReadFull(conn, response[:stunHeaderSize]); err != nil {
+				return 0, err
+			}
+			length := int(binary.BigEndian.Uint16(response[2:]))
+			if stunHeaderSize+length > len(response) {
+				return 0, errors.New("oversized STUN response")
+			}
+			if _, err := io.ReadFull(conn, response[stunHeaderSize:stunHeaderSize+length]); err != nil {
+				return 0, err
+			}
+			n = stunHeaderSize + length
+		} else if n, err = conn.Read(response); err != nil {
+			return 0, err
+		}
+		if n < stunHeaderSize || binary.BigEndian.Uint32(response[4:]) != stunMagicCookie {
+			return 0, errors.New("not a STUN response")
+		}
+		// a stray datagram from an earlier probe
+		if !bytes.Equal(response[8:20], transactionID) {
+			continue
+		}
+		if messageType := binary.BigEndian.Uint16(response); messageType != stunBindingResponse {
+			return 0, fmt.Errorf("unexpected STUN message type 0x%04x", messageType)
+		}
+		return time.Since(start), nil
+	}
+}
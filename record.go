@@ -0,0 +1,116 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/iknow/coturn_exporter/source"
+)
+
+// recordedMessage is a single line in a recording. Recordings are stored as
+// JSON lines so that they can be inspected and trimmed with standard tools.
+type recordedMessage struct {
+	Time    time.Time `json:"time"`
+	Channel string    `json:"channel"`
+	Payload string    `json:"payload"`
+}
+
+type recorder struct {
+	// messages of realm subscriptions are recorded concurrently
+	lock    sync.Mutex
+	encoder *json.Encoder
+}
+
+func newRecorder(path string) (*recorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{encoder: json.NewEncoder(file)}, nil
+}
+
+func (r *recorder) Record(channel string, payload string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.encoder.Encode(recordedMessage{time.Now(), channel, payload})
+}
+
+// replaySource feeds the messages of a recording to the handler, preserving
+// the gaps between them divided by speed. A speed of 0 replays without any
+// delay. The messages are dispatched with their recorded time, which clock
+// reports while they are handled.
+type replaySource struct {
+	path  string
+	speed float64
+	clock *replayClock
+}
+
+// replayClock is a collector.Clock telling the time of the message being
+// replayed, so that the rates come out as they were when it was recorded
+// regardless of the replay speed. It tells the system time until the first
+// message.
+type replayClock struct {
+	nanos int64
+}
+
+func (c *replayClock) Now() time.Time {
+	if nanos := atomic.LoadInt64(&c.nanos); nanos != 0 {
+		return time.Unix(0, nanos)
+	}
+	return time.Now()
+}
+
+func (c *replayClock) set(t time.Time) {
+	atomic.StoreInt64(&c.nanos, t.UnixNano())
+}
+
+func (r *replaySource) Run(handler source.Handler) error {
+	file, err := os.Open(r.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var previous time.Time
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var msg recordedMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			return err
+		}
+
+		if r.speed > 0 && !previous.IsZero() && msg.Time.After(previous) {
+			time.Sleep(time.Duration(float64(msg.Time.Sub(previous)) / r.speed))
+		}
+		previous = msg.Time
+
+		r.clock.set(msg.Time)
+		source.Dispatch(handler, msg.Channel, msg.Payload, msg.Time)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,86 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/iknow/coturn_exporter/collector"
+)
+
+func TestReplayClock(t *testing.T) {
+	clock := &replayClock{}
+	if now := clock.Now(); time.Since(now) > time.Minute {
+		t.Fatalf("Now() = %v before the first message, want the system time", now)
+	}
+	recorded := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock.set(recorded)
+	if now := clock.Now(); !now.Equal(recorded) {
+		t.Fatalf("Now() = %v, want the recorded time %v", now, recorded)
+	}
+}
+
+// TestReplayUsesRecordedTimes replays a recording as fast as possible and
+// expects the rates of the recorded report interval.
+func TestReplayUsesRecordedTimes(t *testing.T) {
+	start := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	const name = "turn/realm/r/user/u/allocation/1"
+	messages := []recordedMessage{
+		{start, name + "/status", "new lifetime=600"},
+		{start.Add(10 * time.Second), name + "/traffic", "rcvp=10, rcvb=1000, sentp=0, sentb=0"},
+		{start.Add(20 * time.Second), name + "/traffic", "rcvp=20, rcvb=2000, sentp=0, sentb=0"},
+	}
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder := json.NewEncoder(file)
+	for _, msg := range messages {
+		if err := encoder.Encode(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := &replayClock{}
+	coll := collector.New(collector.Options{Clock: clock})
+	if err := (&replaySource{path, 0, clock}).Run(coll); err != nil {
+		t.Fatal(err)
+	}
+
+	allocation, ok := coll.Allocations()[name]
+	if !ok {
+		t.Fatalf("allocation %s is not tracked", name)
+	}
+	if rates := allocation.PreviousRates; rates == nil || rates.Rcvb != 200 || rates.Rcvp != 2 {
+		t.Errorf("rates %+v, want 200 bytes and 2 packets per second", rates)
+	}
+	if last := start.Add(20 * time.Second); !allocation.LastMetricTimestamp.Equal(last) {
+		t.Errorf("last report at %v, want %v", allocation.LastMetricTimestamp, last)
+	}
+}
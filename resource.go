@@ -0,0 +1,67 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"os"
+
+	"github.com/iknow/coturn_exporter/exporter"
+)
+
+// resourceAttributes returns the OpenTelemetry resource attributes
+// describing this exporter: the defaults, overridden by
+// $OTEL_RESOURCE_ATTRIBUTES and $OTEL_SERVICE_NAME, overridden by
+// -resource-attributes.
+func resourceAttributes() (map[string]string, error) {
+	attributes := map[string]string{
+		"service.name":    "coturn_exporter",
+		"service.version": version,
+	}
+	if host, err := os.Hostname(); err == nil {
+		attributes["host.name"] = host
+		attributes["service.instance.id"] = host
+	}
+	if *coturnInstance != "" {
+		attributes["coturn.instance"] = *coturnInstance
+	} else if opt, err := exporter.ParseRedisURL(*redisUrl); err == nil {
+		attributes["coturn.instance"] = opt.Addr
+	}
+
+	env, err := parseLabels(os.Getenv("OTEL_RESOURCE_ATTRIBUTES"))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range env {
+		attributes[name] = value
+	}
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		attributes["service.name"] = name
+	}
+
+	flags, err := parseLabels(*resourceAttributesFlag)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range flags {
+		attributes[name] = value
+	}
+	return attributes, nil
+}
@@ -0,0 +1,261 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iknow/coturn_exporter/parser"
+
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// restSecretKeyPattern matches the sets of TURN REST API shared secrets in a
+// redis userdb.
+const restSecretKeyPattern = "turn/realm/*/secret"
+
+var (
+	restSecretsDesc = prometheus.NewDesc(
+		"coturn_rest_secrets",
+		"Number of configured TURN REST API shared secrets",
+		[]string{"realm"}, nil,
+	)
+	restSecretAgeDesc = prometheus.NewDesc(
+		"coturn_rest_secret_age_seconds",
+		"Time since the newest TURN REST API shared secret was added",
+		[]string{"realm"}, nil,
+	)
+)
+
+// realmSecrets are the secrets of a realm.
+type realmSecrets struct {
+	count int
+	added time.Time
+}
+
+// restSecretWatcher reads the TURN REST API shared secrets from the userdb
+// or the static-auth-secret of a coturn configuration file. The secrets
+// themselves are never kept, only a hash to recognize them.
+type restSecretWatcher struct {
+	userdb *redis.Client
+	// hash the userdb secrets are first seen in, empty to only remember
+	// them in memory
+	seenKey string
+	file    string
+
+	lock    sync.Mutex
+	secrets map[string]realmSecrets
+	// secret hash -> when it was first seen, for the userdb
+	firstSeen map[string]time.Time
+}
+
+func newRestSecretWatcher(userdb *redis.Client, seenKey string, file string) *restSecretWatcher {
+	return &restSecretWatcher{
+		userdb:    userdb,
+		seenKey:   seenKey,
+		file:      file,
+		secrets:   make(map[string]realmSecrets),
+		firstSeen: make(map[string]time.Time),
+	}
+}
+
+// Run reloads the secrets every interval. It never returns.
+func (w *restSecretWatcher) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.load(); err != nil {
+			fmt.Println("Unable to load the TURN REST API secrets: ", err)
+		}
+		<-ticker.C
+	}
+}
+
+func (w *restSecretWatcher) load() error {
+	secrets := make(map[string]realmSecrets)
+	if w.file != "" {
+		if err := w.loadFile(secrets); err != nil {
+			return err
+		}
+	}
+	if w.userdb != nil {
+		if err := w.loadUserdb(secrets); err != nil {
+			return err
+		}
+	}
+
+	w.lock.Lock()
+	w.secrets = secrets
+	w.lock.Unlock()
+	return nil
+}
+
+// loadFile counts the static-auth-secret lines of a turnserver.conf, which
+// is taken to be changed when the secret is rotated. They belong to the
+// realm of the file.
+func (w *restSecretWatcher) loadFile(secrets map[string]realmSecrets) error {
+	f, err := os.Open(w.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	realm, count := "", 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name, value := configOption(scanner.Text())
+		switch name {
+		case "realm":
+			realm = parser.MapRealm(value)
+		case "static-auth-secret":
+			if value != "" {
+				count++
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if count > 0 {
+		secrets[realm] = realmSecrets{count, info.ModTime()}
+	}
+	return nil
+}
+
+// configOption splits a turnserver.conf line into the option name and
+// value, which are separated by "=" or white space.
+func configOption(line string) (string, string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", ""
+	}
+	i := strings.IndexAny(line, "= \t")
+	if i < 0 {
+		return line, ""
+	}
+	return strings.TrimSpace(line[:i]), strings.Trim(strings.TrimSpace(line[i+1:]), `"`)
+}
+
+// loadUserdb reads the secret sets of the userdb. Since coturn does not
+// store when a secret was added, it is the time the exporter first saw it.
+func (w *restSecretWatcher) loadUserdb(secrets map[string]realmSecrets) error {
+	now := time.Now()
+	seen := make(map[string]time.Time)
+
+	iter := w.userdb.Scan(0, restSecretKeyPattern, 1000).Iterator()
+	for iter.Next() {
+		key := iter.Val()
+		members, err := w.userdb.SMembers(key).Result()
+		if err != nil {
+			return err
+		}
+		realm := parser.MapRealm(strings.Split(key, "/")[2])
+		s := secrets[realm]
+		for _, secret := range members {
+			hash := secretHash(realm, secret)
+			added, err := w.added(hash, now)
+			if err != nil {
+				return err
+			}
+			seen[hash] = added
+			s.count++
+			if added.After(s.added) {
+				s.added = added
+			}
+		}
+		if s.count > 0 {
+			secrets[realm] = s
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	w.firstSeen = seen
+	w.lock.Unlock()
+	return nil
+}
+
+// added returns when the secret with hash was first seen, recording now if
+// it is new.
+func (w *restSecretWatcher) added(hash string, now time.Time) (time.Time, error) {
+	w.lock.Lock()
+	added, ok := w.firstSeen[hash]
+	w.lock.Unlock()
+	if ok {
+		return added, nil
+	}
+	if w.seenKey == "" {
+		return now, nil
+	}
+
+	// HSETNX keeps the time of whichever exporter saw the secret first
+	if _, err := w.userdb.HSetNX(w.seenKey, hash, now.Unix()).Result(); err != nil {
+		return time.Time{}, err
+	}
+	value, err := w.userdb.HGet(w.seenKey, hash).Result()
+	if err != nil {
+		return time.Time{}, err
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q in %s", value, w.seenKey)
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+func secretHash(realm string, secret string) string {
+	sum := sha256.Sum256([]byte(realm + "/" + secret))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Describe implements prometheus.Collector.
+func (w *restSecretWatcher) Describe(ch chan<- *prometheus.Desc) {
+	ch <- restSecretsDesc
+	ch <- restSecretAgeDesc
+}
+
+// Collect implements prometheus.Collector.
+func (w *restSecretWatcher) Collect(ch chan<- prometheus.Metric) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	now := time.Now()
+	for realm, s := range w.secrets {
+		ch <- prometheus.MustNewConstMetric(restSecretsDesc, prometheus.GaugeValue, float64(s.count), realm)
+		ch <- prometheus.MustNewConstMetric(restSecretAgeDesc, prometheus.GaugeValue, now.Sub(s.added).Seconds(), realm)
+	}
+}
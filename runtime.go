@@ -0,0 +1,128 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"math"
+	"runtime/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// runtimeBuckets are the bucket upper bounds the fine grained runtime
+// histograms are folded into, from a microsecond to a second.
+var runtimeBuckets = []float64{1e-6, 1e-5, 5e-5, 1e-4, 5e-4, 1e-3, 5e-3, 1e-2, 5e-2, 0.1, 0.5, 1}
+
+// runtimeHistograms maps the runtime/metrics histograms to the exposed
+// metric names.
+var runtimeHistograms = []struct {
+	runtimeName string
+	desc        *prometheus.Desc
+}{
+	{"/sched/pauses/total/gc:seconds", prometheus.NewDesc(
+		"go_gc_pause_seconds",
+		"Distribution of stop-the-world pauses caused by the garbage collector",
+		nil, nil,
+	)},
+	{"/sched/latencies:seconds", prometheus.NewDesc(
+		"go_sched_latency_seconds",
+		"Distribution of the time goroutines spent runnable before running",
+		nil, nil,
+	)},
+}
+
+// registerRuntimeCollectors drops the default Go and process collectors
+// unless enabled and adds the runtime histograms if enabled.
+func registerRuntimeCollectors(goMetrics bool, processMetrics bool, runtimeMetrics bool) {
+	if !goMetrics {
+		prometheus.Unregister(prometheus.NewGoCollector())
+	}
+	if !processMetrics {
+		prometheus.Unregister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	}
+	if runtimeMetrics {
+		prometheus.MustRegister(runtimeCollector{})
+	}
+}
+
+// runtimeCollector exposes runtime histograms that the Go collector of
+// the vendored client_golang does not have, for debugging the exporter
+// itself. The runtime does not track their sums, so the sum is estimated
+// from the bucket midpoints.
+type runtimeCollector struct{}
+
+// Describe implements prometheus.Collector.
+func (runtimeCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, h := range runtimeHistograms {
+		ch <- h.desc
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (runtimeCollector) Collect(ch chan<- prometheus.Metric) {
+	samples := make([]metrics.Sample, len(runtimeHistograms))
+	for i, h := range runtimeHistograms {
+		samples[i].Name = h.runtimeName
+	}
+	metrics.Read(samples)
+
+	for i, h := range runtimeHistograms {
+		if samples[i].Value.Kind() != metrics.KindFloat64Histogram {
+			continue
+		}
+		count, sum, buckets := foldHistogram(samples[i].Value.Float64Histogram(), runtimeBuckets)
+		ch <- prometheus.MustNewConstHistogram(h.desc, count, sum, buckets)
+	}
+}
+
+// foldHistogram sums the counts of the runtime histogram h into cumulative
+// buckets with the given upper bounds. h.Buckets holds the len(h.Counts)+1
+// boundaries, so a runtime bucket is counted in the first bound it lies
+// entirely below.
+func foldHistogram(h *metrics.Float64Histogram, bounds []float64) (uint64, float64, map[float64]uint64) {
+	buckets := make(map[float64]uint64, len(bounds))
+	for _, bound := range bounds {
+		buckets[bound] = 0
+	}
+	var count uint64
+	var sum float64
+	for i, n := range h.Counts {
+		if n == 0 {
+			continue
+		}
+		low, high := h.Buckets[i], h.Buckets[i+1]
+		count += n
+		switch {
+		case math.IsInf(low, -1):
+			sum += float64(n) * high
+		case math.IsInf(high, 1):
+			sum += float64(n) * low
+		default:
+			sum += float64(n) * (low + high) / 2
+		}
+		for _, bound := range bounds {
+			if high <= bound {
+				buckets[bound] += n
+			}
+		}
+	}
+	return count, sum, buckets
+}
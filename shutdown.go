@@ -0,0 +1,88 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type shutdownHook struct {
+	name string
+	run  func() error
+}
+
+var (
+	shutdownLock  sync.Mutex
+	shutdownHooks []shutdownHook
+)
+
+// onShutdown adds a hook run on SIGINT or SIGTERM before the exporter exits.
+// The hooks run one after the other in reverse order, so that a sink added
+// early is flushed after the ones added later that may still feed it.
+func onShutdown(name string, run func() error) {
+	shutdownLock.Lock()
+	defer shutdownLock.Unlock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, run})
+}
+
+// shutdownOnSignal runs the shutdown hooks on SIGINT or SIGTERM and exits,
+// with status 1 if a hook failed or the hooks did not finish within
+// timeout. A second signal exits right away.
+func shutdownOnSignal(timeout time.Duration) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	fmt.Println("Shutting down on", <-signals)
+
+	done := make(chan int, 1)
+	go func() {
+		done <- runShutdownHooks()
+	}()
+	select {
+	case status := <-done:
+		os.Exit(status)
+	case <-time.After(timeout):
+		fmt.Println("Shutdown timed out after", timeout)
+	case sig := <-signals:
+		fmt.Println("Exiting on", sig)
+	}
+	os.Exit(1)
+}
+
+// runShutdownHooks runs the hooks and returns the exit status.
+func runShutdownHooks() int {
+	shutdownLock.Lock()
+	hooks := shutdownHooks
+	shutdownLock.Unlock()
+
+	status := 0
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if err := hooks[i].run(); err != nil {
+			fmt.Println("Unable to "+hooks[i].name+": ", err)
+			status = 1
+		}
+	}
+	return status
+}
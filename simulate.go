@@ -0,0 +1,143 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/iknow/coturn_exporter/parser"
+
+	"github.com/go-redis/redis"
+)
+
+// simulatedLifetime is the lifetime of the simulated allocations, which are
+// refreshed when half of it has passed like coturn clients do.
+const simulatedLifetime = 600 * time.Second
+
+type simulatedAllocation struct {
+	// key is the key prefix of the allocation, the message type is appended
+	key       string
+	lastSeen  time.Time
+	refreshed time.Time
+}
+
+// simulate publishes synthetic coturn statsdb messages into redis. Every
+// allocation reports traffic in turn so that the total message rate matches
+// the configured rate, and a small fraction of allocations is replaced on
+// every round to exercise the status handling.
+func simulate(client *redis.Client, allocationCount int, realmCount int, rate float64) error {
+	// NaN is not positive either
+	if allocationCount <= 0 || realmCount <= 0 || !(rate > 0) {
+		return fmt.Errorf("allocation count, realm count and rate must be positive")
+	}
+
+	allocations := make([]simulatedAllocation, allocationCount)
+	for i := range allocations {
+		allocation, err := newSimulatedAllocation(realmCount)
+		if err != nil {
+			return err
+		}
+		allocations[i] = allocation
+		if err := publishStatus(client, allocations[i].key, parser.StatusNew); err != nil {
+			return err
+		}
+	}
+
+	// above 1e9 messages/s the interval rounds down to zero, which the
+	// ticker does not take; the rate is then bound by redis anyway
+	interval := time.Duration(float64(time.Second) / rate)
+	if interval < time.Nanosecond {
+		interval = time.Nanosecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for i := 0; ; i = (i + 1) % len(allocations) {
+		<-ticker.C
+
+		// replace roughly 1% of the allocations per round
+		if rand.Intn(100) == 0 {
+			if err := publishStatus(client, allocations[i].key, parser.StatusDeleted); err != nil {
+				return err
+			}
+			allocation, err := newSimulatedAllocation(realmCount)
+			if err != nil {
+				return err
+			}
+			allocations[i] = allocation
+			if err := publishStatus(client, allocations[i].key, parser.StatusNew); err != nil {
+				return err
+			}
+			continue
+		}
+
+		now := time.Now()
+		if now.Sub(allocations[i].refreshed) > simulatedLifetime/2 {
+			if err := publishStatus(client, allocations[i].key, parser.StatusRefreshed); err != nil {
+				return err
+			}
+			allocations[i].refreshed = now
+		}
+		elapsed := now.Sub(allocations[i].lastSeen).Seconds()
+		allocations[i].lastSeen = now
+
+		// roughly 50 packets per second of 1000 bytes each with some jitter
+		rcvp := int(elapsed * float64(25+rand.Intn(50)))
+		sentp := int(elapsed * float64(25+rand.Intn(50)))
+		payload := fmt.Sprintf("rcvp=%d, rcvb=%d, sentp=%d, sentb=%d", rcvp, rcvp*(500+rand.Intn(1000)), sentp, sentp*(500+rand.Intn(1000)))
+		if err := client.Publish(allocations[i].key+parser.MessageTraffic, payload).Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// publishStatus mirrors what coturn does for a status change: the status key
+// is updated with the lifetime as expiry, or deleted, and the new status is
+// published on the same channel.
+func publishStatus(client *redis.Client, key string, state string) error {
+	key += parser.MessageStatus
+	status := state
+	var err error
+	if state == parser.StatusDeleted {
+		err = client.Del(key).Err()
+	} else {
+		status = fmt.Sprintf("%s lifetime=%d", state, int(simulatedLifetime/time.Second))
+		err = client.Set(key, status, simulatedLifetime).Err()
+	}
+	if err != nil {
+		return err
+	}
+	return client.Publish(key, status).Err()
+}
+
+// newSimulatedAllocation returns an allocation with its key laid out like
+// -key-prefix and -key-pattern say.
+func newSimulatedAllocation(realmCount int) (simulatedAllocation, error) {
+	realm := fmt.Sprintf("realm%d.example.com", rand.Intn(realmCount))
+	key, ok := parser.AllocationKey(realm, fmt.Sprintf("user%d", rand.Intn(10000)), fmt.Sprint(rand.Int63()))
+	if !ok {
+		return simulatedAllocation{}, fmt.Errorf("cannot lay out keys for -key-pattern and -key-regexp, the pattern has to have the realm, user and allocation in this order")
+	}
+	now := time.Now()
+	return simulatedAllocation{key: key, lastSeen: now, refreshed: now}, nil
+}
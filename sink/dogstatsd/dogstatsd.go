@@ -0,0 +1,131 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package dogstatsd mirrors the metrics to a Datadog agent using the
+// DogStatsD protocol.
+package dogstatsd
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/iknow/coturn_exporter/sink"
+)
+
+// Datagrams are kept below the default agent buffer and the usual MTU for
+// UDP. Unix sockets allow larger packets.
+const (
+	maxUDPPacketSize  = 1432
+	maxUnixPacketSize = 8192
+)
+
+type Sink struct {
+	network       string
+	address       string
+	maxPacketSize int
+	tags          []string
+	conn          net.Conn
+	deltas        sink.Deltas
+}
+
+// New returns a sink sending to address, either udp://host:port or
+// unix:///path/to/dsd.socket. tags are added to every metric.
+func New(address string, tags []string) (*Sink, error) {
+	s := &Sink{tags: tags}
+	switch {
+	case strings.HasPrefix(address, "udp://"):
+		s.network, s.address, s.maxPacketSize = "udp", strings.TrimPrefix(address, "udp://"), maxUDPPacketSize
+	case strings.HasPrefix(address, "unix://"):
+		s.network, s.address, s.maxPacketSize = "unixgram", strings.TrimPrefix(address, "unix://"), maxUnixPacketSize
+	default:
+		return nil, fmt.Errorf("unsupported DogStatsD address %q, expected udp:// or unix://", address)
+	}
+	return s, nil
+}
+
+// Push sends gauges as gauges and counters as counts of the increase since
+// the previous push. Labels become tags.
+func (s *Sink) Push(samples []sink.Sample) error {
+	samples = s.deltas.Apply(samples)
+
+	if s.conn == nil {
+		conn, err := net.Dial(s.network, s.address)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	var packet bytes.Buffer
+	for _, sample := range samples {
+		line := s.format(sample)
+		if packet.Len() > 0 && packet.Len()+1+len(line) > s.maxPacketSize {
+			if err := s.send(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		return s.send(packet.Bytes())
+	}
+	return nil
+}
+
+func (s *Sink) format(sample sink.Sample) string {
+	kind := "g"
+	if sample.Type == sink.Counter {
+		kind = "c"
+	}
+
+	tags := append([]string(nil), s.tags...)
+	for name, value := range sample.Labels {
+		tags = append(tags, name+":"+sanitize(value))
+	}
+	sort.Strings(tags)
+
+	line := sample.Name + ":" + strconv.FormatFloat(sample.Value, 'f', -1, 64) + "|" + kind
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
+
+func (s *Sink) send(packet []byte) error {
+	if _, err := s.conn.Write(packet); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// sanitize removes the characters that delimit tags and fields.
+func sanitize(value string) string {
+	return strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_").Replace(value)
+}
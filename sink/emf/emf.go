@@ -0,0 +1,168 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package emf writes metrics in the CloudWatch embedded metric format, either
+// to stdout for log based ingestion or to a CloudWatch agent endpoint.
+package emf
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/iknow/coturn_exporter/sink"
+)
+
+// CloudWatch accepts at most 100 metrics per document.
+const maxMetricsPerDocument = 100
+
+type Sink struct {
+	namespace string
+	output    string
+	writer    io.Writer
+	// minimum time between two documents
+	minGap time.Duration
+	deltas sink.Deltas
+}
+
+// New returns a sink writing to output, which is either "stdout" or a
+// tcp:// or udp:// address of a CloudWatch agent. maxRate limits the number
+// of documents written per second, 0 disables the limit.
+func New(namespace string, output string, maxRate float64) (*Sink, error) {
+	s := &Sink{namespace: namespace, output: output}
+	if maxRate > 0 {
+		s.minGap = time.Duration(float64(time.Second) / maxRate)
+	}
+
+	switch {
+	case output == "stdout":
+		s.writer = os.Stdout
+	case strings.HasPrefix(output, "tcp://"), strings.HasPrefix(output, "udp://"):
+		// connected lazily so an agent that is not up yet is not fatal
+	default:
+		return nil, fmt.Errorf("unsupported EMF output %q, expected stdout, tcp:// or udp://", output)
+	}
+	return s, nil
+}
+
+type metricDefinition struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+type metricDirective struct {
+	Namespace  string             `json:"Namespace"`
+	Dimensions [][]string         `json:"Dimensions"`
+	Metrics    []metricDefinition `json:"Metrics"`
+}
+
+type metadata struct {
+	Timestamp         int64             `json:"Timestamp"`
+	CloudWatchMetrics []metricDirective `json:"CloudWatchMetrics"`
+}
+
+// Push writes one document per label set, so that every label, usually just
+// the realm, becomes a dimension.
+func (s *Sink) Push(samples []sink.Sample) error {
+	samples = s.deltas.Apply(samples)
+
+	groups := make(map[string][]sink.Sample)
+	for _, sample := range samples {
+		key := labelKey(sample.Labels)
+		groups[key] = append(groups[key], sample)
+	}
+
+	now := time.Now().UnixNano() / 1e6
+	for _, group := range groups {
+		for start := 0; start < len(group); start += maxMetricsPerDocument {
+			end := start + maxMetricsPerDocument
+			if end > len(group) {
+				end = len(group)
+			}
+			if err := s.write(document(s.namespace, now, group[start:end])); err != nil {
+				return err
+			}
+			if s.minGap > 0 {
+				time.Sleep(s.minGap)
+			}
+		}
+	}
+	return nil
+}
+
+func document(namespace string, timestamp int64, samples []sink.Sample) map[string]interface{} {
+	doc := make(map[string]interface{})
+	dimensions := make([]string, 0, len(samples[0].Labels))
+	for name, value := range samples[0].Labels {
+		dimensions = append(dimensions, name)
+		doc[name] = value
+	}
+	sort.Strings(dimensions)
+
+	directive := metricDirective{
+		Namespace:  namespace,
+		Dimensions: [][]string{dimensions},
+	}
+	for _, sample := range samples {
+		unit := "None"
+		if sample.Type == sink.Counter {
+			unit = "Count"
+		}
+		directive.Metrics = append(directive.Metrics, metricDefinition{sample.Name, unit})
+		doc[sample.Name] = sample.Value
+	}
+	doc["_aws"] = metadata{timestamp, []metricDirective{directive}}
+	return doc
+}
+
+func (s *Sink) write(doc map[string]interface{}) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if s.writer == nil {
+		u := strings.SplitN(s.output, "://", 2)
+		conn, err := net.DialTimeout(u[0], u[1], 5*time.Second)
+		if err != nil {
+			return err
+		}
+		s.writer = conn
+	}
+	if _, err := s.writer.Write(data); err != nil {
+		// reconnect on the next document
+		if conn, ok := s.writer.(net.Conn); ok {
+			conn.Close()
+			s.writer = nil
+		}
+		return err
+	}
+	return nil
+}
+
+func labelKey(labels map[string]string) string {
+	return sink.Sample{Labels: labels}.Key()
+}
@@ -0,0 +1,311 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package remotewrite pushes the registry with the Prometheus remote write
+// protocol, e.g. to Grafana Cloud, for hosts that do not run a Prometheus
+// agent.
+package remotewrite
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+)
+
+type Sink struct {
+	url      string
+	username string
+	password string
+	labels   map[string]string
+	// targetInfo are the labels of the target_info series, nil without a
+	// resource
+	targetInfo map[string]string
+	gatherer   prometheus.Gatherer
+	client     *http.Client
+
+	// bufferSize is the number of pushes kept while the endpoint is
+	// unavailable, the oldest are dropped beyond it
+	bufferSize int
+	// compressed write requests that were not sent yet, oldest first
+	pending [][]byte
+	backoff time.Duration
+	retryAt time.Time
+}
+
+// New returns a sink posting to the remote write endpoint at rawURL. labels
+// are added to every series that does not have them already.
+func New(rawURL string, labels map[string]string, gatherer prometheus.Gatherer, bufferSize int) (*Sink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported remote write URL %q", rawURL)
+	}
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+
+	return &Sink{
+		url:        u.String(),
+		labels:     labels,
+		gatherer:   gatherer,
+		client:     &http.Client{Timeout: 30 * time.Second},
+		bufferSize: bufferSize,
+	}, nil
+}
+
+// SetBasicAuth authenticates the pushes with HTTP basic auth. Grafana Cloud
+// expects the instance id as username and an API key as password.
+func (s *Sink) SetBasicAuth(username, password string) {
+	s.username = username
+	s.password = password
+}
+
+// SetResource describes the pushing exporter with OpenTelemetry resource
+// attributes, following the OpenTelemetry to Prometheus compatibility
+// rules: every series that does not have them gets a job label from
+// service.namespace and service.name and an instance label from
+// service.instance.id, and a target_info series carries the other
+// attributes, with the characters that are invalid in label names replaced
+// by underscores.
+func (s *Sink) SetResource(attributes map[string]string) {
+	job := attributes["service.name"]
+	if namespace := attributes["service.namespace"]; namespace != "" {
+		job = namespace + "/" + job
+	}
+	instance := attributes["service.instance.id"]
+
+	labels := make(map[string]string, len(s.labels)+2)
+	for name, value := range s.labels {
+		labels[name] = value
+	}
+	if _, ok := labels["job"]; !ok && job != "" {
+		labels["job"] = job
+	}
+	if _, ok := labels["instance"]; !ok && instance != "" {
+		labels["instance"] = instance
+	}
+	s.labels = labels
+
+	s.targetInfo = map[string]string{"__name__": "target_info"}
+	for name, value := range attributes {
+		switch name {
+		case "service.name", "service.namespace", "service.instance.id":
+			continue
+		}
+		s.targetInfo[sanitizeLabelName(name)] = value
+	}
+	for _, name := range []string{"job", "instance"} {
+		if value, ok := labels[name]; ok {
+			s.targetInfo[name] = value
+		}
+	}
+}
+
+// sanitizeLabelName replaces the characters that are not allowed in
+// Prometheus label names with underscores.
+func sanitizeLabelName(name string) string {
+	result := []byte(name)
+	for i, c := range result {
+		valid := c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9'
+		if !valid {
+			result[i] = '_'
+		}
+	}
+	return string(result)
+}
+
+// Push adds the current state of the registry to the buffer and sends the
+// buffered requests, oldest first. After a failure the endpoint is left
+// alone for an exponentially growing backoff, while further pushes keep
+// filling the buffer.
+func (s *Sink) Push() error {
+	now := time.Now()
+	request, err := s.writeRequest(now)
+	if err != nil {
+		return err
+	}
+	data, err := proto.Marshal(request)
+	if err != nil {
+		return err
+	}
+	s.pending = append(s.pending, snappyEncode(data))
+	if dropped := len(s.pending) - s.bufferSize; dropped > 0 {
+		s.pending = s.pending[dropped:]
+		fmt.Printf("Dropped %d buffered remote write requests\n", dropped)
+	}
+
+	if now.Before(s.retryAt) {
+		return nil
+	}
+
+	var firstErr error
+	for len(s.pending) > 0 {
+		retry, err := s.send(s.pending[0])
+		if err != nil && retry {
+			s.backoff *= 2
+			if s.backoff < minBackoff {
+				s.backoff = minBackoff
+			}
+			if s.backoff > maxBackoff {
+				s.backoff = maxBackoff
+			}
+			s.retryAt = now.Add(s.backoff)
+			return fmt.Errorf("%v, retrying in %s with %d requests buffered", err, s.backoff, len(s.pending))
+		}
+		if err != nil && firstErr == nil {
+			// the request itself is rejected, retrying will not help
+			firstErr = err
+		}
+		s.pending = s.pending[1:]
+		s.backoff = 0
+	}
+	return firstErr
+}
+
+// send posts one request and reports whether it should be retried if it
+// failed.
+func (s *Sink) send(data []byte) (bool, error) {
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		retry := resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	return false, nil
+}
+
+func (s *Sink) writeRequest(now time.Time) (*WriteRequest, error) {
+	families, err := s.gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp := now.UnixNano() / int64(time.Millisecond)
+	request := &WriteRequest{}
+	add := func(metricName string, m *dto.Metric, value float64, extra ...string) {
+		labels := map[string]string{"__name__": metricName}
+		for name, value := range s.labels {
+			labels[name] = value
+		}
+		for _, label := range m.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		for i := 0; i+1 < len(extra); i += 2 {
+			labels[extra[i]] = extra[i+1]
+		}
+		ts := timestamp
+		if m.TimestampMs != nil {
+			ts = m.GetTimestampMs()
+		}
+		request.Timeseries = append(request.Timeseries, &TimeSeries{
+			Labels:  sortedLabels(labels),
+			Samples: []*Sample{{Value: value, Timestamp: ts}},
+		})
+	}
+
+	for _, family := range families {
+		name := family.GetName()
+		for _, m := range family.GetMetric() {
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, m, m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, bucket := range h.GetBucket() {
+					add(name+"_bucket", m, float64(bucket.GetCumulativeCount()), "le", formatFloat(bucket.GetUpperBound()))
+				}
+				add(name+"_bucket", m, float64(h.GetSampleCount()), "le", "+Inf")
+				add(name+"_sum", m, h.GetSampleSum())
+				add(name+"_count", m, float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				summary := m.GetSummary()
+				for _, q := range summary.GetQuantile() {
+					add(name, m, q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+				}
+				add(name+"_sum", m, summary.GetSampleSum())
+				add(name+"_count", m, float64(summary.GetSampleCount()))
+			}
+		}
+	}
+
+	if s.targetInfo != nil {
+		request.Timeseries = append(request.Timeseries, &TimeSeries{
+			Labels:  sortedLabels(s.targetInfo),
+			Samples: []*Sample{{Value: 1, Timestamp: timestamp}},
+		})
+	}
+	return request, nil
+}
+
+// sortedLabels returns the labels sorted by name, as required by the
+// protocol.
+func sortedLabels(labels map[string]string) []*Label {
+	result := make([]*Label, 0, len(labels))
+	for name, value := range labels {
+		result = append(result, &Label{Name: name, Value: value})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
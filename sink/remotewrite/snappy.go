@@ -0,0 +1,98 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package remotewrite
+
+import (
+	"encoding/binary"
+)
+
+// snappyEncode compresses src in the snappy block format expected by remote
+// write receivers. It is a plain greedy matcher; the samples of one push are
+// small and repetitive enough that it does not need to be clever.
+func snappyEncode(src []byte) []byte {
+	dst := make([]byte, 0, len(src)/2+16)
+	var length [binary.MaxVarintLen64]byte
+	dst = append(dst, length[:binary.PutUvarint(length[:], uint64(len(src)))]...)
+
+	const tableBits = 14
+	var table [1 << tableBits]int32
+	hash := func(i int) uint32 {
+		return (binary.LittleEndian.Uint32(src[i:]) * 0x1e35a7bd) >> (32 - tableBits)
+	}
+
+	literal := 0
+	i := 0
+	for i+4 <= len(src) {
+		h := hash(i)
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if candidate < 0 || i-candidate > 0xffff ||
+			binary.LittleEndian.Uint32(src[candidate:]) != binary.LittleEndian.Uint32(src[i:]) {
+			i++
+			continue
+		}
+
+		dst = appendLiteral(dst, src[literal:i])
+		matched := 4
+		for i+matched < len(src) && src[candidate+matched] == src[i+matched] {
+			matched++
+		}
+		dst = appendCopy(dst, i-candidate, matched)
+		i += matched
+		literal = i
+	}
+	return appendLiteral(dst, src[literal:])
+}
+
+func appendLiteral(dst []byte, literal []byte) []byte {
+	for len(literal) > 0 {
+		chunk := literal
+		if len(chunk) > 1<<16 {
+			chunk = chunk[:1<<16]
+		}
+		n := len(chunk) - 1
+		switch {
+		case n < 60:
+			dst = append(dst, byte(n)<<2)
+		case n < 1<<8:
+			dst = append(dst, 60<<2, byte(n))
+		default:
+			dst = append(dst, 61<<2, byte(n), byte(n>>8))
+		}
+		dst = append(dst, chunk...)
+		literal = literal[len(chunk):]
+	}
+	return dst
+}
+
+// appendCopy emits copies with a two byte offset, which cover lengths of 1 to
+// 64 bytes each.
+func appendCopy(dst []byte, offset int, length int) []byte {
+	for length > 0 {
+		n := length
+		if n > 64 {
+			n = 64
+		}
+		dst = append(dst, byte(n-1)<<2|2, byte(offset), byte(offset>>8))
+		length -= n
+	}
+	return dst
+}
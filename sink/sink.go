@@ -0,0 +1,148 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package sink pushes the registered metrics to systems that do not scrape
+// Prometheus endpoints.
+package sink
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type SampleType int
+
+const (
+	Gauge SampleType = iota
+	Counter
+)
+
+// Sample is a single gauge or counter value. Histograms and summaries are
+// not converted since the push targets have no common representation for
+// them.
+type Sample struct {
+	Name   string
+	Labels map[string]string
+	Type   SampleType
+	Value  float64
+}
+
+// Key identifies the series of the sample.
+func (s Sample) Key() string {
+	names := make([]string, 0, len(s.Labels))
+	for name := range s.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(s.Name)
+	for _, name := range names {
+		b.WriteString("\xff" + name + "=" + s.Labels[name])
+	}
+	return b.String()
+}
+
+// Gather returns the samples of every metric whose name has prefix.
+func Gather(gatherer prometheus.Gatherer, prefix string) ([]Sample, error) {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []Sample
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), prefix) {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			labels := make(map[string]string, len(m.GetLabel()))
+			for _, label := range m.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			switch family.GetType() {
+			case dto.MetricType_GAUGE:
+				samples = append(samples, Sample{family.GetName(), labels, Gauge, m.GetGauge().GetValue()})
+			case dto.MetricType_COUNTER:
+				samples = append(samples, Sample{family.GetName(), labels, Counter, m.GetCounter().GetValue()})
+			case dto.MetricType_UNTYPED:
+				samples = append(samples, Sample{family.GetName(), labels, Gauge, m.GetUntyped().GetValue()})
+			}
+		}
+	}
+	return samples, nil
+}
+
+// Deltas converts counter samples into the increase since the previous call,
+// for targets that expect counts per interval. Counters seen for the first
+// time or that were reset are dropped for one interval.
+type Deltas struct {
+	previous map[string]float64
+}
+
+func (d *Deltas) Apply(samples []Sample) []Sample {
+	current := make(map[string]float64)
+	result := samples[:0]
+	for _, s := range samples {
+		if s.Type != Counter {
+			result = append(result, s)
+			continue
+		}
+		key := s.Key()
+		current[key] = s.Value
+		previous, ok := d.previous[key]
+		if !ok || s.Value < previous {
+			continue
+		}
+		s.Value -= previous
+		result = append(result, s)
+	}
+	d.previous = current
+	return result
+}
+
+// Run gathers the metrics with prefix from the default registry every
+// interval and passes them to push. It never returns.
+func Run(name string, prefix string, interval time.Duration, push func([]Sample) error) {
+	Every(name, interval, func() error {
+		samples, err := Gather(prometheus.DefaultGatherer, prefix)
+		if err != nil {
+			return err
+		}
+		return push(samples)
+	})
+}
+
+// Every calls push every interval, logging the errors. It never returns.
+func Every(name string, interval time.Duration, push func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := push(); err != nil {
+			fmt.Printf("Unable to push metrics to %s: %v\n", name, err)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package vmimport pushes the registry in the Prometheus text format to the
+// VictoriaMetrics import API, for hosts that cannot be scraped.
+package vmimport
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+type Sink struct {
+	url         string
+	username    string
+	password    string
+	bearerToken string
+	gatherer    prometheus.Gatherer
+	client      *http.Client
+}
+
+// New returns a sink posting to the /api/v1/import/prometheus endpoint below
+// baseURL. extraLabels are added by VictoriaMetrics to every pushed series.
+func New(baseURL string, extraLabels map[string]string, gatherer prometheus.Gatherer) (*Sink, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported VictoriaMetrics URL %q", baseURL)
+	}
+	u.Path = u.Path + "/api/v1/import/prometheus"
+
+	query := u.Query()
+	for name, value := range extraLabels {
+		query.Add("extra_label", name+"="+value)
+	}
+	u.RawQuery = query.Encode()
+
+	return &Sink{
+		url:      u.String(),
+		gatherer: gatherer,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// SetBasicAuth authenticates the pushes with HTTP basic auth.
+func (s *Sink) SetBasicAuth(username, password string) {
+	s.username = username
+	s.password = password
+}
+
+// SetBearerToken authenticates the pushes with a bearer token.
+func (s *Sink) SetBearerToken(token string) {
+	s.bearerToken = token
+}
+
+// Push posts the current state of the registry.
+func (s *Sink) Push() error {
+	families, err := s.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(&body, family); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest("POST", s.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", string(expfmt.FmtText))
+	if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+	if s.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.bearerToken)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/iknow/coturn_exporter/collector"
+	"github.com/iknow/coturn_exporter/sink"
+	"github.com/iknow/coturn_exporter/snmp"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var sysOID = snmp.OID{1, 3, 6, 1, 2, 1, 1}
+
+// snmpValues caches the aggregates for a second so that a walk does not
+// gather the registry for every object.
+type snmpValues struct {
+	coll *collector.Collector
+
+	lock    sync.Mutex
+	updated time.Time
+	values  map[string]float64
+}
+
+func (v *snmpValues) get(name string) func() interface{} {
+	return func() interface{} {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+
+		if time.Since(v.updated) > time.Second {
+			v.refresh()
+		}
+		if value := v.values[name]; value > 0 {
+			return uint64(value)
+		}
+		return uint64(0)
+	}
+}
+
+func (v *snmpValues) refresh() {
+	values := make(map[string]float64)
+
+	samples, err := sink.Gather(prometheus.DefaultGatherer, "coturn_")
+	if err != nil {
+		fmt.Println("Unable to gather metrics for SNMP: ", err)
+	}
+	for _, sample := range samples {
+		if _, ok := sample.Labels["le"]; !ok {
+			values[sample.Name] += sample.Value
+		}
+	}
+
+	realms := make(map[string]bool)
+	for _, allocation := range v.coll.Allocations() {
+		realms[allocation.Realm] = true
+		if r := allocation.PreviousRates; r != nil {
+			values["received_packet_rate"] += r.Rcvp
+			values["received_byte_rate"] += r.Rcvb
+			values["sent_packet_rate"] += r.Sentp
+			values["sent_byte_rate"] += r.Sentb
+		}
+	}
+	values["realms"] = float64(len(realms))
+
+	v.values = values
+	v.updated = time.Now()
+}
+
+// serveSNMP exposes the aggregate allocation count, traffic counters and
+// rates below base.
+func serveSNMP(address string, community string, base snmp.OID, coll *collector.Collector) error {
+	agent := snmp.NewAgent(community)
+	start := time.Now()
+
+	agent.Register(sysOID.Append(1, 0), snmp.TypeOctetString, func() interface{} {
+		return "coturn_exporter"
+	})
+	agent.Register(sysOID.Append(2, 0), snmp.TypeOID, func() interface{} {
+		return base
+	})
+	agent.Register(sysOID.Append(3, 0), snmp.TypeTimeTicks, func() interface{} {
+		return uint64(time.Since(start) / (10 * time.Millisecond))
+	})
+
+	values := &snmpValues{coll: coll}
+	objects := []struct {
+		typ  byte
+		name string
+	}{
+		{snmp.TypeGauge32, "coturn_allocations"},
+		{snmp.TypeGauge32, "realms"},
+		{snmp.TypeCounter64, "coturn_received_packets_total"},
+		{snmp.TypeCounter64, "coturn_received_bytes_total"},
+		{snmp.TypeCounter64, "coturn_sent_packets_total"},
+		{snmp.TypeCounter64, "coturn_sent_bytes_total"},
+		{snmp.TypeGauge32, "received_packet_rate"},
+		{snmp.TypeGauge32, "received_byte_rate"},
+		{snmp.TypeGauge32, "sent_packet_rate"},
+		{snmp.TypeGauge32, "sent_byte_rate"},
+	}
+	for i, object := range objects {
+		agent.Register(base.Append(uint32(i+1), 0), object.typ, values.get(object.name))
+	}
+
+	fmt.Println("Serving SNMP on", address)
+	return agent.ListenAndServe(address)
+}
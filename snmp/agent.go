@@ -0,0 +1,296 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package snmp implements a minimal read-only SNMPv2c agent for systems that
+// can only poll SNMP.
+package snmp
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+// maxResponseSize keeps responses within a single unfragmented datagram on
+// most networks.
+const maxResponseSize = 1400
+
+// Object is a scalar exposed by the agent. Value returns a uint64 for the
+// numeric types, a string for TypeOctetString and an OID for TypeOID.
+type Object struct {
+	OID   OID
+	Type  byte
+	Value func() interface{}
+}
+
+type Agent struct {
+	community string
+
+	lock    sync.RWMutex
+	objects []Object
+}
+
+// NewAgent returns an agent answering requests carrying community.
+func NewAgent(community string) *Agent {
+	return &Agent{community: community}
+}
+
+// Register adds an object to the agent.
+func (a *Agent) Register(oid OID, typ byte, value func() interface{}) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.objects = append(a.objects, Object{oid, typ, value})
+	sort.Slice(a.objects, func(i, j int) bool {
+		return a.objects[i].OID.Compare(a.objects[j].OID) < 0
+	})
+}
+
+// ListenAndServe answers requests on the UDP address until an error occurs.
+func (a *Agent) ListenAndServe(address string) error {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		response, err := a.handle(buf[:n])
+		if err != nil {
+			fmt.Printf("Unable to handle SNMP request from %s: %v\n", addr, err)
+			continue
+		}
+		if response != nil {
+			conn.WriteTo(response, addr)
+		}
+	}
+}
+
+type varbind struct {
+	oid   OID
+	tag   byte
+	value []byte
+}
+
+// handle parses a request and returns the encoded response. Requests with a
+// wrong community or version are dropped without a response, as other agents
+// do.
+func (a *Agent) handle(packet []byte) ([]byte, error) {
+	tag, message, _, err := readTLV(packet)
+	if err != nil {
+		return nil, err
+	}
+	if tag != tagSequence {
+		return nil, fmt.Errorf("unexpected message tag 0x%x", tag)
+	}
+	version, message, err := readInteger(message)
+	if err != nil {
+		return nil, err
+	}
+	if version != 1 {
+		// only SNMPv2c is supported
+		return nil, nil
+	}
+	tag, community, message, err := readTLV(message)
+	if err != nil {
+		return nil, err
+	}
+	if tag != tagOctetString || string(community) != a.community {
+		return nil, nil
+	}
+
+	pduType, pdu, _, err := readTLV(message)
+	if err != nil {
+		return nil, err
+	}
+	requestID, pdu, err := readInteger(pdu)
+	if err != nil {
+		return nil, err
+	}
+	// error-status and error-index, or non-repeaters and max-repetitions for
+	// GetBulk
+	first, pdu, err := readInteger(pdu)
+	if err != nil {
+		return nil, err
+	}
+	second, pdu, err := readInteger(pdu)
+	if err != nil {
+		return nil, err
+	}
+	tag, list, _, err := readTLV(pdu)
+	if err != nil {
+		return nil, err
+	}
+	if tag != tagSequence {
+		return nil, fmt.Errorf("unexpected varbind list tag 0x%x", tag)
+	}
+
+	var oids []OID
+	for len(list) > 0 {
+		var entry []byte
+		_, entry, list, err = readTLV(list)
+		if err != nil {
+			return nil, err
+		}
+		tag, value, _, err := readTLV(entry)
+		if err != nil {
+			return nil, err
+		}
+		if tag != tagOID {
+			return nil, fmt.Errorf("unexpected varbind name tag 0x%x", tag)
+		}
+		oid, err := decodeOID(value)
+		if err != nil {
+			return nil, err
+		}
+		oids = append(oids, oid)
+	}
+
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	var bindings []varbind
+	switch pduType {
+	case pduGetRequest:
+		for _, oid := range oids {
+			bindings = append(bindings, a.get(oid))
+		}
+	case pduGetNextRequest:
+		for _, oid := range oids {
+			bindings = append(bindings, a.next(oid))
+		}
+	case pduGetBulkRequest:
+		bindings = a.bulk(oids, int(first), int(second))
+	default:
+		return nil, fmt.Errorf("unsupported PDU type 0x%x", pduType)
+	}
+
+	response := encodeResponse(a.community, requestID, bindings)
+	for len(response) > maxResponseSize && len(bindings) > 1 {
+		bindings = bindings[:len(bindings)/2]
+		response = encodeResponse(a.community, requestID, bindings)
+	}
+	return response, nil
+}
+
+func (a *Agent) get(oid OID) varbind {
+	i := sort.Search(len(a.objects), func(i int) bool {
+		return a.objects[i].OID.Compare(oid) >= 0
+	})
+	if i < len(a.objects) && a.objects[i].OID.Compare(oid) == 0 {
+		return a.encode(a.objects[i])
+	}
+	return varbind{oid, tagNoSuchObject, nil}
+}
+
+func (a *Agent) next(oid OID) varbind {
+	i := sort.Search(len(a.objects), func(i int) bool {
+		return a.objects[i].OID.Compare(oid) > 0
+	})
+	if i < len(a.objects) {
+		return a.encode(a.objects[i])
+	}
+	return varbind{oid, tagEndOfMibView, nil}
+}
+
+func (a *Agent) bulk(oids []OID, nonRepeaters int, maxRepetitions int) []varbind {
+	if nonRepeaters < 0 {
+		nonRepeaters = 0
+	}
+	if nonRepeaters > len(oids) {
+		nonRepeaters = len(oids)
+	}
+	if maxRepetitions < 0 {
+		maxRepetitions = 0
+	}
+
+	var bindings []varbind
+	for _, oid := range oids[:nonRepeaters] {
+		bindings = append(bindings, a.next(oid))
+	}
+	repeaters := append([]OID(nil), oids[nonRepeaters:]...)
+	for r := 0; r < maxRepetitions && len(repeaters) > 0; r++ {
+		done := true
+		for i, oid := range repeaters {
+			binding := a.next(oid)
+			bindings = append(bindings, binding)
+			repeaters[i] = binding.oid
+			if binding.tag != tagEndOfMibView {
+				done = false
+			}
+		}
+		if done {
+			break
+		}
+	}
+	return bindings
+}
+
+func (a *Agent) encode(object Object) varbind {
+	var value []byte
+	switch v := object.Value().(type) {
+	case uint64:
+		if object.Type == TypeInteger {
+			value = appendInteger(nil, object.Type, int64(v))
+		} else {
+			if object.Type != TypeCounter64 && v > 0xffffffff {
+				v = 0xffffffff
+			}
+			value = appendUnsigned(nil, object.Type, v)
+		}
+	case string:
+		value = appendTLV(nil, tagOctetString, []byte(v))
+	case OID:
+		value = appendOID(nil, v)
+	default:
+		return varbind{object.OID, tagNoSuchInstance, nil}
+	}
+	// value already carries its own tag and length
+	return varbind{object.OID, 0, value}
+}
+
+func encodeResponse(community string, requestID int64, bindings []varbind) []byte {
+	var list []byte
+	for _, binding := range bindings {
+		entry := appendOID(nil, binding.oid)
+		if binding.tag != 0 {
+			entry = appendTLV(entry, binding.tag, nil)
+		} else {
+			entry = append(entry, binding.value...)
+		}
+		list = appendTLV(list, tagSequence, entry)
+	}
+
+	pdu := appendInteger(nil, tagInteger, requestID)
+	pdu = appendInteger(pdu, tagInteger, 0)
+	pdu = appendInteger(pdu, tagInteger, 0)
+	pdu = appendTLV(pdu, tagSequence, list)
+
+	message := appendInteger(nil, tagInteger, 1)
+	message = appendTLV(message, tagOctetString, []byte(community))
+	message = appendTLV(message, pduResponse, pdu)
+	return appendTLV(nil, tagSequence, message)
+}
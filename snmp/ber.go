@@ -0,0 +1,208 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snmp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// BER tags used by SNMPv2c.
+const (
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagOID         = 0x06
+	tagSequence    = 0x30
+
+	TypeInteger     = tagInteger
+	TypeOctetString = tagOctetString
+	TypeOID         = tagOID
+	TypeCounter32   = 0x41
+	TypeGauge32     = 0x42
+	TypeTimeTicks   = 0x43
+	TypeCounter64   = 0x46
+
+	tagNoSuchObject   = 0x80
+	tagNoSuchInstance = 0x81
+	tagEndOfMibView   = 0x82
+
+	pduGetRequest     = 0xa0
+	pduGetNextRequest = 0xa1
+	pduResponse       = 0xa2
+	pduGetBulkRequest = 0xa5
+)
+
+var errTruncated = errors.New("truncated BER value")
+
+// OID is an object identifier such as 1.3.6.1.2.1.1.3.0.
+type OID []uint32
+
+// ParseOID parses the dotted representation of an OID.
+func ParseOID(s string) (OID, error) {
+	var oid OID
+	for _, part := range strings.Split(strings.TrimPrefix(s, "."), ".") {
+		n, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OID %q", s)
+		}
+		oid = append(oid, uint32(n))
+	}
+	if len(oid) < 2 {
+		return nil, fmt.Errorf("invalid OID %q", s)
+	}
+	return oid, nil
+}
+
+func (o OID) String() string {
+	parts := make([]string, len(o))
+	for i, n := range o {
+		parts[i] = strconv.FormatUint(uint64(n), 10)
+	}
+	return strings.Join(parts, ".")
+}
+
+// Compare orders OIDs lexicographically as required for GetNext.
+func (o OID) Compare(other OID) int {
+	for i := 0; i < len(o) && i < len(other); i++ {
+		if o[i] != other[i] {
+			if o[i] < other[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(o) - len(other)
+}
+
+// Append returns a new OID with suffix appended.
+func (o OID) Append(suffix ...uint32) OID {
+	return append(append(OID(nil), o...), suffix...)
+}
+
+// readTLV splits the first value off b.
+func readTLV(b []byte) (tag byte, value []byte, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errTruncated
+	}
+	tag = b[0]
+	length := int(b[1])
+	b = b[2:]
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 || len(b) < n {
+			return 0, nil, nil, errTruncated
+		}
+		length = 0
+		for _, c := range b[:n] {
+			length = length<<8 | int(c)
+		}
+		b = b[n:]
+	}
+	if length < 0 || len(b) < length {
+		return 0, nil, nil, errTruncated
+	}
+	return tag, b[:length], b[length:], nil
+}
+
+func readInteger(b []byte) (int64, []byte, error) {
+	tag, value, rest, err := readTLV(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	if tag != tagInteger || len(value) == 0 || len(value) > 8 {
+		return 0, nil, fmt.Errorf("expected integer, got tag 0x%x", tag)
+	}
+	n := int64(int8(value[0]))
+	for _, c := range value[1:] {
+		n = n<<8 | int64(c)
+	}
+	return n, rest, nil
+}
+
+func decodeOID(b []byte) (OID, error) {
+	if len(b) == 0 {
+		return nil, errTruncated
+	}
+	oid := OID{uint32(b[0]) / 40, uint32(b[0]) % 40}
+	var n uint32
+	for _, c := range b[1:] {
+		n = n<<7 | uint32(c&0x7f)
+		if c&0x80 == 0 {
+			oid = append(oid, n)
+			n = 0
+		}
+	}
+	return oid, nil
+}
+
+func appendLength(b []byte, length int) []byte {
+	switch {
+	case length < 0x80:
+		return append(b, byte(length))
+	case length <= 0xff:
+		return append(b, 0x81, byte(length))
+	default:
+		return append(b, 0x82, byte(length>>8), byte(length))
+	}
+}
+
+func appendTLV(b []byte, tag byte, value []byte) []byte {
+	b = append(b, tag)
+	b = appendLength(b, len(value))
+	return append(b, value...)
+}
+
+func appendInteger(b []byte, tag byte, n int64) []byte {
+	value := []byte{byte(n)}
+	// prepend bytes until the remaining ones only repeat the sign
+	for n>>7 != 0 && n>>7 != -1 {
+		n >>= 8
+		value = append([]byte{byte(n)}, value...)
+	}
+	return appendTLV(b, tag, value)
+}
+
+func appendUnsigned(b []byte, tag byte, n uint64) []byte {
+	var value []byte
+	for ; n > 0; n >>= 8 {
+		value = append([]byte{byte(n)}, value...)
+	}
+	// a leading zero keeps values with the high bit set positive
+	if len(value) == 0 || value[0]&0x80 != 0 {
+		value = append([]byte{0}, value...)
+	}
+	return appendTLV(b, tag, value)
+}
+
+func appendOID(b []byte, oid OID) []byte {
+	value := []byte{byte(oid[0]*40 + oid[1])}
+	for _, n := range oid[2:] {
+		var encoded []byte
+		encoded = append(encoded, byte(n&0x7f))
+		for n >>= 7; n > 0; n >>= 7 {
+			encoded = append([]byte{byte(n&0x7f | 0x80)}, encoded...)
+		}
+		value = append(value, encoded...)
+	}
+	return appendTLV(b, tagOID, value)
+}
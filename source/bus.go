@@ -0,0 +1,133 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package source
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Bus passes every event from a source to the sinks subscribed to it. A
+// sink subscribed without a queue is called inline, in order with the
+// source, which is what the collector needs. Every other sink gets its own
+// queue and goroutine, so that a slow sink drops its own events instead of
+// holding up the source and the other sinks.
+type Bus struct {
+	sinks []*busSink
+
+	dropped     *prometheus.CounterVec
+	queueLength *prometheus.Desc
+}
+
+// queuedEvent holds either an allocation or a traffic event.
+type queuedEvent struct {
+	allocation *AllocationEvent
+	traffic    *TrafficEvent
+}
+
+// busSink is a subscribed handler and its queue, nil for inline sinks.
+type busSink struct {
+	name    string
+	handler Handler
+	queue   chan queuedEvent
+}
+
+// NewBus returns a bus without sinks.
+func NewBus() *Bus {
+	return &Bus{
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "coturn_exporter_sink_dropped_events_total",
+			Help: "Number of events dropped because the queue of a sink was full",
+		}, []string{"sink", "type"}),
+		queueLength: prometheus.NewDesc(
+			"coturn_exporter_sink_queue_length",
+			"Number of events waiting for a sink",
+			[]string{"sink"}, nil,
+		),
+	}
+}
+
+// Subscribe adds a sink receiving every event. With a queueSize of 0 the
+// sink is called inline, otherwise up to queueSize events wait for it.
+// Sinks have to be subscribed before events are passed to the bus.
+func (b *Bus) Subscribe(name string, handler Handler, queueSize int) {
+	sink := &busSink{name: name, handler: handler}
+	if queueSize > 0 {
+		sink.queue = make(chan queuedEvent, queueSize)
+		go sink.run()
+	}
+	b.sinks = append(b.sinks, sink)
+}
+
+// HandleAllocation implements Handler.
+func (b *Bus) HandleAllocation(e AllocationEvent) {
+	for _, sink := range b.sinks {
+		if sink.queue == nil {
+			sink.handler.HandleAllocation(e)
+			continue
+		}
+		b.enqueue(sink, queuedEvent{allocation: &e}, "allocation")
+	}
+}
+
+// HandleTraffic implements Handler.
+func (b *Bus) HandleTraffic(e TrafficEvent) {
+	for _, sink := range b.sinks {
+		if sink.queue == nil {
+			sink.handler.HandleTraffic(e)
+			continue
+		}
+		b.enqueue(sink, queuedEvent{traffic: &e}, "traffic")
+	}
+}
+
+func (b *Bus) enqueue(sink *busSink, e queuedEvent, eventType string) {
+	select {
+	case sink.queue <- e:
+	default:
+		b.dropped.WithLabelValues(sink.name, eventType).Inc()
+	}
+}
+
+func (s *busSink) run() {
+	for e := range s.queue {
+		if e.allocation != nil {
+			s.handler.HandleAllocation(*e.allocation)
+		} else {
+			s.handler.HandleTraffic(*e.traffic)
+		}
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (b *Bus) Describe(ch chan<- *prometheus.Desc) {
+	b.dropped.Describe(ch)
+	ch <- b.queueLength
+}
+
+// Collect implements prometheus.Collector.
+func (b *Bus) Collect(ch chan<- prometheus.Metric) {
+	b.dropped.Collect(ch)
+	for _, sink := range b.sinks {
+		if sink.queue != nil {
+			ch <- prometheus.MustNewConstMetric(b.queueLength, prometheus.GaugeValue, float64(len(sink.queue)), sink.name)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package source
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The kinds of parse failures.
+const (
+	ParseFailureKey     = "key"
+	ParseFailureTraffic = "traffic"
+	ParseFailureStatus  = "status"
+)
+
+// errUnknownState is the failure of status payloads that are not new,
+// refreshed or deleted.
+var errUnknownState = errors.New("unknown allocation state")
+
+// ParseFailures counts the keys and payloads that could not be parsed, so
+// that a change of coturn's format shows up in alerts. The realm is empty
+// for keys. It has to be registered by the program using the package.
+var ParseFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "coturn_exporter_parse_failures_total",
+	Help: "Number of statsdb keys and payloads that could not be parsed",
+}, []string{"kind", "realm"})
+
+// parseFailureSamples is the number of failures RecentParseFailures keeps.
+const parseFailureSamples = 20
+
+// ParseFailure is a key or payload that could not be parsed.
+type ParseFailure struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Realm   string    `json:"realm,omitempty"`
+	Key     string    `json:"key"`
+	Payload string    `json:"payload,omitempty"`
+	Error   string    `json:"error"`
+}
+
+var recentParseFailures struct {
+	sync.Mutex
+	failures []ParseFailure
+	next     int
+}
+
+// RecordParseFailure counts a parse failure and keeps it as a sample.
+func RecordParseFailure(kind string, realm string, key string, payload string, err error) {
+	ParseFailures.WithLabelValues(kind, realm).Inc()
+
+	failure := ParseFailure{time.Now(), kind, realm, key, payload, err.Error()}
+	recentParseFailures.Lock()
+	defer recentParseFailures.Unlock()
+	if len(recentParseFailures.failures) < parseFailureSamples {
+		recentParseFailures.failures = append(recentParseFailures.failures, failure)
+		return
+	}
+	recentParseFailures.failures[recentParseFailures.next] = failure
+	recentParseFailures.next = (recentParseFailures.next + 1) % parseFailureSamples
+}
+
+// RecentParseFailures returns the last parse failures, oldest first.
+func RecentParseFailures() []ParseFailure {
+	recentParseFailures.Lock()
+	defer recentParseFailures.Unlock()
+	failures := recentParseFailures.failures
+	result := make([]ParseFailure, 0, len(failures))
+	result = append(result, failures[recentParseFailures.next:]...)
+	return append(result, failures[:recentParseFailures.next]...)
+}
@@ -0,0 +1,126 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package source
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RateLimiter passes traffic events to a handler at a bounded rate. Events
+// that arrive faster are queued, and dropped once the queue is full, so that
+// a burst of messages cannot take more than the configured share of the CPU.
+// Allocation events always pass right away, since a dropped one would leave
+// the allocation count off.
+type RateLimiter struct {
+	handler Handler
+	rate    float64
+	queue   chan TrafficEvent
+
+	dropped     *prometheus.CounterVec
+	deferred    *prometheus.CounterVec
+	queueLength prometheus.GaugeFunc
+}
+
+// NewRateLimiter returns a handler passing at most rate traffic events per
+// second to handler, queueing up to queueSize events. Start has to be called
+// to start the processing. handler has to be safe for concurrent use.
+func NewRateLimiter(handler Handler, rate float64, queueSize int) *RateLimiter {
+	l := &RateLimiter{
+		handler: handler,
+		rate:    rate,
+		queue:   make(chan TrafficEvent, queueSize),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "coturn_exporter_dropped_events_total",
+			Help: "Number of events dropped because the rate limit queue was full",
+		}, []string{"type"}),
+		deferred: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "coturn_exporter_deferred_events_total",
+			Help: "Number of events that had to wait for the rate limit",
+		}, []string{"type"}),
+	}
+	l.queueLength = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "coturn_exporter_event_queue_length",
+		Help: "Number of events waiting for the rate limit",
+	}, func() float64 {
+		return float64(len(l.queue))
+	})
+	return l
+}
+
+// HandleAllocation implements Handler.
+func (l *RateLimiter) HandleAllocation(e AllocationEvent) {
+	l.handler.HandleAllocation(e)
+}
+
+// HandleTraffic implements Handler.
+func (l *RateLimiter) HandleTraffic(e TrafficEvent) {
+	select {
+	case l.queue <- e:
+	default:
+		l.dropped.WithLabelValues("traffic").Inc()
+	}
+}
+
+// Start processes the queued events in the background.
+func (l *RateLimiter) Start() {
+	go l.run()
+}
+
+// run is a token bucket allowing bursts of up to one second worth of events.
+func (l *RateLimiter) run() {
+	tokens := l.rate
+	last := time.Now()
+
+	for e := range l.queue {
+		now := time.Now()
+		tokens += now.Sub(last).Seconds() * l.rate
+		if tokens > l.rate {
+			tokens = l.rate
+		}
+		last = now
+
+		if tokens < 1 {
+			l.deferred.WithLabelValues("traffic").Inc()
+			time.Sleep(time.Duration((1 - tokens) / l.rate * float64(time.Second)))
+			tokens = 1
+			last = time.Now()
+		}
+		tokens--
+
+		l.handler.HandleTraffic(e)
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (l *RateLimiter) Describe(ch chan<- *prometheus.Desc) {
+	l.dropped.Describe(ch)
+	l.deferred.Describe(ch)
+	l.queueLength.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (l *RateLimiter) Collect(ch chan<- prometheus.Metric) {
+	l.dropped.Collect(ch)
+	l.deferred.Collect(ch)
+	l.queueLength.Collect(ch)
+}
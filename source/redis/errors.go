@@ -0,0 +1,78 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package redis
+
+import (
+	"io"
+	"net"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Errors counts the failed redis operations by what the exporter was doing
+// and the class of the error. It has to be registered by the program using
+// the package.
+var Errors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "coturn_exporter_redis_errors_total",
+	Help: "Number of failed redis operations by operation and error class",
+}, []string{"operation", "class"})
+
+// countError counts err, if any, for operation and returns it.
+func countError(operation string, err error) error {
+	if err != nil {
+		Errors.WithLabelValues(operation, errorClass(err)).Inc()
+	}
+	return err
+}
+
+// errClosedMessage is the message of the unexported error go-redis returns
+// from a closed client or subscription.
+const errClosedMessage = "redis: client is closed"
+
+// errorClass sorts err into timeout, connection, pool_timeout, server or
+// other. go-redis does not export its error types, so replies from the
+// server are recognized by their upper case error code, e.g. ERR or
+// LOADING.
+func errorClass(err error) string {
+	if netErr, ok := err.(net.Error); ok {
+		if netErr.Timeout() {
+			return "timeout"
+		}
+		return "connection"
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return "connection"
+	}
+
+	message := err.Error()
+	switch message {
+	case "redis: connection pool timeout":
+		return "pool_timeout"
+	case errClosedMessage:
+		return "connection"
+	}
+	code := strings.SplitN(message, " ", 2)[0]
+	if code != "" && strings.ToUpper(code) == code && strings.ToLower(code) != code {
+		return "server"
+	}
+	return "other"
+}
@@ -0,0 +1,119 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package redis
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/iknow/coturn_exporter/parser"
+
+	goredis "github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// mgetBatchSize limits the number of keys fetched per MGET so a large
+// statsdb does not block redis with a single huge command.
+const mgetBatchSize = 1000
+
+var (
+	pullAllocationsDesc = prometheus.NewDesc(
+		"coturn_allocations",
+		"Number of allocations",
+		[]string{"realm"}, nil,
+	)
+	pullDurationDesc = prometheus.NewDesc(
+		"coturn_exporter_pull_duration_seconds",
+		"Time spent reading the statsdb keys",
+		nil, nil,
+	)
+	pullSuccessDesc = prometheus.NewDesc(
+		"coturn_exporter_pull_success",
+		"Whether reading the statsdb keys succeeded",
+		nil, nil,
+	)
+)
+
+// pullCollector reads the allocation status keys on every scrape instead of
+// maintaining state from pubsub. Traffic is only published and never stored
+// by coturn, so only the allocation count is available in this mode.
+type pullCollector struct {
+	client *goredis.Client
+}
+
+// NewPullCollector returns a collector reading the allocation status keys on
+// every scrape.
+func NewPullCollector(client *goredis.Client) prometheus.Collector {
+	return &pullCollector{client}
+}
+
+func (c *pullCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pullAllocationsDesc
+	ch <- pullDurationDesc
+	ch <- pullSuccessDesc
+}
+
+func (c *pullCollector) Collect(ch chan<- prometheus.Metric) {
+	start := time.Now()
+	counts, err := c.countAllocations()
+	ch <- prometheus.MustNewConstMetric(pullDurationDesc, prometheus.GaugeValue, time.Since(start).Seconds())
+
+	if err != nil {
+		fmt.Println("Unable to read statsdb keys: ", err)
+		ch <- prometheus.MustNewConstMetric(pullSuccessDesc, prometheus.GaugeValue, 0)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(pullSuccessDesc, prometheus.GaugeValue, 1)
+
+	for realm, count := range counts {
+		ch <- prometheus.MustNewConstMetric(pullAllocationsDesc, prometheus.GaugeValue, count, realm)
+	}
+}
+
+func (c *pullCollector) countAllocations() (map[string]float64, error) {
+	var keys []string
+	iter := c.client.Scan(0, parser.StatusPattern(), mgetBatchSize).Iterator()
+	for iter.Next() {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, countError("scan", err)
+	}
+
+	values, err := mget(c.client, keys)
+	if err != nil {
+		return nil, countError("mget", err)
+	}
+
+	counts := make(map[string]float64)
+	for i, value := range values {
+		// the key expired between the SCAN and the MGET
+		if value == nil {
+			continue
+		}
+		metadata, err := parser.ParseKeyName(keys[i])
+		if err != nil {
+			continue
+		}
+		counts[metadata.Realm]++
+	}
+	return counts, nil
+}
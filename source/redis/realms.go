@@ -0,0 +1,116 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package redis
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/iknow/coturn_exporter/parser"
+	"github.com/iknow/coturn_exporter/source"
+)
+
+// realmScanCount is the number of keys asked for per SCAN call when
+// discovering realms.
+const realmScanCount = 1000
+
+// runRealms subscribes to every realm found by discoverRealms, now and every
+// RealmDiscoveryInterval, until Close is called and every realm
+// subscription has processed its buffered messages.
+func (s *Source) runRealms(handler source.Handler) error {
+	if _, ok := parser.RealmChannelPattern(""); !ok {
+		return fmt.Errorf("subscribing to every realm separately requires the stock key layout")
+	}
+
+	// like a first subscription, for LastReceive until a realm is found
+	s.lock.Lock()
+	s.lastReceive = time.Now()
+	s.lock.Unlock()
+
+	var running sync.WaitGroup
+	subscribe := func() {
+		realms, err := s.discoverRealms()
+		if err != nil {
+			fmt.Println("Unable to discover realms: ", err)
+			return
+		}
+		for _, realm := range realms {
+			s.subscribeRealm(realm, handler, &running)
+		}
+	}
+
+	subscribe()
+	ticker := time.NewTicker(s.RealmDiscoveryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			subscribe()
+		case <-s.done:
+			running.Wait()
+			return nil
+		}
+	}
+}
+
+// discoverRealms returns the realms, as they appear in the keys, that have
+// at least one allocation.
+func (s *Source) discoverRealms() ([]string, error) {
+	found := make(map[string]bool)
+	iter := s.client.Scan(0, parser.StatusPattern(), realmScanCount).Iterator()
+	for iter.Next() {
+		if realm, ok := parser.KeyRealm(iter.Val()); ok {
+			found[realm] = true
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, countError("scan", err)
+	}
+
+	realms := make([]string, 0, len(found))
+	for realm := range found {
+		realms = append(realms, realm)
+	}
+	sort.Strings(realms)
+	return realms, nil
+}
+
+// subscribeRealm starts a subscription to the channels of realm unless
+// there already is one. Subscriptions are kept until Close, a realm that
+// lost its last allocation usually gets new ones.
+func (s *Source) subscribeRealm(realm string, handler source.Handler, running *sync.WaitGroup) {
+	pattern, _ := parser.RealmChannelPattern(realm)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed || s.realms[realm] != nil {
+		return
+	}
+	child := s.child(pattern)
+	s.realms[realm] = child
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		child.Run(handler)
+	}()
+}
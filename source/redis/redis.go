@@ -0,0 +1,580 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package redis reads the coturn statsdb from redis.
+package redis
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iknow/coturn_exporter/parser"
+	"github.com/iknow/coturn_exporter/source"
+
+	goredis "github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Source delivers the events published on the statsdb.
+type Source struct {
+	client *goredis.Client
+
+	// OnMessage, if set, is called with every raw message before it is
+	// dispatched.
+	OnMessage func(channel string, payload string)
+	// OnResubscribe, if set, is called after the subscription was
+	// reestablished, since messages may have been lost in between.
+	OnResubscribe func()
+	// ChannelSize is the number of received messages buffered for
+	// processing. Messages arriving while the buffer is full are dropped,
+	// since blocking would only make redis drop the subscription once its
+	// output buffer limit is reached.
+	ChannelSize int
+	// HealthCheckInterval is how long the subscription may be idle before
+	// it is pinged. The subscription is reestablished if the ping is not
+	// answered within the interval either. Zero disables the check.
+	HealthCheckInterval time.Duration
+	// LagProbeInterval is how often the lag is probed with a ping through
+	// the subscription, whose pong is processed after every message
+	// published before it. Zero disables the probes.
+	LagProbeInterval time.Duration
+	// LoadTraffic makes LoadAllocations also read the traffic key of every
+	// allocation. Stock coturn only publishes the traffic reports, patched
+	// builds may store them.
+	LoadTraffic bool
+	// RealmDiscoveryInterval, if set, subscribes to the channels of every
+	// realm separately instead of to all channels at once, each realm with
+	// its own buffer and processing goroutine, so that a flood of messages
+	// of one realm neither delays nor drops those of the others. Realms are
+	// discovered by scanning the status keys every interval, the messages
+	// of a new realm are missed until then. It requires the stock key
+	// layout.
+	RealmDiscoveryInterval time.Duration
+
+	dropped      prometheus.Counter
+	resubscribes prometheus.Counter
+	buffered     prometheus.GaugeFunc
+	realmCount   prometheus.GaugeFunc
+	lagDesc      *prometheus.Desc
+
+	// pattern is the channel pattern subscribed to, every channel if empty
+	pattern string
+
+	lock         sync.Mutex
+	subscription *goredis.PubSub
+	closed       bool
+	done         chan struct{}
+	messages     chan received
+	lastReceive  time.Time
+	// lag is the delay of the last processed probe, pendingProbe when the
+	// oldest probe still in flight was sent
+	lag          time.Duration
+	hasLag       bool
+	pendingProbe time.Time
+	// realm -> source subscribed to the realm with RealmDiscoveryInterval
+	realms map[string]*Source
+}
+
+// received is a message or a lag probe in the processing buffer.
+type received struct {
+	msg   *goredis.Message
+	probe time.Time
+	// time is when the message was received, before it waited in the
+	// buffer
+	time time.Time
+}
+
+// lagProbePrefix marks the pongs of lag probes, which carry the time they
+// were sent.
+const lagProbePrefix = "coturn_exporter_lag:"
+
+func New(client *goredis.Client) *Source {
+	s := &Source{
+		client:              client,
+		ChannelSize:         10000,
+		HealthCheckInterval: 5 * time.Second,
+		LagProbeInterval:    10 * time.Second,
+		done:                make(chan struct{}),
+		realms:              make(map[string]*Source),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "coturn_exporter_pubsub_dropped_messages_total",
+			Help: "Number of pubsub messages dropped because the processing buffer was full",
+		}),
+		resubscribes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "coturn_exporter_pubsub_resubscribes_total",
+			Help: "Number of times the subscription was reestablished after failing the health check or being dropped by Resubscribe",
+		}),
+		lagDesc: prometheus.NewDesc(
+			"coturn_exporter_pubsub_lag_seconds",
+			"Time from sending a ping through the subscription until the messages published before it were processed",
+			nil, nil,
+		),
+	}
+	s.buffered = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "coturn_exporter_pubsub_buffered_messages",
+		Help: "Number of received pubsub messages waiting to be processed",
+	}, func() float64 {
+		return float64(s.bufferedMessages())
+	})
+	s.realmCount = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "coturn_exporter_pubsub_realm_subscriptions",
+		Help: "Number of realms subscribed to separately",
+	}, func() float64 {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		return float64(len(s.realms))
+	})
+	return s
+}
+
+// child returns a source subscribed to pattern that shares the
+// configuration and the counters of s.
+func (s *Source) child(pattern string) *Source {
+	return &Source{
+		client:              s.client,
+		OnMessage:           s.OnMessage,
+		OnResubscribe:       s.OnResubscribe,
+		ChannelSize:         s.ChannelSize,
+		HealthCheckInterval: s.HealthCheckInterval,
+		LagProbeInterval:    s.LagProbeInterval,
+		dropped:             s.dropped,
+		resubscribes:        s.resubscribes,
+		pattern:             pattern,
+		done:                make(chan struct{}),
+	}
+}
+
+// Run subscribes to every statsdb channel. It only returns after Close
+// was called and the buffered messages are processed.
+func (s *Source) Run(handler source.Handler) error {
+	if s.RealmDiscoveryInterval > 0 {
+		return s.runRealms(handler)
+	}
+
+	messages := make(chan received, s.ChannelSize)
+	s.lock.Lock()
+	s.messages = messages
+	s.lock.Unlock()
+	go s.receive(messages)
+	if s.LagProbeInterval > 0 {
+		go s.probeLag()
+	}
+
+	for r := range messages {
+		if !r.probe.IsZero() {
+			s.probed(r.probe)
+			continue
+		}
+		msg := r.msg
+		if s.OnMessage != nil {
+			s.OnMessage(msg.Channel, msg.Payload)
+		}
+		source.Dispatch(handler, msg.Channel, msg.Payload, r.time)
+	}
+	return nil
+}
+
+// Close ends the subscription, making Run return.
+func (s *Source) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.closed {
+		close(s.done)
+	}
+	s.closed = true
+	for _, realm := range s.realms {
+		realm.Close()
+	}
+	if s.subscription != nil {
+		return s.subscription.Close()
+	}
+	return nil
+}
+
+// Resubscribe drops the current subscriptions and subscribes again.
+func (s *Source) Resubscribe() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, realm := range s.realms {
+		realm.Resubscribe()
+	}
+	if s.subscription != nil {
+		s.subscription.Close()
+		s.subscription = nil
+	}
+}
+
+// LastReceive returns when the last message or health check pong was
+// received, or when the first subscription was made if there was none yet.
+func (s *Source) LastReceive() time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	last := s.lastReceive
+	for _, realm := range s.realms {
+		if t := realm.LastReceive(); t.After(last) {
+			last = t
+		}
+	}
+	return last
+}
+
+// bufferedMessages returns the number of received messages waiting to be
+// processed.
+func (s *Source) bufferedMessages() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	buffered := len(s.messages)
+	for _, realm := range s.realms {
+		buffered += realm.bufferedMessages()
+	}
+	return buffered
+}
+
+func (s *Source) received() {
+	s.lock.Lock()
+	s.lastReceive = time.Now()
+	s.lock.Unlock()
+}
+
+// probeLag pings the subscription every LagProbeInterval until Close is
+// called.
+func (s *Source) probeLag() {
+	ticker := time.NewTicker(s.LagProbeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.lock.Lock()
+		subscription, closed := s.subscription, s.closed
+		now := time.Now()
+		if subscription != nil && s.pendingProbe.IsZero() {
+			s.pendingProbe = now
+		}
+		s.lock.Unlock()
+		if closed {
+			return
+		}
+		if subscription == nil {
+			continue
+		}
+		// failures show in the health check, which pings the same way
+		subscription.Ping(lagProbePrefix + strconv.FormatInt(now.UnixNano(), 10))
+	}
+}
+
+// probed records the lag of a probe sent at sent that was just processed.
+func (s *Source) probed(sent time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lag = time.Since(sent)
+	s.hasLag = true
+	// later probes are still in flight, but they cannot have been sent
+	// before this one was processed
+	if !sent.Before(s.pendingProbe) {
+		s.pendingProbe = time.Time{}
+	}
+}
+
+// parseProbe returns when the lag probe answered by payload was sent, or
+// false if the pong answers another ping.
+func parseProbe(payload string) (time.Time, bool) {
+	if !strings.HasPrefix(payload, lagProbePrefix) {
+		return time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(payload[len(lagProbePrefix):], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
+
+func (s *Source) isClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closed
+}
+
+// watch makes subscription the one closed by Close. It returns false if
+// Close was already called.
+func (s *Source) watch(subscription *goredis.PubSub) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.subscription = subscription
+	if s.lastReceive.IsZero() {
+		s.lastReceive = time.Now()
+	}
+	// probes sent on the previous subscription are never answered
+	s.pendingProbe = time.Time{}
+	return !s.closed
+}
+
+// replaced returns whether subscription was closed by Close or Resubscribe.
+func (s *Source) replaced(subscription *goredis.PubSub) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closed || s.subscription != subscription
+}
+
+func (s *Source) receive(messages chan<- received) {
+	defer close(messages)
+	resubscribed := false
+	for {
+		pattern := s.pattern
+		if pattern == "" {
+			pattern = parser.ChannelPattern()
+		}
+		subscription := s.client.PSubscribe(pattern)
+		if !s.watch(subscription) {
+			subscription.Close()
+			return
+		}
+		s.receiveFrom(subscription, messages, resubscribed)
+		subscription.Close()
+		if s.isClosed() {
+			return
+		}
+		s.resubscribes.Inc()
+		resubscribed = true
+	}
+}
+
+// receiveFrom reads messages until the subscription fails the health check,
+// is closed or is replaced. OnResubscribe is called once the subscription
+// is confirmed if resubscribed is set.
+func (s *Source) receiveFrom(subscription *goredis.PubSub, messages chan<- received, resubscribed bool) {
+	pinged := false
+	for {
+		msg, err := subscription.ReceiveTimeout(s.HealthCheckInterval)
+		if err != nil {
+			if s.replaced(subscription) {
+				return
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				if pinged {
+					countError("subscribe", err)
+					fmt.Println("Subscription failed the health check, resubscribing")
+					return
+				}
+				if err := countError("ping", subscription.Ping()); err != nil {
+					fmt.Println("Unable to ping subscription: ", err)
+				}
+				pinged = true
+				continue
+			}
+			countError("receive", err)
+			// a closed subscription never recovers, unlike a broken
+			// connection which go-redis reestablishes on the next receive
+			if err.Error() == errClosedMessage {
+				fmt.Println("Subscription closed, resubscribing")
+				time.Sleep(time.Second)
+				return
+			}
+			fmt.Println("Unable to receive from subscription: ", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		pinged = false
+
+		switch m := msg.(type) {
+		case *goredis.Subscription:
+			if resubscribed && s.OnResubscribe != nil {
+				s.OnResubscribe()
+			}
+			resubscribed = false
+		case *goredis.Pong:
+			s.received()
+			if sent, ok := parseProbe(m.Payload); ok {
+				// with a full buffer the probe stays pending, which shows
+				// as growing lag
+				select {
+				case messages <- received{probe: sent}:
+				default:
+				}
+			}
+		case *goredis.Message:
+			s.received()
+			select {
+			case messages <- received{msg: m, time: time.Now()}:
+			default:
+				s.dropped.Inc()
+			}
+		}
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (s *Source) Describe(ch chan<- *prometheus.Desc) {
+	s.dropped.Describe(ch)
+	s.resubscribes.Describe(ch)
+	s.buffered.Describe(ch)
+	if s.RealmDiscoveryInterval > 0 {
+		s.realmCount.Describe(ch)
+	}
+	ch <- s.lagDesc
+}
+
+// Collect implements prometheus.Collector.
+func (s *Source) Collect(ch chan<- prometheus.Metric) {
+	s.dropped.Collect(ch)
+	s.resubscribes.Collect(ch)
+	s.buffered.Collect(ch)
+	if s.RealmDiscoveryInterval > 0 {
+		s.realmCount.Collect(ch)
+	}
+
+	if lag, ok := s.currentLag(); ok {
+		ch <- prometheus.MustNewConstMetric(s.lagDesc, prometheus.GaugeValue, lag.Seconds())
+	}
+}
+
+// currentLag returns the lag of the subscription, the highest of the realm
+// subscriptions with RealmDiscoveryInterval, or false if none was probed
+// yet.
+func (s *Source) currentLag() (time.Duration, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	lag, hasLag := s.lag, s.hasLag
+	// a probe stuck for longer than the last lag shows the growing backlog
+	if !s.pendingProbe.IsZero() {
+		if pending := time.Since(s.pendingProbe); pending > lag {
+			lag, hasLag = pending, true
+		}
+	}
+	for _, realm := range s.realms {
+		if realmLag, ok := realm.currentLag(); ok && realmLag >= lag {
+			lag, hasLag = realmLag, true
+		}
+	}
+	return lag, hasLag
+}
+
+// LoadAllocations returns every allocation that currently has a status key
+// along with its status.
+func (s *Source) LoadAllocations() ([]source.Allocation, error) {
+	// SCAN instead of KEYS, which blocks the statsdb for as long as it
+	// takes to walk the whole keyspace
+	var keys []string
+	seen := make(map[string]bool)
+	iter := s.client.Scan(0, parser.StatusPattern(), mgetBatchSize).Iterator()
+	for iter.Next() {
+		// SCAN returns keys again that were moved by a rehash
+		if key := iter.Val(); !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, countError("scan", err)
+	}
+	values, err := mget(s.client, keys)
+	if err != nil {
+		return nil, countError("mget", err)
+	}
+
+	result := make([]source.Allocation, 0, len(keys))
+	for i, key := range keys {
+		// the key expired between the SCAN and the MGET
+		status, ok := values[i].(string)
+		if !ok {
+			continue
+		}
+		metadata, err := parser.ParseKeyName(key)
+		if err != nil {
+			fmt.Println("Unexpected key name: ", key)
+			source.RecordParseFailure(source.ParseFailureKey, "", key, "", err)
+			continue
+		}
+		result = append(result, source.Allocation{
+			Metadata:      metadata,
+			Status:        status,
+			ClientAddress: parser.ParseStatusFields(status)[parser.StatusFieldClient],
+		})
+	}
+	if s.LoadTraffic {
+		if err := s.loadTraffic(result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// loadTraffic sets the traffic of the allocations that have a traffic key
+// next to their status key.
+func (s *Source) loadTraffic(allocations []source.Allocation) error {
+	keys := make([]string, len(allocations))
+	for i, a := range allocations {
+		keys[i] = a.Metadata.AllocationName + "/" + parser.MessageTraffic
+	}
+	values, err := mget(s.client, keys)
+	if err != nil {
+		return countError("mget", err)
+	}
+	for i, value := range values {
+		payload, ok := value.(string)
+		if !ok {
+			continue
+		}
+		traffic, err := parser.ParseTrafficMetric(payload)
+		if err != nil {
+			fmt.Println("Unexpected traffic payload: ", payload)
+			source.RecordParseFailure(source.ParseFailureTraffic, allocations[i].Metadata.Realm, keys[i], payload, err)
+			continue
+		}
+		allocations[i].Traffic = &traffic
+	}
+	return nil
+}
+
+// mget reads keys in pipelined batches so a large statsdb neither needs one
+// round trip per key nor blocks redis with a single huge command. Missing
+// keys are returned as nil.
+func mget(client *goredis.Client, keys []string) ([]interface{}, error) {
+	pipe := client.Pipeline()
+	defer pipe.Close()
+
+	var cmds []*goredis.SliceCmd
+	for start := 0; start < len(keys); start += mgetBatchSize {
+		end := start + mgetBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		cmds = append(cmds, pipe.MGet(keys[start:end]...))
+	}
+	if len(cmds) == 0 {
+		return nil, nil
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+
+	values := make([]interface{}, 0, len(keys))
+	for _, cmd := range cmds {
+		values = append(values, cmd.Val()...)
+	}
+	return values, nil
+}
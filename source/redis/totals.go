@@ -0,0 +1,117 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package redis
+
+import (
+	"time"
+
+	"github.com/iknow/coturn_exporter/parser"
+
+	goredis "github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	statsdbTotalDescs = [4]*prometheus.Desc{
+		prometheus.NewDesc("coturn_statsdb_received_packets_total", "Number of packets received as stored in the statsdb at startup", []string{"realm"}, nil),
+		prometheus.NewDesc("coturn_statsdb_received_bytes_total", "Number of bytes received as stored in the statsdb at startup", []string{"realm"}, nil),
+		prometheus.NewDesc("coturn_statsdb_sent_packets_total", "Number of packets sent as stored in the statsdb at startup", []string{"realm"}, nil),
+		prometheus.NewDesc("coturn_statsdb_sent_bytes_total", "Number of bytes sent as stored in the statsdb at startup", []string{"realm"}, nil),
+	}
+	statsdbTimestampDesc = prometheus.NewDesc(
+		"coturn_statsdb_totals_timestamp_seconds",
+		"Time the statsdb totals were read",
+		nil, nil,
+	)
+)
+
+// TotalsCollector exposes the cumulative traffic coturn stores in the
+// total_traffic keys, as read once by Load. It lets a restarted exporter
+// report the traffic of long-lived allocations which its own counters only
+// see from the restart on.
+type TotalsCollector struct {
+	client   *goredis.Client
+	totals   map[string]parser.TrafficMetric
+	loadedAt time.Time
+}
+
+func NewTotalsCollector(client *goredis.Client) *TotalsCollector {
+	return &TotalsCollector{client: client}
+}
+
+// Load reads and sums the total_traffic keys per realm. It must be called
+// before the collector is registered.
+func (c *TotalsCollector) Load() error {
+	var keys []string
+	iter := c.client.Scan(0, parser.TotalTrafficPattern(), mgetBatchSize).Iterator()
+	for iter.Next() {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return countError("scan", err)
+	}
+	values, err := mget(c.client, keys)
+	if err != nil {
+		return countError("mget", err)
+	}
+
+	totals := make(map[string]parser.TrafficMetric)
+	for i, value := range values {
+		payload, ok := value.(string)
+		if !ok {
+			continue
+		}
+		metadata, err := parser.ParseKeyName(keys[i])
+		if err != nil {
+			continue
+		}
+		traffic, err := parser.ParseTrafficMetric(payload)
+		if err != nil {
+			continue
+		}
+		total := totals[metadata.Realm]
+		total.Rcvp += traffic.Rcvp
+		total.Rcvb += traffic.Rcvb
+		total.Sentp += traffic.Sentp
+		total.Sentb += traffic.Sentb
+		totals[metadata.Realm] = total
+	}
+
+	c.totals = totals
+	c.loadedAt = time.Now()
+	return nil
+}
+
+func (c *TotalsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range statsdbTotalDescs {
+		ch <- desc
+	}
+	ch <- statsdbTimestampDesc
+}
+
+func (c *TotalsCollector) Collect(ch chan<- prometheus.Metric) {
+	for realm, total := range c.totals {
+		for i, value := range [4]float64{total.Rcvp, total.Rcvb, total.Sentp, total.Sentb} {
+			ch <- prometheus.MustNewConstMetric(statsdbTotalDescs[i], prometheus.CounterValue, value, realm)
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(statsdbTimestampDesc, prometheus.GaugeValue, float64(c.loadedAt.UnixNano())/1e9)
+}
@@ -0,0 +1,256 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package source defines where coturn events come from. A Source turns
+// whatever coturn exposes into typed events and hands them to a Handler,
+// which keeps the metric logic independent of redis.
+package source
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/iknow/coturn_exporter/logging"
+	"github.com/iknow/coturn_exporter/parser"
+	"github.com/iknow/coturn_exporter/tracing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ParseDuration measures the time spent parsing statsdb messages. It has to
+// be registered by the program using the package.
+var ParseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "coturn_exporter_parse_duration_seconds",
+	Help: "Time spent parsing statsdb messages",
+	// 100ns to 1.6ms
+	Buckets: prometheus.ExponentialBuckets(1e-7, 4, 8),
+}, []string{"parser"})
+
+// keyParseDuration and trafficParseDuration are resolved once as they are
+// observed for every message.
+var (
+	keyParseDuration     = ParseDuration.WithLabelValues("key")
+	trafficParseDuration = ParseDuration.WithLabelValues("traffic")
+)
+
+// UnknownFields counts the fields of traffic payloads that are not traffic
+// fields, such as those added by newer or patched coturn builds. It has to be
+// registered by the program using the package.
+var UnknownFields = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "coturn_exporter_unknown_payload_fields_total",
+	Help: "Number of unknown fields in traffic payloads by field name",
+}, []string{"field"})
+
+// Tracer, if set, traces the receive, parse and update steps of a sample of
+// the dispatched messages. It has to be set by the program using the
+// package.
+var Tracer *tracing.Tracer
+
+// PayloadMode is the mode traffic payloads are parsed in by Dispatch. It has
+// to be set before any source is run.
+var PayloadMode = parser.Lenient
+
+type AllocationEventType int
+
+const (
+	AllocationNew AllocationEventType = iota
+	AllocationRefreshed
+	AllocationDeleted
+)
+
+// AllocationEvent is a change in the lifecycle of an allocation.
+type AllocationEvent struct {
+	Type     AllocationEventType
+	Metadata parser.MessageMetadata
+	// Status is the raw status as reported by coturn.
+	Status string
+	// Time is when the event was received.
+	Time time.Time
+	// ClientAddress is the ip:port of the client if the source knows it.
+	ClientAddress string
+	// Lifetime is the lifetime granted by a new or refreshed status, zero
+	// if the status has none.
+	Lifetime time.Duration
+	// DeletionReason is the parser.Deletion reason of a deleted status.
+	DeletionReason string
+}
+
+type TrafficKind int
+
+const (
+	// TrafficClient is the traffic between the client and the server since
+	// the previous report.
+	TrafficClient TrafficKind = iota
+	// TrafficPeer is the traffic between the server and the peers since the
+	// previous report.
+	TrafficPeer
+	// TrafficTotal is the client traffic over the lifetime of a deleted
+	// allocation.
+	TrafficTotal
+	// TrafficPeerTotal is the peer traffic over the lifetime of a deleted
+	// allocation.
+	TrafficPeerTotal
+)
+
+var trafficKinds = map[string]TrafficKind{
+	parser.MessageTraffic:          TrafficClient,
+	parser.MessagePeerTraffic:      TrafficPeer,
+	parser.MessageTotalTraffic:     TrafficTotal,
+	parser.MessageTotalPeerTraffic: TrafficPeerTotal,
+}
+
+// TrafficEvent is a traffic report of an allocation. The counts are deltas
+// since the previous report unless Kind is one of the totals.
+type TrafficEvent struct {
+	Metadata parser.MessageMetadata
+	Traffic  parser.TrafficMetric
+	// Time is when the event was received.
+	Time time.Time
+	Kind TrafficKind
+}
+
+type Handler interface {
+	HandleAllocation(AllocationEvent)
+	HandleTraffic(TrafficEvent)
+}
+
+// MultiHandler passes every event to each of its handlers in order.
+type MultiHandler []Handler
+
+func (m MultiHandler) HandleAllocation(e AllocationEvent) {
+	for _, handler := range m {
+		handler.HandleAllocation(e)
+	}
+}
+
+func (m MultiHandler) HandleTraffic(e TrafficEvent) {
+	for _, handler := range m {
+		handler.HandleTraffic(e)
+	}
+}
+
+type Source interface {
+	// Run delivers events to handler. It only returns if the source fails or
+	// is exhausted.
+	Run(handler Handler) error
+}
+
+// Allocation is an existing allocation listed by a Loader.
+type Allocation struct {
+	Metadata parser.MessageMetadata
+	// Status is the raw status as reported by coturn.
+	Status string
+	// ClientAddress is the ip:port of the client if the source knows it.
+	ClientAddress string
+	// Traffic is the last traffic report of the allocation if the source
+	// stores it, nil otherwise.
+	Traffic *parser.TrafficMetric
+}
+
+// Loader is implemented by sources that can list the allocations that
+// already exist when the exporter starts.
+type Loader interface {
+	LoadAllocations() ([]Allocation, error)
+}
+
+// MultiLoader lists the allocations of all of its loaders.
+type MultiLoader []Loader
+
+func (m MultiLoader) LoadAllocations() ([]Allocation, error) {
+	var result []Allocation
+	for _, loader := range m {
+		allocations, err := loader.LoadAllocations()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, allocations...)
+	}
+	return result, nil
+}
+
+// Dispatch parses a raw statsdb message and passes the resulting event to
+// handler. Messages that do not map to an event are ignored.
+func Dispatch(handler Handler, channel string, payload string, now time.Time) {
+	span := Tracer.Start("receive", now)
+	span.SetAttribute("channel", channel)
+	defer span.End()
+
+	parseSpan := span.Child("parse")
+	start := time.Now()
+	// checked first to keep the arguments off the heap at the info level
+	if logging.CurrentLevel() == logging.Debug {
+		logging.Debugf("received %s %q", channel, payload)
+	}
+	metadata, err := parser.ParseKeyName(channel)
+	keyParseDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		parseSpan.SetAttribute("error", err.Error())
+		parseSpan.End()
+		fmt.Println("Unexpected key name: ", channel)
+		RecordParseFailure(ParseFailureKey, "", channel, payload, err)
+		return
+	}
+	parseSpan.SetAttribute("message_type", metadata.MessageType)
+
+	if kind, ok := trafficKinds[metadata.MessageType]; ok {
+		start := time.Now()
+		trafficMetric, unknown, err := parser.ParseTrafficFields(payload, PayloadMode)
+		trafficParseDuration.Observe(time.Since(start).Seconds())
+		for _, field := range unknown {
+			UnknownFields.WithLabelValues(field).Inc()
+		}
+		if err != nil {
+			parseSpan.SetAttribute("error", err.Error())
+			parseSpan.End()
+			fmt.Println("Unexpected traffic payload: ", payload)
+			RecordParseFailure(ParseFailureTraffic, metadata.Realm, channel, payload, err)
+			return
+		}
+		parseSpan.End()
+
+		updateSpan := span.Child("update")
+		handler.HandleTraffic(TrafficEvent{metadata, trafficMetric, now, kind})
+		updateSpan.End()
+	} else if metadata.MessageType == parser.MessageStatus {
+		status := parser.ParseStatus(payload)
+		client := status.Fields[parser.StatusFieldClient]
+		if metadata.Origin == "" {
+			metadata.Origin = status.Fields[parser.StatusFieldOrigin]
+		}
+		parseSpan.End()
+
+		updateSpan := span.Child("update")
+		switch status.State {
+		case parser.StatusNew:
+			handler.HandleAllocation(AllocationEvent{AllocationNew, metadata, payload, now, client, status.Lifetime, ""})
+		case parser.StatusRefreshed:
+			handler.HandleAllocation(AllocationEvent{AllocationRefreshed, metadata, payload, now, client, status.Lifetime, ""})
+		case parser.StatusDeleted:
+			handler.HandleAllocation(AllocationEvent{AllocationDeleted, metadata, payload, now, client, 0, status.DeletionReason()})
+		default:
+			RecordParseFailure(ParseFailureStatus, metadata.Realm, channel, payload, errUnknownState)
+			logging.Debugf("ignored status %q of unknown state on %s", payload, channel)
+		}
+		updateSpan.End()
+	} else {
+		parseSpan.End()
+		logging.Debugf("ignored message type %s on %s", metadata.MessageType, channel)
+	}
+}
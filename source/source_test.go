@@ -0,0 +1,56 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package source_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/iknow/coturn_exporter/collector"
+	"github.com/iknow/coturn_exporter/parser"
+	"github.com/iknow/coturn_exporter/source"
+)
+
+// BenchmarkDispatch measures parsing and handling a raw traffic message of
+// a tracked allocation, as received from the subscription.
+func BenchmarkDispatch(b *testing.B) {
+	c := collector.New(collector.Options{ReportInterval: 10 * time.Second})
+	channels := make([]string, 10000)
+	for i := range channels {
+		name := fmt.Sprintf("turn/realm/r%d/user/u%d/allocation/%d", i%4, i, i)
+		metadata, err := parser.ParseKeyName(name + "/status")
+		if err != nil {
+			b.Fatal(err)
+		}
+		c.HandleAllocation(source.AllocationEvent{Type: source.AllocationNew, Metadata: metadata, Status: "new lifetime=600"})
+		channels[i] = name + "/traffic"
+	}
+	payload := "rcvp=100, rcvb=20000, sentp=100, sentb=5000"
+	now := time.Now()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		source.Dispatch(c, channels[i%len(channels)], payload, now)
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+}
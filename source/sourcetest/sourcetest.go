@@ -0,0 +1,61 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package sourcetest provides a scripted source for testing the handlers of
+// source events without redis.
+package sourcetest
+
+import (
+	"time"
+
+	"github.com/iknow/coturn_exporter/source"
+)
+
+// Message is a raw statsdb message as the redis source receives it.
+type Message struct {
+	Channel string
+	Payload string
+	// Time is when the message was received, unknown if zero.
+	Time time.Time
+}
+
+// Source is a source.Source and source.Loader playing back scripted
+// messages through source.Dispatch, so that they are parsed like the ones
+// from redis.
+type Source struct {
+	// Allocations are listed by LoadAllocations.
+	Allocations []source.Allocation
+	// Messages are dispatched in order by Run.
+	Messages []Message
+}
+
+// Run implements source.Source. It returns once all messages are
+// dispatched.
+func (s *Source) Run(handler source.Handler) error {
+	for _, m := range s.Messages {
+		source.Dispatch(handler, m.Channel, m.Payload, m.Time)
+	}
+	return nil
+}
+
+// LoadAllocations implements source.Loader.
+func (s *Source) LoadAllocations() ([]source.Allocation, error) {
+	return s.Allocations, nil
+}
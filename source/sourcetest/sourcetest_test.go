@@ -0,0 +1,136 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sourcetest_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/iknow/coturn_exporter/collector"
+	"github.com/iknow/coturn_exporter/parser"
+	"github.com/iknow/coturn_exporter/source"
+	"github.com/iknow/coturn_exporter/source/sourcetest"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// recorder is a handler remembering the events it got.
+type recorder struct {
+	allocations []source.AllocationEvent
+	traffic     []source.TrafficEvent
+}
+
+func (r *recorder) HandleAllocation(e source.AllocationEvent) {
+	r.allocations = append(r.allocations, e)
+}
+
+func (r *recorder) HandleTraffic(e source.TrafficEvent) {
+	r.traffic = append(r.traffic, e)
+}
+
+func TestSourceDispatchesInOrder(t *testing.T) {
+	received := time.Unix(1000, 0)
+	src := &sourcetest.Source{Messages: []sourcetest.Message{
+		{Channel: "turn/realm/r/user/u/allocation/1/status", Payload: "new lifetime=600", Time: received},
+		{Channel: "turn/realm/r/user/u/allocation/1/traffic", Payload: "rcvp=1, rcvb=100, sentp=2, sentb=200", Time: received},
+		{Channel: "turn/realm/r/user/u/allocation/1/status", Payload: "deleted"},
+		{Channel: "not/a/statsdb/key", Payload: "new"},
+	}}
+	var r recorder
+	if err := src.Run(&r); err != nil {
+		t.Fatal(err)
+	}
+
+	var types []source.AllocationEventType
+	for _, e := range r.allocations {
+		types = append(types, e.Type)
+	}
+	if want := []source.AllocationEventType{source.AllocationNew, source.AllocationDeleted}; !reflect.DeepEqual(types, want) {
+		t.Fatalf("allocation events %v, want %v", types, want)
+	}
+	if r.allocations[0].Lifetime != 10*time.Minute || !r.allocations[0].Time.Equal(received) {
+		t.Errorf("new event %+v, want the lifetime and receive time of the message", r.allocations[0])
+	}
+	if len(r.traffic) != 1 || r.traffic[0].Traffic.Sentb != 200 {
+		t.Errorf("traffic events %+v, want the one report", r.traffic)
+	}
+}
+
+// TestCollectorAgainstSource runs the collector on a scripted source, as
+// the exporter runs it on redis.
+func TestCollectorAgainstSource(t *testing.T) {
+	loaded, err := parser.ParseKeyName("turn/realm/r/user/u/allocation/1/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &sourcetest.Source{
+		Allocations: []source.Allocation{{Metadata: loaded, Status: "new lifetime=600"}},
+		Messages: []sourcetest.Message{
+			{Channel: "turn/realm/r/user/u/allocation/2/status", Payload: "new lifetime=600"},
+			{Channel: "turn/realm/r/user/u/allocation/2/traffic", Payload: "rcvp=1, rcvb=100, sentp=2, sentb=200"},
+			{Channel: "turn/realm/r/user/u/allocation/1/traffic", Payload: "rcvp=3, rcvb=300, sentp=4, sentb=400"},
+			{Channel: "turn/realm/r/user/u/allocation/1/status", Payload: "deleted"},
+		},
+	}
+	c := collector.New(collector.Options{})
+	found, err := src.LoadAllocations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range found {
+		c.TrackAllocation(a)
+	}
+	if err := src.Run(c); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(c)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{
+		"coturn_allocations":          1,
+		"coturn_received_bytes_total": 400,
+		"coturn_sent_bytes_total":     600,
+	}
+	for _, family := range families {
+		if expected, ok := want[family.GetName()]; ok {
+			if got := value(family.GetMetric()[0]); got != expected {
+				t.Errorf("%s = %v, want %v", family.GetName(), got, expected)
+			}
+			delete(want, family.GetName())
+		}
+	}
+	if len(want) > 0 {
+		t.Errorf("missing metrics %v", want)
+	}
+}
+
+func value(m *dto.Metric) float64 {
+	if m.Gauge != nil {
+		return m.Gauge.GetValue()
+	}
+	return m.Counter.GetValue()
+}
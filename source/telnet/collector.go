@@ -0,0 +1,195 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package telnet
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	sessionsDesc = prometheus.NewDesc(
+		"coturn_sessions",
+		"Number of sessions listed by the admin interface",
+		[]string{"realm", "client_protocol", "relay_protocol"}, nil,
+	)
+	sessionAgeDesc = prometheus.NewDesc(
+		"coturn_session_age_seconds",
+		"Age of the sessions listed by the admin interface",
+		[]string{"realm"}, nil,
+	)
+	relaySessionsDesc = prometheus.NewDesc(
+		"coturn_sessions_by_relay_ip",
+		"Number of sessions by relay address, without the port",
+		[]string{"realm", "relay_ip"}, nil,
+	)
+	telnetDurationDesc = prometheus.NewDesc(
+		"coturn_exporter_telnet_duration_seconds",
+		"Time spent reading the session listing of the admin interface",
+		nil, nil,
+	)
+	telnetSuccessDesc = prometheus.NewDesc(
+		"coturn_exporter_telnet_success",
+		"Whether reading the session listing of the admin interface succeeded",
+		nil, nil,
+	)
+
+	// 10s to about 11h
+	sessionAgeBuckets = prometheus.ExponentialBuckets(10, 4, 7)
+)
+
+type sessionCollector struct {
+	client *Client
+}
+
+// NewCollector returns a collector reading the session listing on every
+// scrape.
+func NewCollector(client *Client) prometheus.Collector {
+	return &sessionCollector{client}
+}
+
+func (c *sessionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sessionsDesc
+	ch <- sessionAgeDesc
+	ch <- relaySessionsDesc
+	ch <- telnetDurationDesc
+	ch <- telnetSuccessDesc
+}
+
+type protocolKey struct {
+	realm  string
+	client string
+	relay  string
+}
+
+type relayKey struct {
+	realm string
+	ip    string
+}
+
+type ageHistogram struct {
+	count   uint64
+	sum     float64
+	buckets map[float64]uint64
+}
+
+func (c *sessionCollector) Collect(ch chan<- prometheus.Metric) {
+	start := time.Now()
+	sessions, err := c.client.Sessions()
+	ch <- prometheus.MustNewConstMetric(telnetDurationDesc, prometheus.GaugeValue, time.Since(start).Seconds())
+
+	if err != nil {
+		fmt.Println("Unable to read sessions from the admin interface: ", err)
+		ch <- prometheus.MustNewConstMetric(telnetSuccessDesc, prometheus.GaugeValue, 0)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(telnetSuccessDesc, prometheus.GaugeValue, 1)
+
+	protocols := make(map[protocolKey]float64)
+	relays := make(map[relayKey]float64)
+	ages := make(map[string]*ageHistogram)
+	for _, session := range sessions {
+		protocols[protocolKey{session.Realm, session.ClientProtocol, session.RelayProtocol}]++
+
+		for _, address := range session.RelayAddresses {
+			ip := address
+			if host, _, err := net.SplitHostPort(address); err == nil {
+				ip = host
+			}
+			relays[relayKey{session.Realm, ip}]++
+		}
+
+		h := ages[session.Realm]
+		if h == nil {
+			h = &ageHistogram{buckets: make(map[float64]uint64)}
+			for _, bound := range sessionAgeBuckets {
+				h.buckets[bound] = 0
+			}
+			ages[session.Realm] = h
+		}
+		age := session.Age.Seconds()
+		h.count++
+		h.sum += age
+		for _, bound := range sessionAgeBuckets {
+			if age <= bound {
+				h.buckets[bound]++
+			}
+		}
+	}
+
+	for key, count := range protocols {
+		ch <- prometheus.MustNewConstMetric(sessionsDesc, prometheus.GaugeValue, count, key.realm, key.client, key.relay)
+	}
+	for key, count := range relays {
+		ch <- prometheus.MustNewConstMetric(relaySessionsDesc, prometheus.GaugeValue, count, key.realm, key.ip)
+	}
+	for realm, h := range ages {
+		ch <- prometheus.MustNewConstHistogram(sessionAgeDesc, h.count, h.sum, h.buckets, realm)
+	}
+}
+
+var (
+	serverInfoDesc = prometheus.NewDesc(
+		"coturn_server_info",
+		"Version of the coturn server, always 1",
+		[]string{"version"}, nil,
+	)
+	serverUptimeDesc = prometheus.NewDesc(
+		"coturn_server_uptime_seconds",
+		"Time since the coturn server started",
+		nil, nil,
+	)
+)
+
+type infoCollector struct {
+	client  *Client
+	command string
+}
+
+// NewInfoCollector returns a collector running command on every scrape for
+// the server version and uptime.
+func NewInfoCollector(client *Client, command string) prometheus.Collector {
+	return &infoCollector{client, command}
+}
+
+func (c *infoCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- serverInfoDesc
+	ch <- serverUptimeDesc
+}
+
+func (c *infoCollector) Collect(ch chan<- prometheus.Metric) {
+	info, err := c.client.Info(c.command)
+	if err != nil {
+		fmt.Println("Unable to read the server info from the admin interface: ", err)
+		return
+	}
+	version := info.Version
+	if version == "" {
+		version = "unknown"
+	}
+	ch <- prometheus.MustNewConstMetric(serverInfoDesc, prometheus.GaugeValue, 1, version)
+	if info.Uptime > 0 {
+		ch <- prometheus.MustNewConstMetric(serverUptimeDesc, prometheus.GaugeValue, info.Uptime.Seconds())
+	}
+}
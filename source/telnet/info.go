@@ -0,0 +1,77 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package telnet
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Info is the server information printed by the admin interface.
+type Info struct {
+	// Version is the coturn version of the greeting, e.g. 4.5.2, empty if
+	// there is none.
+	Version string
+	// Uptime is read from a value named like "uptime" in seconds, zero if
+	// there is none.
+	Uptime time.Duration
+	// Values holds every "name: value" line by the lower case name.
+	Values map[string]string
+}
+
+var (
+	versionRegexp = regexp.MustCompile(`Coturn-(\S+)`)
+	valueRegexp   = regexp.MustCompile(`^([^:]+):\s*(.*)$`)
+	secondsRegexp = regexp.MustCompile(`^(\d+)(?:\s*(?:s|secs?|seconds))?$`)
+)
+
+// ParseInfo parses the greeting and the output of the configuration
+// command. coturn versions print different values, so none of them are
+// required.
+func ParseInfo(output string) *Info {
+	info := &Info{Values: make(map[string]string)}
+	if m := versionRegexp.FindStringSubmatch(output); m != nil {
+		info.Version = m[1]
+	}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), ">"))
+		m := valueRegexp.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		info.Values[strings.ToLower(strings.TrimSpace(m[1]))] = strings.TrimSpace(m[2])
+	}
+	if version := info.Values["version"]; version != "" && info.Version == "" {
+		info.Version = version
+	}
+	for name, value := range info.Values {
+		if !strings.Contains(name, "uptime") {
+			continue
+		}
+		if m := secondsRegexp.FindStringSubmatch(value); m != nil {
+			seconds, _ := strconv.Atoi(m[1])
+			info.Uptime = time.Duration(seconds) * time.Second
+		}
+	}
+	return info
+}
@@ -0,0 +1,219 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package telnet reads the session listing of the coturn admin interface,
+// which has details that coturn does not write to the statsdb.
+package telnet
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iknow/coturn_exporter/parser"
+)
+
+// Session is a session as listed by the "ps" command.
+type Session struct {
+	ID             string
+	User           string
+	Realm          string
+	Age            time.Duration
+	ExpiresIn      time.Duration
+	ClientProtocol string
+	RelayProtocol  string
+	ClientAddress  string
+	RelayAddresses []string
+}
+
+var (
+	sessionRegexp  = regexp.MustCompile(`^\d+\) id=(\d+), user <(.*)>:$`)
+	realmRegexp    = regexp.MustCompile(`^realm: (.*)$`)
+	startedRegexp  = regexp.MustCompile(`^started (\d+) secs ago$`)
+	expiringRegexp = regexp.MustCompile(`^expiring in (-?\d+) secs$`)
+	protocolRegexp = regexp.MustCompile(`^client protocol (\S+), relay protocol (\S+)$`)
+	clientRegexp   = regexp.MustCompile(`^client addr (\S+), server addr`)
+	relayRegexp    = regexp.MustCompile(`^relay addr (\S+)$`)
+	totalRegexp    = regexp.MustCompile(`^Total sessions: \d+$`)
+)
+
+// ParseSessions parses the output of the "ps" command up to the total line.
+// Lines it does not know are skipped so that details added by other coturn
+// versions do not break the parsing.
+func ParseSessions(r io.Reader) ([]Session, error) {
+	var sessions []Session
+	var current *Session
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "> "))
+		if totalRegexp.MatchString(line) {
+			return sessions, nil
+		}
+		if m := sessionRegexp.FindStringSubmatch(line); m != nil {
+			sessions = append(sessions, Session{ID: m[1], User: m[2]})
+			current = &sessions[len(sessions)-1]
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		if m := realmRegexp.FindStringSubmatch(line); m != nil {
+			current.Realm = parser.MapRealm(m[1])
+		} else if m := startedRegexp.FindStringSubmatch(line); m != nil {
+			seconds, _ := strconv.Atoi(m[1])
+			current.Age = time.Duration(seconds) * time.Second
+		} else if m := expiringRegexp.FindStringSubmatch(line); m != nil {
+			seconds, _ := strconv.Atoi(m[1])
+			current.ExpiresIn = time.Duration(seconds) * time.Second
+		} else if m := protocolRegexp.FindStringSubmatch(line); m != nil {
+			current.ClientProtocol = m[1]
+			current.RelayProtocol = m[2]
+		} else if m := clientRegexp.FindStringSubmatch(line); m != nil {
+			current.ClientAddress = m[1]
+		} else if m := relayRegexp.FindStringSubmatch(line); m != nil {
+			current.RelayAddresses = append(current.RelayAddresses, m[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("session listing ended without a total")
+}
+
+// Client runs commands on the coturn admin interface.
+type Client struct {
+	Address  string
+	Password string
+	Timeout  time.Duration
+	// Exclude, if set, leaves out the sessions of the users it returns true
+	// for.
+	Exclude func(user string) bool
+}
+
+// Sessions lists the current sessions.
+func (c *Client) Sessions() ([]Session, error) {
+	var sessions []Session
+	err := c.run("ps", func(r *bufio.Reader, banner string) error {
+		var err error
+		sessions, err = ParseSessions(r)
+		return err
+	})
+	if err != nil || c.Exclude == nil {
+		return sessions, err
+	}
+	included := sessions[:0]
+	for _, session := range sessions {
+		if !c.Exclude(session.User) {
+			included = append(included, session)
+		}
+	}
+	return included, nil
+}
+
+// Info runs command, "pc" on coturn, and parses its "name: value" lines
+// along with the version in the greeting.
+func (c *Client) Info(command string) (*Info, error) {
+	var info *Info
+	err := c.run(command, func(r *bufio.Reader, banner string) error {
+		output, err := readOutput(r)
+		if err != nil {
+			return err
+		}
+		info = ParseInfo(banner + "\n" + output)
+		return nil
+	})
+	return info, err
+}
+
+// run logs in, sends command and calls read with the output and the text
+// shown before the first prompt.
+func (c *Client) run(command string, read func(r *bufio.Reader, banner string) error) error {
+	conn, err := net.DialTimeout("tcp", c.Address, c.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.Timeout))
+
+	reader := bufio.NewReader(conn)
+	prompt, err := readPrompt(reader)
+	if err != nil {
+		return err
+	}
+	banner := prompt
+	if strings.Contains(strings.ToLower(prompt), "password") {
+		if c.Password == "" {
+			return errors.New("the admin interface asks for a password but none is configured")
+		}
+		if _, err := fmt.Fprintf(conn, "%s\r\n", c.Password); err != nil {
+			return err
+		}
+		if banner, err = readPrompt(reader); err != nil {
+			return err
+		}
+	}
+
+	if _, err := io.WriteString(conn, command+"\r\n"); err != nil {
+		return err
+	}
+	err = read(reader, banner)
+	io.WriteString(conn, "quit\r\n")
+	return err
+}
+
+// readPrompt reads until the interface waits for input, which is signalled by
+// a line ending in "> " or a password prompt ending in ": ".
+func readPrompt(r *bufio.Reader) (string, error) {
+	var buf bytes.Buffer
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", fmt.Errorf("unable to read the admin prompt: %v", err)
+		}
+		buf.WriteByte(c)
+		if bytes.HasSuffix(buf.Bytes(), []byte("> ")) || bytes.HasSuffix(buf.Bytes(), []byte(": ")) {
+			return buf.String(), nil
+		}
+	}
+}
+
+// readOutput reads the output of a command up to the next prompt, which
+// unlike readPrompt does not stop at the ": " of "name: value" lines.
+func readOutput(r *bufio.Reader) (string, error) {
+	var buf bytes.Buffer
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", fmt.Errorf("unable to read the command output: %v", err)
+		}
+		buf.WriteByte(c)
+		if bytes.HasSuffix(buf.Bytes(), []byte("\n> ")) || buf.String() == "> " {
+			return buf.String(), nil
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package source
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// UserFilter excludes the allocations of some users, such as synthetic
+// monitoring or load test accounts, from everything behind it.
+type UserFilter struct {
+	names   map[string]bool
+	pattern *regexp.Regexp
+
+	excluded *prometheus.CounterVec
+}
+
+// NewUserFilter excludes the users named in names and the ones matching
+// pattern as a whole. TURN REST API users also match by the name after the
+// expiry timestamp, so "probe" excludes "1600000000:probe".
+func NewUserFilter(names []string, pattern string) (*UserFilter, error) {
+	f := &UserFilter{
+		names: make(map[string]bool),
+		excluded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "coturn_exporter_excluded_events_total",
+			Help: "Number of events and allocations of excluded users that were dropped",
+		}, []string{"type"}),
+	}
+	for _, name := range names {
+		f.names[name] = true
+	}
+	if pattern != "" {
+		var err error
+		if f.pattern, err = regexp.Compile("^(?:" + pattern + ")$"); err != nil {
+			return nil, fmt.Errorf("invalid user pattern: %v", err)
+		}
+	}
+	return f, nil
+}
+
+// Excluded reports whether the allocations of user are excluded.
+func (f *UserFilter) Excluded(user string) bool {
+	if f.match(user) {
+		return true
+	}
+	if i := strings.IndexByte(user, ':'); i >= 0 {
+		return f.match(user[i+1:])
+	}
+	return false
+}
+
+func (f *UserFilter) match(user string) bool {
+	return f.names[user] || f.pattern != nil && f.pattern.MatchString(user)
+}
+
+// Handler returns a handler passing the events of users that are not
+// excluded to handler.
+func (f *UserFilter) Handler(handler Handler) Handler {
+	return &filteredHandler{f, handler}
+}
+
+// Loader returns a loader listing the allocations of loader whose users are
+// not excluded.
+func (f *UserFilter) Loader(loader Loader) Loader {
+	return &filteredLoader{f, loader}
+}
+
+type filteredHandler struct {
+	filter  *UserFilter
+	handler Handler
+}
+
+func (h *filteredHandler) HandleAllocation(e AllocationEvent) {
+	if h.filter.Excluded(e.Metadata.User) {
+		h.filter.excluded.WithLabelValues("allocation").Inc()
+		return
+	}
+	h.handler.HandleAllocation(e)
+}
+
+func (h *filteredHandler) HandleTraffic(e TrafficEvent) {
+	if h.filter.Excluded(e.Metadata.User) {
+		h.filter.excluded.WithLabelValues("traffic").Inc()
+		return
+	}
+	h.handler.HandleTraffic(e)
+}
+
+type filteredLoader struct {
+	filter *UserFilter
+	loader Loader
+}
+
+func (l *filteredLoader) LoadAllocations() ([]Allocation, error) {
+	allocations, err := l.loader.LoadAllocations()
+	if err != nil {
+		return nil, err
+	}
+	result := allocations[:0]
+	for _, a := range allocations {
+		if l.filter.Excluded(a.Metadata.User) {
+			l.filter.excluded.WithLabelValues("loaded").Inc()
+			continue
+		}
+		result = append(result, a)
+	}
+	return result, nil
+}
+
+// Describe implements prometheus.Collector.
+func (f *UserFilter) Describe(ch chan<- *prometheus.Desc) {
+	f.excluded.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (f *UserFilter) Collect(ch chan<- prometheus.Metric) {
+	f.excluded.Collect(ch)
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/iknow/coturn_exporter/collector"
+
+	"github.com/go-redis/redis"
+)
+
+type stateStore interface {
+	// Load returns nil without an error if there is no saved state yet.
+	Load() (*collector.Snapshot, error)
+	Save(*collector.Snapshot) error
+}
+
+type fileStateStore string
+
+func (f fileStateStore) Load() (*collector.Snapshot, error) {
+	data, err := ioutil.ReadFile(string(f))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var s collector.Snapshot
+	return &s, json.Unmarshal(data, &s)
+}
+
+func (f fileStateStore) Save(s *collector.Snapshot) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first so a crash never leaves a torn snapshot
+	tmp := string(f) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, string(f))
+}
+
+type redisStateStore struct {
+	client *redis.Client
+	key    string
+}
+
+func (r *redisStateStore) Load() (*collector.Snapshot, error) {
+	data, err := r.client.Get(r.key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var s collector.Snapshot
+	return &s, json.Unmarshal(data, &s)
+}
+
+func (r *redisStateStore) Save(s *collector.Snapshot) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(r.key, data, 0).Err()
+}
+
+// checkpointState saves the state every interval.
+func checkpointState(store stateStore, coll *collector.Collector, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := store.Save(coll.Snapshot()); err != nil {
+			fmt.Println("Unable to save state: ", err)
+		}
+	}
+}
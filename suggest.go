@@ -0,0 +1,144 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iknow/coturn_exporter/collector"
+	"github.com/iknow/coturn_exporter/exporter"
+	redissource "github.com/iknow/coturn_exporter/source/redis"
+
+	"github.com/go-redis/redis"
+)
+
+// suggestBuckets observes the rates of the allocations for duration and
+// prints bucket lists for -packet-rate-buckets and -byte-rate-buckets,
+// spaced logarithmically between the 1st and 99th percentile of the
+// observed rates.
+func suggestBuckets(client *redis.Client, coll *collector.Collector, duration time.Duration, count int) error {
+	if count < 2 {
+		return fmt.Errorf("bucket count must be at least 2")
+	}
+	src := redissource.New(client)
+	if err := exporter.LoadAllocations(src, coll); err != nil {
+		return err
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- src.Run(coll) }()
+
+	fmt.Printf("Observing rates for %v\n", duration)
+
+	var packetRates, byteRates []float64
+	// reported holds the time of the last report of every allocation
+	// that was sampled, so that every report is counted once
+	reported := make(map[string]time.Time)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	deadline := time.After(duration)
+	for done := false; !done; {
+		select {
+		case err := <-errs:
+			return err
+		case <-deadline:
+			done = true
+		case <-ticker.C:
+		}
+		for name, info := range coll.Allocations() {
+			r := info.PreviousRates
+			if r == nil || !info.LastMetricTimestamp.After(reported[name]) {
+				continue
+			}
+			reported[name] = info.LastMetricTimestamp
+			packetRates = append(packetRates, r.Rcvp, r.Sentp)
+			byteRates = append(byteRates, r.Rcvb, r.Sentb)
+		}
+	}
+
+	if len(reported) == 0 {
+		return fmt.Errorf("no traffic reports received in %v", duration)
+	}
+	fmt.Printf("Observed %d rates of %d allocations\n\n", len(byteRates), len(reported))
+	printSuggestion("Packet rate (pps)", "-packet-rate-buckets", packetRates, count)
+	printSuggestion("Byte rate (B/s)", "-byte-rate-buckets", byteRates, count)
+	return nil
+}
+
+func printSuggestion(title string, flagName string, samples []float64, count int) {
+	positive := make([]float64, 0, len(samples))
+	for _, v := range samples {
+		if v > 0 {
+			positive = append(positive, v)
+		}
+	}
+	fmt.Printf("%s, %d of %d idle:\n", title, len(samples)-len(positive), len(samples))
+	if len(positive) == 0 {
+		fmt.Printf("  no traffic observed\n\n")
+		return
+	}
+	sort.Float64s(positive)
+	fmt.Printf("  p1 %.3g, p50 %.3g, p99 %.3g\n", percentile(positive, 0.01), percentile(positive, 0.5), percentile(positive, 0.99))
+
+	buckets := logBuckets(percentile(positive, 0.01), percentile(positive, 0.99), count)
+	formatted := make([]string, len(buckets))
+	for i, bucket := range buckets {
+		formatted[i] = formatBucket(bucket)
+	}
+	fmt.Printf("  %s %s\n\n", flagName, strings.Join(formatted, ","))
+}
+
+// percentile returns the nearest rank percentile of sorted samples.
+func percentile(sorted []float64, p float64) float64 {
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// logBuckets returns up to count buckets spaced logarithmically from low to
+// high, rounded to two significant digits. Buckets that become equal when
+// rounded are merged.
+func logBuckets(low, high float64, count int) []float64 {
+	factor := math.Pow(high/low, 1/float64(count-1))
+	var buckets []float64
+	for i := 0; i < count; i++ {
+		bucket := roundSignificant(low*math.Pow(factor, float64(i)), 2)
+		if len(buckets) == 0 || bucket > buckets[len(buckets)-1] {
+			buckets = append(buckets, bucket)
+		}
+	}
+	return buckets
+}
+
+func roundSignificant(v float64, digits int) float64 {
+	scale := math.Pow(10, float64(digits)-math.Ceil(math.Log10(v)))
+	return math.Round(v*scale) / scale
+}
+
+func formatBucket(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,304 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package tracing records spans of sampled event processing and exports
+// them to an OpenTelemetry collector with OTLP over HTTP, using the JSON
+// encoding so that no OpenTelemetry SDK is needed.
+package tracing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// number of finished spans waiting for export, further ones are dropped
+	queueSize = 4096
+	// maximum number of spans per export request
+	batchSize     = 512
+	batchInterval = 5 * time.Second
+)
+
+type Tracer struct {
+	endpoint string
+	resource []attribute
+	ratio    float64
+	spans    chan *Span
+	client   *http.Client
+	// closing passes Close's channel to Run
+	closing chan chan struct{}
+}
+
+// New returns a tracer exporting to the OTLP/HTTP endpoint, e.g.
+// http://localhost:4318, that samples the given ratio of root spans. The
+// spans are attributed to a resource with the given attributes, which
+// should include service.name. Run has to be started to export the spans.
+func New(endpoint string, resource map[string]string, ratio float64) (*Tracer, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported OTLP endpoint %q", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+
+	names := make([]string, 0, len(resource))
+	for name := range resource {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	attributes := make([]attribute, 0, len(names))
+	for _, name := range names {
+		attributes = append(attributes, attribute{name, attributeValue{resource[name]}})
+	}
+
+	return &Tracer{
+		endpoint: u.String(),
+		resource: attributes,
+		ratio:    ratio,
+		spans:    make(chan *Span, queueSize),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		closing:  make(chan chan struct{}),
+	}, nil
+}
+
+// Span is a timed operation. All methods are safe to call on a nil span,
+// which is what unsampled and disabled traces get.
+type Span struct {
+	tracer     *Tracer
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	name       string
+	start      time.Time
+	end        time.Time
+	attributes map[string]string
+}
+
+// Start begins a root span at start, or returns nil if the tracer is nil or
+// the trace is not sampled.
+func (t *Tracer) Start(name string, start time.Time) *Span {
+	if t == nil || mathrand.Float64() >= t.ratio {
+		return nil
+	}
+	span := &Span{tracer: t, name: name, start: start}
+	rand.Read(span.traceID[:])
+	rand.Read(span.spanID[:])
+	return span
+}
+
+// Child begins a span below s.
+func (s *Span) Child(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	span := &Span{tracer: s.tracer, traceID: s.traceID, parentID: s.spanID, name: name, start: time.Now()}
+	rand.Read(span.spanID[:])
+	return span
+}
+
+func (s *Span) SetAttribute(key string, value string) {
+	if s == nil {
+		return
+	}
+	if s.attributes == nil {
+		s.attributes = make(map[string]string)
+	}
+	s.attributes[key] = value
+}
+
+// End finishes the span and queues it for export.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	select {
+	case s.tracer.spans <- s:
+	default:
+	}
+}
+
+// Run exports the finished spans in batches until Close is called.
+func (t *Tracer) Run() {
+	ticker := time.NewTicker(batchInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case span := <-t.spans:
+			batch = append(batch, span)
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case done := <-t.closing:
+			t.drain(batch)
+			close(done)
+			return
+		}
+		t.exportBatch(batch)
+		batch = nil
+	}
+}
+
+// Close exports the spans finished so far and stops Run, which has to be
+// running. Spans ending afterwards are dropped.
+func (t *Tracer) Close() {
+	done := make(chan struct{})
+	t.closing <- done
+	<-done
+}
+
+// drain exports batch and the queued spans.
+func (t *Tracer) drain(batch []*Span) {
+	for {
+		select {
+		case span := <-t.spans:
+			batch = append(batch, span)
+			if len(batch) < batchSize {
+				continue
+			}
+		default:
+			if len(batch) > 0 {
+				t.exportBatch(batch)
+			}
+			return
+		}
+		t.exportBatch(batch)
+		batch = nil
+	}
+}
+
+func (t *Tracer) exportBatch(batch []*Span) {
+	if err := t.export(batch); err != nil {
+		fmt.Printf("Unable to export %d spans: %v\n", len(batch), err)
+	}
+}
+
+// The types below are the OTLP/JSON encoding of
+// opentelemetry/proto/collector/trace/v1/trace_service.proto.
+
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []attribute `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope      `json:"scope"`
+	Spans []jsonSpan `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type jsonSpan struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	ParentSpanID      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []attribute `json:"attributes,omitempty"`
+}
+
+type attribute struct {
+	Key   string         `json:"key"`
+	Value attributeValue `json:"value"`
+}
+
+type attributeValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// spanKindInternal is SPAN_KIND_INTERNAL.
+const spanKindInternal = 1
+
+func (t *Tracer) export(batch []*Span) error {
+	spans := make([]jsonSpan, 0, len(batch))
+	for _, s := range batch {
+		span := jsonSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              spanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for key, value := range s.attributes {
+			span.Attributes = append(span.Attributes, attribute{key, attributeValue{value}})
+		}
+		spans = append(spans, span)
+	}
+
+	body, err := json.Marshal(exportRequest{[]resourceSpans{{
+		Resource: resource{t.resource},
+		ScopeSpans: []scopeSpans{{
+			Scope: scope{"github.com/iknow/coturn_exporter"},
+			Spans: spans,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iknow/coturn_exporter/collector"
+	"github.com/iknow/coturn_exporter/parser"
+	"github.com/iknow/coturn_exporter/source/telnet"
+
+	"github.com/go-redis/redis"
+)
+
+// The realm options coturn reads from a redis userdb.
+const (
+	maxBPSKeyPattern     = "turn/realm/*/max-bps"
+	userQuotaKeyPattern  = "turn/realm/*/user-quota"
+	totalQuotaKeyPattern = "turn/realm/*/total-quota"
+)
+
+// loadQuotas reads the max-bps and user-quota of every realm from the
+// userdb.
+func loadQuotas(client *redis.Client) (map[string]collector.Quota, error) {
+	quotas := make(map[string]collector.Quota)
+	err := scanRealmOption(client, maxBPSKeyPattern, func(realm string, value float64) {
+		q := quotas[realm]
+		q.MaxBPS = value
+		quotas[realm] = q
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = scanRealmOption(client, userQuotaKeyPattern, func(realm string, value float64) {
+		q := quotas[realm]
+		q.UserQuota = value
+		quotas[realm] = q
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = scanRealmOption(client, totalQuotaKeyPattern, func(realm string, value float64) {
+		q := quotas[realm]
+		q.TotalQuota = value
+		quotas[realm] = q
+	})
+	return quotas, err
+}
+
+func scanRealmOption(client *redis.Client, pattern string, set func(realm string, value float64)) error {
+	iter := client.Scan(0, pattern, 1000).Iterator()
+	for iter.Next() {
+		key := iter.Val()
+		value, err := client.Get(key).Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return err
+		}
+		number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			fmt.Printf("Unexpected value %q of %s\n", value, key)
+			continue
+		}
+		parts := strings.Split(key, "/")
+		set(parser.MapRealm(parts[2]), number)
+	}
+	return iter.Err()
+}
+
+// quotaLoader reads the limits coturn enforces per realm from the userdb and
+// the server wide ones from the admin interface.
+type quotaLoader struct {
+	// nil without -userdb-url
+	userdb *redis.Client
+	// nil without -telnet-address
+	admin        *telnet.Client
+	adminCommand string
+	// the -default-* limits, which take precedence over the admin interface
+	defaults collector.Quota
+}
+
+// load returns the limits per realm and the fallback for the other realms.
+// The admin interface being unavailable is not an error, the defaults are
+// used instead.
+func (l *quotaLoader) load() (map[string]collector.Quota, collector.Quota, error) {
+	quotas := make(map[string]collector.Quota)
+	if l.userdb != nil {
+		var err error
+		if quotas, err = loadQuotas(l.userdb); err != nil {
+			return nil, collector.Quota{}, err
+		}
+	}
+
+	fallback := l.defaults
+	if l.admin != nil && l.adminCommand != "" {
+		info, err := l.admin.Info(l.adminCommand)
+		if err != nil {
+			fmt.Println("Unable to read the limits from the admin interface: ", err)
+			return quotas, fallback, nil
+		}
+		setLimit(&fallback.MaxBPS, info.Values["max-bps"])
+		setLimit(&fallback.TotalQuota, info.Values["total-quota"])
+		setLimit(&fallback.UserQuota, info.Values["user-quota"])
+	}
+	return quotas, fallback, nil
+}
+
+// setLimit sets limit to value if it is not set yet.
+func setLimit(limit *float64, value string) {
+	if *limit != 0 || value == "" {
+		return
+	}
+	if number, err := strconv.ParseFloat(value, 64); err == nil {
+		*limit = number
+	}
+}
+
+func refreshQuotas(loader *quotaLoader, coll *collector.Collector, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		quotas, fallback, err := loader.load()
+		if err != nil {
+			fmt.Println("Unable to load quotas from the userdb: ", err)
+			continue
+		}
+		coll.SetQuotas(quotas, fallback)
+	}
+}
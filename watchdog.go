@@ -0,0 +1,140 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/iknow/coturn_exporter/collector"
+	redissource "github.com/iknow/coturn_exporter/source/redis"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var errNotLoaded = errors.New("allocations not loaded yet")
+
+// subscriptionWatchdog fails the readiness check and forces a resubscribe
+// when nothing, not even a health check pong, was received on the
+// subscription for timeout while allocations are tracked. coturn reports
+// the traffic of every allocation periodically, so a silent subscription
+// with allocations is a dead one rather than an idle server.
+type subscriptionWatchdog struct {
+	src     *redissource.Source
+	coll    *collector.Collector
+	timeout time.Duration
+
+	lock       sync.Mutex
+	loaded     bool
+	err        error
+	lastForced time.Time
+
+	trips prometheus.Counter
+}
+
+func newSubscriptionWatchdog(src *redissource.Source, coll *collector.Collector, timeout time.Duration) *subscriptionWatchdog {
+	return &subscriptionWatchdog{
+		src:     src,
+		coll:    coll,
+		timeout: timeout,
+		trips: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "coturn_exporter_subscription_watchdog_trips_total",
+			Help: "Number of times the subscription was found silent while allocations were tracked and was reestablished",
+		}),
+	}
+}
+
+// Loaded marks the initial allocations as loaded.
+func (d *subscriptionWatchdog) Loaded() {
+	d.lock.Lock()
+	d.loaded = true
+	d.lock.Unlock()
+}
+
+// Ready returns why the exporter is not ready, or nil.
+func (d *subscriptionWatchdog) Ready() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if !d.loaded {
+		return errNotLoaded
+	}
+	return d.err
+}
+
+func (d *subscriptionWatchdog) Run() {
+	ticker := time.NewTicker(d.timeout / 4)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		d.check(now)
+	}
+}
+
+func (d *subscriptionWatchdog) check(now time.Time) {
+	silent := now.Sub(d.src.LastReceive())
+	count := d.coll.AllocationCount()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if silent < d.timeout || count == 0 {
+		d.err = nil
+		return
+	}
+	d.err = fmt.Errorf("nothing received on the subscription for %s with %d allocations", silent.Truncate(time.Second), count)
+	if now.Sub(d.lastForced) >= d.timeout {
+		fmt.Println("Subscription watchdog tripped, resubscribing: ", d.err)
+		d.lastForced = now
+		d.trips.Inc()
+		d.src.Resubscribe()
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (d *subscriptionWatchdog) Describe(ch chan<- *prometheus.Desc) {
+	d.trips.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (d *subscriptionWatchdog) Collect(ch chan<- prometheus.Metric) {
+	d.trips.Collect(ch)
+}
+
+// registerHealthHandlers serves /-/healthy, which succeeds as long as the
+// exporter is serving, and /-/ready, which fails while ready returns an
+// error. ready may be nil for modes that are always ready.
+func registerHealthHandlers(ready func() error) {
+	http.HandleFunc("/-/healthy", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "OK")
+	})
+	http.HandleFunc("/-/ready", func(w http.ResponseWriter, r *http.Request) {
+		if ready != nil {
+			if err := ready(); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(w, "OK")
+	})
+}
@@ -0,0 +1,149 @@
+// Copyright 2019 DMM.com
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/iknow/coturn_exporter/collector"
+)
+
+type webhookThresholds struct {
+	allocations float64
+	byteRate    float64
+}
+
+type webhookAlert struct {
+	Alert     string    `json:"alert"`
+	State     string    `json:"state"`
+	Realm     string    `json:"realm"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	Time      time.Time `json:"time"`
+}
+
+type webhookNotifier struct {
+	coll       *collector.Collector
+	url        string
+	thresholds webhookThresholds
+	debounce   time.Duration
+	client     *http.Client
+
+	firing   map[webhookKey]bool
+	lastSent map[webhookKey]time.Time
+}
+
+type webhookKey struct {
+	alert string
+	realm string
+}
+
+func newWebhookNotifier(coll *collector.Collector, url string, thresholds webhookThresholds, debounce time.Duration) *webhookNotifier {
+	return &webhookNotifier{
+		coll:       coll,
+		url:        url,
+		thresholds: thresholds,
+		debounce:   debounce,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		firing:     make(map[webhookKey]bool),
+		lastSent:   make(map[webhookKey]time.Time),
+	}
+}
+
+// Run evaluates the thresholds every interval. A notification is sent when
+// an alert starts or stops firing, but at most once per debounce period for
+// the same alert and realm so that a value oscillating around the threshold
+// does not flood the receiver.
+func (n *webhookNotifier) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		counts, byteRates := n.coll.RealmTotals()
+		now := time.Now()
+
+		realms := make(map[string]bool)
+		for realm := range counts {
+			realms[realm] = true
+		}
+		// realms that disappeared still need their alerts resolved
+		for key := range n.firing {
+			realms[key.realm] = true
+		}
+
+		for realm := range realms {
+			if n.thresholds.allocations > 0 {
+				n.evaluate("allocations", realm, counts[realm], n.thresholds.allocations, now)
+			}
+			if n.thresholds.byteRate > 0 {
+				n.evaluate("byte_rate", realm, byteRates[realm], n.thresholds.byteRate, now)
+			}
+		}
+	}
+}
+
+func (n *webhookNotifier) evaluate(alert string, realm string, value float64, threshold float64, now time.Time) {
+	key := webhookKey{alert, realm}
+	firing := value > threshold
+	if firing == n.firing[key] {
+		return
+	}
+	if now.Sub(n.lastSent[key]) < n.debounce {
+		return
+	}
+
+	state := "resolved"
+	if firing {
+		state = "firing"
+	}
+	err := n.send(webhookAlert{alert, state, realm, value, threshold, now})
+	if err != nil {
+		fmt.Println("Unable to send webhook: ", err)
+		return
+	}
+
+	n.lastSent[key] = now
+	if firing {
+		n.firing[key] = true
+	} else {
+		delete(n.firing, key)
+	}
+}
+
+func (n *webhookNotifier) send(alert webhookAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}